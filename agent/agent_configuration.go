@@ -6,22 +6,37 @@ type AgentConfiguration struct {
 	ConfigPath                 string
 	BootstrapScript            string
 	BuildPath                  string
+	WorkspacePolicy            string
+	WorkspaceTmpPath           string
+	WorkspacePoolSize          int
+	WorkspaceMaxAgeDays        int
 	HooksPath                  string
+	HookTimeouts               []string
+	HookFailurePolicies        []string
 	GitMirrorsPath             string
 	GitMirrorsLockTimeout      int
 	PluginsPath                string
+	PluginsLockfile            string
+	PluginsPolicy              string
+	PluginsCachePath           string
+	PluginsOffline             bool
 	GitCloneFlags              string
 	GitCloneMirrorFlags        string
 	GitCleanFlags              string
 	GitFetchFlags              string
+	GitPullRequestMerge        string
+	GitCredentialsPath         string
 	GitSubmodules              bool
 	SSHKeyscan                 bool
+	SSHKnownHostsPath          string
+	SSHStrictHostKeyChecking   bool
 	CommandEval                bool
 	PluginsEnabled             bool
 	PluginValidation           bool
 	LocalHooksEnabled          bool
 	RunInPty                   bool
 	TimestampLines             bool
+	TimingReport               bool
 	HealthCheckAddr            string
 	DisconnectAfterJob         bool
 	DisconnectAfterIdleTimeout int
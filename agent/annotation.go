@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// AnnotationBodyLimit is the largest annotation body, in bytes, that the
+// Buildkite API will accept
+const AnnotationBodyLimit = 1024 * 1024
+
+// TruncateAnnotation shortens an annotation body so that it fits within limit
+// bytes, cutting at the end of a line and closing any code fence left open.
+// A notice linking to the full body at artifactPath is added to the end.
+func TruncateAnnotation(body string, limit int, artifactPath string) string {
+	if len(body) <= limit {
+		return body
+	}
+
+	notice := fmt.Sprintf("\n\n---\n\n_This annotation was truncated because it's larger than %s. "+
+		"[View the full annotation](artifact://%s)._\n", formatAnnotationSize(limit), artifactPath)
+
+	// Leave enough room for the notice and a closing code fence
+	cut := limit - len(notice) - len("\n```")
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+
+	truncated := body[:cut]
+	if i := strings.LastIndex(truncated, "\n"); i > 0 {
+		truncated = truncated[:i]
+	}
+
+	if fence, _ := openCodeFence(truncated); fence != "" {
+		truncated += "\n" + fence
+	}
+
+	return truncated + notice
+}
+
+// CheckAnnotationMarkdown looks for common mistakes in an annotation body that
+// stop it from rendering as expected, returning a description of each
+func CheckAnnotationMarkdown(body string) []string {
+	var problems []string
+
+	if !utf8.ValidString(body) {
+		problems = append(problems, "the body isn't valid UTF-8")
+	}
+
+	if fence, line := openCodeFence(body); fence != "" {
+		problems = append(problems, fmt.Sprintf("the code block opened with %s on line %d is never closed", fence, line))
+	}
+
+	return problems
+}
+
+// openCodeFence returns the fence and line number of a fenced code block that
+// is still open at the end of body, or an empty string if there isn't one
+func openCodeFence(body string) (string, int) {
+	var fence string
+	var opened int
+
+	for i, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if len(line)-len(trimmed) > 3 {
+			continue
+		}
+
+		marker := codeFenceMarker(trimmed)
+		if marker == "" {
+			continue
+		}
+
+		if fence == "" {
+			fence, opened = marker, i+1
+		} else if marker[0] == fence[0] && len(marker) >= len(fence) &&
+			strings.TrimSpace(trimmed[len(marker):]) == "" {
+			fence = ""
+		}
+	}
+
+	return fence, opened
+}
+
+// codeFenceMarker returns the run of three or more backticks or tildes that
+// starts line, if any
+func codeFenceMarker(line string) string {
+	if line == "" || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+
+	return line[:n]
+}
+
+func formatAnnotationSize(bytes int) string {
+	if bytes >= 1024*1024 && bytes%(1024*1024) == 0 {
+		return fmt.Sprintf("%dMiB", bytes/(1024*1024))
+	}
+	if bytes >= 1024 && bytes%1024 == 0 {
+		return fmt.Sprintf("%dKiB", bytes/1024)
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
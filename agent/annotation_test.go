@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateAnnotationLeavesSmallBodiesAlone(t *testing.T) {
+	body := "# Tests\n\nAll passed"
+	assert.Equal(t, body, TruncateAnnotation(body, 1024, "annotation.md"))
+}
+
+func TestTruncateAnnotationCutsAtALineAndLinksToTheArtifact(t *testing.T) {
+	body := strings.Repeat("A line of the report\n", 100)
+
+	truncated := TruncateAnnotation(body, 1024, "report.md")
+
+	assert.True(t, len(truncated) <= 1024, "length %d", len(truncated))
+	assert.True(t, strings.HasPrefix(truncated, "A line of the report\n"))
+	assert.Contains(t, truncated, "A line of the report\n\n---\n\n")
+	assert.True(t, strings.HasSuffix(truncated, "because it's larger than 1KiB. [View the full annotation](artifact://report.md)._\n"))
+	assert.Empty(t, CheckAnnotationMarkdown(truncated))
+}
+
+func TestTruncateAnnotationClosesCodeFences(t *testing.T) {
+	body := "Failures:\n\n~~~~ text\n" + strings.Repeat("expected 1 got 2\n", 100) + "~~~~\n"
+
+	truncated := TruncateAnnotation(body, 1024, "annotation.md")
+
+	assert.True(t, len(truncated) <= 1024, "length %d", len(truncated))
+	assert.Contains(t, truncated, "expected 1 got 2\n~~~~\n\n---\n\n")
+	assert.Empty(t, CheckAnnotationMarkdown(truncated))
+}
+
+func TestTruncateAnnotationKeepsRunesWhole(t *testing.T) {
+	body := strings.Repeat("🦙", 1000)
+
+	truncated := TruncateAnnotation(body, 1024, "annotation.md")
+
+	assert.True(t, len(truncated) <= 1024, "length %d", len(truncated))
+	assert.Empty(t, CheckAnnotationMarkdown(truncated))
+}
+
+func TestCheckAnnotationMarkdown(t *testing.T) {
+	assert.Empty(t, CheckAnnotationMarkdown("```go\nfmt.Println()\n```\n\n````\n```\n````"))
+
+	assert.Equal(t, []string{
+		"the code block opened with ``` on line 3 is never closed",
+	}, CheckAnnotationMarkdown("Output:\n\n```\nllamas\n``` not a fence\n"))
+
+	assert.Equal(t, []string{
+		"the body isn't valid UTF-8",
+	}, CheckAnnotationMarkdown("llamas \xff"))
+}
@@ -11,6 +11,7 @@ type APIClient interface {
 	AcceptJob(*api.Job) (*api.Job, *api.Response, error)
 	AcquireJob(string) (*api.Job, *api.Response, error)
 	Annotate(string, *api.Annotation) (*api.Response, error)
+	AnnotationRemove(string, string) (*api.Response, error)
 	Config() api.Config
 	Connect() (*api.Response, error)
 	CreateArtifacts(string, *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, *api.Response, error)
@@ -21,12 +22,15 @@ type APIClient interface {
 	FromPing(*api.Ping) *api.Client
 	GetJobState(string) (*api.JobState, *api.Response, error)
 	GetMetaData(string, string) (*api.MetaData, *api.Response, error)
+	GetMetaDataBatch(string, []string) (*api.MetaDataBatch, *api.Response, error)
 	Heartbeat() (*api.Heartbeat, *api.Response, error)
+	MetaDataKeys(string) ([]string, *api.Response, error)
 	Ping() (*api.Ping, *api.Response, error)
 	Register(*api.AgentRegisterRequest) (*api.AgentRegisterResponse, *api.Response, error)
 	SaveHeaderTimes(string, *api.HeaderTimes) (*api.Response, error)
 	SearchArtifacts(string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error)
 	SetMetaData(string, *api.MetaData) (*api.Response, error)
+	SetMetaDataBatch(string, *api.MetaDataBatch) (*api.Response, error)
 	StartJob(*api.Job) (*api.Response, error)
 	StepUpdate(string, *api.StepUpdate) (*api.Response, error)
 	UpdateArtifacts(string, map[string]string) (*api.Response, error)
@@ -402,10 +402,23 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_BIN_PATH`,
 		`BUILDKITE_CONFIG_PATH`,
 		`BUILDKITE_BUILD_PATH`,
+		`BUILDKITE_WORKSPACE_POLICY`,
+		`BUILDKITE_WORKSPACE_TMP_PATH`,
+		`BUILDKITE_WORKSPACE_POOL_SIZE`,
+		`BUILDKITE_WORKSPACE_MAX_AGE_DAYS`,
 		`BUILDKITE_GIT_MIRRORS_PATH`,
+		`BUILDKITE_GIT_CREDENTIALS_PATH`,
 		`BUILDKITE_HOOKS_PATH`,
+		`BUILDKITE_HOOK_TIMEOUTS`,
+		`BUILDKITE_HOOK_FAILURE_POLICIES`,
 		`BUILDKITE_PLUGINS_PATH`,
+		`BUILDKITE_PLUGINS_LOCKFILE`,
+		`BUILDKITE_PLUGINS_POLICY`,
+		`BUILDKITE_PLUGINS_CACHE_PATH`,
+		`BUILDKITE_PLUGINS_OFFLINE`,
 		`BUILDKITE_SSH_KEYSCAN`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_PATH`,
+		`BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING`,
 		`BUILDKITE_GIT_SUBMODULES`,
 		`BUILDKITE_COMMAND_EVAL`,
 		`BUILDKITE_PLUGINS_ENABLED`,
@@ -449,10 +462,23 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Add options from the agent configuration
 	env["BUILDKITE_CONFIG_PATH"] = r.conf.AgentConfiguration.ConfigPath
 	env["BUILDKITE_BUILD_PATH"] = r.conf.AgentConfiguration.BuildPath
+	env["BUILDKITE_WORKSPACE_POLICY"] = r.conf.AgentConfiguration.WorkspacePolicy
+	env["BUILDKITE_WORKSPACE_TMP_PATH"] = r.conf.AgentConfiguration.WorkspaceTmpPath
+	env["BUILDKITE_WORKSPACE_POOL_SIZE"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.WorkspacePoolSize)
+	env["BUILDKITE_WORKSPACE_MAX_AGE_DAYS"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.WorkspaceMaxAgeDays)
 	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.conf.AgentConfiguration.GitMirrorsPath
+	env["BUILDKITE_GIT_CREDENTIALS_PATH"] = r.conf.AgentConfiguration.GitCredentialsPath
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
+	env["BUILDKITE_HOOK_TIMEOUTS"] = strings.Join(r.conf.AgentConfiguration.HookTimeouts, ",")
+	env["BUILDKITE_HOOK_FAILURE_POLICIES"] = strings.Join(r.conf.AgentConfiguration.HookFailurePolicies, ",")
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
+	env["BUILDKITE_PLUGINS_LOCKFILE"] = r.conf.AgentConfiguration.PluginsLockfile
+	env["BUILDKITE_PLUGINS_POLICY"] = r.conf.AgentConfiguration.PluginsPolicy
+	env["BUILDKITE_PLUGINS_CACHE_PATH"] = r.conf.AgentConfiguration.PluginsCachePath
+	env["BUILDKITE_PLUGINS_OFFLINE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsOffline)
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_PATH"] = r.conf.AgentConfiguration.SSHKnownHostsPath
+	env["BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHStrictHostKeyChecking)
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
@@ -466,6 +492,17 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
 
+	// Pipelines can opt-in to pull request merging themselves, so only
+	// override it if the agent has been configured to do it
+	if r.conf.AgentConfiguration.GitPullRequestMerge != "" {
+		env["BUILDKITE_GIT_PULL_REQUEST_MERGE"] = r.conf.AgentConfiguration.GitPullRequestMerge
+	}
+
+	// Likewise pipelines can opt-in to timing reports
+	if r.conf.AgentConfiguration.TimingReport {
+		env["BUILDKITE_TIMING_REPORT"] = "true"
+	}
+
 	// Whether to enable profiling in the bootstrap
 	if r.conf.AgentConfiguration.Profile != "" {
 		env["BUILDKITE_AGENT_PROFILE"] = r.conf.AgentConfiguration.Profile
@@ -0,0 +1,384 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// PipelineStepDecision is whether a step with if_changed paths was kept in a
+// pipeline, and why
+type PipelineStepDecision struct {
+	Step   string
+	Kept   bool
+	Reason string
+}
+
+func (d PipelineStepDecision) String() string {
+	if d.Kept {
+		return fmt.Sprintf("Keeping %s, %s", d.Step, d.Reason)
+	}
+	return fmt.Sprintf("Skipping %s, %s", d.Step, d.Reason)
+}
+
+// HasChangeConditions returns whether any steps have if_changed paths
+func (p *PipelineParserResult) HasChangeConditions() bool {
+	var walk func(v interface{}) bool
+	walk = func(v interface{}) bool {
+		switch vv := v.(type) {
+		case yaml.MapSlice:
+			for _, item := range vv {
+				if item.Key == "if_changed" || walk(item.Value) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, item := range vv {
+				if walk(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if item, ok := mapSliceItem("steps", p.pipeline); ok {
+		return walk(item.Value)
+	}
+	return false
+}
+
+// FilterUnchangedSteps removes the steps with if_changed paths that don't
+// match any of the changed files, and the if_changed attribute from the
+// steps that are kept. If changed is nil, the changes aren't known and every
+// step is kept. Steps that depended on a removed step depend on what it
+// depended on instead, so they still run in the same order
+func (p *PipelineParserResult) FilterUnchangedSteps(changed []string) ([]PipelineStepDecision, error) {
+	var decisions []PipelineStepDecision
+	removedKeys := map[string][]interface{}{}
+
+	for i, item := range p.pipeline {
+		if item.Key != "steps" {
+			continue
+		}
+		steps, ok := item.Value.([]interface{})
+		if !ok {
+			continue
+		}
+
+		filtered, err := filterUnchangedSteps(steps, "", changed, removedKeys, &decisions)
+		if err != nil {
+			return nil, err
+		}
+		p.pipeline[i].Value = filtered
+	}
+
+	if len(removedKeys) > 0 {
+		p.pipeline = removeDependencies(p.pipeline, removedKeys).(yaml.MapSlice)
+	}
+
+	return decisions, nil
+}
+
+func filterUnchangedSteps(steps []interface{}, prefix string, changed []string, removedKeys map[string][]interface{}, decisions *[]PipelineStepDecision) ([]interface{}, error) {
+	filtered := []interface{}{}
+
+	for i, step := range steps {
+		attrs, ok := step.(yaml.MapSlice)
+		if !ok {
+			filtered = append(filtered, step)
+			continue
+		}
+
+		name := pipelineStepName(attrs, prefix+strconv.Itoa(i+1))
+
+		if item, ok := mapSliceItem("if_changed", attrs); ok {
+			patterns, err := stringOrStrings(item.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid if_changed for %s: %v", name, err)
+			}
+
+			without := yaml.MapSlice{}
+			for _, attr := range attrs {
+				if attr.Key != "if_changed" {
+					without = append(without, attr)
+				}
+			}
+			attrs = without
+
+			decision := PipelineStepDecision{Step: name, Kept: true}
+			if changed == nil {
+				decision.Reason = "the changed files aren't known"
+			} else if file, pattern, matched := matchChangedFiles(patterns, changed); matched {
+				decision.Reason = fmt.Sprintf("%s changed (matches %s)", file, pattern)
+			} else {
+				decision.Kept = false
+				decision.Reason = fmt.Sprintf("none of its paths changed (%s)", strings.Join(patterns, ", "))
+			}
+			*decisions = append(*decisions, decision)
+
+			if !decision.Kept {
+				addStepKeys(attrs, nil, removedKeys)
+				continue
+			}
+		}
+
+		// Steps within groups can have if_changed too, and a group without
+		// any steps left is removed
+		if _, isGroup := mapSliceItem("group", attrs); isGroup {
+			if item, ok := mapSliceItem("steps", attrs); ok {
+				if groupSteps, ok := item.Value.([]interface{}); ok {
+					groupFiltered, err := filterUnchangedSteps(groupSteps, prefix+strconv.Itoa(i+1)+".", changed, removedKeys, decisions)
+					if err != nil {
+						return nil, err
+					}
+
+					if len(groupFiltered) < len(groupSteps) && !hasCommandSteps(groupFiltered) {
+						*decisions = append(*decisions, PipelineStepDecision{Step: name, Reason: "none of its steps are left"})
+						addStepKeys(attrs, nil, removedKeys)
+						continue
+					}
+
+					group := yaml.MapSlice{}
+					for _, attr := range attrs {
+						if attr.Key == "steps" {
+							attr.Value = groupFiltered
+						}
+						group = append(group, attr)
+					}
+					attrs = group
+				}
+			}
+		}
+
+		filtered = append(filtered, attrs)
+	}
+
+	return filtered, nil
+}
+
+// hasCommandSteps returns whether there are any steps other than waits
+func hasCommandSteps(steps []interface{}) bool {
+	for _, step := range steps {
+		if t, err := pipelineStepType(toJSONValue(step)); err != nil || t != "wait" {
+			return true
+		}
+	}
+	return false
+}
+
+// toJSONValue converts the maps of a step so its type can be found
+func toJSONValue(v interface{}) interface{} {
+	if attrs, ok := v.(yaml.MapSlice); ok {
+		m := map[string]interface{}{}
+		for _, item := range attrs {
+			m[fmt.Sprint(item.Key)] = item.Value
+		}
+		return m
+	}
+	return v
+}
+
+// matchChangedFiles returns the first changed file that matches a pattern.
+// Patterns starting with ! exclude the files they match
+func matchChangedFiles(patterns []string, changed []string) (string, string, bool) {
+	for _, file := range changed {
+		file = filepath.ToSlash(file)
+
+		excluded := false
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, "!") {
+				if ok, _ := zglob.Match(strings.TrimPrefix(pattern, "!"), file); ok {
+					excluded = true
+					break
+				}
+			}
+		}
+		if excluded {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, "!") {
+				continue
+			}
+			if ok, _ := zglob.Match(pattern, file); ok {
+				return file, pattern, true
+			}
+			// A directory matches everything within it
+			if strings.HasPrefix(file, strings.TrimSuffix(pattern, "/")+"/") {
+				return file, pattern, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// removeDependencies replaces depends_on entries for removed step keys with
+// the dependencies of the removed steps
+func removeDependencies(v interface{}, removedKeys map[string][]interface{}) interface{} {
+	switch vv := v.(type) {
+	case yaml.MapSlice:
+		copied := yaml.MapSlice{}
+		for _, item := range vv {
+			if item.Key == "depends_on" {
+				item.Value = removeDependsOn(item.Value, removedKeys)
+				if item.Value == nil {
+					continue
+				}
+			} else {
+				item.Value = removeDependencies(item.Value, removedKeys)
+			}
+			copied = append(copied, item)
+		}
+		return copied
+
+	case []interface{}:
+		copied := make([]interface{}, len(vv))
+		for i := range vv {
+			copied[i] = removeDependencies(vv[i], removedKeys)
+		}
+		return copied
+	}
+
+	return v
+}
+
+func removeDependsOn(v interface{}, removedKeys map[string][]interface{}) interface{} {
+	deps := dependsOnList(v)
+
+	// The step's own dependencies come first, so they're kept over the same
+	// dependencies of removed steps
+	var own []interface{}
+	for _, dep := range deps {
+		if _, removed := removedKeys[dependencyKey(dep)]; !removed {
+			own = append(own, dep)
+		}
+	}
+	if len(own) == len(deps) {
+		return v
+	}
+
+	kept := []interface{}{}
+	seen := map[string]bool{}
+	for _, dep := range append(own, replaceRemovedDependencies(deps, removedKeys, map[string]bool{})...) {
+		if key := dependencyKey(dep); key != "" {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		kept = append(kept, dep)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// replaceRemovedDependencies replaces dependencies on removed steps with
+// their dependencies, following them through steps that were removed too
+func replaceRemovedDependencies(deps []interface{}, removedKeys map[string][]interface{}, followed map[string]bool) []interface{} {
+	var replaced []interface{}
+	for _, dep := range deps {
+		key := dependencyKey(dep)
+		removedDeps, removed := removedKeys[key]
+		if !removed {
+			replaced = append(replaced, dep)
+			continue
+		}
+		if followed[key] {
+			continue
+		}
+		followed[key] = true
+		replaced = append(replaced, replaceRemovedDependencies(removedDeps, removedKeys, followed)...)
+	}
+	return replaced
+}
+
+// dependencyKey returns the step key of a depends_on entry, which is either
+// the key or a map with the key in "step"
+func dependencyKey(dep interface{}) string {
+	key, _ := dep.(string)
+	if attrs, ok := dep.(yaml.MapSlice); ok {
+		if item, ok := mapSliceItem("step", attrs); ok {
+			key, _ = item.Value.(string)
+		}
+	}
+	return key
+}
+
+// dependsOnList returns the entries of a depends_on attribute as a list
+func dependsOnList(v interface{}) []interface{} {
+	switch vv := v.(type) {
+	case string:
+		return []interface{}{vv}
+	case []interface{}:
+		return vv
+	}
+	return nil
+}
+
+// addStepKeys records the keys of a removed step along with its dependencies,
+// which include those of the group it's in
+func addStepKeys(attrs yaml.MapSlice, groupDeps []interface{}, keys map[string][]interface{}) {
+	deps := append([]interface{}{}, groupDeps...)
+	if item, ok := mapSliceItem("depends_on", attrs); ok {
+		deps = append(deps, dependsOnList(item.Value)...)
+	}
+
+	for _, attr := range []string{"key", "id", "identifier"} {
+		if item, ok := mapSliceItem(attr, attrs); ok {
+			if key, ok := item.Value.(string); ok {
+				keys[key] = deps
+			}
+		}
+	}
+
+	// The steps of removed groups are removed too
+	if item, ok := mapSliceItem("steps", attrs); ok {
+		if steps, ok := item.Value.([]interface{}); ok {
+			for _, step := range steps {
+				if stepAttrs, ok := step.(yaml.MapSlice); ok {
+					addStepKeys(stepAttrs, deps, keys)
+				}
+			}
+		}
+	}
+}
+
+// pipelineStepName describes a step for logging
+func pipelineStepName(attrs yaml.MapSlice, position string) string {
+	for _, attr := range []string{"label", "name", "group", "key", "trigger", "block", "input"} {
+		if item, ok := mapSliceItem(attr, attrs); ok {
+			if s, ok := item.Value.(string); ok && s != "" {
+				return fmt.Sprintf("step %s %q", position, s)
+			}
+		}
+	}
+	return "step " + position
+}
+
+func stringOrStrings(v interface{}) ([]string, error) {
+	switch vv := v.(type) {
+	case string:
+		return []string{vv}, nil
+	case []interface{}:
+		var s []string
+		for _, item := range vv {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %T", item)
+			}
+			s = append(s, str)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("expected a string or a list of strings, got %T", v)
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const changesPipeline = `steps:
+  - label: Web
+    key: web
+    command: make web
+    if_changed:
+      - web/**
+      - "!web/**/*.md"
+  - label: API
+    key: api
+    command: make api
+    if_changed: api
+  - wait
+  - label: Deploy
+    command: make deploy
+    depends_on:
+      - web
+      - step: api
+  - group: Docs
+    key: docs
+    steps:
+      - command: make docs
+        if_changed: docs/**
+  - command: make check
+    depends_on: docs
+`
+
+func parseChangesPipeline(t *testing.T) *PipelineParserResult {
+	t.Helper()
+
+	result, err := PipelineParser{Pipeline: []byte(changesPipeline), NoInterpolation: true}.Parse()
+	require.NoError(t, err)
+	_, err = result.Validate(true)
+	require.NoError(t, err)
+	require.True(t, result.HasChangeConditions())
+
+	return result
+}
+
+func TestFilterUnchangedStepsRemovesStepsWithoutChanges(t *testing.T) {
+	result := parseChangesPipeline(t)
+
+	decisions, err := result.FilterUnchangedSteps([]string{"web/README.md", "api/server.go"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []PipelineStepDecision{
+		{Step: `step 1 "Web"`, Kept: false, Reason: "none of its paths changed (web/**, !web/**/*.md)"},
+		{Step: `step 2 "API"`, Kept: true, Reason: "api/server.go changed (matches api)"},
+		{Step: `step 5.1`, Kept: false, Reason: "none of its paths changed (docs/**)"},
+		{Step: `step 5 "Docs"`, Kept: false, Reason: "none of its steps are left"},
+	}, decisions)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"label":"API","key":"api","command":"make api"},`+
+		`"wait",`+
+		`{"label":"Deploy","command":"make deploy","depends_on":[{"step":"api"}]},`+
+		`{"command":"make check"}]}`, string(j))
+}
+
+func TestFilterUnchangedStepsKeepsStepsWhenChangesAreUnknown(t *testing.T) {
+	result := parseChangesPipeline(t)
+
+	decisions, err := result.FilterUnchangedSteps(nil)
+	require.NoError(t, err)
+	assert.Len(t, decisions, 3)
+	for _, d := range decisions {
+		assert.True(t, d.Kept, d.Step)
+	}
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.NotContains(t, string(j), "if_changed")
+	assert.Contains(t, string(j), `"group":"Docs"`)
+}
+
+func TestFilterUnchangedStepsKeepsTheOrderOfStepsThatDependedOnRemovedSteps(t *testing.T) {
+	result, err := PipelineParser{Pipeline: []byte(`steps:
+  - command: make build
+    key: build
+  - command: make lint
+    key: lint
+  - command: make web
+    key: web
+    depends_on: build
+    if_changed: web/**
+  - group: Docs
+    key: docs
+    depends_on: lint
+    steps:
+      - command: make docs
+        key: docs-build
+        depends_on: web
+        if_changed: docs/**
+  - command: make deploy
+    depends_on:
+      - web
+      - step: build
+        allow_failure: true
+  - command: make publish
+    depends_on: docs-build
+`), NoInterpolation: true}.Parse()
+	require.NoError(t, err)
+
+	_, err = result.FilterUnchangedSteps([]string{"api/server.go"})
+	require.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"command":"make build","key":"build"},`+
+		`{"command":"make lint","key":"lint"},`+
+		`{"command":"make deploy","depends_on":[{"step":"build","allow_failure":true}]},`+
+		`{"command":"make publish","depends_on":["lint","build"]}]}`, string(j))
+}
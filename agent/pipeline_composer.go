@@ -0,0 +1,512 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// pipelineSource is a file that a pipeline, or part of one, was read from.
+// Problems with steps are reported against where in it they were defined
+type pipelineSource struct {
+	filename  string
+	source    []byte
+	stepsOnly bool
+	order     int
+	locator   *yamlLocator
+}
+
+func (s *pipelineSource) locate(pointer string) yamlLocation {
+	if s.locator == nil {
+		root := ""
+		if s.stepsOnly {
+			root = "/steps"
+		}
+		s.locator = newYAMLLocator(s.source, root)
+	}
+	return s.locator.Locate(pointer)
+}
+
+// pipelineStepOrigin is where a step of a composed pipeline was defined
+type pipelineStepOrigin struct {
+	source  *pipelineSource
+	pointer string
+}
+
+// pipelineComposerFrame is a file or template that steps are being expanded
+// from. Templates are looked up through the frames they're defined in, and
+// cycles are found through the frames that included them
+type pipelineComposerFrame struct {
+	key       string
+	source    *pipelineSource
+	templates yaml.MapSlice
+	scope     *pipelineComposerFrame
+	caller    *pipelineComposerFrame
+}
+
+// pipelineComposer expands include and template steps, so a pipeline can be
+// split across files and reuse parameterised steps. For example:
+//
+//	templates:
+//	  test:
+//	    params:
+//	      package: ~
+//	      timeout:
+//	        default: 10
+//	    steps:
+//	      - command: "go test ./${{ params.package }}"
+//	        timeout_in_minutes: ${{ params.timeout }}
+//
+//	steps:
+//	  - include: .buildkite/pipelines/web.yml
+//	  - template: test
+//	    params:
+//	      package: agent
+//
+// Templates can also be files with params and steps at the top level, which
+// are used by their path (e.g. template: .buildkite/templates/test.yml)
+type pipelineComposer struct {
+	dir     func() (string, error)
+	sources []*pipelineSource
+	origins map[string]pipelineStepOrigin
+}
+
+var pipelineParamRegex = regexp.MustCompile(`\$\{\{\s*params\.([A-Za-z0-9_\-]+)\s*\}\}`)
+
+// Compose expands the steps of a pipeline, removing its templates
+func (c *pipelineComposer) Compose(root *pipelineSource, pipeline yaml.MapSlice) (yaml.MapSlice, error) {
+	c.origins = map[string]pipelineStepOrigin{}
+	c.addSource(root)
+
+	frame := &pipelineComposerFrame{key: root.filename, source: root}
+	if frame.key == "" {
+		frame.key = "(stdin)"
+	}
+
+	if item, ok := mapSliceItem("templates", pipeline); ok {
+		templates, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, c.errorf(frame, "/templates", "templates should be a map of template names to templates")
+		}
+		frame.templates = templates
+	}
+
+	composed := yaml.MapSlice{}
+	for _, item := range pipeline {
+		switch item.Key {
+		case "templates":
+			continue
+		case "steps":
+			if steps, ok := item.Value.([]interface{}); ok {
+				expanded := []interface{}{}
+				if err := c.expandSteps(frame, steps, "/steps", "/steps", &expanded); err != nil {
+					return nil, err
+				}
+				item.Value = expanded
+			}
+		}
+		composed = append(composed, item)
+	}
+
+	return composed, nil
+}
+
+func (c *pipelineComposer) addSource(source *pipelineSource) {
+	source.order = len(c.sources)
+	c.sources = append(c.sources, source)
+}
+
+// expandSteps appends the steps to out, expanding any include and template
+// steps, and recording where each step came from
+func (c *pipelineComposer) expandSteps(frame *pipelineComposerFrame, steps []interface{}, srcPath, outPath string, out *[]interface{}) error {
+	for i, step := range steps {
+		srcPointer := srcPath + "/" + strconv.Itoa(i)
+
+		attrs, ok := step.(yaml.MapSlice)
+		if !ok {
+			c.appendStep(frame, srcPointer, outPath, step, out)
+			continue
+		}
+
+		if item, ok := mapSliceItem("include", attrs); ok {
+			if err := c.expandInclude(frame, attrs, item.Value, srcPointer, outPath, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if item, ok := mapSliceItem("template", attrs); ok {
+			if err := c.expandTemplate(frame, attrs, item.Value, srcPointer, outPath, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Groups can have includes and templates in their steps
+		if _, isGroup := mapSliceItem("group", attrs); isGroup {
+			if item, ok := mapSliceItem("steps", attrs); ok {
+				if groupSteps, ok := item.Value.([]interface{}); ok {
+					outPointer := outPath + "/" + strconv.Itoa(len(*out))
+
+					expanded := []interface{}{}
+					if err := c.expandSteps(frame, groupSteps, srcPointer+"/steps", outPointer+"/steps", &expanded); err != nil {
+						return err
+					}
+
+					group := yaml.MapSlice{}
+					for _, attr := range attrs {
+						if attr.Key == "steps" {
+							attr.Value = expanded
+						}
+						group = append(group, attr)
+					}
+					step = group
+				}
+			}
+		}
+
+		c.appendStep(frame, srcPointer, outPath, step, out)
+	}
+
+	return nil
+}
+
+func (c *pipelineComposer) appendStep(frame *pipelineComposerFrame, srcPointer, outPath string, step interface{}, out *[]interface{}) {
+	outPointer := outPath + "/" + strconv.Itoa(len(*out))
+	c.origins[outPointer] = pipelineStepOrigin{source: frame.source, pointer: srcPointer}
+	*out = append(*out, step)
+}
+
+func (c *pipelineComposer) expandInclude(frame *pipelineComposerFrame, attrs yaml.MapSlice, value interface{}, srcPointer, outPath string, out *[]interface{}) error {
+	if len(attrs) != 1 {
+		return c.errorf(frame, srcPointer, "include steps can't have any other attributes")
+	}
+
+	path, ok := value.(string)
+	if !ok || path == "" {
+		return c.errorf(frame, srcPointer+"/include", "include should be the path of a pipeline file")
+	}
+
+	source, pipeline, err := c.load(frame, srcPointer+"/include", path)
+	if err != nil {
+		return err
+	}
+
+	included := &pipelineComposerFrame{key: source.filename, source: source, scope: frame, caller: frame}
+	if err := c.checkCycle(frame, srcPointer, included.key); err != nil {
+		return err
+	}
+
+	var steps []interface{}
+	for _, item := range pipeline {
+		switch item.Key {
+		case "steps":
+			if steps, ok = item.Value.([]interface{}); !ok {
+				return c.errorf(included, "/steps", "steps should be a list of steps")
+			}
+		case "templates":
+			if included.templates, ok = item.Value.(yaml.MapSlice); !ok {
+				return c.errorf(included, "/templates", "templates should be a map of template names to templates")
+			}
+		default:
+			return c.errorf(included, "/"+escapeJSONPointer(fmt.Sprint(item.Key)),
+				"included pipelines can only have steps and templates, not %q", item.Key)
+		}
+	}
+
+	return c.expandSteps(included, steps, "/steps", outPath, out)
+}
+
+func (c *pipelineComposer) expandTemplate(frame *pipelineComposerFrame, attrs yaml.MapSlice, value interface{}, srcPointer, outPath string, out *[]interface{}) error {
+	name, ok := value.(string)
+	if !ok || name == "" {
+		return c.errorf(frame, srcPointer+"/template", "template should be the name or path of a template")
+	}
+
+	args := yaml.MapSlice{}
+	for _, item := range attrs {
+		switch item.Key {
+		case "template":
+		case "params":
+			if args, ok = item.Value.(yaml.MapSlice); !ok {
+				return c.errorf(frame, srcPointer+"/params", "params should be a map of param names to values")
+			}
+		default:
+			return c.errorf(frame, srcPointer+"/"+escapeJSONPointer(fmt.Sprint(item.Key)),
+				"unknown attribute %q for a template step, only template and params are allowed", item.Key)
+		}
+	}
+
+	template, err := c.resolveTemplate(frame, srcPointer, name)
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkCycle(frame, srcPointer, template.frame.key); err != nil {
+		return err
+	}
+	template.frame.caller = frame
+
+	params, err := c.templateParams(frame, srcPointer, template, args)
+	if err != nil {
+		return err
+	}
+
+	steps, err := c.substituteParams(template, template.steps, params)
+	if err != nil {
+		return err
+	}
+
+	return c.expandSteps(template.frame, steps.([]interface{}), template.pointer+"/steps", outPath, out)
+}
+
+// pipelineTemplate is a template that's been found for a template step
+type pipelineTemplate struct {
+	name    string
+	frame   *pipelineComposerFrame
+	pointer string
+	params  yaml.MapSlice
+	steps   []interface{}
+}
+
+// resolveTemplate finds a template either by its path, or by its name in
+// the templates of the frame or the frames that include it
+func (c *pipelineComposer) resolveTemplate(frame *pipelineComposerFrame, srcPointer, name string) (*pipelineTemplate, error) {
+	template := &pipelineTemplate{name: name}
+
+	var definition yaml.MapSlice
+
+	if strings.Contains(name, "/") || strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml") {
+		source, pipeline, err := c.load(frame, srcPointer+"/template", name)
+		if err != nil {
+			return nil, err
+		}
+
+		template.frame = &pipelineComposerFrame{key: source.filename, source: source, scope: frame}
+		template.pointer = ""
+		definition = pipeline
+
+		if item, ok := mapSliceItem("templates", pipeline); ok {
+			if template.frame.templates, ok = item.Value.(yaml.MapSlice); !ok {
+				return nil, c.errorf(template.frame, "/templates", "templates should be a map of template names to templates")
+			}
+		}
+	} else {
+		for scope := frame; scope != nil && template.frame == nil; scope = scope.scope {
+			item, ok := mapSliceItem(name, scope.templates)
+			if !ok {
+				continue
+			}
+
+			template.frame = &pipelineComposerFrame{
+				key:       scope.source.filename + "#" + name,
+				source:    scope.source,
+				templates: scope.templates,
+				scope:     scope,
+			}
+			template.pointer = "/templates/" + escapeJSONPointer(name)
+
+			if definition, ok = item.Value.(yaml.MapSlice); !ok {
+				return nil, c.errorf(template.frame, template.pointer, "template %q should be a map with params and steps", name)
+			}
+		}
+
+		if template.frame == nil {
+			return nil, c.errorf(frame, srcPointer+"/template", "there's no template named %q", name)
+		}
+	}
+
+	for _, item := range definition {
+		var ok bool
+		switch item.Key {
+		case "params":
+			if item.Value == nil {
+				continue
+			}
+			if template.params, ok = item.Value.(yaml.MapSlice); !ok {
+				return nil, c.errorf(template.frame, template.pointer+"/params", "params should be a map of param names to their defaults")
+			}
+		case "steps":
+			if template.steps, ok = item.Value.([]interface{}); !ok {
+				return nil, c.errorf(template.frame, template.pointer+"/steps", "steps should be a list of steps")
+			}
+		case "templates":
+			if template.pointer != "" {
+				return nil, c.errorf(template.frame, template.pointer+"/templates", "templates can't be defined within other templates")
+			}
+		default:
+			return nil, c.errorf(template.frame, template.pointer+"/"+escapeJSONPointer(fmt.Sprint(item.Key)),
+				"templates can only have params and steps, not %q", item.Key)
+		}
+	}
+
+	return template, nil
+}
+
+// templateParams works out the values of a template's params from the
+// arguments it's used with and the defaults of its params
+func (c *pipelineComposer) templateParams(frame *pipelineComposerFrame, srcPointer string, template *pipelineTemplate, args yaml.MapSlice) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+
+	for _, item := range template.params {
+		name := fmt.Sprint(item.Key)
+		paramPointer := template.pointer + "/params/" + escapeJSONPointer(name)
+
+		switch def := item.Value.(type) {
+		case nil:
+			// Params without a default are required
+		case yaml.MapSlice:
+			for _, attr := range def {
+				switch attr.Key {
+				case "default":
+					params[name] = attr.Value
+				case "description":
+				default:
+					return nil, c.errorf(template.frame, paramPointer, "params can only have a default and a description, not %q", attr.Key)
+				}
+			}
+		default:
+			return nil, c.errorf(template.frame, paramPointer, "param %q should be either empty or a map with a default", name)
+		}
+	}
+
+	for _, item := range args {
+		name := fmt.Sprint(item.Key)
+		if _, ok := mapSliceItem(name, template.params); !ok {
+			return nil, c.errorf(frame, srcPointer+"/params/"+escapeJSONPointer(name), "template %q doesn't have a param named %q", template.name, name)
+		}
+		params[name] = item.Value
+	}
+
+	for _, item := range template.params {
+		name := fmt.Sprint(item.Key)
+		if _, ok := params[name]; !ok {
+			return nil, c.errorf(frame, srcPointer, "template %q requires a value for param %q", template.name, name)
+		}
+	}
+
+	return params, nil
+}
+
+// substituteParams copies a value, replacing ${{ params.name }} in strings.
+// A string that's only a param is replaced with the param's value as is
+func (c *pipelineComposer) substituteParams(template *pipelineTemplate, value interface{}, params map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		var missing string
+		if m := pipelineParamRegex.FindStringSubmatch(v); m != nil && m[0] == v {
+			if param, ok := params[m[1]]; ok {
+				return param, nil
+			}
+			missing = m[1]
+		}
+		substituted := pipelineParamRegex.ReplaceAllStringFunc(v, func(s string) string {
+			name := pipelineParamRegex.FindStringSubmatch(s)[1]
+			param, ok := params[name]
+			if !ok {
+				missing = name
+				return s
+			}
+			if param == nil {
+				return ""
+			}
+			return fmt.Sprint(param)
+		})
+		if missing != "" {
+			return nil, c.errorf(template.frame, template.pointer, "template %q uses param %q, which isn't defined in its params", template.name, missing)
+		}
+		return substituted, nil
+
+	case yaml.MapSlice:
+		copied := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			substituted, err := c.substituteParams(template, item.Value, params)
+			if err != nil {
+				return nil, err
+			}
+			copied[i] = yaml.MapItem{Key: item.Key, Value: substituted}
+		}
+		return copied, nil
+
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i := range v {
+			substituted, err := c.substituteParams(template, v[i], params)
+			if err != nil {
+				return nil, err
+			}
+			copied[i] = substituted
+		}
+		return copied, nil
+	}
+
+	return value, nil
+}
+
+// checkCycle returns an error if key is already being expanded by the frame
+// or the frames that called it
+func (c *pipelineComposer) checkCycle(frame *pipelineComposerFrame, srcPointer, key string) error {
+	chain := []string{key}
+	for f := frame; f != nil; f = f.caller {
+		chain = append([]string{f.key}, chain...)
+		if f.key == key {
+			return c.errorf(frame, srcPointer, "pipeline includes itself: %s", strings.Join(chain, " -> "))
+		}
+	}
+	return nil
+}
+
+// load reads and parses a pipeline file, which must be within the directory
+// the pipeline is being composed in
+func (c *pipelineComposer) load(frame *pipelineComposerFrame, srcPointer, path string) (*pipelineSource, yaml.MapSlice, error) {
+	dir, err := c.dir()
+	if err != nil {
+		return nil, nil, c.errorf(frame, srcPointer, "%v", err)
+	}
+
+	rel, err := repositoryPath(dir, path)
+	if err != nil {
+		return nil, nil, c.errorf(frame, srcPointer, "%v", err)
+	}
+
+	src, err := ioutil.ReadFile(filepath.Join(dir, rel))
+	if err != nil {
+		return nil, nil, c.errorf(frame, srcPointer, "Failed to read %q: %v", path, err)
+	}
+
+	pipeline, stepsOnly, err := unmarshalPipeline(src)
+	if err != nil {
+		return nil, nil, c.errorf(frame, srcPointer, "Failed to parse %s: %v", filepath.ToSlash(rel), err)
+	}
+
+	source := &pipelineSource{filename: filepath.ToSlash(rel), source: src, stepsOnly: stepsOnly}
+	c.addSource(source)
+
+	return source, pipeline, nil
+}
+
+// errorf returns an error prefixed with where in its source a value is
+func (c *pipelineComposer) errorf(frame *pipelineComposerFrame, pointer string, format string, v ...interface{}) error {
+	loc := frame.source.locate(pointer)
+	filename := frame.source.filename
+	if filename == "" {
+		filename = "(stdin)"
+	}
+	return fmt.Errorf("%s:%d:%d: %s", filename, loc.Line, loc.Column, fmt.Sprintf(format, v...))
+}
+
+// repositoryPath cleans a path that's relative to the repository, returning
+// an error if it's outside of it
+func repositoryPath(dir, path string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q isn't within the repository, paths should be relative to %s", path, dir)
+	}
+	return rel, nil
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePipelineFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "pipeline-composer")
+	require.NoError(t, err)
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	return dir
+}
+
+func TestPipelineParserExpandsIncludes(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"pipelines/web.yml":    "steps:\n  - command: make web\n  - include: pipelines/shared.yml\n",
+		"pipelines/shared.yml": "- wait\n- command: make ${THING}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	result, err := PipelineParser{
+		Filename: "pipeline.yml",
+		Dir:      dir,
+		Env:      env.FromSlice([]string{"THING=deploy"}),
+		Pipeline: []byte("steps:\n  - command: make test\n  - include: pipelines/web.yml\n  - group: More\n    steps:\n      - include: pipelines/shared.yml\n"),
+	}.Parse()
+	require.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make test"},{"command":"make web"},"wait",{"command":"make deploy"},{"group":"More","steps":["wait",{"command":"make deploy"}]}]}`, string(j))
+}
+
+func TestPipelineParserExpandsTemplates(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"templates/lint.yml": "params:\n  path:\n    default: .\nsteps:\n  - command: lint ${{ params.path }}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	result, err := PipelineParser{
+		Filename: "pipeline.yml",
+		Dir:      dir,
+		Env:      env.FromSlice([]string{"BUILDKITE_BRANCH=master"}),
+		Pipeline: []byte(`templates:
+  test:
+    params:
+      package: ~
+      timeout:
+        default: 10
+    steps:
+      - label: "Test ${{ params.package }} on ${BUILDKITE_BRANCH}"
+        command: "go test ./${{params.package}}"
+        timeout_in_minutes: ${{ params.timeout }}
+
+steps:
+  - template: test
+    params:
+      package: agent
+  - template: test
+    params:
+      package: bootstrap
+      timeout: 20
+  - template: templates/lint.yml
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"label":"Test agent on master","command":"go test ./agent","timeout_in_minutes":10},`+
+		`{"label":"Test bootstrap on master","command":"go test ./bootstrap","timeout_in_minutes":20},`+
+		`{"command":"lint ."}]}`, string(j))
+}
+
+func TestPipelineParserReportsCompositionErrorsWhereTheyAre(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"a.yml":      "steps:\n  - include: b.yml\n",
+		"b.yml":      "steps:\n  - wait\n  - include: a.yml\n",
+		"broken.yml": "steps:\n  - command: [\n",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{"steps:\n  - include: a.yml\n", `b.yml:3:3: pipeline includes itself: a.yml -> b.yml -> a.yml`},
+		{"steps:\n  - wait\n  - include: missing.yml\n", `pipeline.yml:3:5: Failed to read "missing.yml"`},
+		{"steps:\n  - include: broken.yml\n", `pipeline.yml:2:5: Failed to parse broken.yml: line 2`},
+		{"steps:\n  - include: ../outside.yml\n", `pipeline.yml:2:5: "../outside.yml" isn't within the repository`},
+		{"steps:\n  - template: nope\n", `pipeline.yml:2:5: there's no template named "nope"`},
+		{"templates:\n  t:\n    params:\n      a: ~\n    steps: []\nsteps:\n  - template: t\n", `pipeline.yml:7:3: template "t" requires a value for param "a"`},
+		{"templates:\n  t:\n    steps:\n      - command: ${{ params.b }}\nsteps:\n  - template: t\n", `pipeline.yml:2:3: template "t" uses param "b", which isn't defined in its params`},
+		{"templates:\n  t:\n    steps:\n      - template: t\nsteps:\n  - template: t\n", `pipeline.yml:4:7: pipeline includes itself: pipeline.yml#t -> pipeline.yml#t`},
+	} {
+		_, err := PipelineParser{
+			Filename:        "pipeline.yml",
+			Dir:             dir,
+			Pipeline:        []byte(tc.pipeline),
+			NoInterpolation: true,
+		}.Parse()
+		if assert.Error(t, err, tc.pipeline) {
+			assert.Contains(t, err.Error(), tc.err, tc.pipeline)
+		}
+	}
+}
+
+func TestPipelineValidationLocatesErrorsInIncludedFiles(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"web.yml": "steps:\n  - label: Web\n    comand: make web\n",
+	})
+	defer os.RemoveAll(dir)
+
+	result, err := PipelineParser{
+		Filename:        "pipeline.yml",
+		Dir:             dir,
+		Pipeline:        []byte("steps:\n  - wait\n  - include: web.yml\n  - command: make\n    timeout_in_minutes: soon\n"),
+		NoInterpolation: true,
+	}.Parse()
+	require.NoError(t, err)
+
+	_, err = result.Validate(true)
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`pipeline.yml:5:5: /steps/2/timeout_in_minutes: should be a number, not "soon"`,
+		`web.yml:3:5: /steps/0/comand: unknown attribute "comand" for a command step, did you mean "command"?`,
+	}, errorStrings(err.(PipelineValidationErrors)))
+}
+
+func TestPipelineRootDirIsTheCheckout(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"web.yml": "steps:\n  - command: make web\n",
+	})
+	defer os.RemoveAll(dir)
+
+	root, err := pipelineRootDir(env.FromSlice([]string{"BUILDKITE_BUILD_CHECKOUT_PATH=" + dir}))
+	require.NoError(t, err)
+	assert.Equal(t, dir, root)
+
+	// Includes are found in the checkout, wherever the upload is run from
+	result, err := PipelineParser{
+		Env:             env.FromSlice([]string{"BUILDKITE_BUILD_CHECKOUT_PATH=" + dir}),
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte("steps:\n  - include: web.yml\n"),
+		NoInterpolation: true,
+	}.Parse()
+	require.NoError(t, err)
+
+	b, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"steps":[{"command":"make web"}]}`, string(b))
+
+	// A checkout path that doesn't exist is ignored
+	root, err = pipelineRootDir(env.FromSlice([]string{"BUILDKITE_BUILD_CHECKOUT_PATH=" + filepath.Join(dir, "missing")}))
+	require.NoError(t, err)
+	assert.NotEqual(t, filepath.Join(dir, "missing"), root)
+}
+
+func TestPipelineRootDirIsOnlyFoundWhenNeeded(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"web.yml":  "steps:\n  - command: make web\n",
+		"name.txt": "llamas",
+	})
+	defer os.RemoveAll(dir)
+
+	var calls int
+	defer func(f func(*env.Environment) (string, error)) { findPipelineRootDir = f }(findPipelineRootDir)
+	findPipelineRootDir = func(*env.Environment) (string, error) {
+		calls++
+		return dir, nil
+	}
+
+	parse := func(pipeline string) {
+		_, err := PipelineParser{
+			Env:                    env.FromSlice([]string{}),
+			Filename:               "pipeline.yml",
+			Pipeline:               []byte(pipeline),
+			InterpolationFunctions: true,
+		}.Parse()
+		require.NoError(t, err)
+	}
+
+	parse("steps:\n  - command: make test\n")
+	assert.Equal(t, 0, calls)
+
+	parse("steps:\n  - include: web.yml\n  - include: web.yml\n  - command: echo ${file:name.txt}\n")
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// PipelineFormats are the formats a pipeline can be rendered in
+var PipelineFormats = []string{"json", "yaml", "summary"}
+
+// Format renders the pipeline as it would be uploaded, either as JSON, YAML
+// or a summary of its steps for people to read
+func (p *PipelineParserResult) Format(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(p); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case "yaml":
+		return yaml.Marshal(p.pipeline)
+
+	case "summary":
+		return p.summary(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown pipeline format %q, expected one of %s", format, strings.Join(PipelineFormats, ", "))
+}
+
+func (p *PipelineParserResult) summary() []byte {
+	var buf bytes.Buffer
+
+	var steps []interface{}
+	if item, ok := mapSliceItem("steps", p.pipeline); ok {
+		steps, _ = item.Value.([]interface{})
+	}
+
+	fmt.Fprintf(&buf, "Steps: %d\n", countPipelineSteps(steps))
+
+	if item, ok := mapSliceItem("agents", p.pipeline); ok {
+		fmt.Fprintf(&buf, "Default agents: %s\n", summarizeAgents(item.Value))
+	}
+
+	if item, ok := mapSliceItem("env", p.pipeline); ok {
+		if vars, ok := item.Value.(yaml.MapSlice); ok {
+			fmt.Fprintf(&buf, "Env: %s\n", strings.Join(mapSliceKeys(vars), ", "))
+		}
+	}
+
+	buf.WriteString("\n")
+	summarizeSteps(&buf, steps, "", "")
+
+	return buf.Bytes()
+}
+
+func summarizeSteps(buf *bytes.Buffer, steps []interface{}, prefix, indent string) {
+	for i, step := range steps {
+		position := prefix + strconv.Itoa(i+1) + "."
+
+		stepType, _ := pipelineStepType(toJSONValue(step))
+		if stepType == "" {
+			stepType = "unknown"
+		}
+
+		attrs, ok := step.(yaml.MapSlice)
+		if !ok {
+			fmt.Fprintf(buf, "%s%s %s\n", indent, position, stepType)
+			continue
+		}
+
+		title := stepType
+		for _, attr := range []string{"label", "name", stepType} {
+			if item, ok := mapSliceItem(attr, attrs); ok {
+				if s, ok := item.Value.(string); ok && s != "" {
+					title = fmt.Sprintf("%s %q", stepType, s)
+					break
+				}
+			}
+		}
+		fmt.Fprintf(buf, "%s%s %s\n", indent, position, title)
+
+		detail := indent + strings.Repeat(" ", len(position)+1)
+
+		for _, attr := range []string{"key", "id", "identifier"} {
+			if item, ok := mapSliceItem(attr, attrs); ok {
+				fmt.Fprintf(buf, "%skey: %v\n", detail, item.Value)
+				break
+			}
+		}
+
+		if stepType == "command" {
+			for _, attr := range []string{"command", "commands"} {
+				if item, ok := mapSliceItem(attr, attrs); ok {
+					if commands, err := stringOrStrings(item.Value); err == nil {
+						for _, command := range commands {
+							fmt.Fprintf(buf, "%scommand: %s\n", detail, command)
+						}
+					}
+				}
+			}
+		}
+
+		if item, ok := mapSliceItem("plugins", attrs); ok {
+			fmt.Fprintf(buf, "%splugins: %s\n", detail, strings.Join(pluginNames(item.Value), ", "))
+		}
+
+		if item, ok := mapSliceItem("depends_on", attrs); ok {
+			if deps := dependencyKeys(item.Value); len(deps) > 0 {
+				fmt.Fprintf(buf, "%sdepends on: %s\n", detail, strings.Join(deps, ", "))
+			}
+		}
+
+		if item, ok := mapSliceItem("agents", attrs); ok {
+			fmt.Fprintf(buf, "%sagents: %s\n", detail, summarizeAgents(item.Value))
+		}
+
+		for _, attr := range []string{"branches", "if"} {
+			if item, ok := mapSliceItem(attr, attrs); ok {
+				if values, err := stringOrStrings(item.Value); err == nil {
+					fmt.Fprintf(buf, "%s%s: %s\n", detail, attr, strings.Join(values, " "))
+				}
+			}
+		}
+
+		if stepType == "group" {
+			if item, ok := mapSliceItem("steps", attrs); ok {
+				if groupSteps, ok := item.Value.([]interface{}); ok {
+					summarizeSteps(buf, groupSteps, position, detail)
+				}
+			}
+		}
+	}
+}
+
+func countPipelineSteps(steps []interface{}) int {
+	count := 0
+	for _, step := range steps {
+		count++
+		if attrs, ok := step.(yaml.MapSlice); ok {
+			if _, isGroup := mapSliceItem("group", attrs); isGroup {
+				if item, ok := mapSliceItem("steps", attrs); ok {
+					groupSteps, _ := item.Value.([]interface{})
+					count += countPipelineSteps(groupSteps)
+				}
+			}
+		}
+	}
+	return count
+}
+
+// summarizeAgents formats agent tags like queue=default, os=linux
+func summarizeAgents(v interface{}) string {
+	switch agents := v.(type) {
+	case yaml.MapSlice:
+		var tags []string
+		for _, item := range agents {
+			tags = append(tags, fmt.Sprintf("%v=%v", item.Key, item.Value))
+		}
+		return strings.Join(tags, ", ")
+	case []interface{}:
+		var tags []string
+		for _, tag := range agents {
+			tags = append(tags, fmt.Sprint(tag))
+		}
+		return strings.Join(tags, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+func dependencyKeys(v interface{}) []string {
+	switch deps := v.(type) {
+	case string:
+		return []string{deps}
+	case []interface{}:
+		var keys []string
+		for _, dep := range deps {
+			switch d := dep.(type) {
+			case string:
+				keys = append(keys, d)
+			case yaml.MapSlice:
+				if item, ok := mapSliceItem("step", d); ok {
+					key := fmt.Sprint(item.Value)
+					if allow, ok := mapSliceItem("allow_failure", d); ok && allow.Value == true {
+						key += " (allowing failure)"
+					}
+					keys = append(keys, key)
+				}
+			}
+		}
+		return keys
+	}
+	return nil
+}
+
+func pluginNames(v interface{}) []string {
+	var names []string
+	switch plugins := v.(type) {
+	case []interface{}:
+		for _, plugin := range plugins {
+			switch p := plugin.(type) {
+			case string:
+				names = append(names, p)
+			case yaml.MapSlice:
+				names = append(names, mapSliceKeys(p)...)
+			}
+		}
+	case yaml.MapSlice:
+		names = mapSliceKeys(plugins)
+	}
+	return names
+}
+
+func mapSliceKeys(s yaml.MapSlice) []string {
+	keys := make([]string, 0, len(s))
+	for _, item := range s {
+		keys = append(keys, fmt.Sprint(item.Key))
+	}
+	return keys
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const formatPipeline = `agents:
+  queue: default
+steps:
+  - label: ":hammer: Test"
+    key: test
+    command:
+      - make deps
+      - make test
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+    agents:
+      queue: linux
+  - wait
+  - group: Deploy
+    steps:
+      - trigger: deploy
+        depends_on:
+          - test
+          - step: lint
+            allow_failure: true
+        branches: master
+`
+
+func TestPipelineFormats(t *testing.T) {
+	result, err := PipelineParser{Pipeline: []byte(formatPipeline), NoInterpolation: true}.Parse()
+	require.NoError(t, err)
+
+	j, err := result.Format("json")
+	require.NoError(t, err)
+	assert.Contains(t, string(j), "{\n  \"agents\": {\n    \"queue\": \"default\"\n  },\n")
+
+	y, err := result.Format("yaml")
+	require.NoError(t, err)
+	assert.Contains(t, string(y), "agents:\n  queue: default\nsteps:\n- label: ':hammer: Test'\n  key: test\n")
+
+	s, err := result.Format("summary")
+	require.NoError(t, err)
+	assert.Equal(t, `Steps: 4
+Default agents: queue=default
+
+1. command ":hammer: Test"
+   key: test
+   command: make deps
+   command: make test
+   plugins: docker#v3.0.0
+   agents: queue=linux
+2. wait
+3. group "Deploy"
+   3.1. trigger "deploy"
+        depends on: test, lint (allowing failure)
+        branches: master
+`, string(s))
+
+	_, err = result.Format("xml")
+	assert.EqualError(t, err, `Unknown pipeline format "xml", expected one of json, yaml, summary`)
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// interpolationTransforms can be applied to interpolated values, like
+// ${BUILDKITE_BRANCH|slug}
+var interpolationTransforms = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"slug":  slugify,
+}
+
+var (
+	interpolationVariableRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	slugRegex                  = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// expandFunctions replaces the interpolation functions in a string with
+// their values. Values are escaped so they aren't interpolated again, and
+// functions escaped with $$ are left as they are
+func (p PipelineParser) expandFunctions(s string) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], "$$") {
+			out.WriteString("$$")
+			i += 2
+			continue
+		}
+
+		if strings.HasPrefix(s[i:], "${") {
+			if end := strings.IndexByte(s[i:], '}'); end != -1 {
+				expr := s[i+2 : i+end]
+				if isInterpolationFunction(expr) {
+					value, err := p.evaluateFunction(expr)
+					if err != nil {
+						return "", err
+					}
+					out.WriteString(strings.Replace(value, "$", "$$", -1))
+					i += end + 1
+					continue
+				}
+			}
+		}
+
+		out.WriteByte(s[i])
+		i++
+	}
+
+	return out.String(), nil
+}
+
+// isInterpolationFunction returns whether an expression within ${...} is a
+// function, rather than a variable for the interpolate library
+func isInterpolationFunction(expr string) bool {
+	parts := strings.Split(expr, "|")
+	head := strings.TrimSpace(parts[0])
+
+	if strings.HasPrefix(head, "meta-data:") || strings.HasPrefix(head, "file:") {
+		return true
+	}
+
+	return len(parts) > 1 && interpolationVariableRegex.MatchString(head)
+}
+
+func (p PipelineParser) evaluateFunction(expr string) (string, error) {
+	parts := strings.Split(expr, "|")
+	head := strings.TrimSpace(parts[0])
+
+	var value, variable string
+	switch {
+	case strings.HasPrefix(head, "meta-data:"):
+		key := strings.TrimPrefix(head, "meta-data:")
+		if key == "" {
+			return "", fmt.Errorf("${%s} is missing the meta-data key", expr)
+		}
+
+		cached, ok := p.functionValues[head]
+		if !ok {
+			if p.MetaData == nil {
+				return "", fmt.Errorf("meta-data can't be read to interpolate ${%s}", expr)
+			}
+			var err error
+			if cached, err = p.MetaData(key); err != nil {
+				return "", fmt.Errorf("Failed to read meta-data %q: %v", key, err)
+			}
+			p.functionValues[head] = cached
+		}
+		value = cached
+
+	case strings.HasPrefix(head, "file:"):
+		path := strings.TrimPrefix(head, "file:")
+		if path == "" {
+			return "", fmt.Errorf("${%s} is missing the file's path", expr)
+		}
+
+		cached, ok := p.functionValues[head]
+		if !ok {
+			dir, err := p.rootDir()
+			if err != nil {
+				return "", err
+			}
+			rel, err := repositoryPath(dir, path)
+			if err != nil {
+				return "", err
+			}
+			contents, err := ioutil.ReadFile(filepath.Join(dir, rel))
+			if err != nil {
+				return "", fmt.Errorf("Failed to read %q: %v", path, err)
+			}
+			// Like $(cat file), the trailing newline isn't included
+			cached = strings.TrimSuffix(strings.TrimSuffix(string(contents), "\n"), "\r")
+			p.functionValues[head] = cached
+		}
+		value = cached
+
+	default:
+		if v, ok := p.recorder.Get(head); ok {
+			value, variable = v, head
+		}
+	}
+
+	for _, name := range parts[1:] {
+		name = strings.TrimSpace(name)
+		transform, ok := interpolationTransforms[name]
+		if !ok {
+			return "", fmt.Errorf("Unknown transform %q in ${%s}, expected one of %s",
+				name, expr, strings.Join(interpolationTransformNames(), ", "))
+		}
+		value = transform(value)
+	}
+
+	// Transformed values of variables need checking for secrets too, as
+	// they won't match the original value
+	if variable != "" && len(parts) > 1 {
+		p.recorder.transform(variable, value)
+	}
+
+	return value, nil
+}
+
+func interpolationTransformNames() []string {
+	var names []string
+	for name := range interpolationTransforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// slugify converts a string to lowercase letters and numbers separated by
+// dashes, which can be used in step keys
+func slugify(s string) string {
+	return strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineParserInterpolationFunctions(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"VERSION": "1.2.3\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var metaDataReads []string
+
+	result, err := PipelineParser{
+		Dir:                    dir,
+		Env:                    env.FromSlice([]string{"BUILDKITE_BRANCH=Feature/New Thing ", "PRICE=$5"}),
+		InterpolationFunctions: true,
+		MetaData: func(key string) (string, error) {
+			metaDataReads = append(metaDataReads, key)
+			return " Release-Candidate ", nil
+		},
+		Pipeline: []byte(`steps:
+  - label: "Build ${BUILDKITE_BRANCH|trim} v${file:VERSION}"
+    key: "build-${BUILDKITE_BRANCH|slug}"
+    command: "echo ${meta-data:release|trim|upper} ${meta-data:release|lower} ${PRICE|trim} $${meta-data:release}"
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Equal(t, `{"steps":[{`+
+		`"label":"Build Feature/New Thing v1.2.3",`+
+		`"key":"build-feature-new-thing",`+
+		`"command":"echo RELEASE-CANDIDATE  release-candidate  $5 ${meta-data:release}"}]}`, string(j))
+
+	assert.Equal(t, []string{"release"}, metaDataReads)
+}
+
+func TestPipelineParserInterpolationFunctionsAreOptIn(t *testing.T) {
+	_, err := PipelineParser{
+		Filename: "pipeline.yml",
+		Env:      env.FromSlice([]string{"BUILDKITE_BRANCH=master"}),
+		Pipeline: []byte("steps:\n  - label: \"${BUILDKITE_BRANCH|slug}\"\n"),
+	}.Parse()
+	assert.Error(t, err)
+}
+
+func TestPipelineParserInterpolationErrorsNameTheStepAndField(t *testing.T) {
+	dir := writePipelineFiles(t, map[string]string{
+		"web.yml": "steps:\n  - label: Web\n    env:\n      NAME: \"${BUILDKITE_BRANCH|title}\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{
+			"steps:\n  - wait\n  - label: Deploy\n    command: \"deploy ${meta-data:version}\"\n",
+			`pipeline.yml:4:5: Failed to interpolate the command of step 2 "Deploy": Failed to read meta-data "version": not found`,
+		},
+		{
+			"steps:\n  - group: Checks\n    steps:\n      - command: \"cat ${file:../secrets}\"\n",
+			`pipeline.yml:4:9: Failed to interpolate the command of step 1.1: "../secrets" isn't within the repository`,
+		},
+		{
+			"steps:\n  - include: web.yml\n",
+			`web.yml:4:7: Failed to interpolate the env/NAME of step 1 "Web": Unknown transform "title" in ${BUILDKITE_BRANCH|title}, expected one of lower, slug, trim, upper`,
+		},
+		{
+			"env:\n  FOO: \"${meta-data:}\"\nsteps: []\n",
+			`pipeline.yml:2:3: Failed to interpolate env/FOO: ${meta-data:} is missing the meta-data key`,
+		},
+	} {
+		_, err := PipelineParser{
+			Filename:               "pipeline.yml",
+			Dir:                    dir,
+			Env:                    env.FromSlice([]string{"BUILDKITE_BRANCH=master"}),
+			InterpolationFunctions: true,
+			MetaData: func(key string) (string, error) {
+				return "", errors.New("not found")
+			},
+			Pipeline: []byte(tc.pipeline),
+		}.Parse()
+		if assert.Error(t, err, tc.pipeline) {
+			assert.Contains(t, err.Error(), tc.err, tc.pipeline)
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "feature-new-thing-2", slugify("  Feature/New_Thing (2)!"))
+}
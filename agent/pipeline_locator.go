@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+)
+
+// yamlLocation is a 1-indexed position in a YAML document
+type yamlLocation struct {
+	Line   int
+	Column int
+}
+
+// yamlLocator finds where values are defined in a YAML document by their
+// JSON pointer (e.g. /steps/0/command). The YAML library doesn't expose node
+// positions, so this follows the structure of block mappings and sequences by
+// their indentation. Values within flow collections ({...} and [...]) and
+// multi-line scalars are located at their closest block-style ancestor
+type yamlLocator struct {
+	locations map[string]yamlLocation
+}
+
+type yamlLocatorFrame struct {
+	indent int
+	path   string
+	isSeq  bool
+	next   int
+}
+
+// newYAMLLocator scans a YAML document. If root is set, it's used as the
+// pointer prefix of the document, e.g. /steps for a top-level list of steps
+func newYAMLLocator(src []byte, root string) *yamlLocator {
+	l := &yamlLocator{locations: map[string]yamlLocation{root: {Line: 1, Column: 1}}}
+
+	var stack []*yamlLocatorFrame
+	var pending *yamlLocatorFrame
+	blockScalarIndent := -1
+
+	for idx, line := range strings.Split(string(src), "\n") {
+		lineNum := idx + 1
+		line = strings.TrimRight(line, "\r")
+
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+
+		if strings.TrimSpace(content) == "" || strings.HasPrefix(content, "#") {
+			continue
+		}
+
+		// Lines within a literal or folded block scalar aren't structure
+		if blockScalarIndent >= 0 {
+			if indent > blockScalarIndent {
+				continue
+			}
+			blockScalarIndent = -1
+		}
+
+		if content == "---" || strings.HasPrefix(content, "--- ") || content == "..." {
+			stack, pending = nil, nil
+			continue
+		}
+
+		isDash := content == "-" || strings.HasPrefix(content, "- ")
+
+		// A key without an inline value starts a nested collection, which
+		// can be a sequence at the same indentation as the key
+		if pending != nil && (indent > pending.indent || (indent == pending.indent && isDash)) {
+			stack = append(stack, &yamlLocatorFrame{indent: indent, path: pending.path, isSeq: isDash})
+		}
+		pending = nil
+
+		for len(stack) > 0 && stack[len(stack)-1].indent > indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) == 0 {
+			stack = append(stack, &yamlLocatorFrame{indent: indent, path: root, isSeq: isDash})
+		}
+
+		// Each "- " on a line starts a new item, and what follows can start a
+		// nested collection at a deeper indentation
+		column := indent
+		for {
+			top := stack[len(stack)-1]
+			if top.indent != column {
+				break
+			}
+
+			if isDash && top.isSeq {
+				path := top.path + "/" + strconv.Itoa(top.next)
+				top.next++
+				l.add(path, lineNum, column+1)
+
+				rest := strings.TrimPrefix(strings.TrimPrefix(content, "-"), " ")
+				trimmed := strings.TrimLeft(rest, " ")
+				if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+					pending = &yamlLocatorFrame{indent: column, path: path}
+					break
+				}
+
+				column += len(content) - len(trimmed)
+				content = trimmed
+				isDash = content == "-" || strings.HasPrefix(content, "- ")
+
+				if _, _, ok := splitYAMLKey(content); ok || isDash {
+					stack = append(stack, &yamlLocatorFrame{indent: column, path: path, isSeq: isDash})
+					continue
+				}
+				break
+			}
+
+			key, value, ok := splitYAMLKey(content)
+			if !ok || top.isSeq {
+				break
+			}
+
+			path := top.path + "/" + escapeJSONPointer(key)
+			l.add(path, lineNum, column+1)
+
+			value = stripYAMLProperties(value)
+			switch {
+			case value == "" || strings.HasPrefix(value, "#"):
+				pending = &yamlLocatorFrame{indent: column, path: path}
+			case strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">"):
+				blockScalarIndent = column
+			}
+			break
+		}
+	}
+
+	return l
+}
+
+func (l *yamlLocator) add(path string, line, column int) {
+	if _, exists := l.locations[path]; !exists {
+		l.locations[path] = yamlLocation{Line: line, Column: column}
+	}
+}
+
+// Locate returns where a JSON pointer is defined, or where its closest
+// located ancestor is
+func (l *yamlLocator) Locate(pointer string) yamlLocation {
+	for {
+		if loc, ok := l.locations[pointer]; ok {
+			return loc
+		}
+
+		idx := strings.LastIndex(pointer, "/")
+		if idx <= 0 {
+			if loc, ok := l.locations[""]; ok && idx == 0 {
+				return loc
+			}
+			return yamlLocation{Line: 1, Column: 1}
+		}
+		pointer = pointer[:idx]
+	}
+}
+
+// splitYAMLKey splits a "key: value" line of a block mapping
+func splitYAMLKey(content string) (string, string, bool) {
+	if strings.HasPrefix(content, "{") || strings.HasPrefix(content, "[") {
+		return "", "", false
+	}
+
+	// Quoted keys
+	if strings.HasPrefix(content, `"`) || strings.HasPrefix(content, `'`) {
+		quote := content[0]
+		end := strings.IndexByte(content[1:], quote)
+		if end == -1 {
+			return "", "", false
+		}
+		key := content[1 : end+1]
+		rest := strings.TrimLeft(content[end+2:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+
+	for i := 0; i < len(content); i++ {
+		if content[i] == ':' && (i == len(content)-1 || content[i+1] == ' ') {
+			return strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]), true
+		}
+		if content[i] == '#' && i > 0 && content[i-1] == ' ' {
+			break
+		}
+	}
+
+	return "", "", false
+}
+
+// stripYAMLProperties removes anchors and tags from the start of a value
+func stripYAMLProperties(value string) string {
+	for strings.HasPrefix(value, "&") || strings.HasPrefix(value, "!") {
+		idx := strings.IndexByte(value, ' ')
+		if idx == -1 {
+			return ""
+		}
+		value = strings.TrimLeft(value[idx:], " ")
+	}
+	return value
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
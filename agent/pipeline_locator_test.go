@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYAMLLocatorFindsBlockValues(t *testing.T) {
+	src := `# A pipeline
+env:
+  FOO: bar
+
+steps:
+  - label: "Test"
+    command:
+      - make test
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+  - wait
+  -   trigger: deploy
+      build:
+        message: |
+          A message
+          over: lines
+        branch: master
+  - group: things
+    steps:
+    - command: one
+    - "a/b": two
+`
+
+	l := newYAMLLocator([]byte(src), "")
+
+	for pointer, expected := range map[string]yamlLocation{
+		"":                                       {1, 1},
+		"/env/FOO":                               {3, 3},
+		"/steps":                                 {5, 1},
+		"/steps/0":                               {6, 3},
+		"/steps/0/label":                         {6, 5},
+		"/steps/0/command/0":                     {8, 7},
+		"/steps/0/plugins/0/docker#v3.0.0":       {10, 9},
+		"/steps/0/plugins/0/docker#v3.0.0/image": {11, 11},
+		"/steps/1":                               {12, 3},
+		"/steps/2/trigger":                       {13, 7},
+		"/steps/2/build/branch":                  {18, 9},
+		"/steps/3/steps/0/command":               {21, 7},
+		"/steps/3/steps/1/a~1b":                  {22, 7},
+		"/steps/3/steps/1/a~1b/missing":          {22, 7},
+		"/steps/9":                               {5, 1},
+	} {
+		assert.Equal(t, expected, l.Locate(pointer), pointer)
+	}
+}
+
+func TestYAMLLocatorFindsTopLevelSequences(t *testing.T) {
+	src := "- command: one\n- wait\n- block: Deploy?\n  branches: master\n"
+
+	l := newYAMLLocator([]byte(src), "/steps")
+
+	assert.Equal(t, yamlLocation{1, 3}, l.Locate("/steps/0/command"))
+	assert.Equal(t, yamlLocation{2, 1}, l.Locate("/steps/1"))
+	assert.Equal(t, yamlLocation{4, 3}, l.Locate("/steps/2/branches"))
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/buildkite/agent/v3/env"
@@ -20,12 +22,82 @@ type PipelineParser struct {
 	Filename        string
 	Pipeline        []byte
 	NoInterpolation bool
+
+	// The directory that included pipelines, templates and files are
+	// relative to, which defaults to the root of the checkout (see
+	// pipelineRootDir), only worked out when a pipeline needs it
+	Dir string
+
+	// Whether interpolation functions can be used, which are meta-data values
+	// (${meta-data:key}), file contents (${file:path}) and transforms of
+	// values (${VAR|lower|trim|slug})
+	InterpolationFunctions bool
+
+	// Reads meta-data values for ${meta-data:key} interpolation
+	MetaData func(key string) (string, error)
+
+	// Records the variables that are interpolated into the pipeline
+	recorder *interpolationRecorder
+
+	// The values of interpolation functions, so each is only read once
+	functionValues map[string]string
+
+	// Returns Dir, working out the root of the checkout the first time it's
+	// needed
+	rootDir func() (string, error)
+}
+
+// findPipelineRootDir is replaced in tests to check when it's called
+var findPipelineRootDir = pipelineRootDir
+
+// pipelineRootDir returns the root of the checkout that pipelines are
+// uploaded from, so paths in them don't depend on which directory the upload
+// is run in. It's the build's checkout path in a job, otherwise the top level
+// of the git repository, falling back to the current directory
+func pipelineRootDir(environ *env.Environment) (string, error) {
+	if dir, ok := environ.Get("BUILDKITE_BUILD_CHECKOUT_PATH"); ok && dir != "" {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+
+	if out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return dir, nil
+		}
+	}
+
+	return os.Getwd()
+}
+
+// lazyPipelineRootDir returns a function that returns dir, or if it's empty
+// the root of the checkout, which is only worked out once it's first needed
+// as it can mean running git
+func lazyPipelineRootDir(dir string, environ *env.Environment) func() (string, error) {
+	var err error
+	resolved := dir != ""
+
+	return func() (string, error) {
+		if !resolved {
+			dir, err = findPipelineRootDir(environ)
+			resolved = true
+		}
+		return dir, err
+	}
 }
 
 func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 	if p.Env == nil {
 		p.Env = env.FromSlice(os.Environ())
 	}
+	p.recorder = &interpolationRecorder{
+		env:         p.Env,
+		used:        map[string]string{},
+		transformed: map[string][]string{},
+		defined:     map[string]bool{},
+	}
+	p.functionValues = map[string]string{}
+	p.rootDir = lazyPipelineRootDir(p.Dir, p.Env)
 
 	var errPrefix string
 	if p.Filename == "" {
@@ -34,31 +106,29 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 		errPrefix = fmt.Sprintf("Failed to parse %s", p.Filename)
 	}
 
-	var pipelineAsSlice []topLevelStep
-	var pipeline yaml.MapSlice
+	pipeline, stepsOnly, err := unmarshalPipeline(p.Pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errPrefix, err)
+	}
 
-	// We support top-level arrays of steps, so try that first
-	if err := yaml.Unmarshal(p.Pipeline, &pipelineAsSlice); err == nil {
-		var steps []interface{}
+	source := &pipelineSource{filename: p.Filename, source: p.Pipeline, stepsOnly: stepsOnly}
 
-		// Unwrap our custom topLevelStep types for marshaling later
-		for _, step := range pipelineAsSlice {
-			if step.MapSlice != nil {
-				steps = append(steps, step.MapSlice)
-			} else {
-				steps = append(steps, step.Body)
-			}
-		}
+	// Includes and templates are expanded before anything is interpolated,
+	// so params and env can be used in them
+	composer := &pipelineComposer{dir: p.rootDir}
+	pipeline, err = composer.Compose(source, pipeline)
+	if err != nil {
+		return nil, err
+	}
 
-		pipeline = yaml.MapSlice{
-			{Key: "steps", Value: steps},
-		}
-	} else if err := yaml.Unmarshal(p.Pipeline, &pipeline); err != nil {
-		return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+	result := &PipelineParserResult{
+		sources: composer.sources,
+		origins: composer.origins,
 	}
 
 	if p.NoInterpolation {
-		return &PipelineParserResult{pipeline: pipeline}, nil
+		result.pipeline = pipeline
+		return result, nil
 	}
 
 	// Preprocess any env that are defined in the top level block and place them into env for
@@ -66,7 +136,7 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 	if item, ok := mapSliceItem("env", pipeline); ok {
 		if envMap, ok := item.Value.(yaml.MapSlice); ok {
 			if err := p.interpolateEnvBlock(envMap); err != nil {
-				return nil, err
+				return nil, result.interpolationError(pipeline, err)
 			}
 		} else {
 			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item)
@@ -77,10 +147,42 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 	// variable interpolation on strings
 	interpolated, err := p.interpolate(pipeline)
 	if err != nil {
-		return nil, err
+		return nil, result.interpolationError(pipeline, err)
+	}
+
+	result.pipeline = interpolated.(yaml.MapSlice)
+	result.interpolated = p.recorder.interpolated()
+	result.transformed = p.recorder.interpolatedTransforms()
+	return result, nil
+}
+
+// unmarshalPipeline parses a pipeline document, which is either a map with
+// steps, or a top-level list of steps
+func unmarshalPipeline(src []byte) (yaml.MapSlice, bool, error) {
+	var pipelineAsSlice []topLevelStep
+	var pipeline yaml.MapSlice
+
+	// We support top-level arrays of steps, so try that first
+	if err := yaml.Unmarshal(src, &pipelineAsSlice); err == nil {
+		var steps []interface{}
+
+		// Unwrap our custom topLevelStep types for marshaling later
+		for _, step := range pipelineAsSlice {
+			if step.MapSlice != nil {
+				steps = append(steps, step.MapSlice)
+			} else {
+				steps = append(steps, step.Body)
+			}
+		}
+
+		return yaml.MapSlice{
+			{Key: "steps", Value: steps},
+		}, true, nil
+	} else if err := yaml.Unmarshal(src, &pipeline); err != nil {
+		return nil, false, formatYAMLError(err)
 	}
 
-	return &PipelineParserResult{pipeline: interpolated.(yaml.MapSlice)}, nil
+	return pipeline, false, nil
 }
 
 func mapSliceItem(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
@@ -100,11 +202,12 @@ func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
 		}
 		switch tv := item.Value.(type) {
 		case string:
-			interpolated, err := interpolate.Interpolate(p.Env, tv)
+			interpolated, err := p.interpolateString(tv, "/env/"+escapeJSONPointer(k))
 			if err != nil {
 				return err
 			}
 			p.Env.Set(k, interpolated)
+			p.recorder.defined[k] = true
 		}
 	}
 	return nil
@@ -114,6 +217,153 @@ func formatYAMLError(err error) error {
 	return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
 }
 
+// interpolateString interpolates variables, and any interpolation functions
+// if they're enabled, into a string at a path in the pipeline
+func (p PipelineParser) interpolateString(s string, path string) (string, error) {
+	if p.InterpolationFunctions {
+		expanded, err := p.expandFunctions(s)
+		if err != nil {
+			return "", &interpolationError{pointer: path, err: err}
+		}
+		s = expanded
+	}
+
+	interpolated, err := interpolate.Interpolate(p.recorder, s)
+	if err != nil {
+		return "", &interpolationError{pointer: path, err: err}
+	}
+
+	return interpolated, nil
+}
+
+// interpolationError is an error interpolating a value in a pipeline
+type interpolationError struct {
+	pointer string
+	err     error
+}
+
+func (e *interpolationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.pointer, e.err)
+}
+
+// interpolationError describes where an interpolation error happened, with
+// the step and field, and where in the pipeline's source it is
+func (p *PipelineParserResult) interpolationError(pipeline yaml.MapSlice, err error) error {
+	ie, ok := err.(*interpolationError)
+	if !ok {
+		return err
+	}
+
+	source, srcPointer := p.origin(ie.pointer)
+	loc := source.locate(srcPointer)
+
+	filename := source.filename
+	if filename == "" {
+		filename = "(stdin)"
+	}
+
+	return fmt.Errorf("%s:%d:%d: Failed to interpolate %s: %v",
+		filename, loc.Line, loc.Column, describePipelinePointer(pipeline, ie.pointer), ie.err)
+}
+
+// describePipelinePointer names the field a pointer is to, and the step it's
+// in, like: the command of step 2 "Test"
+func describePipelinePointer(pipeline yaml.MapSlice, pointer string) string {
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+
+	var value interface{} = pipeline
+	var step yaml.MapSlice
+	var position []string
+	field := 0
+
+	for i := 0; i+1 < len(parts) && parts[i] == "steps"; i += 2 {
+		attrs, ok := value.(yaml.MapSlice)
+		if !ok {
+			break
+		}
+		item, ok := mapSliceItem("steps", attrs)
+		if !ok {
+			break
+		}
+		steps, ok := item.Value.([]interface{})
+		if !ok {
+			break
+		}
+		idx, err := strconv.Atoi(parts[i+1])
+		if err != nil || idx >= len(steps) {
+			break
+		}
+
+		value = steps[idx]
+		step, _ = value.(yaml.MapSlice)
+		position = append(position, strconv.Itoa(idx+1))
+		field = i + 2
+	}
+
+	fieldPath := strings.Join(parts[field:], "/")
+	if len(position) == 0 {
+		return fieldPath
+	}
+
+	name := pipelineStepName(step, strings.Join(position, "."))
+	if fieldPath == "" {
+		return name
+	}
+	return fmt.Sprintf("the %s of %s", fieldPath, name)
+}
+
+// interpolationRecorder is an interpolation environment that records which
+// variables are used, so their values can be checked before upload
+type interpolationRecorder struct {
+	env         *env.Environment
+	used        map[string]string
+	transformed map[string][]string
+	defined     map[string]bool
+}
+
+func (r *interpolationRecorder) Get(key string) (string, bool) {
+	value, ok := r.env.Get(key)
+	if ok {
+		r.used[key] = value
+	}
+	return value, ok
+}
+
+// interpolated returns the variables that were used from the environment,
+// rather than defined in the pipeline's env
+func (r *interpolationRecorder) interpolated() map[string]string {
+	vars := map[string]string{}
+	for key, value := range r.used {
+		if !r.defined[key] {
+			vars[key] = value
+		}
+	}
+	return vars
+}
+
+// transform records the value a variable was transformed to, like with
+// ${VAR|lower}
+func (r *interpolationRecorder) transform(key string, value string) {
+	for _, existing := range r.transformed[key] {
+		if existing == value {
+			return
+		}
+	}
+	r.transformed[key] = append(r.transformed[key], value)
+}
+
+// interpolatedTransforms returns the transformed values of variables that
+// were used from the environment, rather than defined in the pipeline's env
+func (r *interpolationRecorder) interpolatedTransforms() map[string][]string {
+	vars := map[string][]string{}
+	for key, values := range r.transformed {
+		if !r.defined[key] {
+			vars[key] = values
+		}
+	}
+	return vars
+}
+
 // interpolate function inspired from: https://gist.github.com/hvoecking/10772475
 
 func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
@@ -128,7 +378,7 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	// Make a copy that we'll add the new values to
 	copy := reflect.New(original.Type()).Elem()
 
-	err := p.interpolateRecursive(copy, original)
+	err := p.interpolateRecursive(copy, original, "")
 	if err != nil {
 		return nil, err
 	}
@@ -137,7 +387,7 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	return copy.Interface(), nil
 }
 
-func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error {
+func (p PipelineParser) interpolateRecursive(copy, original reflect.Value, path string) error {
 	switch original.Kind() {
 	// If it is a pointer we need to unwrap and call once again
 	case reflect.Ptr:
@@ -155,7 +405,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		copy.Set(reflect.New(originalValue.Type()))
 
 		// Unwrap the newly created pointer
-		err := p.interpolateRecursive(copy.Elem(), originalValue)
+		err := p.interpolateRecursive(copy.Elem(), originalValue, path)
 		if err != nil {
 			return err
 		}
@@ -177,7 +427,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		// points to, so we have to call Elem() to unwrap it
 		copyValue := reflect.New(originalValue.Type()).Elem()
 
-		err := p.interpolateRecursive(copyValue, originalValue)
+		err := p.interpolateRecursive(copyValue, originalValue, path)
 		if err != nil {
 			return err
 		}
@@ -187,7 +437,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 	// If it is a struct we interpolate each field
 	case reflect.Struct:
 		for i := 0; i < original.NumField(); i += 1 {
-			err := p.interpolateRecursive(copy.Field(i), original.Field(i))
+			err := p.interpolateRecursive(copy.Field(i), original.Field(i), path)
 			if err != nil {
 				return err
 			}
@@ -198,7 +448,14 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		copy.Set(reflect.MakeSlice(original.Type(), original.Len(), original.Cap()))
 
 		for i := 0; i < original.Len(); i += 1 {
-			err := p.interpolateRecursive(copy.Index(i), original.Index(i))
+			// Items of maps are tracked by their keys, and items of
+			// lists by their index
+			itemPath := path + "/" + strconv.Itoa(i)
+			if item, ok := original.Index(i).Interface().(yaml.MapItem); ok {
+				itemPath = path + "/" + escapeJSONPointer(fmt.Sprint(item.Key))
+			}
+
+			err := p.interpolateRecursive(copy.Index(i), original.Index(i), itemPath)
 			if err != nil {
 				return err
 			}
@@ -213,14 +470,14 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 			// New gives us a pointer, but again we want the value
 			copyValue := reflect.New(originalValue.Type()).Elem()
-			err := p.interpolateRecursive(copyValue, originalValue)
+			err := p.interpolateRecursive(copyValue, originalValue, path)
 			if err != nil {
 				return err
 			}
 
 			// Also interpolate the key if it's a string
 			if key.Kind() == reflect.String {
-				interpolatedKey, err := interpolate.Interpolate(p.Env, key.Interface().(string))
+				interpolatedKey, err := p.interpolateString(key.Interface().(string), path)
 				if err != nil {
 					return err
 				}
@@ -232,7 +489,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a string interpolate it (yay finally we're doing what we came for)
 	case reflect.String:
-		interpolated, err := interpolate.Interpolate(p.Env, original.Interface().(string))
+		interpolated, err := p.interpolateString(original.Interface().(string), path)
 		if err != nil {
 			return err
 		}
@@ -249,6 +506,16 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 // PipelineParserResult is the ordered parse tree of a Pipeline document
 type PipelineParserResult struct {
 	pipeline yaml.MapSlice
+
+	// The files the pipeline came from, and where each of its steps was
+	// defined in them, so problems can be located
+	sources []*pipelineSource
+	origins map[string]pipelineStepOrigin
+
+	// The values of variables from the environment that were interpolated,
+	// and the values they were transformed to
+	interpolated map[string]string
+	transformed  map[string][]string
 }
 
 func (p *PipelineParserResult) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,263 @@
+package agent
+
+// pipelineSchema is the JSON schema that pipelines are validated against
+// before they're uploaded. Each step type has its own definition, which is
+// chosen by the keys of the step (see pipelineStepType), and the properties
+// of each definition are the attributes known for that type of step. Numeric
+// attributes also accept strings of digits, or strings with a $ in them, as
+// interpolation and templates leave strings behind. YAML parses keys and
+// labels that look like numbers as numbers, so they accept those too.
+const pipelineSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["steps"],
+  "properties": {
+    "steps": { "type": "array" },
+    "env": { "$ref": "#/definitions/env" },
+    "agents": { "$ref": "#/definitions/agents" },
+    "notify": { "$ref": "#/definitions/notify" }
+  },
+  "definitions": {
+    "env": {
+      "type": ["object", "null"],
+      "additionalProperties": { "type": ["string", "number", "boolean", "null"] }
+    },
+    "agents": {
+      "type": ["object", "array", "null"],
+      "items": { "type": "string" }
+    },
+    "notify": {
+      "type": ["array", "null"],
+      "items": { "type": ["object", "string"] }
+    },
+    "stringOrStrings": {
+      "type": ["string", "array", "null"],
+      "items": { "type": "string" }
+    },
+    "dependsOn": {
+      "type": ["string", "number", "array", "null"],
+      "items": {
+        "type": ["string", "number", "object"],
+        "properties": {
+          "step": { "type": ["string", "number"] },
+          "allow_failure": { "type": "boolean" }
+        }
+      }
+    },
+    "integer": {
+      "type": ["integer", "string"],
+      "pattern": "^\\s*-?[0-9]+\\s*$|\\$"
+    },
+    "positiveInteger": {
+      "type": ["integer", "string"],
+      "minimum": 1,
+      "pattern": "^\\s*[0-9]+\\s*$|\\$"
+    },
+    "key": { "type": ["string", "number"], "minLength": 1 },
+    "label": { "type": ["string", "number"] },
+    "if": { "type": "string" },
+    "branches": { "$ref": "#/definitions/stringOrStrings" },
+    "plugins": {
+      "type": ["array", "object", "null"],
+      "items": { "type": ["string", "object"] }
+    },
+    "softFail": {
+      "type": ["boolean", "array"],
+      "items": {
+        "type": "object",
+        "properties": {
+          "exit_status": { "type": ["integer", "string"] }
+        }
+      }
+    },
+    "skip": { "type": ["boolean", "string"] },
+    "matrix": {
+      "type": ["array", "object"],
+      "items": { "type": ["string", "number", "boolean"] },
+      "properties": {
+        "setup": { "type": ["array", "object"] },
+        "adjustments": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "properties": {
+              "with": { "type": ["array", "object"] },
+              "skip": { "$ref": "#/definitions/skip" },
+              "soft_fail": { "$ref": "#/definitions/softFail" }
+            }
+          }
+        }
+      }
+    },
+    "fields": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "key": { "type": "string" },
+          "text": { "type": "string" },
+          "select": { "type": "string" },
+          "hint": { "type": "string" },
+          "required": { "type": "boolean" },
+          "default": { "type": ["string", "array"] },
+          "multiple": { "type": "boolean" },
+          "options": {
+            "type": "array",
+            "items": { "type": "object" }
+          }
+        },
+        "required": ["key"]
+      }
+    },
+    "commandStep": {
+      "type": "object",
+      "properties": {
+        "type": { "type": "string" },
+        "command": { "$ref": "#/definitions/stringOrStrings" },
+        "commands": { "$ref": "#/definitions/stringOrStrings" },
+        "label": { "$ref": "#/definitions/label" },
+        "name": { "$ref": "#/definitions/label" },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" },
+        "agents": { "$ref": "#/definitions/agents" },
+        "agent_query_rules": { "$ref": "#/definitions/stringOrStrings" },
+        "env": { "$ref": "#/definitions/env" },
+        "plugins": { "$ref": "#/definitions/plugins" },
+        "artifact_paths": { "$ref": "#/definitions/stringOrStrings" },
+        "timeout_in_minutes": { "$ref": "#/definitions/positiveInteger" },
+        "parallelism": { "$ref": "#/definitions/positiveInteger" },
+        "concurrency": { "$ref": "#/definitions/positiveInteger" },
+        "concurrency_group": { "type": "string" },
+        "concurrency_method": { "enum": ["ordered", "eager"] },
+        "priority": { "$ref": "#/definitions/integer" },
+        "cancel_on_build_failing": { "type": "boolean" },
+        "matrix": { "$ref": "#/definitions/matrix" },
+        "retry": {
+          "type": "object",
+          "properties": {
+            "automatic": { "type": ["boolean", "object", "array"] },
+            "manual": { "type": ["boolean", "object"] }
+          }
+        },
+        "soft_fail": { "$ref": "#/definitions/softFail" },
+        "skip": { "$ref": "#/definitions/skip" },
+        "notify": { "$ref": "#/definitions/notify" }
+      }
+    },
+    "waitStep": {
+      "type": "object",
+      "properties": {
+        "type": { "type": "string" },
+        "wait": { "type": ["string", "null"] },
+        "waiter": { "type": ["string", "null"] },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "continue_on_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" }
+      }
+    },
+    "blockStep": {
+      "type": "object",
+      "properties": {
+        "type": { "type": "string" },
+        "block": { "type": ["string", "null"] },
+        "label": { "$ref": "#/definitions/label" },
+        "name": { "$ref": "#/definitions/label" },
+        "prompt": { "type": "string" },
+        "fields": { "$ref": "#/definitions/fields" },
+        "blocked_state": { "enum": ["passed", "failed", "running"] },
+        "allowed_teams": { "$ref": "#/definitions/stringOrStrings" },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" }
+      }
+    },
+    "inputStep": {
+      "type": "object",
+      "properties": {
+        "type": { "type": "string" },
+        "input": { "type": ["string", "null"] },
+        "label": { "$ref": "#/definitions/label" },
+        "name": { "$ref": "#/definitions/label" },
+        "prompt": { "type": "string" },
+        "fields": { "$ref": "#/definitions/fields" },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" }
+      }
+    },
+    "triggerStep": {
+      "type": "object",
+      "required": ["trigger"],
+      "properties": {
+        "type": { "type": "string" },
+        "trigger": { "type": "string", "minLength": 1 },
+        "label": { "$ref": "#/definitions/label" },
+        "name": { "$ref": "#/definitions/label" },
+        "async": { "type": "boolean" },
+        "build": {
+          "type": "object",
+          "properties": {
+            "message": { "type": "string" },
+            "commit": { "type": "string" },
+            "branch": { "type": "string" },
+            "meta_data": { "type": "object" },
+            "env": { "$ref": "#/definitions/env" }
+          }
+        },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" },
+        "soft_fail": { "$ref": "#/definitions/softFail" },
+        "skip": { "$ref": "#/definitions/skip" }
+      }
+    },
+    "groupStep": {
+      "type": "object",
+      "required": ["steps"],
+      "properties": {
+        "type": { "type": "string" },
+        "group": { "type": ["string", "null"] },
+        "label": { "$ref": "#/definitions/label" },
+        "name": { "$ref": "#/definitions/label" },
+        "steps": { "type": "array", "minItems": 1 },
+        "key": { "$ref": "#/definitions/key" },
+        "id": { "$ref": "#/definitions/key" },
+        "identifier": { "$ref": "#/definitions/key" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "if": { "$ref": "#/definitions/if" },
+        "if_changed": { "$ref": "#/definitions/stringOrStrings" },
+        "branches": { "$ref": "#/definitions/branches" },
+        "skip": { "$ref": "#/definitions/skip" },
+        "notify": { "$ref": "#/definitions/notify" }
+      }
+    }
+  }
+}`
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+const (
+	// Values shorter than this aren't checked, the same as with redaction
+	secretLengthMin = 6
+
+	// Values need to be at least this long, with this many bits of entropy
+	// per character, to look like generated tokens
+	tokenLengthMin  = 20
+	tokenEntropyMin = 4.0
+)
+
+// CheckSecrets returns PipelineValidationErrors for every place that the
+// value of a secret variable was interpolated into the pipeline. Variables
+// are secret if their names match one of the redacted vars patterns, or if
+// their values look like generated tokens. Values that secrets were
+// transformed to, like with ${API_TOKEN|lower}, are checked too
+func (p *PipelineParserResult) CheckSecrets(redactedVars []string) error {
+	type secret struct {
+		name   string
+		values []string
+		reason string
+	}
+
+	var secrets []secret
+	for name, value := range p.interpolated {
+		var values []string
+		for _, v := range append([]string{value}, p.transformed[name]...) {
+			if len(v) >= secretLengthMin {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		if pattern, ok := matchRedactedVars(name, redactedVars); ok {
+			secrets = append(secrets, secret{name, values, fmt.Sprintf("matches the redacted vars pattern %q", pattern)})
+			continue
+		}
+
+		// Variables set by Buildkite aren't secret unless they're redacted,
+		// and include many IDs and commits
+		if !strings.HasPrefix(name, "BUILDKITE") && looksLikeToken(value) {
+			secrets = append(secrets, secret{name, values, "looks like a token"})
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].name < secrets[j].name })
+
+	type located struct {
+		*PipelineValidationError
+		order int
+	}
+
+	var found []located
+	walkPipelineStrings(p.pipeline, "", func(pointer, s string) {
+		for _, secret := range secrets {
+			if !containsAny(s, secret.values) {
+				continue
+			}
+
+			source, srcPointer := p.origin(pointer)
+			loc := source.locate(srcPointer)
+
+			found = append(found, located{
+				PipelineValidationError: &PipelineValidationError{
+					Filename: source.filename,
+					Line:     loc.Line,
+					Column:   loc.Column,
+					Pointer:  srcPointer,
+					Message: fmt.Sprintf("the value of $%s, which %s, has been interpolated into the pipeline. "+
+						"Use $$%s to have it interpolated when the job runs instead", secret.name, secret.reason, secret.name),
+				},
+				order: source.order,
+			})
+		}
+	})
+
+	if len(found) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].order != found[j].order {
+			return found[i].order < found[j].order
+		}
+		return found[i].Line < found[j].Line
+	})
+
+	errs := PipelineValidationErrors{}
+	for _, f := range found {
+		errs = append(errs, f.PipelineValidationError)
+	}
+	return errs
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRedactedVars(name string, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// looksLikeToken returns whether a value looks like a randomly generated
+// secret, such as an API key. Hex strings like commits and UUIDs aren't
+func looksLikeToken(value string) bool {
+	if len(value) < tokenLengthMin {
+		return false
+	}
+
+	var lower, upper, digit, hex bool
+	for _, r := range value {
+		switch {
+		case unicode.IsSpace(r):
+			return false
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+		if !strings.ContainsRune("0123456789abcdefABCDEF-", r) {
+			hex = true
+		}
+	}
+
+	if !hex || !(lower && upper && digit) {
+		return false
+	}
+
+	return shannonEntropy(value) >= tokenEntropyMin
+}
+
+// shannonEntropy returns the bits of entropy per character of a string
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// walkPipelineStrings calls fn with every string in a pipeline, including
+// map keys, and the JSON pointer to it
+func walkPipelineStrings(v interface{}, pointer string, fn func(pointer, s string)) {
+	switch vv := v.(type) {
+	case string:
+		fn(pointer, vv)
+	case yaml.MapSlice:
+		for _, item := range vv {
+			key := fmt.Sprint(item.Key)
+			itemPointer := pointer + "/" + escapeJSONPointer(key)
+			fn(itemPointer, key)
+			walkPipelineStrings(item.Value, itemPointer, fn)
+		}
+	case []interface{}:
+		for i, item := range vv {
+			walkPipelineStrings(item, pointer+"/"+strconv.Itoa(i), fn)
+		}
+	}
+}
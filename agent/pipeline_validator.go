@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qri-io/jsonschema"
+)
+
+// PipelineValidationError is a problem with a pipeline, and where in the
+// pipeline's source it was found
+type PipelineValidationError struct {
+	Filename string
+	Line     int
+	Column   int
+	Pointer  string
+	Message  string
+}
+
+func (e *PipelineValidationError) Error() string {
+	filename := e.Filename
+	if filename == "" {
+		filename = "(stdin)"
+	}
+	pointer := e.Pointer
+	if pointer == "" {
+		pointer = "/"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", filename, e.Line, e.Column, pointer, e.Message)
+}
+
+// PipelineValidationErrors is every problem found when validating a pipeline
+type PipelineValidationErrors []*PipelineValidationError
+
+func (errs PipelineValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pipelineStepTypes are the types of steps that have a definition in the
+// pipeline schema
+var pipelineStepTypes = []string{"command", "wait", "block", "input", "trigger", "group"}
+
+type pipelineValidator struct {
+	root       *jsonschema.RootSchema
+	steps      map[string]*jsonschema.RootSchema
+	attributes map[string][]string
+}
+
+var (
+	pipelineValidatorOnce   sync.Once
+	pipelineValidatorCached *pipelineValidator
+)
+
+// loadPipelineValidator compiles the bundled pipeline schema, once
+func loadPipelineValidator() *pipelineValidator {
+	pipelineValidatorOnce.Do(func() {
+		var schema struct {
+			Definitions map[string]json.RawMessage `json:"definitions"`
+		}
+		if err := json.Unmarshal([]byte(pipelineSchema), &schema); err != nil {
+			panic(fmt.Sprintf("Invalid pipeline schema: %v", err))
+		}
+
+		v := &pipelineValidator{
+			root:       jsonschema.Must(pipelineSchema),
+			steps:      map[string]*jsonschema.RootSchema{},
+			attributes: map[string][]string{},
+		}
+
+		for _, stepType := range pipelineStepTypes {
+			name := stepType + "Step"
+
+			// Each step type is compiled as its own schema, sharing the
+			// definitions so references between them resolve
+			stepSchema, err := json.Marshal(map[string]interface{}{
+				"$ref":        "#/definitions/" + name,
+				"definitions": schema.Definitions,
+			})
+			if err != nil {
+				panic(fmt.Sprintf("Invalid pipeline schema: %v", err))
+			}
+			v.steps[stepType] = jsonschema.Must(string(stepSchema))
+
+			var def struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			}
+			if err := json.Unmarshal(schema.Definitions[name], &def); err != nil {
+				panic(fmt.Sprintf("Invalid pipeline schema: %v", err))
+			}
+			for attr := range def.Properties {
+				v.attributes[stepType] = append(v.attributes[stepType], attr)
+			}
+			sort.Strings(v.attributes[stepType])
+		}
+
+		pipelineValidatorCached = v
+	})
+
+	return pipelineValidatorCached
+}
+
+// Validate checks the pipeline against the bundled pipeline schema. If there
+// are problems, every one of them is returned as PipelineValidationErrors,
+// with the line and column in the source of the pipeline they relate to.
+// Attributes that aren't in the schema are returned as warnings, as the schema
+// might not know about every attribute, unless strict is true in which case
+// they're errors too
+func (p *PipelineParserResult) Validate(strict bool) (PipelineValidationErrors, error) {
+	b, err := p.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	v := loadPipelineValidator()
+
+	var valErrs, valWarnings []jsonschema.ValError
+	v.root.Validate("/", doc, &valErrs)
+
+	unknown := &valWarnings
+	if strict {
+		unknown = &valErrs
+	}
+
+	if pipeline, ok := doc.(map[string]interface{}); ok {
+		if steps, ok := pipeline["steps"].([]interface{}); ok {
+			v.validateSteps("/steps", steps, false, &valErrs, unknown)
+		}
+	}
+
+	warnings := p.locateValidationErrors(valWarnings)
+	if len(valErrs) == 0 {
+		return warnings, nil
+	}
+
+	return warnings, p.locateValidationErrors(valErrs)
+}
+
+// locateValidationErrors finds where in the pipeline's source each error is,
+// returning them in the order they appear
+func (p *PipelineParserResult) locateValidationErrors(valErrs []jsonschema.ValError) PipelineValidationErrors {
+	if len(valErrs) == 0 {
+		return nil
+	}
+
+	type located struct {
+		*PipelineValidationError
+		order int
+	}
+
+	var found []located
+	for _, valErr := range valErrs {
+		pointer := valErr.PropertyPath
+		if pointer == "/" {
+			pointer = ""
+		}
+
+		source, srcPointer := p.origin(pointer)
+		loc := source.locate(srcPointer)
+
+		found = append(found, located{
+			PipelineValidationError: &PipelineValidationError{
+				Filename: source.filename,
+				Line:     loc.Line,
+				Column:   loc.Column,
+				Pointer:  srcPointer,
+				Message:  validationMessage(valErr),
+			},
+			order: source.order,
+		})
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].order != found[j].order {
+			return found[i].order < found[j].order
+		}
+		if found[i].Line != found[j].Line {
+			return found[i].Line < found[j].Line
+		}
+		return found[i].Column < found[j].Column
+	})
+
+	errs := PipelineValidationErrors{}
+	for _, f := range found {
+		errs = append(errs, f.PipelineValidationError)
+	}
+
+	return errs
+}
+
+// validationMessage describes a validation error. The only patterns in the
+// schema are for numeric attributes given as strings.
+func validationMessage(valErr jsonschema.ValError) string {
+	if strings.HasPrefix(valErr.Message, "regexp pattrn ") {
+		return fmt.Sprintf("should be a number, not %q", valErr.InvalidValue)
+	}
+	return valErr.Message
+}
+
+// origin returns the file a value in the pipeline was defined in, and the
+// pointer to it within that file
+func (p *PipelineParserResult) origin(pointer string) (*pipelineSource, string) {
+	for prefix := pointer; prefix != ""; prefix = prefix[:strings.LastIndex(prefix, "/")] {
+		if origin, ok := p.origins[prefix]; ok {
+			return origin.source, origin.pointer + strings.TrimPrefix(pointer, prefix)
+		}
+	}
+	return p.sources[0], pointer
+}
+
+func (v *pipelineValidator) validateSteps(path string, steps []interface{}, inGroup bool, errs *[]jsonschema.ValError, unknown *[]jsonschema.ValError) {
+	for i, step := range steps {
+		stepPath := path + "/" + strconv.Itoa(i)
+
+		stepType, err := pipelineStepType(step)
+		if err != nil {
+			*errs = append(*errs, jsonschema.ValError{PropertyPath: stepPath, InvalidValue: step, Message: err.Error()})
+			continue
+		}
+
+		// Steps like "wait" don't have any attributes to validate
+		attrs, ok := step.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		v.steps[stepType].Validate(stepPath, step, errs)
+
+		keys := make([]string, 0, len(attrs))
+		for key := range attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !containsString(v.attributes[stepType], key) {
+				msg := fmt.Sprintf("unknown attribute %q for a %s step", key, stepType)
+				if suggestion := closestString(key, v.attributes[stepType]); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				*unknown = append(*unknown, jsonschema.ValError{PropertyPath: stepPath + "/" + escapeJSONPointer(key), InvalidValue: key, Message: msg})
+			}
+		}
+
+		if stepType == "group" {
+			if inGroup {
+				*errs = append(*errs, jsonschema.ValError{PropertyPath: stepPath, InvalidValue: step, Message: "group steps can't be nested in other groups"})
+				continue
+			}
+			if groupSteps, ok := attrs["steps"].([]interface{}); ok {
+				v.validateSteps(stepPath+"/steps", groupSteps, true, errs, unknown)
+			}
+		}
+	}
+}
+
+// pipelineStepType works out which type of step a step is, either by its
+// explicit type, or by the attribute that names it (e.g. "trigger")
+func pipelineStepType(step interface{}) (string, error) {
+	switch s := step.(type) {
+	case string:
+		switch s {
+		case "wait", "waiter":
+			return "wait", nil
+		case "block", "input":
+			return s, nil
+		}
+		return "", fmt.Errorf("unknown step type %q", s)
+
+	case map[string]interface{}:
+		if t, ok := s["type"].(string); ok {
+			switch t {
+			case "script", "command", "commands":
+				return "command", nil
+			case "waiter":
+				return "wait", nil
+			case "manual":
+				return "block", nil
+			}
+			if containsString(pipelineStepTypes, t) {
+				return t, nil
+			}
+			return "", fmt.Errorf("unknown step type %q", t)
+		}
+
+		for _, stepType := range []string{"wait", "waiter", "block", "input", "trigger", "group"} {
+			if _, ok := s[stepType]; ok {
+				if stepType == "waiter" {
+					return "wait", nil
+				}
+				return stepType, nil
+			}
+		}
+
+		// Anything else is a command step, which might only have plugins
+		return "command", nil
+	}
+
+	return "", fmt.Errorf("step should be an object or a string")
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// closestString returns the candidate that's the fewest edits from s, if it's
+// close enough to likely be a typo
+func closestString(s string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validatePipeline(t *testing.T, src string) error {
+	t.Helper()
+
+	return validatePipelineStrictly(t, src, true)
+}
+
+func validatePipelineStrictly(t *testing.T, src string, strict bool) error {
+	t.Helper()
+
+	result, err := PipelineParser{
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte(src),
+		NoInterpolation: true,
+	}.Parse()
+	require.NoError(t, err)
+
+	_, err = result.Validate(strict)
+	return err
+}
+
+func TestPipelineValidationAllowsValidPipelines(t *testing.T) {
+	err := validatePipeline(t, `
+env:
+  FOO: bar
+steps:
+  - label: ":hammer: Test"
+    key: test
+    command: make test
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+    retry:
+      automatic: true
+    cancel_on_build_failing: true
+  - command: "make test-{{matrix}}"
+    matrix:
+      - linux
+      - darwin
+  - command: "make {{matrix.os}}"
+    matrix:
+      setup:
+        os: [linux, darwin]
+      adjustments:
+        - with:
+            os: darwin
+          soft_fail: true
+  - wait
+  - block: "Deploy?"
+    fields:
+      - text: Reason
+        key: reason
+  - trigger: deploy
+    depends_on:
+      - test
+      - step: other
+        allow_failure: true
+    build:
+      branch: master
+  - group: Checks
+    branches: main
+    steps:
+      - command: make lint
+      - wait: ~
+        continue_on_failure: true
+`)
+	assert.NoError(t, err)
+}
+
+func TestPipelineValidationAllowsTopLevelSteps(t *testing.T) {
+	assert.NoError(t, validatePipeline(t, "- command: one\n- wait\n- input: Info\n"))
+}
+
+func TestPipelineValidationReportsEveryErrorWithLocations(t *testing.T) {
+	err := validatePipeline(t, `steps:
+  - label: Test
+    comand: make test
+  - wait
+  - trigger: deploy
+    depends_on: true
+  - group: Checks
+    steps:
+      - timeout_in_minutes: "ten"
+`)
+
+	require.Error(t, err)
+	errs, ok := err.(PipelineValidationErrors)
+	require.True(t, ok, "expected PipelineValidationErrors, got %T", err)
+
+	assert.Equal(t, []string{
+		`pipeline.yml:3:5: /steps/0/comand: unknown attribute "comand" for a command step, did you mean "command"?`,
+		`pipeline.yml:6:5: /steps/2/depends_on: type should be one of: string,number,array,null`,
+		`pipeline.yml:9:9: /steps/3/steps/0/timeout_in_minutes: should be a number, not "ten"`,
+	}, errorStrings(errs))
+}
+
+func TestPipelineValidationAllowsInterpolatedNumbers(t *testing.T) {
+	result, err := PipelineParser{
+		Filename: "pipeline.yml",
+		Env:      env.FromSlice([]string{"PARALLELISM=2", "TIMEOUT=10"}),
+		Pipeline: []byte(`templates:
+  deploy:
+    params:
+      priority: ~
+    steps:
+      - label: 2020
+        depends_on: 123
+        command: make deploy
+        priority: "${{ params.priority }}0"
+
+steps:
+  - key: 123
+    command: make test
+    parallelism: ${PARALLELISM}
+    timeout_in_minutes: "$TIMEOUT"
+    concurrency: 1
+  - template: deploy
+    params:
+      priority: 1
+`),
+	}.Parse()
+	require.NoError(t, err)
+
+	_, err = result.Validate(true)
+	assert.NoError(t, err)
+
+	err = validatePipeline(t, "steps:\n  - command: make test\n    parallelism: lots\n    priority: -1\n")
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`pipeline.yml:3:5: /steps/0/parallelism: should be a number, not "lots"`,
+	}, errorStrings(err.(PipelineValidationErrors)))
+}
+
+func TestPipelineValidationWarnsAboutUnknownAttributes(t *testing.T) {
+	result, err := PipelineParser{
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte("steps:\n  - comand: make test\n    timeout_in_minutes: 10\n"),
+		NoInterpolation: true,
+	}.Parse()
+	require.NoError(t, err)
+
+	warnings, err := result.Validate(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`pipeline.yml:2:5: /steps/0/comand: unknown attribute "comand" for a command step, did you mean "command"?`,
+	}, errorStrings(warnings))
+
+	// Type errors are always errors
+	assert.Error(t, validatePipelineStrictly(t, "steps:\n  - comand: make test\n    timeout_in_minutes: ten\n", false))
+}
+
+func TestPipelineValidationReportsUnknownStepTypes(t *testing.T) {
+	err := validatePipeline(t, "- wait\n- pause\n- type: sleep\n")
+
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`pipeline.yml:2:1: /steps/1: unknown step type "pause"`,
+		`pipeline.yml:3:1: /steps/2: unknown step type "sleep"`,
+	}, errorStrings(err.(PipelineValidationErrors)))
+}
+
+func TestPipelineValidationRequiresSteps(t *testing.T) {
+	err := validatePipeline(t, "env:\n  FOO: bar\n")
+
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`pipeline.yml:1:1: /: "steps" value is required`,
+	}, errorStrings(err.(PipelineValidationErrors)))
+}
+
+func errorStrings(errs PipelineValidationErrors) []string {
+	var s []string
+	for _, err := range errs {
+		s = append(s, err.Error())
+	}
+	return s
+}
@@ -0,0 +1,380 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	archiveExtensionRegex = regexp.MustCompile(`(?i)\.(tar\.gz|tgz|tar)\z`)
+	archiveVersionRegex   = regexp.MustCompile(`[-_]v?[0-9]+(\.[0-9]+)*\z`)
+	sha256DigestRegex     = regexp.MustCompile(`\Asha256:[0-9a-f]{64}\z`)
+)
+
+// The client used to download archive and OCI plugins
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// IsArchive returns whether the plugin is a tarball downloaded over http(s),
+// e.g https://example.com/plugins/docker-compose-v1.0.0.tar.gz#sha256:...
+func (p *Plugin) IsArchive() bool {
+	return (p.Scheme == "https" || p.Scheme == "http") && archiveExtensionRegex.MatchString(p.Location)
+}
+
+// ArchiveURL returns the url that an archive plugin is downloaded from
+func (p *Plugin) ArchiveURL() string {
+	if p.Authentication != "" {
+		return p.Scheme + "://" + p.Authentication + "@" + p.Location
+	}
+	return p.Scheme + "://" + p.Location
+}
+
+// ArchiveChecksum returns the sha256 digest an archive plugin must match,
+// which is required to be in the version, e.g. #sha256:2c26b46b68ffc...
+func (p *Plugin) ArchiveChecksum() (string, error) {
+	checksum := strings.ToLower(p.Version)
+	if !sha256DigestRegex.MatchString(checksum) {
+		return "", fmt.Errorf("Archive plugin %q needs a checksum like #sha256:<64 hex characters>", p.Location)
+	}
+	return checksum, nil
+}
+
+// Fetch downloads an archive or OCI plugin, verifies its digest and unpacks
+// it into dir, returning the digest that was verified
+func Fetch(p *Plugin, dir string) (string, error) {
+	switch {
+	case p.IsArchive():
+		checksum, err := p.ArchiveChecksum()
+		if err != nil {
+			return "", err
+		}
+
+		req, err := http.NewRequest("GET", p.ArchiveURL(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if err := downloadAndUnpack(req, checksum, dir); err != nil {
+			return "", err
+		}
+		return checksum, nil
+
+	case p.IsOCI():
+		return fetchOCI(p, dir)
+	}
+
+	return "", fmt.Errorf("Plugin %q isn't an archive or OCI plugin", p.Label())
+}
+
+// downloadAndUnpack downloads a tarball to a temporary file, verifies it
+// against a sha256 digest and only then unpacks it
+func downloadAndUnpack(req *http.Request, digest string, dir string) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Downloading %s failed with %s", redactURL(req), resp.Status)
+	}
+
+	f, err := ioutil.TempFile("", "buildkite-plugin-archive")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+		return fmt.Errorf("Downloading %s failed: %v", redactURL(req), err)
+	}
+
+	actual := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if actual != digest {
+		return fmt.Errorf("Downloaded %s has digest %s, but expected %s", redactURL(req), actual, digest)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return unpackTarball(f, dir)
+}
+
+// The most bytes that unpacking a plugin archive can write
+var maxUnpackedArchiveSize int64 = 512 << 20
+
+// unpackTarball unpacks a (optionally gzipped) tarball into dir. If every
+// entry is within a single top level directory, that directory is stripped.
+// The tarball is read twice, first for the names of its entries and then to
+// stream each of them to disk.
+func unpackTarball(r io.ReadSeeker, dir string) error {
+	var names []string
+	err := readTarball(r, func(header *tar.Header, _ io.Reader) error {
+		names = append(names, header.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := commonArchivePrefix(names)
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Entries are checked against where they really end up, after any
+	// symlinks that earlier entries created
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	var symlinks []string
+	var written int64
+
+	err = readTarball(r, func(header *tar.Header, data io.Reader) error {
+		name := cleanArchivePath(header.Name)
+		if strings.HasPrefix(name, "/") || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Plugin archive contains a path outside of the plugin: %s", header.Name)
+		}
+
+		name = strings.TrimPrefix(name, prefix)
+		if name == "" || name == "." {
+			return nil
+		}
+
+		target := filepath.Join(realDir, filepath.FromSlash(name))
+
+		if err := checkInsideDir(realDir, filepath.Dir(target)); err != nil {
+			return fmt.Errorf("Plugin archive contains a path outside of the plugin: %s", header.Name)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if err := checkInsideDir(realDir, target); err != nil {
+				return fmt.Errorf("Plugin archive contains a path outside of the plugin: %s", header.Name)
+			}
+			return os.MkdirAll(target, 0777)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		if err := replaceArchiveTarget(target); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0777|0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			n, err := io.Copy(f, io.LimitReader(data, maxUnpackedArchiveSize-written+1))
+			written += n
+			if err != nil {
+				return fmt.Errorf("Failed to read %s from plugin archive: %v", header.Name, err)
+			}
+			if written > maxUnpackedArchiveSize {
+				return fmt.Errorf("Plugin archive is larger than %d bytes when unpacked", maxUnpackedArchiveSize)
+			}
+			return f.Close()
+
+		case tar.TypeSymlink:
+			resolved := path.Clean(path.Join(path.Dir(name), header.Linkname))
+			if path.IsAbs(header.Linkname) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+				return fmt.Errorf("Plugin archive contains a symlink outside of the plugin: %s", header.Name)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			symlinks = append(symlinks, target)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Symlinks can point through other symlinks, so they're only checked
+	// once they all exist. Ones that don't resolve to anything are left.
+	for _, link := range symlinks {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		if !isInsideDir(realDir, resolved) {
+			rel, _ := filepath.Rel(realDir, link)
+			return fmt.Errorf("Plugin archive contains a symlink outside of the plugin: %s", filepath.ToSlash(rel))
+		}
+	}
+
+	return nil
+}
+
+// readTarball calls fn for each file, directory and symlink in a (optionally
+// gzipped) tarball, with a reader for the file's contents
+func readTarball(r io.Reader, fn func(header *tar.Header, data io.Reader) error) error {
+	br := bufio.NewReader(r)
+
+	// Detect gzip from the magic bytes rather than trusting the filename
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read plugin archive: %v", err)
+		}
+
+		// Only files, directories and symlinks are unpacked
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+		default:
+			continue
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkInsideDir returns an error unless the deepest part of p that exists
+// is within dir once symlinks are resolved, so that creating the rest of p
+// can't write outside of dir
+func checkInsideDir(dir string, p string) error {
+	existing := p
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !isInsideDir(dir, resolved) {
+		return fmt.Errorf("%s is outside of %s", p, dir)
+	}
+	return nil
+}
+
+// isInsideDir returns whether p is dir or within it
+func isInsideDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// replaceArchiveTarget removes a file or symlink that an earlier entry
+// created, so that writing the target never follows a symlink
+func replaceArchiveTarget(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Plugin archive contains a file where there's already a directory: %s", target)
+	}
+	return os.Remove(target)
+}
+
+// commonArchivePrefix returns the single top level directory that every
+// entry is within, e.g. "docker-compose-v1.0.0/", or "" if there isn't one
+func commonArchivePrefix(names []string) string {
+	prefix := ""
+
+	for _, name := range names {
+		name = cleanArchivePath(name)
+		if name == "" {
+			continue
+		}
+
+		idx := strings.Index(name, "/")
+		if idx == -1 {
+			return ""
+		}
+
+		if top := name[:idx+1]; prefix == "" {
+			prefix = top
+		} else if top != prefix {
+			return ""
+		}
+	}
+
+	return prefix
+}
+
+// cleanArchivePath cleans a path from a tarball, keeping any trailing slash
+func cleanArchivePath(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	if name == "" {
+		return ""
+	}
+
+	cleaned := path.Clean(name)
+	if strings.HasSuffix(name, "/") && cleaned != "." && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// redactURL returns a request's url without any credentials in it
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	return u.String()
+}
+
+// IsPinnedByDigest returns whether an archive or OCI plugin is referenced by
+// the digest of its contents, so what's downloaded can't change
+func (p *Plugin) IsPinnedByDigest() bool {
+	switch {
+	case p.IsArchive():
+		_, err := p.ArchiveChecksum()
+		return err == nil
+	case p.IsOCI():
+		ref, err := parseOCIReference(p)
+		return err == nil && ref.IsDigest()
+	}
+	return false
+}
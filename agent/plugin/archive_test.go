@@ -0,0 +1,317 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testArchiveEntry struct {
+	Name     string
+	Body     string
+	Mode     int64
+	Linkname string
+}
+
+func createTestArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		header := &tar.Header{Name: e.Name, Mode: e.Mode, Size: int64(len(e.Body)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e.Name, "/") {
+			header.Typeflag = tar.TypeDir
+		} else if e.Linkname != "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = e.Linkname
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func testDigest(b []byte) string {
+	hash := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+var testArchiveEntries = []testArchiveEntry{
+	{Name: "llamas-v1.0.0/", Mode: 0755},
+	{Name: "llamas-v1.0.0/plugin.yml", Body: "name: llamas\n", Mode: 0644},
+	{Name: "llamas-v1.0.0/hooks/environment", Body: "#!/bin/bash\necho llamas\n", Mode: 0755},
+	{Name: "llamas-v1.0.0/hooks/pre-command", Linkname: "environment"},
+}
+
+func TestFetchingArchivePlugins(t *testing.T) {
+	archive := createTestArchive(t, testArchiveEntries)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/plugins/llamas-v1.0.0.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = server.Client()
+
+	location := server.URL + "/plugins/llamas-v1.0.0.tar.gz"
+
+	p, err := CreatePlugin(location+"#"+testDigest(archive), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, p.IsArchive())
+	assert.True(t, p.IsPinnedByDigest())
+	assert.Equal(t, "llamas", p.Name())
+
+	dir, err := ioutil.TempDir("", "archive-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	digest, err := Fetch(p, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testDigest(archive), digest)
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "plugin.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "name: llamas\n", string(body))
+
+	info, err := os.Stat(filepath.Join(dir, "hooks", "environment"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	link, err := os.Readlink(filepath.Join(dir, "hooks", "pre-command"))
+	assert.NoError(t, err)
+	assert.Equal(t, "environment", link)
+
+	// A checksum is required, and has to match
+	for _, version := range []string{"", "v1.0.0", "sha256:" + strings.Repeat("0", 64)} {
+		p, err := CreatePlugin(location+"#"+version, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		empty, err := ioutil.TempDir("", "archive-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(empty)
+
+		if _, err := Fetch(p, empty); err == nil {
+			t.Errorf("Expected an error fetching %q", p.Label())
+		}
+
+		files, _ := ioutil.ReadDir(empty)
+		assert.Empty(t, files)
+	}
+}
+
+func TestUnpackingArchivesRejectsPathsOutsideThePlugin(t *testing.T) {
+	t.Parallel()
+
+	for _, entries := range [][]testArchiveEntry{
+		{{Name: "../evil", Body: "llamas", Mode: 0644}},
+		{{Name: "plugin/../../evil", Body: "llamas", Mode: 0644}},
+		{{Name: "/etc/evil", Body: "llamas", Mode: 0644}},
+		{{Name: "hooks/evil", Linkname: "../../../etc/passwd"}},
+		{{Name: "hooks/evil", Linkname: "/etc/passwd"}},
+	} {
+		dir, err := ioutil.TempDir("", "archive-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = unpackTarball(bytes.NewReader(createTestArchive(t, entries)), dir)
+		assert.Error(t, err, entries[0].Name)
+	}
+}
+
+func TestUnpackingArchivesRejectsSymlinksThatEscapeThePlugin(t *testing.T) {
+	t.Parallel()
+
+	for _, entries := range [][]testArchiveEntry{
+		// Each link looks like it stays inside the plugin, but e is really
+		// the plugin's parent directory
+		{
+			{Name: "d", Linkname: "."},
+			{Name: "e", Linkname: "d/.."},
+			{Name: "e/evil", Body: "llamas", Mode: 0644},
+		},
+		{
+			{Name: "d", Linkname: "."},
+			{Name: "e", Linkname: "d/.."},
+			{Name: "e/evil/"},
+		},
+		{
+			{Name: "d", Linkname: "."},
+			{Name: "evil", Linkname: "d/../outside"},
+		},
+	} {
+		root, err := ioutil.TempDir("", "archive-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+
+		if err := ioutil.WriteFile(filepath.Join(root, "outside"), []byte("alpacas"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(root, "plugin")
+		if err := os.Mkdir(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		err = unpackTarball(bytes.NewReader(createTestArchive(t, entries)), dir)
+		assert.Error(t, err, entries[len(entries)-1].Name)
+
+		_, err = os.Lstat(filepath.Join(root, "evil"))
+		assert.True(t, os.IsNotExist(err), "Expected nothing to be written outside of the plugin")
+	}
+}
+
+func TestUnpackingArchivesLimitsTheirSize(t *testing.T) {
+	defer func(max int64) { maxUnpackedArchiveSize = max }(maxUnpackedArchiveSize)
+	maxUnpackedArchiveSize = 10
+
+	dir, err := ioutil.TempDir("", "archive-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = unpackTarball(bytes.NewReader(createTestArchive(t, []testArchiveEntry{
+		{Name: "plugin.yml", Body: "name: llamas\n", Mode: 0644},
+	})), dir)
+	assert.EqualError(t, err, "Plugin archive is larger than 10 bytes when unpacked")
+
+	err = unpackTarball(bytes.NewReader(createTestArchive(t, []testArchiveEntry{
+		{Name: "a", Body: "llamas", Mode: 0644},
+		{Name: "b", Body: "alpaca", Mode: 0644},
+	})), dir)
+	assert.EqualError(t, err, "Plugin archive is larger than 10 bytes when unpacked")
+}
+
+func TestFetchingOCIPlugins(t *testing.T) {
+	layer := createTestArchive(t, testArchiveEntries)
+	layerDigest := testDigest(layer)
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers": []map[string]interface{}{
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layerDigest, "size": len(layer)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := testDigest(manifest)
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal(t, "repository:org/llamas:pull", r.URL.Query().Get("scope"))
+			w.Write([]byte(`{"token":"llamas-token"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer llamas-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/org/llamas/manifests/v1.0.0", "/v2/org/llamas/manifests/" + manifestDigest:
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write(manifest)
+		case "/v2/org/llamas/blobs/" + layerDigest:
+			w.Write(layer)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = server.Client()
+
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	for _, tc := range []struct {
+		Location string
+		Pinned   bool
+		Valid    bool
+	}{
+		{"oci://" + registry + "/org/llamas:v1.0.0", false, true},
+		{"oci://" + registry + "/org/llamas#v1.0.0", false, true},
+		{"oci://" + registry + "/org/llamas@" + manifestDigest, true, true},
+		{"oci://" + registry + "/org/llamas@sha256:" + strings.Repeat("0", 64), true, false},
+		{"oci://" + registry + "/org/llamas:v2.0.0", false, false},
+	} {
+		p, err := CreatePlugin(tc.Location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.True(t, p.IsOCI())
+		assert.Equal(t, "llamas", p.Name())
+		assert.Equal(t, tc.Pinned, p.IsPinnedByDigest(), tc.Location)
+
+		dir, err := ioutil.TempDir("", "oci-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		digest, err := Fetch(p, dir)
+		if !tc.Valid {
+			assert.Error(t, err, tc.Location)
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Fetching %s failed: %v", tc.Location, err)
+		}
+		assert.Equal(t, manifestDigest, digest)
+		assert.FileExists(t, filepath.Join(dir, "hooks", "environment"))
+	}
+}
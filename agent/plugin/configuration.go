@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxSchemaRefDepth stops self-referencing schemas from recursing forever
+const maxSchemaRefDepth = 32
+
+// ApplyConfigurationSchema returns a copy of a plugin's configuration with
+// defaults from the definition's configuration schema filled in, and scalar
+// values coerced to the types the schema expects where that's unambiguous
+// (e.g. "3" for an integer, or true for a string). Validation happens
+// separately, so values that can't be coerced are left as they are
+func (def *Definition) ApplyConfigurationSchema(config map[string]interface{}) (map[string]interface{}, error) {
+	copied, err := copyJSONValue(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result, _ := copied.(map[string]interface{})
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+
+	if def.Configuration == nil {
+		return result, nil
+	}
+
+	// The jsonschema library doesn't expose keyword values, so walk the
+	// schema as plain json
+	schemaJSON, err := json.Marshal(def.Configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	var root map[string]interface{}
+	if err := decodeJSON(schemaJSON, &root); err != nil {
+		return nil, err
+	}
+
+	// Objects are updated in place
+	applySchema(root, root, result, 0)
+
+	return result, nil
+}
+
+func applySchema(root map[string]interface{}, schema map[string]interface{}, value interface{}, depth int) interface{} {
+	if schema == nil || depth > maxSchemaRefDepth {
+		return value
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		return applySchema(root, resolveSchemaRef(root, ref), value, depth+1)
+	}
+
+	value = coerceValue(schemaTypes(schema), value)
+
+	for _, sub := range schemaList(schema["allOf"]) {
+		value = applySchema(root, sub, value, depth+1)
+	}
+
+	switch vv := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, p := range properties {
+			propSchema, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if existing, ok := vv[name]; ok {
+				vv[name] = applySchema(root, propSchema, existing, depth+1)
+				continue
+			}
+
+			if def, ok := schemaDefault(root, propSchema, depth+1); ok {
+				if copied, err := copyJSONValue(def); err == nil {
+					vv[name] = applySchema(root, propSchema, copied, depth+1)
+				}
+			}
+		}
+
+	case []interface{}:
+		switch items := schema["items"].(type) {
+		case map[string]interface{}:
+			for idx := range vv {
+				vv[idx] = applySchema(root, items, vv[idx], depth+1)
+			}
+		case []interface{}:
+			for idx := range vv {
+				if idx < len(items) {
+					if itemSchema, ok := items[idx].(map[string]interface{}); ok {
+						vv[idx] = applySchema(root, itemSchema, vv[idx], depth+1)
+					}
+				}
+			}
+		}
+	}
+
+	return value
+}
+
+// schemaDefault finds the default for a schema, following references
+func schemaDefault(root map[string]interface{}, schema map[string]interface{}, depth int) (interface{}, bool) {
+	for ; schema != nil && depth <= maxSchemaRefDepth; depth++ {
+		if def, ok := schema["default"]; ok {
+			return def, true
+		}
+
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			break
+		}
+		schema = resolveSchemaRef(root, ref)
+	}
+
+	return nil, false
+}
+
+// resolveSchemaRef resolves a local reference like #/definitions/thing
+func resolveSchemaRef(root map[string]interface{}, ref string) map[string]interface{} {
+	if ref == "#" {
+		return root
+	}
+
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+
+	var current interface{} = root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[token]
+	}
+
+	resolved, _ := current.(map[string]interface{})
+	return resolved
+}
+
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func schemaList(v interface{}) []map[string]interface{} {
+	var schemas []map[string]interface{}
+	if list, ok := v.([]interface{}); ok {
+		for _, item := range list {
+			if schema, ok := item.(map[string]interface{}); ok {
+				schemas = append(schemas, schema)
+			}
+		}
+	}
+	return schemas
+}
+
+// coerceValue converts a scalar to the only scalar type a schema allows
+func coerceValue(types []string, value interface{}) interface{} {
+	if len(types) == 0 || jsonTypeMatches(types, value) {
+		return value
+	}
+
+	for _, t := range types {
+		switch t {
+		case "string":
+			switch vv := value.(type) {
+			case json.Number:
+				return vv.String()
+			case bool:
+				return strconv.FormatBool(vv)
+			}
+
+		case "integer":
+			if s, ok := value.(string); ok {
+				if _, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+					return json.Number(strings.TrimSpace(s))
+				}
+			}
+
+		case "number":
+			if s, ok := value.(string); ok {
+				if _, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+					return json.Number(strings.TrimSpace(s))
+				}
+			}
+
+		case "boolean":
+			if s, ok := value.(string); ok {
+				if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+					return b
+				}
+			}
+		}
+	}
+
+	return value
+}
+
+func jsonTypeMatches(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch vv := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if _, err := vv.Int64(); err == nil && t == "integer" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied interface{}
+	if err := decodeJSON(b, &copied); err != nil {
+		return nil, fmt.Errorf("Failed to copy configuration: %v", err)
+	}
+	return copied, nil
+}
+
+func decodeJSON(b []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
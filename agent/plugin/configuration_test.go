@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfigurationPluginDef = `
+name: test-plugin
+configuration:
+  properties:
+    image:
+      type: string
+    retries:
+      type: integer
+      default: 3
+    push:
+      type: boolean
+      default: false
+    tag:
+      type: string
+    volumes:
+      type: array
+      items:
+        $ref: "#/definitions/volume"
+      default: []
+    cache:
+      type: object
+      properties:
+        enabled:
+          type: boolean
+          default: true
+        key:
+          type: string
+  required:
+    - image
+  additionalProperties: false
+  definitions:
+    volume:
+      type: object
+      properties:
+        readonly:
+          type: boolean
+          default: true
+`
+
+func TestApplyingConfigurationSchema(t *testing.T) {
+	t.Parallel()
+
+	def, err := ParseDefinition([]byte(testConfigurationPluginDef))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := map[string]interface{}{
+		"image":   "golang",
+		"retries": "5",
+		"tag":     json.Number("1.13"),
+		"volumes": []interface{}{
+			map[string]interface{}{"path": "/src"},
+			map[string]interface{}{"path": "/cache", "readonly": "false"},
+		},
+		"cache": map[string]interface{}{},
+	}
+
+	applied, err := def.ApplyConfigurationSchema(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"image":   "golang",
+		"retries": json.Number("5"),
+		"push":    false,
+		"tag":     "1.13",
+		"volumes": []interface{}{
+			map[string]interface{}{"path": "/src", "readonly": true},
+			map[string]interface{}{"path": "/cache", "readonly": false},
+		},
+		"cache": map[string]interface{}{"enabled": true},
+	}, applied)
+
+	// The original configuration isn't modified
+	assert.Equal(t, "5", config["retries"])
+	assert.NotContains(t, config, "push")
+
+	validator := &Validator{commandExists: func(string) bool { return true }}
+	assert.True(t, validator.Validate(def, applied).Valid())
+}
+
+func TestValidationReportsEveryErrorWithJSONPointers(t *testing.T) {
+	t.Parallel()
+
+	def, err := ParseDefinition([]byte(testConfigurationPluginDef))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := def.ApplyConfigurationSchema(map[string]interface{}{
+		"retries": "lots",
+		"cache":   map[string]interface{}{"enabled": "maybe"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validator := &Validator{commandExists: func(string) bool { return true }}
+	res := validator.Validate(def, applied)
+
+	assert.False(t, res.Valid())
+	assert.Equal(t, []string{
+		`/: "image" value is required`,
+		`/cache/enabled: type should be boolean`,
+		`/retries: type should be integer`,
+	}, res.Errors)
+}
+
+func TestApplyingConfigurationWithoutSchema(t *testing.T) {
+	t.Parallel()
+
+	applied, err := (&Definition{}).ApplyConfigurationSchema(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{}, applied)
+}
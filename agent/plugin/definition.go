@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/buildkite/agent/v3/yamltojson"
@@ -113,10 +114,18 @@ func (v Validator) Validate(def *Definition, config map[string]interface{}) Vali
 		if err != nil {
 			result.Errors = append(result.Errors, err.Error())
 		}
-		if len(valErrors) > 0 {
-			for _, err := range valErrors {
-				result.Errors = append(result.Errors, err.Error())
+
+		// Report every error against the json pointer of the invalid value,
+		// in a consistent order
+		sort.SliceStable(valErrors, func(i, j int) bool {
+			if valErrors[i].PropertyPath != valErrors[j].PropertyPath {
+				return valErrors[i].PropertyPath < valErrors[j].PropertyPath
 			}
+			return valErrors[i].Message < valErrors[j].Message
+		})
+
+		for _, err := range valErrors {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", err.PropertyPath, err.Message))
 		}
 	}
 
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+var commitRegex = regexp.MustCompile(`\A[0-9a-f]{40}\z`)
+
+// Lockfile pins plugins to the commit their location and version must resolve
+// to, e.g:
+//
+//	plugins:
+//	  github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0: 5a9f1c...
+type Lockfile struct {
+	Plugins map[string]string `yaml:"plugins"`
+}
+
+// LoadLockfile reads a plugin lockfile
+func LoadLockfile(path string) (*Lockfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseLockfile(b)
+}
+
+// ParseLockfile parses and validates a yaml (or json) plugin lockfile
+func ParseLockfile(b []byte) (*Lockfile, error) {
+	var lockfile Lockfile
+	if err := yaml.Unmarshal(b, &lockfile); err != nil {
+		return nil, err
+	}
+
+	for label, commit := range lockfile.Plugins {
+		commit = strings.ToLower(strings.TrimSpace(commit))
+		if !commitRegex.MatchString(commit) {
+			return nil, fmt.Errorf("Invalid commit %q for plugin %q, expected a full 40 character commit SHA", commit, label)
+		}
+		lockfile.Plugins[label] = commit
+	}
+
+	return &lockfile, nil
+}
+
+// ExpectedCommit returns the commit that a plugin is pinned to
+func (l *Lockfile) ExpectedCommit(p *Plugin) (string, bool) {
+	commit, ok := l.Plugins[p.Label()]
+	return commit, ok
+}
+
+// Verify returns an error unless the commit a plugin resolved to is the one
+// that it's pinned to
+func (l *Lockfile) Verify(p *Plugin, commit string) error {
+	expected, ok := l.ExpectedCommit(p)
+	if !ok {
+		return fmt.Errorf("Plugin %q isn't in the plugin lockfile", p.Label())
+	}
+
+	if strings.ToLower(commit) != expected {
+		return fmt.Errorf("Plugin %q resolved to commit %s, but the plugin lockfile expects %s", p.Label(), commit, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testLockfile = []byte(`
+plugins:
+  github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0: 5A9F1C2E3D4B5A6978877665544332211FFEEDDC
+  github.com/buildkite-plugins/shellcheck-buildkite-plugin#v1.1.2: 0123abcdef0123456789abcdef0123456789abcd
+`)
+
+func TestParsingLockfile(t *testing.T) {
+	t.Parallel()
+
+	lockfile, err := ParseLockfile(testLockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0": "5a9f1c2e3d4b5a6978877665544332211ffeeddc",
+		"github.com/buildkite-plugins/shellcheck-buildkite-plugin#v1.1.2":     "0123abcdef0123456789abcdef0123456789abcd",
+	}, lockfile.Plugins)
+
+	for _, invalid := range []string{
+		"plugins:\n  github.com/buildkite-plugins/foo#v1: v1.0.0\n",
+		"plugins:\n  github.com/buildkite-plugins/foo#v1: abc\n",
+		"plugins:\n  github.com/buildkite-plugins/foo#v1: 0123abc\n",
+		"plugins: [llamas]\n",
+	} {
+		if _, err := ParseLockfile([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestVerifyingPluginsAgainstLockfile(t *testing.T) {
+	t.Parallel()
+
+	lockfile, err := ParseLockfile(testLockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerCompose, err := CreatePlugin("github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shellcheck, err := CreatePlugin("github.com/buildkite-plugins/shellcheck-buildkite-plugin#v1.1.2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpinned, err := CreatePlugin("github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, lockfile.Verify(dockerCompose, "5a9f1c2e3d4b5a6978877665544332211ffeeddc"))
+	assert.Error(t, lockfile.Verify(dockerCompose, "1111111111111111111111111111111111111111"))
+	assert.NoError(t, lockfile.Verify(shellcheck, "0123ABCdef0123456789abcdef0123456789abcd"))
+	assert.Error(t, lockfile.Verify(shellcheck, "0123abcdef0123456789abcdef0123456789abcdef"))
+	assert.Error(t, lockfile.Verify(shellcheck, "0123abc"))
+	assert.Error(t, lockfile.Verify(unpinned, "5a9f1c2e3d4b5a6978877665544332211ffeeddc"))
+}
@@ -0,0 +1,261 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The manifest media types that are accepted from OCI registries
+var ociManifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var ociAuthParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// IsOCI returns whether the plugin is an artifact in an OCI registry, e.g
+// oci://registry.example.com/plugins/docker-compose:v1.0.0 or
+// oci://registry.example.com/plugins/docker-compose@sha256:...
+func (p *Plugin) IsOCI() bool {
+	return p.Scheme == "oci"
+}
+
+// ociReference is a parsed reference to an artifact in an OCI registry
+type ociReference struct {
+	Registry   string
+	Repository string
+
+	// Either a tag or a digest
+	Reference string
+}
+
+// IsDigest returns whether the reference is to an exact digest
+func (r ociReference) IsDigest() bool {
+	return sha256DigestRegex.MatchString(r.Reference)
+}
+
+func parseOCIReference(p *Plugin) (ociReference, error) {
+	var ref ociReference
+
+	parts := strings.SplitN(p.Location, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ref, fmt.Errorf("Invalid OCI plugin reference %q, expected oci://<registry>/<repository>[:<tag>|@<digest>]", p.Location)
+	}
+
+	ref.Registry, ref.Repository = parts[0], parts[1]
+
+	if idx := strings.Index(ref.Repository, "@"); idx != -1 {
+		ref.Repository, ref.Reference = ref.Repository[:idx], strings.ToLower(ref.Repository[idx+1:])
+		if !sha256DigestRegex.MatchString(ref.Reference) {
+			return ref, fmt.Errorf("Invalid digest %q in OCI plugin reference, expected sha256:<64 hex characters>", ref.Reference)
+		}
+	} else if idx := strings.LastIndex(ref.Repository, ":"); idx > strings.LastIndex(ref.Repository, "/") {
+		ref.Repository, ref.Reference = ref.Repository[:idx], ref.Repository[idx+1:]
+	}
+
+	// A version in the fragment works as a tag or digest too
+	if ref.Reference == "" {
+		ref.Reference = p.Version
+	}
+	if ref.Reference == "" {
+		ref.Reference = "latest"
+	}
+
+	return ref, nil
+}
+
+// ociManifest is the part of an OCI image manifest that's needed to find
+// the plugin's layer
+type ociManifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+}
+
+// ociClient makes authenticated requests to an OCI registry
+type ociClient struct {
+	ref ociReference
+
+	// user:pass from the plugin location, if any
+	authentication string
+
+	// A bearer token from the registry's token service
+	token string
+}
+
+func fetchOCI(p *Plugin, dir string) (string, error) {
+	ref, err := parseOCIReference(p)
+	if err != nil {
+		return "", err
+	}
+
+	client := &ociClient{ref: ref, authentication: p.Authentication}
+
+	// Resolve the manifest, verifying it if it was referenced by digest
+	resp, err := client.get("/manifests/"+ref.Reference, strings.Join(ociManifestMediaTypes, ", "))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	if ref.IsDigest() && digest != ref.Reference {
+		return "", fmt.Errorf("OCI manifest for %s has digest %s, but expected %s", p.Location, digest, ref.Reference)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return "", fmt.Errorf("Invalid OCI manifest for %s: %v", p.Location, err)
+	}
+
+	// Plugins are published as a single tarball layer
+	if len(manifest.Layers) != 1 {
+		return "", fmt.Errorf("OCI artifact %s has %d layers, plugins must have exactly one", p.Location, len(manifest.Layers))
+	}
+
+	layer := manifest.Layers[0]
+	if !sha256DigestRegex.MatchString(layer.Digest) {
+		return "", fmt.Errorf("OCI artifact %s has an unsupported layer digest %q", p.Location, layer.Digest)
+	}
+
+	req, err := client.newRequest("/blobs/"+layer.Digest, layer.MediaType)
+	if err != nil {
+		return "", err
+	}
+
+	if err := downloadAndUnpack(req, layer.Digest, dir); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+func (c *ociClient) newRequest(path string, accept string) (*http.Request, error) {
+	u := "https://" + c.ref.Registry + "/v2/" + c.ref.Repository + path
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", accept)
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.authentication != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.authentication)))
+	}
+
+	return req, nil
+}
+
+// get makes a request to the registry, authenticating with its token service
+// if the registry asks for a bearer token
+func (c *ociClient) get(path string, accept string) (*http.Response, error) {
+	req, err := c.newRequest(path, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && c.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, fmt.Errorf("Registry %s requires authentication", c.ref.Registry)
+		}
+
+		if err := c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+
+		return c.get(path, accept)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching %s from %s failed with %s", c.ref.Repository+path, c.ref.Registry, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// authenticate gets a pull token for the repository from the token service
+// in a registry's bearer challenge
+func (c *ociClient) authenticate(challenge string) error {
+	params := map[string]string{}
+	for _, m := range ociAuthParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Registry %s sent an invalid authentication challenge", c.ref.Registry)
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+c.ref.Repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if c.authentication != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.authentication)))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Authenticating with registry %s failed with %s", c.ref.Registry, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("Invalid token from registry %s: %v", c.ref.Registry, err)
+	}
+
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("Registry %s didn't return a token", c.ref.Registry)
+	}
+
+	return nil
+}
@@ -136,6 +136,16 @@ func (p *Plugin) Name() string {
 		parts := strings.Split(location, "/")
 		name := parts[len(parts)-1]
 
+		// Archives and OCI artifacts have extensions, tags and versions in
+		// their names that aren't part of the plugin's name
+		if p.IsArchive() || p.IsOCI() {
+			name = archiveExtensionRegex.ReplaceAllString(name, "")
+			if idx := strings.IndexAny(name, ":@"); idx != -1 {
+				name = name[:idx]
+			}
+			name = archiveVersionRegex.ReplaceAllString(name, "")
+		}
+
 		// Clean up the name
 		name = strings.ToLower(name)
 		name = regexp.MustCompile(`\s+`).ReplaceAllString(name, " ")
@@ -216,6 +226,11 @@ func formatEnvKey(key string) string {
 func walkConfigValues(prefix string, v interface{}, into *[]string) error {
 	switch vv := v.(type) {
 
+	// null values are set, but empty
+	case nil:
+		*into = append(*into, prefix+"=")
+		return nil
+
 	// handles all of our primitive types, golang provides a good string representation
 	case string, bool, json.Number:
 		*into = append(*into, fmt.Sprintf("%s=%v", prefix, vv))
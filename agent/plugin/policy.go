@@ -0,0 +1,233 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// Policy is an agent-side allowlist of the plugins that jobs can use, e.g:
+//
+//	allowed:
+//	  - location: github.com/buildkite-plugins/docker-compose-buildkite-plugin
+//	    versions: [">= v3.0.0, < v4.0.0"]
+//	  - location: github.com/my-org/*
+//
+// Locations can end in /* to allow everything under a prefix, or use * to
+// match within a path segment. Versions are optional, and each constraint is
+// either an exact version, a pattern like v3.*, or a comma separated list of
+// comparisons like >= v3.1.0 that must all match. Vendored plugins are part of
+// the repository being built, so they're always allowed.
+type Policy struct {
+	Allowed []PolicyRule `yaml:"allowed"`
+}
+
+// PolicyRule allows plugins from a location, optionally restricted to
+// versions that match one of the constraints
+type PolicyRule struct {
+	Location string   `yaml:"location"`
+	Versions []string `yaml:"versions"`
+}
+
+// LoadPolicy reads a plugin policy
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses and validates a yaml (or json) plugin policy
+func ParsePolicy(b []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+
+	for idx, rule := range policy.Allowed {
+		if strings.TrimSpace(rule.Location) == "" {
+			return nil, fmt.Errorf("Allowed plugin %d is missing a location", idx+1)
+		}
+
+		if _, err := path.Match(rule.Location, ""); err != nil {
+			return nil, fmt.Errorf("Invalid location pattern %q: %v", rule.Location, err)
+		}
+
+		for _, constraint := range rule.Versions {
+			if _, err := matchVersionConstraint(constraint, "v0.0.0"); err != nil {
+				return nil, fmt.Errorf("Invalid version constraint for %s: %v", rule.Location, err)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// Check returns an error explaining why a plugin isn't allowed, or nil if it is
+func (policy *Policy) Check(p *Plugin) error {
+	if p.Vendored {
+		return nil
+	}
+
+	var versionRules []PolicyRule
+
+	for _, rule := range policy.Allowed {
+		if !matchLocation(rule.Location, p.Location) {
+			continue
+		}
+
+		if len(rule.Versions) == 0 {
+			return nil
+		}
+
+		for _, constraint := range rule.Versions {
+			if ok, _ := matchVersionConstraint(constraint, p.Version); ok {
+				return nil
+			}
+		}
+
+		versionRules = append(versionRules, rule)
+	}
+
+	if len(versionRules) == 0 {
+		return fmt.Errorf("Plugin %q isn't allowed on this agent, its location doesn't match any allowed plugin", p.Label())
+	}
+
+	var allowed []string
+	for _, rule := range versionRules {
+		allowed = append(allowed, rule.Versions...)
+	}
+
+	version := p.Version
+	if version == "" {
+		version = "(none)"
+	}
+
+	return fmt.Errorf("Plugin %q isn't allowed on this agent, version %s doesn't match the allowed versions: %s",
+		p.Label(), version, strings.Join(allowed, "; "))
+}
+
+// matchLocation matches a plugin location against a location pattern,
+// ignoring case and any .git suffix
+func matchLocation(pattern string, location string) bool {
+	normalize := func(s string) string {
+		s = strings.ToLower(strings.TrimSpace(s))
+		s = strings.Replace(s, "\\", "/", -1)
+		s = strings.TrimSuffix(s, "/")
+		return strings.TrimSuffix(s, ".git")
+	}
+
+	pattern, location = normalize(pattern), normalize(location)
+
+	// A trailing /* also allows anything nested under the prefix, so only
+	// match against as many path segments as the pattern has
+	if strings.HasSuffix(pattern, "/*") {
+		segments := strings.Count(pattern, "/") + 1
+		if parts := strings.Split(location, "/"); len(parts) > segments {
+			location = strings.Join(parts[:segments], "/")
+		}
+	}
+
+	ok, _ := path.Match(pattern, location)
+	return ok
+}
+
+var versionComparisonRegex = regexp.MustCompile(`\A(>=|<=|>|<|=)?\s*(\S+)\z`)
+
+// matchVersionConstraint returns whether a version satisfies a constraint.
+// Versions that aren't semver (like branches or commits) only ever match an
+// exact version or a pattern
+func matchVersionConstraint(constraint string, version string) (bool, error) {
+	constraint = strings.TrimSpace(constraint)
+	if constraint == "" {
+		return false, fmt.Errorf("Empty version constraint")
+	}
+
+	// Patterns and exact versions
+	if !strings.ContainsAny(constraint, "<>=,") {
+		if strings.ContainsAny(constraint, " \t") {
+			return false, fmt.Errorf("Invalid version constraint %q", constraint)
+		}
+		ok, err := path.Match(constraint, version)
+		if err != nil {
+			return false, fmt.Errorf("Invalid version pattern %q: %v", constraint, err)
+		}
+		return ok, nil
+	}
+
+	v, versionErr := parseSemver(version)
+
+	matched := true
+	for _, part := range strings.Split(constraint, ",") {
+		m := versionComparisonRegex.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return false, fmt.Errorf("Invalid version comparison %q", part)
+		}
+
+		want, err := parseSemver(m[2])
+		if err != nil {
+			return false, fmt.Errorf("Invalid version comparison %q: %v", part, err)
+		}
+
+		if versionErr != nil {
+			matched = false
+			continue
+		}
+
+		cmp := compareSemver(v, want)
+
+		switch m[1] {
+		case ">=":
+			matched = matched && cmp >= 0
+		case "<=":
+			matched = matched && cmp <= 0
+		case ">":
+			matched = matched && cmp > 0
+		case "<":
+			matched = matched && cmp < 0
+		default:
+			matched = matched && cmp == 0
+		}
+	}
+
+	return matched, nil
+}
+
+// parseSemver parses versions like v1, v1.2 or 1.2.3 into their major, minor
+// and patch components. Pre-release and build suffixes aren't supported
+func parseSemver(version string) ([3]int, error) {
+	var parsed [3]int
+
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) > 3 {
+		return parsed, fmt.Errorf("%q isn't a semantic version", version)
+	}
+
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("%q isn't a semantic version", version)
+		}
+		parsed[idx] = n
+	}
+
+	return parsed, nil
+}
+
+func compareSemver(a, b [3]int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = []byte(`
+allowed:
+  - location: github.com/buildkite-plugins/docker-compose-buildkite-plugin
+    versions: [">= v3.0.0, < v4.0.0", "v2.5.*"]
+  - location: github.com/my-org/*
+  - location: github.com/buildkite-plugins/shellcheck-buildkite-plugin
+    versions: ["v1.1.2"]
+`)
+
+func TestCheckingPluginsAgainstPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Location string
+		Allowed  bool
+	}{
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.12", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v2.5.1", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin.git#v3.1.0", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v4.0.0", false},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v2.4.0", false},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#master", false},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", false},
+		{"github.com/My-Org/deploy-buildkite-plugin", true},
+		{"github.com/my-org/monorepo/plugins/deploy#main", true},
+		{"github.com/my-org-evil/deploy-buildkite-plugin", false},
+		{"github.com/buildkite-plugins/shellcheck-buildkite-plugin#v1.1.2", true},
+		{"github.com/buildkite-plugins/shellcheck-buildkite-plugin#v1.1.3", false},
+		{"github.com/someone-else/shellcheck-buildkite-plugin#v1.1.2", false},
+		{"./.buildkite/plugins/llamas", true},
+	} {
+		p, err := CreatePlugin(tc.Location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = policy.Check(p)
+		if tc.Allowed {
+			assert.NoError(t, err, tc.Location)
+		} else {
+			assert.Error(t, err, tc.Location)
+		}
+	}
+}
+
+func TestParsingInvalidPolicies(t *testing.T) {
+	t.Parallel()
+
+	for _, invalid := range []string{
+		"allowed:\n  - versions: [v1.0.0]\n",
+		"allowed:\n  - location: github.com/org/[\n",
+		"allowed:\n  - location: github.com/org/*\n    versions: ['>= llamas']\n",
+		"allowed:\n  - location: github.com/org/*\n    versions: ['~ v1.0.0']\n",
+		"allowed: llamas\n",
+	} {
+		if _, err := ParsePolicy([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
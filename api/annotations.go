@@ -1,13 +1,17 @@
 package api
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+)
 
 // Annotation represents a Buildkite Agent API Annotation
 type Annotation struct {
-	Body    string `json:"body,omitempty"`
-	Context string `json:"context,omitempty"`
-	Style   string `json:"style,omitempty"`
-	Append  bool   `json:"append,omitempty"`
+	Body     string `json:"body,omitempty"`
+	Context  string `json:"context,omitempty"`
+	Style    string `json:"style,omitempty"`
+	Append   bool   `json:"append,omitempty"`
+	Priority int    `json:"priority,omitempty"`
 }
 
 // Annotate a build in the Buildkite UI
@@ -21,3 +25,15 @@ func (c *Client) Annotate(jobId string, annotation *Annotation) (*Response, erro
 
 	return c.doRequest(req, nil)
 }
+
+// Remove an annotation from a build in the Buildkite UI
+func (c *Client) AnnotationRemove(jobId string, context string) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/annotations/%s", jobId, url.PathEscape(context))
+
+	req, err := c.newRequest("DELETE", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(req, nil)
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestAnnotations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.EscapedPath() {
+		case `POST /jobs/job-1/annotations`:
+			var annotation Annotation
+			if err := json.NewDecoder(req.Body).Decode(&annotation); err != nil {
+				t.Fatal(err)
+			}
+			if annotation != (Annotation{Body: "llamas", Context: "junit", Priority: 5}) {
+				t.Errorf("Unexpected annotation %#v", annotation)
+			}
+			rw.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(rw, `{}`)
+
+		case `DELETE /jobs/job-1/annotations/test%2Fjunit`:
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `{}`)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.EscapedPath())
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	if _, err := c.Annotate("job-1", &Annotation{Body: "llamas", Context: "junit", Priority: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.AnnotationRemove("job-1", "test/junit"); err != nil {
+		t.Fatal(err)
+	}
+}
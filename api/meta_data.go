@@ -10,6 +10,17 @@ type MetaData struct {
 	Value string `json:"value,omitempty"`
 }
 
+// MetaDataBatch represents many meta-data values that are set or retrieved
+// with a single request
+type MetaDataBatch struct {
+	Items []*MetaData `json:"items"`
+}
+
+// MetaDataBatchGet represents a request for the values of many meta-data keys
+type MetaDataBatchGet struct {
+	Keys []string `json:"keys"`
+}
+
 // MetaDataExists represents a Buildkite Agent API MetaData Exists check
 // response
 type MetaDataExists struct {
@@ -28,6 +39,18 @@ func (c *Client) SetMetaData(jobId string, metaData *MetaData) (*Response, error
 	return c.doRequest(req, nil)
 }
 
+// Sets many meta data values at once
+func (c *Client) SetMetaDataBatch(jobId string, batch *MetaDataBatch) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/batch_set", jobId)
+
+	req, err := c.newRequest("POST", u, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(req, nil)
+}
+
 // Gets the meta data value
 func (c *Client) GetMetaData(jobId string, key string) (*MetaData, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/get", jobId)
@@ -46,6 +69,25 @@ func (c *Client) GetMetaData(jobId string, key string) (*MetaData, *Response, er
 	return m, resp, err
 }
 
+// Gets the values of many meta data keys at once. Keys that haven't been set
+// aren't included
+func (c *Client) GetMetaDataBatch(jobId string, keys []string) (*MetaDataBatch, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/batch_get", jobId)
+
+	req, err := c.newRequest("POST", u, &MetaDataBatchGet{Keys: keys})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch := new(MetaDataBatch)
+	resp, err := c.doRequest(req, batch)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return batch, resp, err
+}
+
 // Returns true if the meta data key has been set, false if it hasn't.
 func (c *Client) ExistsMetaData(jobId string, key string) (*MetaDataExists, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/exists", jobId)
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestMetaDataBatches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/jobs/job-1/data/batch_set`:
+			var batch MetaDataBatch
+			if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+				t.Fatal(err)
+			}
+			if len(batch.Items) != 2 || batch.Items[0].Key != "llamas" || batch.Items[1].Value != "2" {
+				t.Errorf("Unexpected batch %#v", batch)
+			}
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `{}`)
+
+		case `/jobs/job-1/data/batch_get`:
+			var get MetaDataBatchGet
+			if err := json.NewDecoder(req.Body).Decode(&get); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(get.Keys, []string{"llamas", "alpacas"}) {
+				t.Errorf("Unexpected keys %#v", get.Keys)
+			}
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `{"items":[{"key":"llamas","value":"1"}]}`)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	_, err := c.SetMetaDataBatch("job-1", &MetaDataBatch{Items: []*MetaData{
+		{Key: "llamas", Value: "1"},
+		{Key: "alpacas", Value: "2"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, _, err := c.GetMetaDataBatch("job-1", []string{"llamas", "alpacas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch.Items) != 1 || *batch.Items[0] != (MetaData{Key: "llamas", Value: "1"}) {
+		t.Fatalf("Unexpected batch %#v", batch.Items)
+	}
+}
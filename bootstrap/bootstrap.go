@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildkite/agent/v3/agent/plugin"
@@ -46,9 +47,31 @@ type Bootstrap struct {
 	// Plugin checkouts from the plugin phases
 	pluginCheckouts []*pluginCheckout
 
+	// The commits that plugins are pinned to, if there is a plugin lockfile
+	pluginsLockfile *plugin.Lockfile
+
 	// Directories to clean up at end of bootstrap
 	cleanupDirs []string
 
+	// Where plugin configuration files are written for hooks
+	pluginConfigurationDir string
+
+	// The pull request head commit, if it was merged with its base branch
+	pullRequestHeadCommit string
+
+	// The lock on a pooled workspace, held until the end of the bootstrap
+	workspaceLock shell.LockFile
+
+	// Timeouts and failure policies for hooks, by lifecycle point
+	hookTimeouts        map[string]time.Duration
+	hookFailurePolicies map[string]HookFailurePolicy
+
+	// The exit status to use if a hook soft-failed and the job otherwise passed
+	hookSoftFailExitStatus int
+
+	// How long each phase, hook and step of the job took
+	timings []timing
+
 	// A channel to track cancellation
 	cancelCh chan struct{}
 }
@@ -76,6 +99,15 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		b.shell.Debug = b.Config.Debug
 	}
 
+	// A dry run only prints what would be run
+	if b.DryRun {
+		if err := b.dryRun(); err != nil {
+			b.shell.Errorf("%v", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Listen for cancellation
 	go func() {
 		select {
@@ -96,6 +128,11 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 			// this gets passed back via the named return
 			exitCode = shell.GetExitCode(err)
 		}
+
+		if exitCode == 0 && b.hookSoftFailExitStatus != 0 {
+			b.shell.Warningf("Exiting with status %d as a hook soft-failed", b.hookSoftFailExitStatus)
+			exitCode = b.hookSoftFailExitStatus
+		}
 	}()
 
 	// Initialize the environment, a failure here will still call the tearDown
@@ -104,31 +141,19 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		return shell.GetExitCode(err)
 	}
 
-	var includePhase = func(phase string) bool {
-		if len(b.Phases) == 0 {
-			return true
-		}
-		for _, include := range b.Phases {
-			if include == phase {
-				return true
-			}
-		}
-		return false
-	}
-
 	//  Execute the bootstrap phases in order
 	var phaseErr error
 
-	if includePhase(`plugin`) {
+	if b.includePhase(`plugin`) {
 		phaseErr = b.preparePlugins()
 
 		if phaseErr == nil {
-			phaseErr = b.PluginPhase()
+			phaseErr = b.timePhase("plugin", b.PluginPhase)
 		}
 	}
 
-	if phaseErr == nil && includePhase(`checkout`) {
-		phaseErr = b.CheckoutPhase()
+	if phaseErr == nil && b.includePhase(`checkout`) {
+		phaseErr = b.timePhase("checkout", b.CheckoutPhase)
 	} else {
 		checkoutDir, exists := b.shell.Env.Get(`BUILDKITE_BUILD_CHECKOUT_PATH`)
 		if exists {
@@ -136,12 +161,12 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}
 
-	if phaseErr == nil && includePhase(`plugin`) {
-		phaseErr = b.VendoredPluginPhase()
+	if phaseErr == nil && b.includePhase(`plugin`) {
+		phaseErr = b.timePhase("vendored plugin", b.VendoredPluginPhase)
 	}
 
-	if phaseErr == nil && includePhase(`command`) {
-		phaseErr = b.CommandPhase()
+	if phaseErr == nil && b.includePhase(`command`) {
+		phaseErr = b.timePhase("command", b.CommandPhase)
 
 		// Only upload artifacts as part of the command phase
 		if err := b.uploadArtifacts(); err != nil {
@@ -170,8 +195,9 @@ func (b *Bootstrap) Cancel() error {
 	return nil
 }
 
-// executeHook runs a hook script with the hookRunner
-func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.Environment) error {
+// executeHook runs a hook script with the hookRunner, interrupting it if it
+// runs for longer than the timeout (if there is one)
+func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.Environment, timeout time.Duration) error {
 	if !fileExists(hookPath) {
 		if b.Debug {
 			b.shell.Commentf("Skipping %s hook, no script at \"%s\"", name, hookPath)
@@ -180,6 +206,7 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 	}
 
 	b.shell.Headerf("Running %s hook", name)
+	defer b.recordTiming(timingKindHook, name, time.Now())
 
 	if redactor := b.setupRedactor(); redactor != nil {
 		defer redactor.Flush()
@@ -212,11 +239,42 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 		b.shell.Promptf("%s", process.FormatCommand(cleanHookPath, []string{}))
 	}
 
+	var timedOut int32
+	if timeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			select {
+			case <-done:
+				return
+			case <-time.After(timeout):
+			}
+
+			atomic.StoreInt32(&timedOut, 1)
+			b.shell.Warningf("The %s hook exceeded its timeout of %v, interrupting it", name, timeout)
+			b.shell.Interrupt()
+
+			select {
+			case <-done:
+			case <-time.After(hookTimeoutGracePeriod):
+				b.shell.Terminate()
+			}
+		}()
+	}
+
 	// Run the wrapper script
 	if err := b.shell.RunScript(script.Path(), extraEnviron); err != nil {
 		exitCode := shell.GetExitCode(err)
 		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
 
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return &shell.ExitError{
+				Code:    exitCode,
+				Message: fmt.Sprintf("The %s hook timed out after %v", name, timeout),
+			}
+		}
+
 		// Give a simpler error if it's just a shell exit error
 		if shell.IsExitError(err) {
 			return &shell.ExitError{
@@ -295,46 +353,89 @@ func (b *Bootstrap) findHookFile(hookDir string, name string) (string, error) {
 	return "", os.ErrNotExist
 }
 
+// Returns the absolute paths to all the hook files for a name in a path. The
+// hook file itself runs first, followed by any files in a <name>.d directory
+// in lexical order. Hidden files, directories and editor backups are skipped.
+func (b *Bootstrap) findHookFiles(hookDir string, name string) ([]string, error) {
+	paths := []string{}
+
+	if p, err := b.findHookFile(hookDir, name); err == nil {
+		paths = append(paths, p)
+	}
+
+	// ioutil.ReadDir returns entries sorted by filename
+	entries, err := ioutil.ReadDir(filepath.Join(hookDir, name+".d"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), "~") {
+			continue
+		}
+		paths = append(paths, filepath.Join(hookDir, name+".d", entry.Name()))
+	}
+
+	return paths, nil
+}
+
+// hookDescription describes a hook for the log, including the filename of
+// hooks from a <name>.d directory so they can be told apart
+func hookDescription(prefix string, name string, hookPath string) string {
+	if filepath.Base(filepath.Dir(hookPath)) == name+".d" {
+		return fmt.Sprintf("%s %s (%s)", prefix, name, filepath.Base(hookPath))
+	}
+	return prefix + " " + name
+}
+
+// executeHooks runs each of the hook files in order, so that each sees the
+// environment changes made by the ones before it
+func (b *Bootstrap) executeHooks(prefix string, name string, hookPaths []string, extraEnviron *env.Environment) error {
+	for _, hookPath := range hookPaths {
+		description := hookDescription(prefix, name, hookPath)
+
+		if err := b.executeHook(description, hookPath, extraEnviron, b.hookTimeouts[name]); err != nil {
+			if err = b.applyHookFailurePolicy(name, description, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (b *Bootstrap) hasGlobalHook(name string) bool {
-	_, err := b.globalHookPath(name)
-	return err == nil
+	paths, err := b.globalHookPaths(name)
+	return err == nil && len(paths) > 0
 }
 
-// Returns the absolute path to a global hook, or os.ErrNotExist if none is found
-func (b *Bootstrap) globalHookPath(name string) (string, error) {
-	return b.findHookFile(b.HooksPath, name)
+// Returns the absolute paths to the global hooks for a name
+func (b *Bootstrap) globalHookPaths(name string) ([]string, error) {
+	return b.findHookFiles(b.HooksPath, name)
 }
 
-// Executes a global hook if one exists
+// Executes the global hooks for a name if any exist
 func (b *Bootstrap) executeGlobalHook(name string) error {
-	if !b.hasGlobalHook(name) {
-		return nil
-	}
-	p, err := b.globalHookPath(name)
+	paths, err := b.globalHookPaths(name)
 	if err != nil {
 		return err
 	}
-	return b.executeHook("global "+name, p, nil)
+	return b.executeHooks("global", name, paths, nil)
 }
 
-// Returns the absolute path to a local hook, or os.ErrNotExist if none is found
-func (b *Bootstrap) localHookPath(name string) (string, error) {
-	return b.findHookFile(filepath.Join(b.shell.Getwd(), ".buildkite", "hooks"), name)
+// Returns the absolute paths to the local hooks for a name
+func (b *Bootstrap) localHookPaths(name string) ([]string, error) {
+	return b.findHookFiles(filepath.Join(b.shell.Getwd(), ".buildkite", "hooks"), name)
 }
 
 func (b *Bootstrap) hasLocalHook(name string) bool {
-	_, err := b.localHookPath(name)
-	return err == nil
+	paths, err := b.localHookPaths(name)
+	return err == nil && len(paths) > 0
 }
 
-// Executes a local hook
+// Executes the local hooks for a name
 func (b *Bootstrap) executeLocalHook(name string) error {
-	if !b.hasLocalHook(name) {
-		return nil
-	}
-
-	localHookPath, err := b.localHookPath(name)
-	if err != nil {
+	paths, err := b.localHookPaths(name)
+	if err != nil || len(paths) == 0 {
 		return nil
 	}
 
@@ -348,10 +449,10 @@ func (b *Bootstrap) executeLocalHook(name string) error {
 	}
 
 	if !localHooksEnabled {
-		return fmt.Errorf("Refusing to run %s, local hooks are disabled", localHookPath)
+		return fmt.Errorf("Refusing to run %s, local hooks are disabled", paths[0])
 	}
 
-	return b.executeHook("local "+name, localHookPath, nil)
+	return b.executeHooks("local", name, paths, nil)
 }
 
 // Returns whether or not a file exists on the filesystem. We consider any
@@ -373,22 +474,48 @@ func dirForRepository(repository string) string {
 	return badCharsPattern.ReplaceAllString(repository, "-")
 }
 
-// Given a repository, it will add the host to the set of SSH known_hosts on the machine
-func addRepositoryHostToSSHKnownHosts(sh *shell.Shell, repository string) {
+// Given a repository, it will add the host to the set of SSH known_hosts on the
+// machine, either from pinned host keys or with ssh-keyscan. Errors are only
+// returned with strict host key checking, otherwise they are just warnings
+func (b *Bootstrap) addRepositoryHostToSSHKnownHosts(repository string) error {
 	if fileExists(repository) {
-		return
+		return nil
 	}
 
-	knownHosts, err := findKnownHosts(sh)
+	// Nothing to do unless we've been asked to manage known_hosts
+	if !b.SSHKeyscan && b.SSHKnownHostsPath == "" && !b.SSHStrictHostKeyChecking {
+		return nil
+	}
+
+	// Checking host keys here is no use if ssh then adds unknown ones, so
+	// make sure the ssh that git runs is strict too
+	if b.SSHStrictHostKeyChecking {
+		if b.shell.Env.Exists("GIT_SSH") && !b.shell.Env.Exists("GIT_SSH_COMMAND") {
+			b.shell.Warningf("GIT_SSH is set, so strict host key checking can't be enforced for git")
+		} else {
+			command, _ := b.shell.Env.Get("GIT_SSH_COMMAND")
+			b.shell.Env.Set("GIT_SSH_COMMAND", strictGitSSHCommand(command))
+		}
+	}
+
+	knownHosts, err := findKnownHosts(b.shell)
 	if err != nil {
-		sh.Warningf("Failed to find SSH known_hosts file: %v", err)
-		return
+		if b.SSHStrictHostKeyChecking {
+			return err
+		}
+		b.shell.Warningf("Failed to find SSH known_hosts file: %v", err)
+		return nil
 	}
 
-	if err = knownHosts.AddFromRepository(repository); err != nil {
-		sh.Warningf("Error adding to known_hosts: %v", err)
-		return
+	err = knownHosts.Verify(repository, b.SSHKnownHostsPath, b.SSHStrictHostKeyChecking, b.SSHKeyscan)
+	if err != nil {
+		if b.SSHStrictHostKeyChecking {
+			return err
+		}
+		b.shell.Warningf("Error adding to known_hosts: %v", err)
 	}
+
+	return nil
 }
 
 // Makes sure a file is executable
@@ -423,11 +550,11 @@ func (b *Bootstrap) setUp() error {
 	// Set a BUILDKITE_BUILD_CHECKOUT_PATH unless one exists already. We do this here
 	// so that the environment will have a checkout path to work with
 	if _, exists := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH"); !exists {
-		if b.BuildPath == "" {
-			return fmt.Errorf("Must set either a BUILDKITE_BUILD_PATH or a BUILDKITE_BUILD_CHECKOUT_PATH")
+		checkoutPath, err := b.setUpWorkspace()
+		if err != nil {
+			return err
 		}
-		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH",
-			filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug))
+		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
 	}
 
 	// The job runner sets BUILDKITE_IGNORED_ENV with any keys that were ignored
@@ -456,17 +583,30 @@ func (b *Bootstrap) setUp() error {
 		}
 	}
 
+	var err error
+	if b.hookTimeouts, err = ParseHookTimeouts(b.HookTimeouts); err != nil {
+		return err
+	}
+	if b.hookFailurePolicies, err = ParseHookFailurePolicies(b.HookFailurePolicies); err != nil {
+		return err
+	}
+
 	// Disable any interactive Git/SSH prompting
 	b.shell.Env.Set("GIT_TERMINAL_PROMPT", "0")
 
+	// Supply HTTPS credentials to git without writing them anywhere
+	if err := b.setUpGitCredentialHelper(); err != nil {
+		return err
+	}
+
 	// It's important to do this before checking out plugins, in case you want
 	// to use the global environment hook to whitelist the plugins that are
 	// allowed to be used.
 	return b.executeGlobalHook("environment")
 }
 
-// tearDown is called before the bootstrap exits, even on error
-func (b *Bootstrap) tearDown() error {
+// executePreExitHooks runs the global, local and plugin pre-exit hooks
+func (b *Bootstrap) executePreExitHooks() error {
 	if err := b.executeGlobalHook("pre-exit"); err != nil {
 		return err
 	}
@@ -475,7 +615,21 @@ func (b *Bootstrap) tearDown() error {
 		return err
 	}
 
-	if err := b.executePluginHook("pre-exit", b.pluginCheckouts); err != nil {
+	return b.executePluginHook("pre-exit", b.pluginCheckouts)
+}
+
+// tearDown is called before the bootstrap exits, even on error
+func (b *Bootstrap) tearDown() error {
+	// Ephemeral workspaces are removed and the workspace lock released however
+	// tearing down goes, so that failures don't leak disk space
+	defer b.cleanUpWorkspace()
+
+	err := b.executePreExitHooks()
+
+	// The timings are published even if a pre-exit hook failed
+	b.publishTimingReport()
+
+	if err != nil {
 		return err
 	}
 
@@ -484,13 +638,23 @@ func (b *Bootstrap) tearDown() error {
 		return tearDownDeprecatedDockerIntegration(b.shell)
 	}
 
+	return nil
+}
+
+// cleanUpWorkspace removes the directories that only last for the job, and
+// releases the workspace lock
+func (b *Bootstrap) cleanUpWorkspace() {
 	for _, dir := range b.cleanupDirs {
 		if err := os.RemoveAll(dir); err != nil {
 			b.shell.Warningf("Failed to remove dir %s: %v", dir, err)
 		}
 	}
 
-	return nil
+	if b.workspaceLock != nil {
+		if err := b.workspaceLock.Unlock(); err != nil {
+			b.shell.Warningf("Failed to release workspace lock: %v", err)
+		}
+	}
 }
 
 func (b *Bootstrap) hasPlugins() bool {
@@ -533,14 +697,48 @@ func (b *Bootstrap) preparePlugins() error {
 		b.shell.Commentf("Parsed %d plugins", len(b.plugins))
 	}
 
+	// Make sure every plugin is allowed before checking any of them out
+	if b.PluginsPolicy != "" {
+		policy, err := plugin.LoadPolicy(b.PluginsPolicy)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to load the plugin policy %s", b.PluginsPolicy)
+		}
+
+		for _, p := range b.plugins {
+			if err := policy.Check(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Make sure every plugin is pinned before checking any of them out
+	if b.PluginsLockfile != "" {
+		b.pluginsLockfile, err = plugin.LoadLockfile(b.PluginsLockfile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to load the plugin lockfile %s", b.PluginsLockfile)
+		}
+
+		for _, p := range b.plugins {
+			// Plugins that are referenced by digest are already pinned
+			if p.Vendored || p.IsPinnedByDigest() {
+				continue
+			}
+			if p.IsArchive() || p.IsOCI() {
+				return fmt.Errorf("Plugin %q must be referenced by digest when a plugin lockfile is used", p.Label())
+			}
+			if _, ok := b.pluginsLockfile.ExpectedCommit(p); !ok {
+				return fmt.Errorf("Plugin %q isn't in the plugin lockfile %s", p.Label(), b.PluginsLockfile)
+			}
+		}
+	}
+
 	return nil
 }
 
+// validatePluginCheckout fills in defaults from the plugin's configuration
+// schema, so that hooks see them whether or not plugin validation is on, and
+// then validates the configuration if it is
 func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
-	if !b.Config.PluginValidation {
-		return nil
-	}
-
 	if checkout.Definition == nil {
 		if b.Debug {
 			b.shell.Commentf("Parsing plugin definition for %s from %s", checkout.Plugin.Name(), checkout.CheckoutDir)
@@ -551,13 +749,31 @@ func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
 		checkout.Definition, err = plugin.LoadDefinitionFromDir(checkout.CheckoutDir)
 
 		if err == plugin.ErrDefinitionNotFound {
-			b.shell.Warningf("Failed to find plugin definition for plugin %s", checkout.Plugin.Name())
+			if b.Config.PluginValidation {
+				b.shell.Warningf("Failed to find plugin definition for plugin %s", checkout.Plugin.Name())
+			}
 			return nil
 		} else if err != nil {
-			return err
+			if b.Config.PluginValidation {
+				return err
+			}
+			b.shell.Warningf("Failed to parse plugin definition for plugin %s: %v", checkout.Plugin.Name(), err)
+			return nil
 		}
 	}
 
+	// Fill in defaults from the schema, so that hooks see the same
+	// configuration that was validated
+	configuration, err := checkout.Definition.ApplyConfigurationSchema(checkout.Plugin.Configuration)
+	if err != nil {
+		return err
+	}
+	checkout.Plugin.Configuration = configuration
+
+	if !b.Config.PluginValidation {
+		return nil
+	}
+
 	val := &plugin.Validator{}
 	result := val.Validate(checkout.Definition, checkout.Plugin.Configuration)
 
@@ -565,6 +781,9 @@ func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
 		b.shell.Headerf("Plugin validation failed for %q", checkout.Plugin.Name())
 		json, _ := json.Marshal(checkout.Plugin.Configuration)
 		b.shell.Commentf("Plugin configuration JSON is %s", json)
+		for _, e := range result.Errors {
+			b.shell.Printf("  %s", e)
+		}
 		return result
 	}
 
@@ -669,19 +888,28 @@ func (b *Bootstrap) VendoredPluginPhase() error {
 // Executes a named hook on plugins that have it
 func (b *Bootstrap) executePluginHook(name string, checkouts []*pluginCheckout) error {
 	for _, p := range checkouts {
-		hookPath, err := b.findHookFile(p.HooksDir, name)
-		// os.IsNotExist() doesn't unwrap wrapped errors (as at Go 1.13).
-		// agent is still go pre-1.13 compatible (I think) so we're avoiding errors.Is().
-		// In future somebody should check if os.IsNotExist() has added support for
-		// error unwrapping, or change this code to errors.Is(err, os.ErrNotExist)
-		if os.IsNotExist(err) {
-			continue // this plugin does not implement this hook
-		} else if err != nil {
+		hookPaths, err := b.findHookFiles(p.HooksDir, name)
+		if err != nil {
 			return err
 		}
 
-		env, _ := p.ConfigurationToEnvironment()
-		if err := b.executeHook("plugin "+p.Plugin.Name()+" "+name, hookPath, env); err != nil {
+		// this plugin does not implement this hook
+		if len(hookPaths) == 0 {
+			continue
+		}
+
+		env, err := p.ConfigurationToEnvironment()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to convert the configuration of plugin %s to environment variables", p.Plugin.Name())
+		}
+
+		configFile, err := b.writePluginConfigurationFile(p)
+		if err != nil {
+			return err
+		}
+		env.Set(pluginConfigurationFileEnv, configFile)
+
+		if err := b.executeHooks("plugin "+p.Plugin.Name(), name, hookPaths, env); err != nil {
 			return err
 		}
 	}
@@ -692,7 +920,7 @@ func (b *Bootstrap) executePluginHook(name string, checkouts []*pluginCheckout)
 // If any plugin has a hook by this name
 func (b *Bootstrap) hasPluginHook(name string) bool {
 	for _, p := range b.pluginCheckouts {
-		if _, err := b.findHookFile(p.HooksDir, name); err == nil {
+		if paths, err := b.findHookFiles(p.HooksDir, name); err == nil && len(paths) > 0 {
 			return true
 		}
 	}
@@ -706,6 +934,8 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 		return nil, fmt.Errorf("Can't checkout plugin without a `plugins-path`")
 	}
 
+	defer b.recordTiming(timingKindPlugin, p.Label(), time.Now())
+
 	// Get the identifer for the plugin
 	id, err := p.Identifier()
 	if err != nil {
@@ -736,15 +966,20 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 		HooksDir:    filepath.Join(directory, "hooks"),
 	}
 
+	// Archive and OCI plugins are downloaded rather than cloned
+	if p.IsArchive() || p.IsOCI() {
+		if err := b.downloadPlugin(checkout); err != nil {
+			return nil, err
+		}
+		return checkout, nil
+	}
+
 	// Has it already been checked out?
 	if fileExists(pluginGitDirectory) {
-		// It'd be nice to show the current commit of the plugin, so
-		// let's figure that out.
-		headCommit, err := gitRevParseInWorkingDirectory(b.shell, directory, "--short=7", "HEAD")
-		if err != nil {
-			b.shell.Commentf("Plugin %q already checked out (can't `git rev-parse HEAD` plugin git directory)", p.Label())
-		} else {
-			b.shell.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
+		b.shell.Commentf("Plugin %q already checked out", p.Label())
+
+		if err := b.verifyPluginCheckout(checkout); err != nil {
+			return nil, err
 		}
 
 		return checkout, nil
@@ -760,6 +995,11 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	// checkout the plugin
 	if fileExists(pluginGitDirectory) {
 		b.shell.Commentf("Plugin \"%s\" already checked out", p.Label())
+
+		if err := b.verifyPluginCheckout(checkout); err != nil {
+			return nil, err
+		}
+
 		return checkout, nil
 	}
 
@@ -785,13 +1025,33 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 
 	b.shell.Commentf("Switching to the plugin directory")
 
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(b.shell, repo)
+	if !b.PluginsOffline {
+		if err = b.addRepositoryHostToSSHKnownHosts(repo); err != nil {
+			return nil, err
+		}
 	}
 
-	// Plugin clones shouldn't use custom GitCloneFlags
-	if err = b.shell.Run("git", "clone", "-v", "--", repo, "."); err != nil {
-		return nil, err
+	if b.PluginsCachePath != "" {
+		mirrorDir, err := UpdatePluginCache(b.shell, b.PluginsCachePath, p, b.PluginsOffline)
+		if err != nil {
+			return nil, err
+		}
+
+		// Clone from the cache, then point origin back at the real repository
+		if err = b.shell.Run("git", "clone", "-v", "--", mirrorDir, "."); err != nil {
+			return nil, err
+		}
+
+		if err = b.shell.Run("git", "remote", "set-url", "origin", repo); err != nil {
+			return nil, err
+		}
+	} else if b.PluginsOffline {
+		return nil, fmt.Errorf("Can't checkout plugin %q offline without a `plugins-cache-path`", p.Label())
+	} else {
+		// Plugin clones shouldn't use custom GitCloneFlags
+		if err = b.shell.Run("git", "clone", "-v", "--", repo, "."); err != nil {
+			return nil, err
+		}
 	}
 
 	// Switch to the version if we need to
@@ -802,9 +1062,44 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 		}
 	}
 
+	if err = b.verifyPluginCheckout(checkout); err != nil {
+		return nil, err
+	}
+
 	return checkout, nil
 }
 
+// verifyPluginCheckout records the commit a plugin resolved to, and checks it
+// against the plugin lockfile if there is one. Checkouts that don't match are
+// removed, so that they aren't reused by later jobs
+func (b *Bootstrap) verifyPluginCheckout(checkout *pluginCheckout) error {
+	commit, err := gitRevParseInWorkingDirectory(b.shell, checkout.CheckoutDir, "HEAD")
+	if err != nil {
+		if b.pluginsLockfile == nil {
+			b.shell.Warningf("Can't `git rev-parse HEAD` plugin %q: %v", checkout.Label(), err)
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to resolve the commit of plugin %q", checkout.Label())
+	}
+
+	checkout.Commit = strings.TrimSpace(commit)
+	b.shell.Commentf("Plugin %q resolved to commit %s", checkout.Label(), checkout.Commit)
+
+	if b.pluginsLockfile == nil {
+		return nil
+	}
+
+	if err := b.pluginsLockfile.Verify(checkout.Plugin, checkout.Commit); err != nil {
+		if removeErr := os.RemoveAll(checkout.CheckoutDir); removeErr != nil {
+			b.shell.Warningf("Failed to remove plugin checkout %s: %v", checkout.CheckoutDir, removeErr)
+		}
+		return err
+	}
+
+	b.shell.Commentf("Plugin %q matches the plugin lockfile", checkout.Label())
+	return nil
+}
+
 func (b *Bootstrap) removeCheckoutDir() error {
 	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 
@@ -913,6 +1208,14 @@ func (b *Bootstrap) CheckoutPhase() error {
 					b.shell.Warningf("Checkout was cancelled")
 					s.Break()
 
+				case isGitError(err, gitErrorMergeConflict):
+					// Retrying won't make a conflicting merge apply
+					s.Break()
+
+				case isUnknownHostError(err):
+					// Nor will it make an untrusted host trusted
+					s.Break()
+
 				default:
 					b.shell.Warningf("Checkout failed! %s (%s)", err, s)
 
@@ -1008,9 +1311,11 @@ func hasGitCommit(sh *shell.Shell, gitDir string, commit string) bool {
 	return true
 }
 
-func (b *Bootstrap) updateGitMirror() (string, error) {
+// updateGitMirror makes sure there is an up to date mirror of the repository
+// that contains the commit, and returns the path to it
+func (b *Bootstrap) updateGitMirror(repository string, commit string) (string, error) {
 	// Create a unique directory for the repository mirror
-	mirrorDir := filepath.Join(b.Config.GitMirrorsPath, dirForRepository(b.Repository))
+	mirrorDir := filepath.Join(b.Config.GitMirrorsPath, dirForRepository(repository))
 
 	// Create the mirrors path if it doesn't exist
 	if baseDir := filepath.Dir(mirrorDir); !fileExists(baseDir) {
@@ -1038,7 +1343,7 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	// If we don't have a mirror, we need to clone it
 	if !fileExists(mirrorDir) {
 		b.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
-		if err := gitClone(b.shell, b.GitCloneMirrorFlags, b.Repository, mirrorDir); err != nil {
+		if err := gitClone(b.shell, b.GitCloneMirrorFlags, repository, mirrorDir); err != nil {
 			return "", err
 		}
 
@@ -1049,8 +1354,8 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	mirrorCloneLock.Unlock()
 
 	// Check if the mirror has a commit, this is atomic so should be safe to do
-	if hasGitCommit(b.shell, mirrorDir, b.Commit) {
-		b.shell.Commentf("Commit %q exists in mirror", b.Commit)
+	if hasGitCommit(b.shell, mirrorDir, commit) {
+		b.shell.Commentf("Commit %q exists in mirror", commit)
 		return mirrorDir, nil
 	}
 
@@ -1066,15 +1371,15 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	defer mirrorUpdateLock.Unlock()
 
 	// Check again after we get a lock, in case the other process has already updated
-	if hasGitCommit(b.shell, mirrorDir, b.Commit) {
-		b.shell.Commentf("Commit %q exists in mirror", b.Commit)
+	if hasGitCommit(b.shell, mirrorDir, commit) {
+		b.shell.Commentf("Commit %q exists in mirror", commit)
 		return mirrorDir, nil
 	}
 
-	b.shell.Commentf("Updating existing repository mirror to find commit %s", b.Commit)
+	b.shell.Commentf("Updating existing repository mirror to find commit %s", commit)
 
 	// Update the the origin of the repository so we can gracefully handle repository renames
-	if err := b.shell.Run("git", "--git-dir", mirrorDir, "remote", "set-url", "origin", b.Repository); err != nil {
+	if err := b.shell.Run("git", "--git-dir", mirrorDir, "remote", "set-url", "origin", repository); err != nil {
 		return "", err
 	}
 
@@ -1089,8 +1394,8 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
 // hook exists. It performs the default checkout on the Repository provided in the config
 func (b *Bootstrap) defaultCheckoutPhase() error {
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(b.shell, b.Repository)
+	if err := b.addRepositoryHostToSSHKnownHosts(b.Repository); err != nil {
+		return err
 	}
 
 	var mirrorDir string
@@ -1100,7 +1405,7 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 		b.shell.Commentf("Using git-mirrors experiment 🧪")
 
 		var err error
-		mirrorDir, err = b.updateGitMirror()
+		mirrorDir, err = b.updateGitMirror(b.Repository, b.Commit)
 		if err != nil {
 			return err
 		}
@@ -1200,6 +1505,14 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 		}
 	}
 
+	// Optionally build the result of merging the pull request into its base
+	// branch, rather than the head of the pull request on its own
+	if b.GitPullRequestMerge != "" && b.PullRequest != "" && b.PullRequest != "false" {
+		if err := b.mergePullRequest(); err != nil {
+			return err
+		}
+	}
+
 	var gitSubmodules bool
 	if !b.GitSubmodules && hasGitSubmodules(b.shell) {
 		b.shell.Warningf("This repository has submodules, but submodules are disabled at an agent level")
@@ -1219,20 +1532,7 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 			b.shell.Warningf("Failed to recursively sync git submodules. This is most likely because you have an older version of git installed (" + gitVersionOutput + ") and you need version 1.8.1 and above. If you're using submodules, it's highly recommended you upgrade if you can.")
 		}
 
-		// Checking for submodule repositories
-		submoduleRepos, err := gitEnumerateSubmoduleURLs(b.shell)
-		if err != nil {
-			b.shell.Warningf("Failed to enumerate git submodules: %v", err)
-		} else {
-			for _, repository := range submoduleRepos {
-				// submodules might need their fingerprints verified too
-				if b.SSHKeyscan {
-					addRepositoryHostToSSHKnownHosts(b.shell, repository)
-				}
-			}
-		}
-
-		if err := b.shell.Run("git", "submodule", "update", "--init", "--recursive", "--force"); err != nil {
+		if err := b.updateGitSubmodules(); err != nil {
 			return err
 		}
 
@@ -1269,7 +1569,13 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 	if err := b.shell.Run("buildkite-agent", "meta-data", "exists", "buildkite:git:commit"); err != nil {
 		b.shell.Commentf("Sending Git commit information back to Buildkite")
 
-		gitCommitOutput, err := b.shell.RunAndCapture("git", "--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color")
+		// Report the pull request commit rather than our local merge commit
+		commit := "HEAD"
+		if b.pullRequestHeadCommit != "" {
+			commit = b.pullRequestHeadCommit
+		}
+
+		gitCommitOutput, err := b.shell.RunAndCapture("git", "--no-pager", "show", commit, "-s", "--format=fuller", "--no-color")
 		if err != nil {
 			return err
 		}
@@ -1282,6 +1588,77 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 	return nil
 }
 
+// mergePullRequest merges the checked out pull request with its base branch,
+// either locally or by checking out the merge ref maintained by the provider,
+// and exports the resulting merge commit as BUILDKITE_PULL_REQUEST_MERGE_COMMIT
+func (b *Bootstrap) mergePullRequest() error {
+	headCommit, err := b.shell.RunAndCapture("git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	switch b.GitPullRequestMerge {
+	case "local":
+		if b.PullRequestBaseBranch == "" {
+			return fmt.Errorf("Can't merge pull request #%s without a base branch, BUILDKITE_PULL_REQUEST_BASE_BRANCH is empty", b.PullRequest)
+		}
+
+		b.shell.Commentf("Fetch pull request base branch %q", b.PullRequestBaseBranch)
+		if err := gitFetch(b.shell, b.GitFetchFlags, "origin", b.PullRequestBaseBranch); err != nil {
+			return err
+		}
+
+		b.shell.Commentf("Merging pull request #%s into %q", b.PullRequest, b.PullRequestBaseBranch)
+		message := fmt.Sprintf("Merge pull request #%s into %s", b.PullRequest, b.PullRequestBaseBranch)
+		if err := gitMerge(b.shell, "FETCH_HEAD", message); err != nil {
+			if isGitError(err, gitErrorMergeConflict) {
+				b.shell.Errorf("Pull request #%s doesn't merge cleanly into %q", b.PullRequest, b.PullRequestBaseBranch)
+			}
+			return err
+		}
+
+	case "ref":
+		ref, err := pullRequestMergeRef(b.PipelineProvider, b.PullRequest)
+		if err != nil {
+			return err
+		}
+
+		b.shell.Commentf("Fetch and checkout pull request merge ref %q", ref)
+		if err := gitFetch(b.shell, b.GitFetchFlags, "origin", ref); err != nil {
+			b.shell.Warningf("No merge ref for pull request #%s, it may have conflicts with its base branch", b.PullRequest)
+			return err
+		}
+
+		if err := gitCheckout(b.shell, `-f`, `FETCH_HEAD`); err != nil {
+			return err
+		}
+
+		// Providers update merge refs asynchronously, so make sure the one we
+		// got actually includes the commit we're meant to be building
+		parents, err := b.shell.RunAndCapture("git", "rev-list", "--parents", "-n", "1", "HEAD")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(parents, headCommit) {
+			return fmt.Errorf("Merge ref %q doesn't include commit %s yet", ref, headCommit)
+		}
+
+	default:
+		return fmt.Errorf("Unknown pull request merge mode %q, expected \"local\" or \"ref\"", b.GitPullRequestMerge)
+	}
+
+	mergeCommit, err := b.shell.RunAndCapture("git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	b.shell.Commentf("Building merge commit %s", mergeCommit)
+	b.shell.Env.Set("BUILDKITE_PULL_REQUEST_MERGE_COMMIT", mergeCommit)
+	b.pullRequestHeadCommit = headCommit
+
+	return nil
+}
+
 // CommandPhase determines how to run the build, and then runs it
 func (b *Bootstrap) CommandPhase() error {
 	if err := b.executeGlobalHook("pre-command"); err != nil {
@@ -1355,6 +1732,8 @@ func (b *Bootstrap) defaultCommandPhase() error {
 		return fmt.Errorf("No command has been provided")
 	}
 
+	defer b.recordTiming(timingKindCommand, "command", time.Now())
+
 	scriptFileName := strings.Replace(b.Command, "\n", "", -1)
 	pathToCommand, err := filepath.Abs(filepath.Join(b.shell.Getwd(), scriptFileName))
 	commandIsScript := err == nil && fileExists(pathToCommand)
@@ -1543,6 +1922,7 @@ func (b *Bootstrap) uploadArtifacts() error {
 
 	// Run the artifact upload command
 	b.shell.Headerf("Uploading artifacts")
+	defer b.recordTiming(timingKindArtifact, b.AutomaticArtifactUploadPaths, time.Now())
 	args := []string{"artifact", "upload", b.AutomaticArtifactUploadPaths}
 
 	// If blank, the upload destination is buildkite
@@ -1648,4 +2028,8 @@ type pluginCheckout struct {
 	*plugin.Definition
 	CheckoutDir string
 	HooksDir    string
+	Commit      string
+
+	// The path to the plugin's configuration as json, once it's written
+	ConfigurationFile string
 }
@@ -43,9 +43,26 @@ type Config struct {
 	// Should git submodules be checked out
 	GitSubmodules bool
 
+	// Comma separated submodule paths (or globs) to check out, each with an
+	// optional clone depth like "vendor/*:1". Defaults to all submodules
+	GitSubmodulePaths string `env:"BUILDKITE_GIT_SUBMODULE_PATHS"`
+
+	// The clone depth for submodules, defaults to the full history
+	GitSubmoduleDepth string `env:"BUILDKITE_GIT_SUBMODULE_DEPTH"`
+
+	// The number of submodules to fetch in parallel
+	GitSubmoduleJobs string `env:"BUILDKITE_GIT_SUBMODULE_JOBS"`
+
 	// If the commit was part of a pull request, this will container the PR number
 	PullRequest string
 
+	// The base branch that the pull request targets
+	PullRequestBaseBranch string
+
+	// How to merge a pull request with its base branch before running the
+	// build, either "local" or "ref", or empty to build the head as-is
+	GitPullRequestMerge string `env:"BUILDKITE_GIT_PULL_REQUEST_MERGE"`
+
 	// The provider of the the pipeline
 	PipelineProvider string
 
@@ -91,21 +108,57 @@ type Config struct {
 	// Path where the builds will be run
 	BuildPath string
 
+	// How checkout directories are allocated, either "reuse", "ephemeral" or "pool"
+	WorkspacePolicy string
+
+	// Path where ephemeral workspaces are created, e.g. a tmpfs mount
+	WorkspaceTmpPath string
+
+	// The number of checkout directories per pipeline in the workspace pool
+	WorkspacePoolSize int
+
+	// Remove checkout directories that haven't been used for this many days
+	WorkspaceMaxAgeDays int
+
 	// Path where the repository mirrors are stored
 	GitMirrorsPath string
 
 	// Seconds to wait before allowing git mirror clone lock to be acquired
 	GitMirrorsLockTimeout int
 
+	// Path to a file mapping repository urls to HTTPS credentials
+	GitCredentialsPath string
+
 	// Path to the buildkite-agent binary
 	BinPath string
 
 	// Path to the global hooks
 	HooksPath string
 
+	// Timeouts for hooks as name=duration, e.g. pre-exit=30s
+	HookTimeouts []string
+
+	// What happens when hooks fail as name=policy, e.g. pre-exit=warn
+	HookFailurePolicies []string
+
 	// Path to the plugins directory
 	PluginsPath string
 
+	// Path to a file pinning plugins to the commits they must resolve to
+	PluginsLockfile string
+
+	// Path to a file listing the plugins that are allowed
+	PluginsPolicy string
+
+	// Path to a plugin cache shared between agents
+	PluginsCachePath string
+
+	// Whether plugins should only be checked out from the plugin cache
+	PluginsOffline bool
+
+	// Whether to publish how long each phase and hook took when the job finishes
+	TimingReport bool
+
 	// Paths to automatically upload as artifacts when the build finishes
 	AutomaticArtifactUploadPaths string `env:"BUILDKITE_ARTIFACT_PATHS"`
 
@@ -115,12 +168,22 @@ type Config struct {
 	// Whether ssh-keyscan is run on ssh hosts before checkout
 	SSHKeyscan bool
 
+	// Path to a known_hosts file of pinned host keys and certificate
+	// authorities, which are trusted in preference to ssh-keyscan
+	SSHKnownHostsPath string
+
+	// Whether to refuse ssh hosts without pinned or already known host keys
+	SSHStrictHostKeyChecking bool
+
 	// The shell used to execute commands
 	Shell string
 
 	// Phases to execute, defaults to all phases
 	Phases []string
 
+	// Whether to only print the hooks that would run for each phase
+	DryRun bool
+
 	// List of environment variable globs to redact from job output
 	RedactedVars []string
 }
@@ -20,6 +20,8 @@ const (
 	gitErrorFetch
 	gitErrorClean
 	gitErrorCleanSubmodules
+	gitErrorMerge
+	gitErrorMergeConflict
 )
 
 type gitError struct {
@@ -27,6 +29,12 @@ type gitError struct {
 	Type int
 }
 
+// isGitError returns whether err is a gitError of the given type
+func isGitError(err error, errorType int) bool {
+	ge, ok := err.(*gitError)
+	return ok && ge.Type == errorType
+}
+
 func gitCheckout(sh *shell.Shell, gitCheckoutFlags, reference string) error {
 	individualCheckoutFlags, err := shellwords.Split(gitCheckoutFlags)
 	if err != nil {
@@ -121,16 +129,74 @@ func gitFetch(sh *shell.Shell, gitFetchFlags, repository string, refSpec ...stri
 	return nil
 }
 
-func gitEnumerateSubmoduleURLs(sh *shell.Shell) ([]string, error) {
-	urls := []string{}
+// gitMerge merges a reference into the current HEAD with a generated merge
+// commit. If the merge doesn't apply cleanly it's aborted and a
+// gitErrorMergeConflict is returned listing the conflicting files, or a
+// gitErrorMerge if it failed without any.
+func gitMerge(sh *shell.Shell, reference string, message string) error {
+	// Merge commits need an identity, but the agent user rarely has one
+	// configured and the merge commit is only ever local to the checkout
+	commandArgs := []string{
+		"-c", "user.name=buildkite-agent",
+		"-c", "user.email=buildkite-agent@localhost",
+		"merge", "--no-ff", "--no-edit", "-m", message, reference,
+	}
+
+	if err := sh.Run("git", commandArgs...); err != nil {
+		conflicts, _ := sh.RunAndCapture("git", "diff", "--name-only", "--diff-filter=U")
+
+		// Leave the working tree as it was before the merge attempt
+		if abortErr := sh.Run("git", "merge", "--abort"); abortErr != nil {
+			sh.Warningf("Failed to abort merge: %v", abortErr)
+		}
+
+		// Only a merge that left unmerged paths is a conflict, other
+		// failures may be temporary and are worth retrying
+		if strings.TrimSpace(conflicts) == "" {
+			return &gitError{error: err, Type: gitErrorMerge}
+		}
+
+		return &gitError{
+			error: fmt.Errorf("Merge of %s has conflicts in:\n%s", reference, conflicts),
+			Type:  gitErrorMergeConflict,
+		}
+	}
+
+	return nil
+}
+
+// pullRequestMergeRef returns the ref that a provider maintains with the result
+// of merging a pull request into its base branch
+func pullRequestMergeRef(provider string, pullRequest string) (string, error) {
+	switch {
+	case strings.Contains(provider, "github"):
+		return fmt.Sprintf("refs/pull/%s/merge", pullRequest), nil
+	case strings.Contains(provider, "gitlab"):
+		return fmt.Sprintf("refs/merge-requests/%s/merge", pullRequest), nil
+	case strings.Contains(provider, "bitbucket"):
+		return fmt.Sprintf("refs/pull-requests/%s/merge", pullRequest), nil
+	}
+	return "", fmt.Errorf("Pipeline provider %q doesn't provide pull request merge refs", provider)
+}
+
+// gitSubmodule is a submodule as defined in a repository's .gitmodules
+type gitSubmodule struct {
+	Name string
+	Path string
+	URL  string
+}
+
+func gitEnumerateSubmodules(sh *shell.Shell) ([]gitSubmodule, error) {
+	submodules := []gitSubmodule{}
+	index := map[string]int{}
 
 	// The output of this command looks like:
-	// submodule.bitbucket-git-docker-example.url\ngit@bitbucket.org:lox24/docker-example.git\0
-	// submodule.bitbucket-https-docker-example.url\nhttps://lox24@bitbucket.org/lox24/docker-example.git\0
-	// submodule.github-git-docker-example.url\ngit@github.com:buildkite/docker-example.git\0
-	// submodule.github-https-docker-example.url\nhttps://github.com/buildkite/docker-example.git\0
+	// submodule.docker-example.path\ndocker-example\0
+	// submodule.docker-example.url\ngit@github.com:buildkite/docker-example.git\0
+	// submodule.vendor/llamas.path\nvendor/llamas\0
+	// submodule.vendor/llamas.url\nhttps://github.com/buildkite/llamas.git\0
 	output, err := sh.RunAndCapture(
-		"git", "config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url")
+		"git", "config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)")
 	if err != nil {
 		return nil, err
 	}
@@ -144,10 +210,45 @@ func gitEnumerateSubmoduleURLs(sh *shell.Shell) ([]string, error) {
 		if len(tokens) != 2 {
 			return nil, fmt.Errorf("Failed to parse .gitmodules line %q", line)
 		}
-		urls = append(urls, tokens[1])
+
+		// Submodule names can contain dots, so only trim the known parts
+		key := strings.TrimPrefix(tokens[0], "submodule.")
+		name := key[:strings.LastIndex(key, ".")]
+
+		i, ok := index[name]
+		if !ok {
+			i = len(submodules)
+			index[name] = i
+			submodules = append(submodules, gitSubmodule{Name: name})
+		}
+
+		switch {
+		case strings.HasSuffix(key, ".path"):
+			submodules[i].Path = tokens[1]
+		case strings.HasSuffix(key, ".url"):
+			submodules[i].URL = tokens[1]
+		}
+	}
+
+	return submodules, nil
+}
+
+// gitSubmoduleCommit returns the commit that the superproject has recorded
+// for the submodule at the given path
+func gitSubmoduleCommit(sh *shell.Shell, path string) (string, error) {
+	// The output of this command looks like:
+	// 160000 commit 0cfa44d0b7c6ab4d4b6a8f3c9d1e0b2f3a4c5d6e\tdocker-example
+	output, err := sh.RunAndCapture("git", "ls-tree", "HEAD", path)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) < 3 || fields[1] != "commit" {
+		return "", fmt.Errorf("Failed to find submodule commit for %q", path)
 	}
 
-	return urls, nil
+	return fields[2], nil
 }
 
 func gitRevParseInWorkingDirectory(sh *shell.Shell, workingDirectory string, extraRevParseArgs ...string) (string, error) {
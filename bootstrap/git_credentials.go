@@ -0,0 +1,99 @@
+package bootstrap
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/shellwords"
+)
+
+// setUpGitCredentialHelper configures every git command run by the bootstrap
+// (and its hooks and plugins) to get HTTPS credentials from the agent's
+// git-credential helper. It's done through the environment, so that nothing
+// is written to .git/config and no tokens end up in remote urls.
+func (b *Bootstrap) setUpGitCredentialHelper() error {
+	if b.GitCredentialsPath == "" {
+		return nil
+	}
+
+	if !fileExists(b.GitCredentialsPath) {
+		return fmt.Errorf("Git credentials file %s doesn't exist", b.GitCredentialsPath)
+	}
+
+	// The helper is configured with GIT_CONFIG_COUNT, which older versions of
+	// git silently ignore
+	version, err := b.shell.RunAndCapture("git", "--version")
+	if err != nil {
+		return fmt.Errorf("Failed to find the version of git: %v", err)
+	}
+	if !gitVersionAtLeast(version, 2, 31) {
+		return fmt.Errorf("Git credentials need git 2.31 or later, found %q", strings.TrimSpace(version))
+	}
+
+	bin := "buildkite-agent"
+	if b.BinPath != "" {
+		bin = filepath.Join(b.BinPath, bin)
+	}
+
+	// Git runs helpers starting with ! with a shell, appending the operation
+	helper := fmt.Sprintf("!%s git-credential --credentials-path %s",
+		shellwords.QuotePosix(bin), shellwords.QuotePosix(b.GitCredentialsPath))
+
+	b.shell.Commentf("Using git credentials from %s", b.GitCredentialsPath)
+
+	return addGitConfigEnv(b.shell.Env, [][2]string{
+		// An empty helper resets any helpers from the user's git config, so
+		// they can't be sent tokens meant for us or supply their own
+		{"credential.helper", ""},
+		{"credential.helper", helper},
+
+		// Credentials are matched against the whole repository url, not just
+		// the host
+		{"credential.useHttpPath", "true"},
+	})
+}
+
+// addGitConfigEnv appends config to the GIT_CONFIG_COUNT style environment
+// variables, which apply to every git command without touching config files
+func addGitConfigEnv(environ *env.Environment, config [][2]string) error {
+	count := 0
+	if value, exists := environ.Get("GIT_CONFIG_COUNT"); exists && value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("Invalid GIT_CONFIG_COUNT %q", value)
+		}
+	}
+
+	for _, kv := range config {
+		environ.Set(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), kv[0])
+		environ.Set(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), kv[1])
+		count++
+	}
+
+	environ.Set("GIT_CONFIG_COUNT", strconv.Itoa(count))
+	return nil
+}
+
+var gitVersionRegexp = regexp.MustCompile(`git version (\d+)\.(\d+)`)
+
+// gitVersionAtLeast returns whether the output of `git --version` is for at
+// least the given major and minor version
+func gitVersionAtLeast(output string, major, minor int) bool {
+	match := gitVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return false
+	}
+
+	// The regexp only matches digits, so these can't fail
+	actualMajor, _ := strconv.Atoi(match[1])
+	actualMinor, _ := strconv.Atoi(match[2])
+
+	if actualMajor != major {
+		return actualMajor > major
+	}
+	return actualMinor >= minor
+}
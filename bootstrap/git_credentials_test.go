@@ -0,0 +1,111 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/bintest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingUpGitCredentialHelper(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "git-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	git, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.CheckAndClose(t)
+
+	git.Expect("--version").AndWriteToStdout("git version 2.31.0\n").AndExitWith(0)
+
+	path := fmt.Sprintf("%s%c%s", filepath.Dir(git.Path), os.PathListSeparator, os.Getenv("PATH"))
+
+	b := New(Config{GitCredentialsPath: f.Name(), BinPath: "/opt/buildkite agent/bin"})
+	b.shell = newTestShell(t)
+	b.shell.Env = env.FromSlice([]string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+		"PATH=" + path,
+	})
+
+	if err := b.setUpGitCredentialHelper(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"PATH":               path,
+		"GIT_CONFIG_COUNT":   "4",
+		"GIT_CONFIG_KEY_0":   "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always",
+		"GIT_CONFIG_KEY_1":   "credential.helper",
+		"GIT_CONFIG_VALUE_1": "",
+		"GIT_CONFIG_KEY_2":   "credential.helper",
+		"GIT_CONFIG_VALUE_2": `!"/opt/buildkite agent/bin/buildkite-agent" git-credential --credentials-path ` + f.Name(),
+		"GIT_CONFIG_KEY_3":   "credential.useHttpPath",
+		"GIT_CONFIG_VALUE_3": "true",
+	}, b.shell.Env.ToMap())
+}
+
+func TestSettingUpGitCredentialHelperWithMissingFile(t *testing.T) {
+	t.Parallel()
+
+	b := New(Config{GitCredentialsPath: "/does/not/exist"})
+	b.shell = newTestShell(t)
+
+	assert.Error(t, b.setUpGitCredentialHelper())
+}
+
+func TestSettingUpGitCredentialHelperWithOldGit(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "git-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	git, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.CheckAndClose(t)
+
+	git.Expect("--version").AndWriteToStdout("git version 2.30.1 (Apple Git-130)\n").AndExitWith(0)
+
+	b := New(Config{GitCredentialsPath: f.Name()})
+	b.shell = newTestShell(t)
+	b.shell.Env.Set("PATH", fmt.Sprintf("%s%c%s", filepath.Dir(git.Path), os.PathListSeparator, os.Getenv("PATH")))
+
+	assert.Error(t, b.setUpGitCredentialHelper())
+	assert.False(t, b.shell.Env.Exists("GIT_CONFIG_COUNT"))
+}
+
+func TestGitVersionAtLeast(t *testing.T) {
+	t.Parallel()
+
+	for output, expected := range map[string]bool{
+		"git version 2.31.0":                 true,
+		"git version 2.39.2":                 true,
+		"git version 3.0.0":                  true,
+		"git version 2.35.1.windows.2":       true,
+		"git version 2.30.1 (Apple Git-130)": false,
+		"git version 1.8.1":                  false,
+		"not git":                            false,
+	} {
+		assert.Equal(t, expected, gitVersionAtLeast(output, 2, 31), output)
+	}
+}
@@ -66,6 +66,27 @@ func TestParsingGittableRepositoryFromSSHURLsWithPorts(t *testing.T) {
 	assert.Equal(t, `git.host.de:4019`, u.Host)
 }
 
+func TestPullRequestMergeRef(t *testing.T) {
+	t.Parallel()
+
+	for provider, expected := range map[string]string{
+		"github":            "refs/pull/123/merge",
+		"github_enterprise": "refs/pull/123/merge",
+		"gitlab":            "refs/merge-requests/123/merge",
+		"bitbucket":         "refs/pull-requests/123/merge",
+	} {
+		ref, err := pullRequestMergeRef(provider, "123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, ref)
+	}
+
+	if _, err := pullRequestMergeRef("git", "123"); err == nil {
+		t.Fatal("Expected an error for a provider without merge refs")
+	}
+}
+
 func TestResolvingGitHostAliasesWithFlagSupport(t *testing.T) {
 	t.Parallel()
 
@@ -345,3 +366,39 @@ usage: ssh [-1246AaCfgKkMNnqsTtVvXxYy] [-b bind_address] [-c cipher_spec]
 
 	assert.Equal(t, "blargh-no-alias.com", resolveGitHost(sh, "blargh-no-alias.com"))
 }
+
+func TestGitMergeConflicts(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name      string
+		Conflicts string
+		Type      int
+	}{
+		{"with unmerged paths", "README.md\n", gitErrorMergeConflict},
+		{"without unmerged paths", "", gitErrorMerge},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			sh := newTestShell(t)
+
+			git, err := bintest.NewMock("git")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer git.CheckAndClose(t)
+
+			sh.Env.Set("PATH", filepath.Dir(git.Path))
+
+			git.Expect("-c", "user.name=buildkite-agent", "-c", "user.email=buildkite-agent@localhost",
+				"merge", "--no-ff", "--no-edit", "-m", "Merge", "FETCH_HEAD").AndExitWith(1)
+			git.Expect("diff", "--name-only", "--diff-filter=U").AndWriteToStdout(tc.Conflicts).AndExitWith(0)
+			git.Expect("merge", "--abort").AndExitWith(0)
+
+			err = gitMerge(sh, "FETCH_HEAD", "Merge")
+			assert.True(t, isGitError(err, tc.Type), "unexpected error: %v", err)
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package bootstrap
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
@@ -14,8 +17,18 @@ import (
 const (
 	hookExitStatusEnv = `BUILDKITE_HOOK_EXIT_STATUS`
 	hookWorkingDirEnv = `BUILDKITE_HOOK_WORKING_DIR`
+	hookEnvFileEnv    = `BUILDKITE_HOOK_ENV_FILE`
 )
 
+// Interpreters of hooks that are sourced rather than executed
+var sourcedHookShells = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"dash": true,
+	"ksh":  true,
+	"zsh":  true,
+}
+
 // Hooks get "sourced" into the bootstrap in the sense that they get the
 // environment set for them and then we capture any extra environment variables
 // that are exported in the script.
@@ -26,6 +39,13 @@ const (
 // Then we can use the diff of the two to figure out what changes to make to the
 // bootstrap. Horrible, but effective.
 
+// Hooks written in other languages (a shebang for something other than a
+// shell, or a compiled binary) can't be sourced, so they are executed as a
+// child process instead. They can change the environment by writing to the
+// file in $BUILDKITE_HOOK_ENV_FILE, either one KEY=value per line in dotenv
+// format or as a JSON object of strings (see env.FromEnvFile). The file is
+// available to shell hooks too, and its values win over exported ones.
+
 // hookScriptWrapper wraps a hook script with env collection and then provides
 // a way to get the difference between the environment before the hook is run and
 // after it
@@ -34,6 +54,7 @@ type hookScriptWrapper struct {
 	scriptFile    *os.File
 	beforeEnvFile *os.File
 	afterEnvFile  *os.File
+	envFile       *os.File
 	beforeWd      string
 }
 
@@ -89,6 +110,15 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	}
 	h.afterEnvFile.Close()
 
+	// The hook can write environment changes to this temp file
+	h.envFile, err = shell.TempFileWithExtension(
+		`buildkite-agent-bootstrap-hook-env-file`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	h.envFile.Close()
+
 	absolutePathToHook, err := filepath.Abs(h.hookPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to \"%s\" (%s)", h.hookPath, err)
@@ -99,12 +129,22 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 		return nil, err
 	}
 
+	// Hooks in other languages get executed rather than sourced
+	var isSourcedHook = true
+	if !isWindows {
+		isSourcedHook, err = isSourcedHookFile(absolutePathToHook)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create the hook runner code
 	var script string
 	if isWindows && !isBashHook && !isPwshHook {
 		script = "@echo off\n" +
 			"SETLOCAL ENABLEDELAYEDEXPANSION\n" +
 			"SET > \"" + h.beforeEnvFile.Name() + "\"\n" +
+			"SET \"" + hookEnvFileEnv + "=" + h.envFile.Name() + "\"\n" +
 			"CALL \"" + absolutePathToHook + "\"\n" +
 			"SET " + hookExitStatusEnv + "=!ERRORLEVEL!\n" +
 			"SET " + hookWorkingDirEnv + "=%CD%\n" +
@@ -113,14 +153,25 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	} else if isWindows && isPwshHook {
 		script = `$ErrorActionPreference = "STOP"\n` +
 			`Get-ChildItem Env: | Foreach-Object {$($_.Name)=$($_.Value)"} | Set-Content "` + h.beforeEnvFile.Name() + `\n` +
+			`$Env:` + hookEnvFileEnv + ` = "` + h.envFile.Name() + `"\n` +
 			absolutePathToHook + `\n` +
 			`if ($LASTEXITCODE -eq $null) {$Env:` + hookExitStatusEnv + ` = 0} else {$Env:` + hookExitStatusEnv + ` = $LASTEXITCODE}\n` +
 			`$Env:` + hookWorkingDirEnv + ` = $PWD | Select-Object -ExpandProperty Path\n` +
 			`Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "` + h.afterEnvFile.Name() + `"\n` +
 			`exit $Env:` + hookExitStatusEnv
 	} else {
+		// Shell hooks are sourced so that we can see what they export
+		run := ". \"" + filepath.ToSlash(absolutePathToHook) + "\""
+		if !isSourcedHook {
+			if err := checkHookIsExecutable(absolutePathToHook); err != nil {
+				return nil, err
+			}
+			run = "\"" + filepath.ToSlash(absolutePathToHook) + "\""
+		}
+
 		script = "export -p > \"" + filepath.ToSlash(h.beforeEnvFile.Name()) + "\"\n" +
-			". \"" + filepath.ToSlash(absolutePathToHook) + "\"\n" +
+			"export " + hookEnvFileEnv + "=\"" + filepath.ToSlash(h.envFile.Name()) + "\"\n" +
+			run + "\n" +
 			"export " + hookExitStatusEnv + "=$?\n" +
 			"export " + hookWorkingDirEnv + "=$PWD\n" +
 			"export -p > \"" + filepath.ToSlash(h.afterEnvFile.Name()) + "\"\n" +
@@ -152,6 +203,7 @@ func (h *hookScriptWrapper) Close() {
 	os.Remove(h.scriptFile.Name())
 	os.Remove(h.beforeEnvFile.Name())
 	os.Remove(h.afterEnvFile.Name())
+	os.Remove(h.envFile.Name())
 }
 
 // Changes returns the changes in the environment and working dir after the hook script runs
@@ -173,6 +225,73 @@ func (h *hookScriptWrapper) Changes() (hookScriptChanges, error) {
 
 	diff.Remove(hookExitStatusEnv)
 	diff.Remove(hookWorkingDirEnv)
+	diff.Remove(hookEnvFileEnv)
+
+	envFileContents, err := ioutil.ReadFile(h.envFile.Name())
+	if err != nil {
+		return hookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", h.envFile.Name(), err)
+	}
+
+	envFileEnv, err := env.FromEnvFile(string(envFileContents))
+	if err != nil {
+		return hookScriptChanges{}, fmt.Errorf("Failed to parse %s written by hook (%s)", hookEnvFileEnv, err)
+	}
+
+	return hookScriptChanges{Env: diff.Merge(envFileEnv), Dir: wd}, nil
+}
+
+// isSourcedHookFile returns whether a hook is a shell script, which is either
+// one with a shell in its shebang or a text file without a shebang at all
+func isSourcedHookFile(hookPath string) (bool, error) {
+	f, err := os.Open(hookPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		// Compiled binaries won't be valid text
+		return bytes.IndexByte(head, 0) == -1, nil
+	}
+
+	line := string(head[2:])
+	if idx := strings.IndexAny(line, "\r\n"); idx != -1 {
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true, nil
+	}
+
+	interpreter := filepath.Base(fields[0])
+
+	// e.g. #!/usr/bin/env bash
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = filepath.Base(fields[1])
+	}
+
+	return sourcedHookShells[interpreter], nil
+}
+
+// checkHookIsExecutable returns an error if a hook that needs to be executed
+// directly doesn't have the execute permission
+func checkHookIsExecutable(hookPath string) error {
+	info, err := os.Stat(hookPath)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&0111 == 0 {
+		return fmt.Errorf("Hook \"%s\" isn't a shell script, so it needs to be executable", hookPath)
+	}
 
-	return hookScriptChanges{Env: diff, Dir: wd}, nil
+	return nil
 }
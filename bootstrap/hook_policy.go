@@ -0,0 +1,143 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// A failing hook fails the job (the default)
+	HookFailurePolicyFail = "fail"
+
+	// A failing hook logs a warning and the job continues
+	HookFailurePolicyWarn = "warn"
+
+	// A failing hook logs a warning and the job continues, but exits with a
+	// specific status if it would have otherwise passed, e.g. soft-fail:42
+	HookFailurePolicySoftFail = "soft-fail"
+)
+
+// How long a hook has to exit after being interrupted for exceeding its
+// timeout, before it's terminated
+var hookTimeoutGracePeriod = 10 * time.Second
+
+// The lifecycle points that hooks can be configured for
+var hookNames = []string{
+	"environment",
+	"pre-checkout",
+	"checkout",
+	"post-checkout",
+	"pre-command",
+	"command",
+	"post-command",
+	"pre-artifact",
+	"post-artifact",
+	"pre-exit",
+}
+
+// HookFailurePolicy is what happens when a hook at a lifecycle point fails
+type HookFailurePolicy struct {
+	Policy     string
+	ExitStatus int
+}
+
+// ParseHookTimeouts parses a list of name=duration pairs, e.g. pre-exit=30s
+func ParseHookTimeouts(values []string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+
+	for _, value := range values {
+		name, setting, err := splitHookSetting(value)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout, err := time.ParseDuration(setting)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q for the %s hook, expected a duration like 30s or 5m", setting, name)
+		}
+
+		timeouts[name] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// ParseHookFailurePolicies parses a list of name=policy pairs, where the
+// policy is either fail, warn or soft-fail:<exit status>
+func ParseHookFailurePolicies(values []string) (map[string]HookFailurePolicy, error) {
+	policies := map[string]HookFailurePolicy{}
+
+	for _, value := range values {
+		name, setting, err := splitHookSetting(value)
+		if err != nil {
+			return nil, err
+		}
+
+		// The command hook's exit status is the result of the job
+		if name == "command" {
+			return nil, fmt.Errorf("A failure policy can't be set for the command hook")
+		}
+
+		policy := HookFailurePolicy{Policy: setting}
+
+		if strings.HasPrefix(setting, HookFailurePolicySoftFail+":") {
+			policy.Policy = HookFailurePolicySoftFail
+			policy.ExitStatus, err = strconv.Atoi(strings.TrimPrefix(setting, HookFailurePolicySoftFail+":"))
+			if err != nil || policy.ExitStatus < 1 || policy.ExitStatus > 255 {
+				return nil, fmt.Errorf("Invalid soft-fail exit status for the %s hook in %q, expected 1-255", name, setting)
+			}
+		} else if setting != HookFailurePolicyFail && setting != HookFailurePolicyWarn {
+			return nil, fmt.Errorf("Unknown failure policy %q for the %s hook, expected %q, %q or %q",
+				setting, name, HookFailurePolicyFail, HookFailurePolicyWarn, HookFailurePolicySoftFail+":<exit status>")
+		}
+
+		policies[name] = policy
+	}
+
+	return policies, nil
+}
+
+func splitHookSetting(value string) (string, string, error) {
+	idx := strings.Index(value, "=")
+	if idx == -1 {
+		return "", "", fmt.Errorf("Invalid hook setting %q, expected <hook>=<value>", value)
+	}
+
+	name, setting := strings.TrimSpace(value[:idx]), strings.TrimSpace(value[idx+1:])
+
+	for _, hookName := range hookNames {
+		if name == hookName {
+			return name, setting, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Unknown hook %q in %q", name, value)
+}
+
+// applyHookFailurePolicy decides whether a hook failure should fail the job,
+// returning nil if the job should continue
+func (b *Bootstrap) applyHookFailurePolicy(name string, description string, err error) error {
+	policy, ok := b.hookFailurePolicies[name]
+	if !ok {
+		return err
+	}
+
+	switch policy.Policy {
+	case HookFailurePolicyWarn:
+		b.shell.Warningf("Continuing after the %s hook failed: %v", description, err)
+		return nil
+
+	case HookFailurePolicySoftFail:
+		b.shell.Warningf("Continuing after the %s hook failed: %v. The job will exit with status %d",
+			description, err, policy.ExitStatus)
+
+		if b.hookSoftFailExitStatus == 0 {
+			b.hookSoftFailExitStatus = policy.ExitStatus
+		}
+		return nil
+	}
+
+	return err
+}
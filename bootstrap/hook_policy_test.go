@@ -0,0 +1,55 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingHookTimeouts(t *testing.T) {
+	t.Parallel()
+
+	timeouts, err := ParseHookTimeouts([]string{"pre-exit=30s", " environment = 2m "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]time.Duration{
+		"pre-exit":    30 * time.Second,
+		"environment": 2 * time.Minute,
+	}, timeouts)
+
+	for _, invalid := range []string{"pre-exit", "pre-exit=soon", "pre-exit=-1s", "llamas=30s"} {
+		if _, err := ParseHookTimeouts([]string{invalid}); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestParsingHookFailurePolicies(t *testing.T) {
+	t.Parallel()
+
+	policies, err := ParseHookFailurePolicies([]string{"pre-exit=warn", "post-command=soft-fail:42", "environment=fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]HookFailurePolicy{
+		"pre-exit":     {Policy: HookFailurePolicyWarn},
+		"post-command": {Policy: HookFailurePolicySoftFail, ExitStatus: 42},
+		"environment":  {Policy: HookFailurePolicyFail},
+	}, policies)
+
+	for _, invalid := range []string{
+		"command=warn",
+		"pre-exit=ignore",
+		"pre-exit=soft-fail",
+		"pre-exit=soft-fail:0",
+		"pre-exit=soft-fail:llamas",
+	} {
+		if _, err := ParseHookFailurePolicies([]string{invalid}); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
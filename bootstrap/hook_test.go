@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -112,6 +113,134 @@ func TestRunningHookDetectsChangedWorkingDirectory(t *testing.T) {
 	}
 }
 
+func TestRunningHookReadsEnvFile(t *testing.T) {
+	t.Parallel()
+
+	var script []string
+
+	if runtime.GOOS != "windows" {
+		script = []string{
+			"#!/bin/bash",
+			"export LLAMAS=rock",
+			`echo 'ALPACAS="are\nok"' >> "$BUILDKITE_HOOK_ENV_FILE"`,
+			`echo 'LLAMAS=rule' >> "$BUILDKITE_HOOK_ENV_FILE"`,
+		}
+	} else {
+		script = []string{
+			"@echo off",
+			"set LLAMAS=rock",
+			`echo ALPACAS="are\nok">> "%BUILDKITE_HOOK_ENV_FILE%"`,
+			`echo LLAMAS=rule>> "%BUILDKITE_HOOK_ENV_FILE%"`,
+		}
+	}
+
+	wrapper := newTestHookWrapper(t, script)
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunScript(wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Env, env.FromSlice([]string{"LLAMAS=rule", "ALPACAS=are\nok"})) {
+		t.Fatalf("Unexpected env in %#v", changes.Env)
+	}
+}
+
+func TestRunningExecutableHookWithOtherInterpreter(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Executable hooks are run with their file associations on Windows")
+	}
+
+	awk, err := exec.LookPath("awk")
+	if err != nil {
+		t.Skip("No awk available")
+	}
+
+	hookFile, err := shell.TempFileWithExtension("hookwrapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(hookFile.Name())
+
+	// Sourcing this with bash would fail
+	fmt.Fprintf(hookFile, "#!%s -f\n", awk)
+	fmt.Fprintln(hookFile, `BEGIN { print "LLAMAS=rock" > ENVIRON["BUILDKITE_HOOK_ENV_FILE"] }`)
+	hookFile.Close()
+
+	// Executable hooks need to have the execute permission
+	if _, err := newHookScriptWrapper(hookFile.Name()); err == nil {
+		t.Fatalf("Expected an error for a hook without execute permissions")
+	}
+
+	if err := os.Chmod(hookFile.Name(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper, err := newHookScriptWrapper(hookFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunScript(wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Env, env.FromSlice([]string{"LLAMAS=rock"})) {
+		t.Fatalf("Unexpected env in %#v", changes.Env)
+	}
+}
+
+func TestDetectingSourcedHookFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hook-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for content, sourced := range map[string]bool{
+		"#!/bin/bash\necho hello\n":             true,
+		"#!/usr/bin/env bash\necho hello\n":     true,
+		"#!/bin/sh -e\necho hello\n":            true,
+		"echo hello\n":                          true,
+		"":                                      true,
+		"#!/usr/bin/env python3\nprint('hi')\n": false,
+		"#!/usr/bin/ruby\nputs 'hi'\n":          false,
+		"\x7fELF\x02\x01\x01\x00\x00":           false,
+	} {
+		path := filepath.Join(dir, "hook")
+		if err := ioutil.WriteFile(path, []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		isSourced, err := isSourcedHookFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isSourced != sourced {
+			t.Errorf("Expected sourced to be %v for %q", sourced, content)
+		}
+	}
+}
+
 func newTestShell(t *testing.T) *shell.Shell {
 	sh, err := shell.New()
 	if err != nil {
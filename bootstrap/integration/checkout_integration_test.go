@@ -100,6 +100,8 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 		t.Fatalf("Committing submodule failed: %s", out)
 	}
 
+	submodulePath := filepath.Base(submoduleRepo.Path)
+
 	env := []string{
 		"BUILDKITE_GIT_CLONE_FLAGS=-v",
 		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
@@ -121,8 +123,10 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 			{"fetch", "-v", "origin", "master"},
 			{"checkout", "-f", "FETCH_HEAD"},
 			{"submodule", "sync", "--recursive"},
-			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
-			{"submodule", "update", "--init", "--recursive", "--force"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+			{"ls-tree", "HEAD", submodulePath},
+			{"clone", "-v", "--mirror", "--", submoduleRepo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"submodule", "update", "--init", "--recursive", "--force", "--reference", matchSubDir(tester.GitMirrorsDir), "--", submodulePath},
 			{"submodule", "foreach", "--recursive", "git reset --hard"},
 			{"clean", "-fdq"},
 			{"submodule", "foreach", "--recursive", "git clean -fdq"},
@@ -136,7 +140,7 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 			{"fetch", "-v", "origin", "master"},
 			{"checkout", "-f", "FETCH_HEAD"},
 			{"submodule", "sync", "--recursive"},
-			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
 			{"submodule", "update", "--init", "--recursive", "--force"},
 			{"submodule", "foreach", "--recursive", "git reset --hard"},
 			{"clean", "-fdq"},
@@ -157,6 +161,230 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutLocalGitProjectWithSelectedSubmodules(t *testing.T) {
+	t.Parallel()
+
+	// Git for windows seems to struggle with local submodules in the temp dir
+	if runtime.GOOS == `windows` {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	var submoduleRepos []*gitRepository
+	for i := 0; i < 2; i++ {
+		submoduleRepo, err := createTestGitRespository()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer submoduleRepo.Close()
+
+		// Newer versions of git don't allow local submodules by default
+		out, err := tester.Repo.Execute("-c", "protocol.file.allow=always", "submodule", "add", submoduleRepo.Path)
+		if err != nil {
+			t.Fatalf("Adding submodule failed: %s", out)
+		}
+
+		submoduleRepos = append(submoduleRepos, submoduleRepo)
+	}
+
+	out, err := tester.Repo.Execute("commit", "-am", "Add example submodules")
+	if err != nil {
+		t.Fatalf("Committing submodules failed: %s", out)
+	}
+
+	selectedPath := filepath.Base(submoduleRepos[1].Path)
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_SUBMODULE_PATHS=" + selectedPath + ":1",
+		"BUILDKITE_GIT_SUBMODULE_JOBS=4",
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	if experiments.IsEnabled(`git-mirrors`) {
+		git.ExpectAll([][]interface{}{
+			{"clone", "-v", "--mirror", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"submodule", "foreach", "--recursive", "git clean -fdq"},
+			{"fetch", "-v", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"submodule", "sync", "--recursive"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+			{"ls-tree", "HEAD", selectedPath},
+			{"clone", "-v", "--mirror", "--", submoduleRepos[1].Path, matchSubDir(tester.GitMirrorsDir)},
+			{"submodule", "update", "--init", "--recursive", "--force", "--jobs", "4", "--depth", "1", "--reference", matchSubDir(tester.GitMirrorsDir), "--", selectedPath},
+			{"submodule", "foreach", "--recursive", "git reset --hard"},
+			{"clean", "-fdq"},
+			{"submodule", "foreach", "--recursive", "git clean -fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color"},
+		})
+	} else {
+		git.ExpectAll([][]interface{}{
+			{"clone", "-v", "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"submodule", "foreach", "--recursive", "git clean -fdq"},
+			{"fetch", "-v", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"submodule", "sync", "--recursive"},
+			{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+			{"submodule", "update", "--init", "--recursive", "--force", "--jobs", "4", "--depth", "1", "--", selectedPath},
+			{"submodule", "foreach", "--recursive", "git reset --hard"},
+			{"clean", "-fdq"},
+			{"submodule", "foreach", "--recursive", "git clean -fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color"},
+		})
+	}
+
+	// Only the selected submodule should be checked out
+	tester.ExpectGlobalHook("post-checkout").Once().AndCallFunc(func(c *bintest.Call) {
+		if _, err := os.Stat(filepath.Join(c.Dir, selectedPath, "test.txt")); err != nil {
+			fmt.Fprintf(c.Stderr, "Expected selected submodule to be checked out: %v\n", err)
+			c.Exit(1)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(c.Dir, filepath.Base(submoduleRepos[0].Path), "test.txt")); err == nil {
+			fmt.Fprintf(c.Stderr, "Expected other submodule not to be checked out\n")
+			c.Exit(1)
+			return
+		}
+		c.Exit(0)
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(1)
+	agent.
+		Expect("meta-data", "set", "buildkite:git:commit", bintest.MatchAny()).
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutLocalGitProjectWithSubmoduleMirrorsConcurrently(t *testing.T) {
+	t.Parallel()
+
+	// Git for windows seems to struggle with local submodules in the temp dir
+	if runtime.GOOS == `windows` {
+		t.Skip()
+	}
+
+	// Only submodules with mirrors are updated concurrently
+	if !experiments.IsEnabled(`git-mirrors`) {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	var submoduleRepos []*gitRepository
+	var submodulePaths []string
+	for i := 0; i < 2; i++ {
+		submoduleRepo, err := createTestGitRespository()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer submoduleRepo.Close()
+
+		// Newer versions of git don't allow local submodules by default
+		out, err := tester.Repo.Execute("-c", "protocol.file.allow=always", "submodule", "add", submoduleRepo.Path)
+		if err != nil {
+			t.Fatalf("Adding submodule failed: %s", out)
+		}
+
+		submoduleRepos = append(submoduleRepos, submoduleRepo)
+		submodulePaths = append(submodulePaths, filepath.Base(submoduleRepo.Path))
+	}
+
+	out, err := tester.Repo.Execute("commit", "-am", "Add example submodules")
+	if err != nil {
+		t.Fatalf("Committing submodules failed: %s", out)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_SUBMODULE_PATHS=*",
+		"BUILDKITE_GIT_SUBMODULE_JOBS=2",
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=protocol.file.allow",
+		"GIT_CONFIG_VALUE_0=always",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// The submodules are initialized together, and then each mirror's
+	// submodules are updated without --init or --jobs
+	git.ExpectAll([][]interface{}{
+		{"clone", "-v", "--mirror", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"submodule", "foreach", "--recursive", "git clean -fdq"},
+		{"fetch", "-v", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"submodule", "sync", "--recursive"},
+		{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+		{"ls-tree", "HEAD", submodulePaths[0]},
+		{"clone", "-v", "--mirror", "--", submoduleRepos[0].Path, matchSubDir(tester.GitMirrorsDir)},
+		{"ls-tree", "HEAD", submodulePaths[1]},
+		{"clone", "-v", "--mirror", "--", submoduleRepos[1].Path, matchSubDir(tester.GitMirrorsDir)},
+		{"submodule", "init", "--", submodulePaths[0], submodulePaths[1]},
+		{"submodule", "update", "--recursive", "--force", "--reference", matchSubDir(tester.GitMirrorsDir), "--", submodulePaths[0]},
+		{"submodule", "update", "--recursive", "--force", "--reference", matchSubDir(tester.GitMirrorsDir), "--", submodulePaths[1]},
+		{"submodule", "foreach", "--recursive", "git reset --hard"},
+		{"clean", "-fdq"},
+		{"submodule", "foreach", "--recursive", "git clean -fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color"},
+	})
+
+	// Both submodules should be checked out
+	tester.ExpectGlobalHook("post-checkout").Once().AndCallFunc(func(c *bintest.Call) {
+		for _, path := range submodulePaths {
+			if _, err := os.Stat(filepath.Join(c.Dir, path, "test.txt")); err != nil {
+				fmt.Fprintf(c.Stderr, "Expected submodule to be checked out: %v\n", err)
+				c.Exit(1)
+				return
+			}
+		}
+		c.Exit(0)
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(1)
+	agent.
+		Expect("meta-data", "set", "buildkite:git:commit", bintest.MatchAny()).
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, env...)
+}
+
 func TestCheckingOutLocalGitProjectWithSubmodulesDisabled(t *testing.T) {
 	t.Parallel()
 
@@ -312,6 +540,137 @@ func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite(t *testing.T) {
 	tester.RunAndCheck(t)
 }
 
+func TestCheckingOutPullRequestMergedLocally(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Diverge a pull request branch from master
+	if err := tester.Repo.ExecuteAll([][]string{
+		{"checkout", "-b", "update-test-txt"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tester.Repo.Path, "pr.txt"), []byte("From the pull request"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Add("pr.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Pull request commit"); err != nil {
+		t.Fatal(err)
+	}
+	headCommit, err := tester.Repo.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tester.Repo.Execute("checkout", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tester.Repo.Path, "base.txt"), []byte("From the base branch"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Add("base.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Base branch commit"); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("post-checkout").Once().AndCallFunc(func(c *bintest.Call) {
+		for _, file := range []string{"pr.txt", "base.txt"} {
+			if _, err := os.Stat(filepath.Join(c.Dir, file)); err != nil {
+				fmt.Fprintf(c.Stderr, "Expected %s in the merged checkout: %v\n", file, err)
+				c.Exit(1)
+				return
+			}
+		}
+		if c.GetEnv("BUILDKITE_PULL_REQUEST_MERGE_COMMIT") == "" {
+			fmt.Fprintf(c.Stderr, "Expected BUILDKITE_PULL_REQUEST_MERGE_COMMIT to be set\n")
+			c.Exit(1)
+			return
+		}
+		c.Exit(0)
+	})
+
+	// The pull request head is reported, not the merge commit
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(1)
+	agent.
+		Expect("meta-data", "set", "buildkite:git:commit",
+			bintest.MatchPattern(`^commit `+strings.TrimSpace(headCommit))).
+		AndExitWith(0)
+
+	tester.RunAndCheck(t,
+		"BUILDKITE_BRANCH=update-test-txt",
+		"BUILDKITE_PULL_REQUEST=123",
+		"BUILDKITE_PULL_REQUEST_BASE_BRANCH=master",
+		"BUILDKITE_GIT_PULL_REQUEST_MERGE=local",
+	)
+}
+
+func TestCheckingOutPullRequestWithMergeConflictsFails(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Change test.txt differently on both branches
+	if _, err := tester.Repo.Execute("checkout", "-b", "update-test-txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tester.Repo.Path, "test.txt"), []byte("From the pull request"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Add("test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Pull request commit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tester.Repo.Execute("checkout", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tester.Repo.Path, "test.txt"), []byte("From the base branch"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Add("test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Base branch commit"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command should never run
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	err = tester.Run(t,
+		"BUILDKITE_BRANCH=update-test-txt",
+		"BUILDKITE_PULL_REQUEST=123",
+		"BUILDKITE_PULL_REQUEST_BASE_BRANCH=master",
+		"BUILDKITE_GIT_PULL_REQUEST_MERGE=local",
+	)
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "test.txt") {
+		t.Fatalf("Expected the conflicting file to be reported, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
 func TestCheckingOutWithSSHKeyscan(t *testing.T) {
 	t.Parallel()
 
@@ -3,7 +3,9 @@ package integration
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
@@ -397,3 +399,203 @@ func TestPreExitHooksFireAfterCancel(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestHooksFromDirectoriesRunInOrder(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	hooks := map[string]string{
+		"environment":                 `export HOOK_ORDER=main`,
+		"environment.d/20-second":     `export HOOK_ORDER="$HOOK_ORDER,second"`,
+		"environment.d/10-first":      `export HOOK_ORDER="$HOOK_ORDER,first"`,
+		"environment.d/.hidden":       `export HOOK_ORDER=hidden`,
+		"environment.d/10-first~":     `export HOOK_ORDER=backup`,
+		"environment.d/30-dir/nested": `export HOOK_ORDER=nested`,
+	}
+
+	for name, script := range hooks {
+		path := filepath.Join(tester.HooksDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("#!/bin/bash\n"+script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand()
+	git.Expect().AtLeastOnce().WithAnyArguments()
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `HOOK_ORDER=main,first,second`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		}
+		c.Exit(0)
+	})
+
+	tester.RunAndCheck(t)
+
+	if !strings.Contains(tester.Output, "Running global environment (20-second) hook") {
+		t.Fatalf("Expected the hook filename in the output, got: %s", tester.Output)
+	}
+}
+
+func TestHookFailurePolicies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Policy   string
+		ExitCode int
+	}{
+		{"pre-exit=fail", 5},
+		{"pre-exit=warn", 0},
+		{"pre-exit=soft-fail:42", 42},
+	} {
+		tc := tc
+		t.Run(tc.Policy, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+			tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(5)
+
+			err = tester.Run(t, "BUILDKITE_HOOK_FAILURE_POLICIES="+tc.Policy)
+			if exitCode := shell.GetExitCode(err); exitCode != tc.ExitCode {
+				t.Fatalf("Expected an exit code of %d, got %d", tc.ExitCode, exitCode)
+			}
+
+			tester.CheckMocks(t)
+		})
+	}
+}
+
+func TestHookTimeouts(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "pre-command"),
+		[]byte("#!/bin/bash\nsleep 30\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	start := time.Now()
+
+	if err := tester.Run(t, "BUILDKITE_HOOK_TIMEOUTS=pre-command=1s"); err == nil {
+		t.Fatalf("Expected the bootstrap to fail because the pre-command hook timed out")
+	}
+
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("Expected the hook to be interrupted, but it took %v", elapsed)
+	}
+
+	if !strings.Contains(tester.Output, "The global pre-command hook timed out after 1s") {
+		t.Fatalf("Expected a timeout error in the output, got: %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestTimingReportIsPublished(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("pre-command").Once().AndExitWith(0)
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+	agent.
+		Expect("annotate", "--context", "timing-report-1111-1111-1111-1111", "--style", "info",
+			bintest.MatchPattern(`(?s)\| hook \| global pre-command \| [0-9.]+m?s \|.*\| phase \| command \|`)).
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", "timing-report:1111-1111-1111-1111",
+			bintest.MatchPattern(`\{"kind":"phase","name":"checkout","seconds":[0-9.e-]+\}`)).
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, "BUILDKITE_TIMING_REPORT=true")
+}
+
+func TestDryRunPrintsHooksWithoutRunningThem(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{"#!/bin/bash", "echo llamas"},
+		"command":     []string{"#!/bin/bash", "echo alpacas"},
+	})
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hook := range []string{"environment", "pre-command", "command", "pre-exit"} {
+		tester.ExpectGlobalHook(hook).NotCalled()
+	}
+
+	// A dry run can only be asked for with the flag
+	tester.Args = append(tester.Args, "--dry-run")
+	tester.RunAndCheck(t,
+		`BUILDKITE_PLUGINS=`+json,
+		`BUILDKITE_HOOK_TIMEOUTS=pre-exit=30s`,
+	)
+
+	pluginHooks := regexp.QuoteMeta(tester.PluginsDir) + `/[^/]+/hooks`
+
+	for _, pattern := range []string{
+		`(?m)^environment\n\s+global\s+\S+/environment\n\s+plugin \S+\s+` + pluginHooks + `/environment$`,
+		`(?m)^checkout\n\s+default\s+git checkout of`,
+		`(?m)^pre-command\n\s+global\s+\S+/pre-command$`,
+		`(?m)^command\n\s+plugin \S+\s+` + pluginHooks + `/command \(overrides the default command\)$`,
+		`(?m)^pre-exit\n\s+global\s+\S+/pre-exit \[timeout 30s\]$`,
+	} {
+		if !regexp.MustCompile(pattern).MatchString(tester.Output) {
+			t.Errorf("Expected output to match %q, got: %s", pattern, tester.Output)
+		}
+	}
+
+	if strings.Contains(tester.Output, "llamas") || strings.Contains(tester.Output, "alpacas") {
+		t.Fatalf("Expected no hooks to run, got: %s", tester.Output)
+	}
+}
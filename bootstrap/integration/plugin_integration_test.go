@@ -1,9 +1,16 @@
 package integration
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -271,3 +278,428 @@ func (tp *testPlugin) MarshalJSON() ([]byte, error) {
 	}
 	return b, nil
 }
+
+func TestPluginsAreVerifiedAgainstLockfile(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	})
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := p.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit = strings.TrimSpace(commit)
+	label := p.Path + "#" + commit
+
+	for _, tc := range []struct {
+		Name     string
+		Lockfile string
+		Passes   bool
+		Resolved bool
+	}{
+		{"matching", label + ": " + commit, true, true},
+		{"abbreviated", label + ": " + commit[:7], false, false},
+		{"mismatched", label + ": 1111111111111111111111111111111111111111", false, true},
+		{"missing", "/some/other/plugin#v1.0.0: " + commit, false, false},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			lockfile := filepath.Join(tester.HooksDir, "plugins.lock")
+			if err := ioutil.WriteFile(lockfile, []byte("plugins:\n  "+tc.Lockfile+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			env := []string{
+				`BUILDKITE_PLUGINS=` + json,
+				`BUILDKITE_PLUGINS_LOCKFILE=` + lockfile,
+			}
+
+			if tc.Passes {
+				tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+				tester.RunAndCheck(t, env...)
+			} else {
+				tester.ExpectGlobalHook("command").NotCalled()
+				if err := tester.Run(t, env...); err == nil {
+					t.Fatalf("Expected the bootstrap to fail")
+				}
+				tester.CheckMocks(t)
+			}
+
+			if tc.Resolved && !strings.Contains(tester.Output, "resolved to commit "+commit) {
+				t.Fatalf("Expected the resolved commit in the output, got: %s", tester.Output)
+			}
+		})
+	}
+}
+
+func TestPluginsAreCheckedOutFromCache(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	})
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir, err := ioutil.TempDir("", "plugins-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	emptyCacheDir, err := ioutil.TempDir("", "plugins-cache-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyCacheDir)
+
+	// The first checkout populates the cache
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+	tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+json, `BUILDKITE_PLUGINS_CACHE_PATH=`+cacheDir)
+
+	if !strings.Contains(tester.Output, "to the plugin cache") {
+		t.Fatalf("Expected the plugin to be added to the cache, got: %s", tester.Output)
+	}
+
+	// Other agents can then checkout the plugin offline
+	offline, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+
+	offline.ExpectGlobalHook("command").Once().AndExitWith(0)
+	offline.RunAndCheck(t, `BUILDKITE_PLUGINS=`+json,
+		`BUILDKITE_PLUGINS_CACHE_PATH=`+cacheDir,
+		`BUILDKITE_PLUGINS_OFFLINE=true`)
+
+	// And fail clearly when the plugin isn't in the cache
+	missing, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+
+	missing.ExpectGlobalHook("command").NotCalled()
+	if err := missing.Run(t, `BUILDKITE_PLUGINS=`+json,
+		`BUILDKITE_PLUGINS_CACHE_PATH=`+emptyCacheDir,
+		`BUILDKITE_PLUGINS_OFFLINE=true`); err == nil {
+		t.Fatalf("Expected the bootstrap to fail")
+	}
+	missing.CheckMocks(t)
+
+	if !strings.Contains(missing.Output, "isn't in the plugin cache") {
+		t.Fatalf("Expected a missing plugin error, got: %s", missing.Output)
+	}
+}
+
+func TestPluginsInCacheAreUpdatedUnlessPinnedToACommit(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	})
+
+	if _, err := p.Execute("tag", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := p.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normalizedPath := strings.TrimPrefix(strings.Replace(p.Path, "\\", "/", -1), "/")
+	tagJSON := fmt.Sprintf(`[{"file:///%s#v1.0.0":{}}]`, normalizedPath)
+	commitJSON := fmt.Sprintf(`[{"file:///%s#%s":{}}]`, normalizedPath, strings.TrimSpace(commit))
+
+	cacheDir, err := ioutil.TempDir("", "plugins-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	for _, tc := range []struct {
+		Plugins string
+		Output  string
+	}{
+		{tagJSON, "to the plugin cache"},
+		{tagJSON, "Updating plugin"},
+		{commitJSON, "is already in the plugin cache"},
+	} {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tester.Close()
+
+		tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+		tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+tc.Plugins, `BUILDKITE_PLUGINS_CACHE_PATH=`+cacheDir)
+
+		if !strings.Contains(tester.Output, tc.Output) {
+			t.Fatalf("Expected %q in the output, got: %s", tc.Output, tester.Output)
+		}
+	}
+}
+
+func TestPluginsAreCheckedAgainstPolicy(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	})
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Policy string
+		Passes bool
+	}{
+		{"allowed", "allowed:\n  - location: " + p.Path + "\n", true},
+		{"other location", "allowed:\n  - location: github.com/my-org/*\n", false},
+		{"wrong version", "allowed:\n  - location: " + p.Path + "\n    versions: ['>= v1.0.0']\n", false},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			policy := filepath.Join(tester.HooksDir, "plugins-policy.yml")
+			if err := ioutil.WriteFile(policy, []byte(tc.Policy), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			env := []string{
+				`BUILDKITE_PLUGINS=` + json,
+				`BUILDKITE_PLUGINS_POLICY=` + policy,
+			}
+
+			if tc.Passes {
+				tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+				tester.RunAndCheck(t, env...)
+				return
+			}
+
+			tester.ExpectGlobalHook("command").NotCalled()
+			if err := tester.Run(t, env...); err == nil {
+				t.Fatalf("Expected the bootstrap to fail")
+			}
+			tester.CheckMocks(t)
+
+			if !strings.Contains(tester.Output, "isn't allowed on this agent") {
+				t.Fatalf("Expected a policy rejection in the output, got: %s", tester.Output)
+			}
+
+			if strings.Contains(tester.Output, "will be checked out") {
+				t.Fatalf("Expected the plugin not to be checked out, got: %s", tester.Output)
+			}
+		})
+	}
+}
+
+func TestPluginConfigurationDefaultsAreAppliedForHooks(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			`export LLAMAS_RETRIES="${LLAMAS_RETRIES:+$LLAMAS_RETRIES,}$(env | grep '^BUILDKITE_PLUGIN_.*_RETRIES=' | cut -d= -f2)"`,
+			`export LLAMAS_CONFIG="${LLAMAS_CONFIG:+$LLAMAS_CONFIG,}$(cat "$BUILDKITE_PLUGIN_CONFIGURATION_FILE")"`,
+		},
+	})
+
+	definition := []byte("name: llamas\nconfiguration:\n  properties:\n    image:\n      type: string\n    retries:\n      type: integer\n      default: 3\n  required: [image]\n")
+	if err := ioutil.WriteFile(filepath.Join(p.Path, "plugin.yml"), definition, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit("Add a plugin definition"); err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := p.RevParse("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same plugin is used twice, and each gets its own configuration
+	location := p.Path + "#" + strings.TrimSpace(commit)
+	plugins, err := json.Marshal([]map[string]interface{}{
+		{location: map[string]interface{}{"image": "golang"}},
+		{location: map[string]interface{}{"image": "alpine", "retries": 5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Defaults are applied whether or not the configuration is validated
+	for _, validation := range []string{"true", "false"} {
+		validation := validation
+		t.Run("validation "+validation, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+				if err := bintest.ExpectEnv(t, c.Env,
+					`LLAMAS_RETRIES=3,5`,
+					`LLAMAS_CONFIG={"image":"golang","retries":3},{"image":"alpine","retries":5}`,
+				); err != nil {
+					fmt.Fprintf(c.Stderr, "%v\n", err)
+					c.Exit(1)
+				}
+				c.Exit(0)
+			})
+
+			tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+string(plugins), `BUILDKITE_PLUGIN_VALIDATION=`+validation)
+		})
+	}
+}
+
+func TestArchivePluginsAreDownloaded(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	hook := []byte("#!/bin/bash\nexport LLAMAS_ROCK=absolutely\n")
+	for _, header := range []*tar.Header{
+		{Name: "llamas-v1.0.0/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "llamas-v1.0.0/hooks/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "llamas-v1.0.0/hooks/environment", Mode: 0755, Typeflag: tar.TypeReg, Size: int64(len(hook))},
+	} {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write(hook)
+		}
+	}
+	tw.Close()
+	gz.Close()
+
+	archive := buf.Bytes()
+	hash := sha256.Sum256(archive)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	location := server.URL + "/plugins/llamas-v1.0.0.tar.gz"
+
+	for _, tc := range []struct {
+		Name     string
+		Checksum string
+		Passes   bool
+	}{
+		{"matching checksum", hex.EncodeToString(hash[:]), true},
+		{"mismatched checksum", strings.Repeat("0", 64), false},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			plugins, err := json.Marshal([]string{location + "#sha256:" + tc.Checksum})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.Passes {
+				tester.ExpectGlobalHook("command").NotCalled()
+				if err := tester.Run(t, `BUILDKITE_PLUGINS=`+string(plugins)); err == nil {
+					t.Fatalf("Expected the bootstrap to fail")
+				}
+				tester.CheckMocks(t)
+				return
+			}
+
+			tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+				if err := bintest.ExpectEnv(t, c.Env, `LLAMAS_ROCK=absolutely`); err != nil {
+					fmt.Fprintf(c.Stderr, "%v\n", err)
+					c.Exit(1)
+				}
+				c.Exit(0)
+			})
+
+			tester.RunAndCheck(t, `BUILDKITE_PLUGINS=`+string(plugins))
+
+			if !strings.Contains(tester.Output, "resolved to sha256:"+tc.Checksum) {
+				t.Fatalf("Expected the verified digest in the output, got: %s", tester.Output)
+			}
+		})
+	}
+}
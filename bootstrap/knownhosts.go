@@ -2,7 +2,12 @@ package bootstrap
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +16,7 @@ import (
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -131,22 +137,445 @@ func (kh *knownHosts) Add(host string) error {
 
 // AddFromRepository takes a git repo url, extracts the host and adds it
 func (kh *knownHosts) AddFromRepository(repository string) error {
+	host, err := kh.hostFromRepository(repository)
+	if err != nil || host == "" {
+		return err
+	}
+
+	if err = kh.Add(host); err != nil {
+		return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, repository)
+	}
+
+	return nil
+}
+
+// hostFromRepository returns the ssh host for a git repo url, or an empty
+// string if the repository isn't accessed over ssh
+func (kh *knownHosts) hostFromRepository(repository string) (string, error) {
 	u, err := parseGittableURL(repository)
 	if err != nil {
 		kh.Shell.Warningf("Could not parse %q as a URL - skipping adding host to SSH known_hosts", repository)
-		return err
+		return "", err
 	}
 
 	// We only need to keyscan ssh repository urls
 	if u.Scheme != "ssh" {
+		return "", nil
+	}
+
+	return resolveGitHost(kh.Shell, u.Host), nil
+}
+
+// unknownHostError is returned when strict host key checking is enabled and
+// there are no trusted keys for a host
+type unknownHostError struct {
+	Host string
+}
+
+func (e *unknownHostError) Error() string {
+	return fmt.Sprintf("Host %q has no pinned or known host keys and strict host key checking is enabled", e.Host)
+}
+
+func isUnknownHostError(err error) bool {
+	_, ok := errors.Cause(err).(*unknownHostError)
+	return ok
+}
+
+// knownHostsEntry is a single line from a known_hosts file
+type knownHostsEntry struct {
+	// Either empty, "cert-authority" or "revoked"
+	Marker string
+	Hosts  []string
+	Key    ssh.PublicKey
+	Line   string
+}
+
+// Describe returns a human readable description of the key
+func (e knownHostsEntry) Describe() string {
+	switch e.Marker {
+	case "cert-authority":
+		return fmt.Sprintf("%s certificate authority %s", e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+	case "revoked":
+		return fmt.Sprintf("revoked %s host key %s", e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+	}
+	return fmt.Sprintf("%s host key %s", e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+// readKnownHostsEntries parses all of the entries in a known_hosts file,
+// optionally skipping any lines that can't be parsed
+func readKnownHostsEntries(path string, skipInvalid bool) ([]knownHostsEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []knownHostsEntry
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil && skipInvalid {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to parse line %q in %q: %v", line, path, err)
+		}
+
+		entries = append(entries, knownHostsEntry{Marker: marker, Hosts: hosts, Key: key, Line: line})
+	}
+
+	return entries, nil
+}
+
+// matchKnownHostsEntries returns the entries that apply to the host
+func matchKnownHostsEntries(entries []knownHostsEntry, host string) []knownHostsEntry {
+	normalized := knownhosts.Normalize(host)
+
+	var matched []knownHostsEntry
+	for _, entry := range entries {
+		if matchKnownHostsPatterns(entry.Hosts, normalized) {
+			matched = append(matched, entry)
+		}
+	}
+
+	return matched
+}
+
+// matchKnownHostsPatterns matches a host against a list of known_hosts
+// patterns, which can be hashed, contain wildcards or be negated
+func matchKnownHostsPatterns(patterns []string, host string) bool {
+	matched := false
+
+	// ssh lowercases hosts before matching or hashing them
+	host = strings.ToLower(host)
+
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if strings.HasPrefix(pattern, "|1|") {
+			ok = matchHashedHost(pattern, host)
+		} else {
+			ok = matchWildcard(strings.ToLower(pattern), host)
+		}
+
+		if ok && negated {
+			return false
+		} else if ok {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchHashedHost matches a host against a hashed entry (|1|salt|hash)
+func matchHashedHost(pattern string, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matchWildcard matches a host against a pattern where * matches any
+// number of characters and ? matches exactly one
+func matchWildcard(pattern string, host string) bool {
+	if pattern == "" {
+		return host == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(host); i++ {
+			if matchWildcard(pattern[1:], host[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return host != "" && matchWildcard(pattern[1:], host[1:])
+	}
+
+	return host != "" && pattern[0] == host[0] && matchWildcard(pattern[1:], host[1:])
+}
+
+// AddPinned copies any entries for the host from a file of pinned host keys
+// and certificate authorities, and returns the ones that are trusted (revoked
+// keys are copied, but aren't trusted). Any other keys for the host, such as
+// ones added by ssh-keyscan, are removed so that ssh only accepts the pinned
+// ones.
+func (kh *knownHosts) AddPinned(host string, pinnedPath string) ([]knownHostsEntry, error) {
+	pinned, err := readKnownHostsEntries(pinnedPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := matchKnownHostsEntries(pinned, host)
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	// Use a lockfile to prevent parallel processes stepping on each other
+	lock, err := kh.Shell.LockFile(kh.Path+".lock", time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			kh.Shell.Warningf("Failed to release known_hosts file lock: %#v", err)
+		}
+	}()
+
+	existing, err := ioutil.ReadFile(kh.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	pinnedLines := map[string]bool{}
+	for _, entry := range matched {
+		pinnedLines[entry.Line] = true
+	}
+
+	normalized := strings.ToLower(knownhosts.Normalize(host))
+
+	var lines []string
+	existingLines := map[string]bool{}
+	removed := 0
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(existing), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		existingLines[trimmed] = true
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || pinnedLines[trimmed] {
+			lines = append(lines, line)
+			continue
+		}
+
+		// Revoked keys only ever make ssh stricter, so they're kept
+		marker, hosts, _, _, _, err := ssh.ParseKnownHosts([]byte(trimmed))
+		if err != nil || marker == "revoked" || !matchKnownHostsPatterns(hosts, normalized) {
+			lines = append(lines, line)
+			continue
+		}
+
+		removed++
+		if rewritten, ok := withoutKnownHost(trimmed, marker, hosts, normalized); ok {
+			lines = append(lines, rewritten)
+		}
+	}
+
+	var missing []string
+	for _, entry := range matched {
+		if !existingLines[entry.Line] {
+			missing = append(missing, entry.Line)
+		}
+	}
+
+	trusted := trustedKnownHostsEntries(matched)
+	if len(missing) == 0 && removed == 0 {
+		return trusted, nil
+	}
+
+	if removed > 0 {
+		kh.Shell.Commentf("Removed %d host keys for %q from \"%s\" that aren't pinned", removed, host, kh.Path)
+	}
+
+	lines = append(lines, missing...)
+	output := strings.TrimLeft(strings.Join(lines, "\n"), "\n") + "\n"
+
+	if err = ioutil.WriteFile(kh.Path, []byte(output), 0600); err != nil {
+		return nil, errors.Wrapf(err, "Could not write to %q", kh.Path)
+	}
+
+	return trusted, nil
+}
+
+// withoutKnownHost returns a known_hosts line that no longer applies to the
+// host, and false if the line should be removed because it only applies to
+// the host. Lines with patterns for other hosts too have the host negated.
+func withoutKnownHost(line string, marker string, hosts []string, host string) (string, bool) {
+	other := false
+	for _, pattern := range hosts {
+		// Hashed entries are always for a single host
+		if strings.HasPrefix(pattern, "|1|") {
+			return "", false
+		}
+		if !strings.HasPrefix(pattern, "!") && strings.ToLower(pattern) != host {
+			other = true
+		}
+	}
+	if !other {
+		return "", false
+	}
+
+	fields := strings.Fields(line)
+	i := 0
+	if marker != "" {
+		i = 1
+	}
+	fields[i] = "!" + host + "," + fields[i]
+
+	return strings.Join(fields, " "), true
+}
+
+// Known returns the entries for the host that are already in known_hosts
+func (kh *knownHosts) Known(host string) ([]knownHostsEntry, error) {
+	// Entries we don't understand can't be used to match hosts anyway
+	entries, err := readKnownHostsEntries(kh.Path, true)
+	if err != nil {
+		return nil, err
+	}
+	return matchKnownHostsEntries(entries, host), nil
+}
+
+// Verify makes sure that there are trusted host keys for the host of a git
+// repo url. Pinned keys replace any others for the host, otherwise keys
+// already in known_hosts are used. In strict mode unknown hosts are an error,
+// otherwise they are optionally added with ssh-keyscan
+func (kh *knownHosts) Verify(repository string, pinnedPath string, strict bool, keyscan bool) error {
+	host, err := kh.hostFromRepository(repository)
+	if err != nil || host == "" {
+		return err
+	}
+
+	if pinnedPath != "" {
+		trusted, err := kh.AddPinned(host, pinnedPath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to add pinned host keys for %q", host)
+		}
+		if len(trusted) > 0 {
+			return kh.checkPresentedKey(host, trusted, pinnedPath, strict, keyscan)
+		}
+		kh.Shell.Commentf("No pinned host keys for %q in \"%s\"", host, pinnedPath)
+	}
+
+	if strict {
+		known, err := kh.Known(host)
+		if err != nil {
+			return err
+		}
+
+		trusted := trustedKnownHostsEntries(known)
+		if len(trusted) == 0 {
+			return &unknownHostError{Host: host}
+		}
+		return kh.checkPresentedKey(host, trusted, kh.Path, strict, keyscan)
+	}
+
+	if keyscan {
+		if err = kh.Add(host); err != nil {
+			return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, repository)
+		}
+	}
+
+	return nil
+}
+
+// checkPresentedKey finds which of the trusted entries matches a key that the
+// host presents, and logs it. The scanned keys are only used to find the entry
+// that matches, they are never trusted themselves. If keyscan is disabled or
+// the keys can't be scanned, ssh still checks them against known_hosts when
+// connecting.
+func (kh *knownHosts) checkPresentedKey(host string, trusted []knownHostsEntry, source string, strict bool, keyscan bool) error {
+	if !keyscan {
+		kh.Shell.Commentf("Trusting %d host keys for %q from \"%s\"", len(trusted), host, source)
 		return nil
 	}
 
-	host := resolveGitHost(kh.Shell, u.Host)
+	presented, err := kh.scanHostKeys(host)
+	if err != nil {
+		kh.Shell.Commentf("Trusting %d host keys for %q from \"%s\", the keys it presents couldn't be checked: %v",
+			len(trusted), host, source, err)
+		return nil
+	}
 
-	if err = kh.Add(host); err != nil {
-		return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, u)
+	for _, key := range presented {
+		for _, entry := range trusted {
+			if entry.Marker == "" && bytes.Equal(entry.Key.Marshal(), key.Marshal()) {
+				kh.Shell.Commentf("Host %q presented %s, which is trusted by \"%s\"", host, entry.Describe(), source)
+				return nil
+			}
+		}
+	}
+
+	// Certificates aren't scanned, so a certificate authority can't be
+	// matched against a key here
+	for _, entry := range trusted {
+		if entry.Marker == "cert-authority" {
+			kh.Shell.Commentf("Trusting %s for host %q from \"%s\"", entry.Describe(), host, source)
+			return nil
+		}
 	}
 
+	err = fmt.Errorf("None of the host keys presented by %q are trusted by \"%s\"", host, source)
+	if strict {
+		return err
+	}
+	kh.Shell.Warningf("%v", err)
 	return nil
 }
+
+// scanHostKeys returns the public keys that a host presents. Unlike
+// sshKeyScan, it only tries once, as failing to scan isn't fatal
+func (kh *knownHosts) scanHostKeys(host string) ([]ssh.PublicKey, error) {
+	toolsDir, err := findPathToSSHTools(kh.Shell)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{host}
+	if parts := strings.Split(host, ":"); len(parts) == 2 {
+		args = []string{"-p", parts[1], parts[0]}
+	}
+
+	output, err := kh.Shell.RunAndCapture(filepath.Join(toolsDir, "ssh-keyscan"), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("`ssh-keyscan` returned no keys")
+	}
+
+	return keys, nil
+}
+
+// trustedKnownHostsEntries returns the entries that aren't revoked
+func trustedKnownHostsEntries(entries []knownHostsEntry) []knownHostsEntry {
+	var trusted []knownHostsEntry
+	for _, entry := range entries {
+		if entry.Marker != "revoked" {
+			trusted = append(trusted, entry)
+		}
+	}
+	return trusted
+}
@@ -5,9 +5,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestAddingToKnownHosts(t *testing.T) {
@@ -85,3 +88,244 @@ usage: ssh [-1246AaCfgKkMNnqsTtVvXxYy] [-b bind_address] [-c cipher_spec]
 		})
 	}
 }
+
+const testGitHubHostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+const testOtherHostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBjDdk7kOD342fGKPgFkdTRz7rpCT8dbaQPHZmLniulh"
+
+func newTestKnownHosts(t *testing.T, pinned string) (*knownHosts, string, func()) {
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHostsPath, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pinnedPath := filepath.Join(dir, "pinned_known_hosts")
+	if err := ioutil.WriteFile(pinnedPath, []byte(pinned), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kh := &knownHosts{Shell: newTestShell(t), Path: knownHostsPath}
+	return kh, pinnedPath, func() { os.RemoveAll(dir) }
+}
+
+func TestAddingPinnedHostKeys(t *testing.T) {
+	t.Parallel()
+
+	kh, pinnedPath, cleanup := newTestKnownHosts(t, strings.Join([]string{
+		"# Pinned host keys",
+		"github.com " + testGitHubHostKey,
+		"@cert-authority *.example.com,!untrusted.example.com " + testGitHubHostKey,
+		knownhosts.HashHostname("[git.llamas.com]:2222") + " " + testGitHubHostKey,
+	}, "\n"))
+	defer cleanup()
+
+	for _, tc := range []struct {
+		Host    string
+		Trusted int
+		Entries int
+	}{
+		{"github.com", 1, 1},
+		{"gitlab.com", 0, 1},
+		{"git.example.com", 1, 2},
+		{"untrusted.example.com", 0, 2},
+		{"git.llamas.com:2222", 1, 3},
+	} {
+		trusted, err := kh.AddPinned(tc.Host, pinnedPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trusted) != tc.Trusted {
+			t.Errorf("Expected %d trusted entries for %q, got %d", tc.Trusted, tc.Host, len(trusted))
+		}
+
+		// Pinned entries are only ever added once
+		entries, err := readKnownHostsEntries(kh.Path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tc.Entries {
+			t.Errorf("Expected %d entries after adding %q, got %d", tc.Entries, tc.Host, len(entries))
+		}
+	}
+}
+
+func TestAddingPinnedHostKeysRemovesOtherKeysForTheHost(t *testing.T) {
+	t.Parallel()
+
+	kh, pinnedPath, cleanup := newTestKnownHosts(t, "github.com "+testGitHubHostKey+"\n")
+	defer cleanup()
+
+	hashed := knownhosts.HashHostname("github.com")
+
+	existing := strings.Join([]string{
+		"# Added by ssh-keyscan",
+		"github.com " + testOtherHostKey,
+		hashed + " " + testOtherHostKey,
+		"GitHub.com,140.82.112.3 " + testOtherHostKey,
+		"@cert-authority *.com " + testOtherHostKey,
+		"@revoked github.com " + testOtherHostKey,
+		"gitlab.com " + testOtherHostKey,
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(kh.Path, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := kh.AddPinned("GitHub.com", pinnedPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(kh.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries that are only for the host are removed, and other hosts'
+	// entries no longer apply to it
+	assert.Equal(t, strings.Join([]string{
+		"# Added by ssh-keyscan",
+		"!github.com,GitHub.com,140.82.112.3 " + testOtherHostKey,
+		"@cert-authority !github.com,*.com " + testOtherHostKey,
+		"@revoked github.com " + testOtherHostKey,
+		"gitlab.com " + testOtherHostKey,
+		"github.com " + testGitHubHostKey,
+	}, "\n")+"\n", string(data))
+
+	known, err := kh.Known("github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, trustedKnownHostsEntries(known), 1)
+}
+
+func TestVerifyingHostsWithStrictHostKeyChecking(t *testing.T) {
+	t.Parallel()
+
+	kh, pinnedPath, cleanup := newTestKnownHosts(t, strings.Join([]string{
+		"github.com " + testGitHubHostKey,
+		"bitbucket.org " + testGitHubHostKey,
+	}, "\n"))
+	defer cleanup()
+
+	ssh, err := bintest.NewMock("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssh.CheckAndClose(t)
+
+	keyscan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyscan.CheckAndClose(t)
+
+	kh.Shell.Env.Set("PATH", strings.Join([]string{
+		filepath.Dir(ssh.Path), filepath.Dir(keyscan.Path), os.Getenv("PATH"),
+	}, string(os.PathListSeparator)))
+
+	ssh.Expect("-G", "github.com").AndExitWith(255)
+	ssh.Expect("-G", "gitlab.com").AndExitWith(255)
+	ssh.Expect("-G", "bitbucket.org").AndExitWith(255)
+
+	// The keys are only scanned to find the pinned key that matches
+	keyscan.Expect("github.com").AndWriteToStdout("github.com " + testGitHubHostKey + "\n").AndExitWith(0)
+	keyscan.Expect("bitbucket.org").AndWriteToStdout("bitbucket.org " + testOtherHostKey + "\n").AndExitWith(0)
+
+	if err := kh.Verify("git@github.com:buildkite/agent.git", pinnedPath, true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err = kh.Verify("git@gitlab.com:buildkite/agent.git", pinnedPath, true, true)
+	if !isUnknownHostError(err) {
+		t.Fatalf("Expected an unknown host error, got %v", err)
+	}
+
+	// A host that presents a key that isn't pinned fails
+	if err := kh.Verify("git@bitbucket.org:buildkite/agent.git", pinnedPath, true, true); err == nil {
+		t.Fatal("Expected an error for a host presenting an untrusted key")
+	}
+
+	// Non-ssh repositories don't need host keys
+	if err := kh.Verify("https://github.com/buildkite/agent.git", pinnedPath, true, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyingHostsWithoutKeyscan(t *testing.T) {
+	t.Parallel()
+
+	kh, pinnedPath, cleanup := newTestKnownHosts(t, "github.com "+testGitHubHostKey+"\n")
+	defer cleanup()
+
+	ssh, err := bintest.NewMock("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssh.CheckAndClose(t)
+
+	// Any call to ssh-keyscan would fail the test
+	keyscan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyscan.CheckAndClose(t)
+
+	kh.Shell.Env.Set("PATH", strings.Join([]string{
+		filepath.Dir(ssh.Path), filepath.Dir(keyscan.Path), os.Getenv("PATH"),
+	}, string(os.PathListSeparator)))
+
+	ssh.Expect("-G", "github.com").AndExitWith(255)
+
+	if err := kh.Verify("git@github.com:buildkite/agent.git", pinnedPath, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictHostKeyCheckingForGitSSHCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Existing string
+		Expected string
+	}{
+		{"", "ssh -o StrictHostKeyChecking=yes"},
+		{"ssh -i ~/.ssh/deploy", "ssh -i ~/.ssh/deploy -o StrictHostKeyChecking=yes"},
+		{"ssh -o StrictHostKeyChecking=yes", "ssh -o StrictHostKeyChecking=yes"},
+	} {
+		if actual := strictGitSSHCommand(tc.Existing); actual != tc.Expected {
+			t.Errorf("Expected %q for %q, got %q", tc.Expected, tc.Existing, actual)
+		}
+	}
+}
+
+func TestMatchingKnownHostsPatterns(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Patterns []string
+		Host     string
+		Expected bool
+	}{
+		{[]string{"github.com"}, "github.com", true},
+		{[]string{"github.com"}, "github.co", false},
+		{[]string{"*.github.com"}, "ssh.github.com", true},
+		{[]string{"git?.example.com"}, "git1.example.com", true},
+		{[]string{"git?.example.com"}, "git.example.com", false},
+		{[]string{"*.example.com", "!bad.example.com"}, "bad.example.com", false},
+		{[]string{"[github.com]:2222"}, "[github.com]:2222", true},
+		{[]string{knownhosts.HashHostname("github.com")}, "github.com", true},
+		{[]string{knownhosts.HashHostname("github.com")}, "gitlab.com", false},
+		{[]string{"*.GitHub.com"}, "SSH.github.com", true},
+		{[]string{knownhosts.HashHostname("github.com")}, "GitHub.com", true},
+	} {
+		if actual := matchKnownHostsPatterns(tc.Patterns, tc.Host); actual != tc.Expected {
+			t.Errorf("Expected %v matching %q against %v, got %v", tc.Expected, tc.Host, tc.Patterns, actual)
+		}
+	}
+}
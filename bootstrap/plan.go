@@ -0,0 +1,308 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// planStep is a lifecycle point of the bootstrap, and what would run for it
+type planStep struct {
+	Name    string
+	Entries []planEntry
+}
+
+// planEntry is a hook, or something built in to the bootstrap, that would run
+type planEntry struct {
+	Source string
+	Detail string
+}
+
+// includePhase returns whether a phase of the bootstrap should be run
+func (b *Bootstrap) includePhase(phase string) bool {
+	if len(b.Phases) == 0 {
+		return true
+	}
+	for _, include := range b.Phases {
+		if include == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRun prints the hooks that would run for each lifecycle point in the
+// order the bootstrap would run them, without running any of them. Plugins
+// are checked out so that their hooks can be found, and local hooks and
+// vendored plugins are found in an existing checkout
+func (b *Bootstrap) dryRun() error {
+	b.shell.Env = env.FromSlice(os.Environ())
+
+	var err error
+	if b.hookTimeouts, err = ParseHookTimeouts(b.HookTimeouts); err != nil {
+		return err
+	}
+	if b.hookFailurePolicies, err = ParseHookFailurePolicies(b.HookFailurePolicies); err != nil {
+		return err
+	}
+
+	steps, err := b.plan()
+	if err != nil {
+		return err
+	}
+
+	b.shell.Headerf("Bootstrap plan")
+	b.shell.Commentf("This is a dry run, no hooks or commands have been run")
+
+	for _, step := range steps {
+		b.shell.Printf("%s", step.Name)
+
+		if len(step.Entries) == 0 {
+			b.shell.Printf("  (nothing)")
+		}
+
+		for _, entry := range step.Entries {
+			b.shell.Printf("  %-30s %s", entry.Source, entry.Detail)
+		}
+	}
+
+	return nil
+}
+
+// plan resolves the global, local, plugin and vendored plugin hooks for each
+// lifecycle point, in the order that Run would execute them
+func (b *Bootstrap) plan() ([]planStep, error) {
+	var steps []planStep
+
+	add := func(name string, entries []planEntry) {
+		steps = append(steps, planStep{Name: name, Entries: entries})
+	}
+
+	// Local hooks and vendored plugins can only be found in an existing checkout
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	hasCheckout := checkoutPath != "" && fileExists(checkoutPath)
+	if hasCheckout {
+		if err := b.shell.Chdir(checkoutPath); err != nil {
+			return nil, err
+		}
+	} else {
+		b.shell.Warningf("No existing checkout in BUILDKITE_BUILD_CHECKOUT_PATH, so local hooks and vendored plugins can't be found")
+	}
+
+	var checkouts, vendoredCheckouts []*pluginCheckout
+
+	if b.includePhase("plugin") && b.hasPlugins() {
+		if err := b.preparePlugins(); err != nil {
+			return nil, err
+		}
+
+		for _, p := range b.plugins {
+			if p.Vendored {
+				if hasCheckout {
+					vendoredCheckouts = append(vendoredCheckouts, &pluginCheckout{
+						Plugin:      p,
+						CheckoutDir: filepath.Join(checkoutPath, p.Location),
+						HooksDir:    filepath.Join(checkoutPath, p.Location, "hooks"),
+					})
+				}
+				continue
+			}
+
+			checkout, err := b.checkoutPlugin(p)
+			if err != nil {
+				return nil, err
+			}
+			checkouts = append(checkouts, checkout)
+		}
+	}
+
+	allCheckouts := append(append([]*pluginCheckout{}, checkouts...), vendoredCheckouts...)
+
+	hooks := func(name string, global bool, local bool, checkouts []*pluginCheckout) ([]planEntry, error) {
+		return b.planHooks(name, global, local && hasCheckout, checkouts)
+	}
+
+	environment, err := hooks("environment", true, false, checkouts)
+	if err != nil {
+		return nil, err
+	}
+	add("environment", environment)
+
+	if b.includePhase("checkout") {
+		preCheckout, err := hooks("pre-checkout", true, false, checkouts)
+		if err != nil {
+			return nil, err
+		}
+		add("pre-checkout", preCheckout)
+
+		// There can only be one checkout hook, either plugin or global, in that order
+		checkout, err := hooks("checkout", false, false, checkouts)
+		if err != nil {
+			return nil, err
+		}
+		if len(checkout) == 0 {
+			checkout, err = hooks("checkout", true, false, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(checkout) > 0 {
+			checkout[0].Detail += " (overrides the default checkout)"
+		} else if b.Repository != "" {
+			checkout = []planEntry{{Source: "default", Detail: fmt.Sprintf("git checkout of %s at %s", b.Repository, b.Commit)}}
+		} else {
+			checkout = []planEntry{{Source: "default", Detail: "skipped, BUILDKITE_REPO is empty"}}
+		}
+		add("checkout", checkout)
+
+		postCheckout, err := hooks("post-checkout", true, true, checkouts)
+		if err != nil {
+			return nil, err
+		}
+		add("post-checkout", postCheckout)
+	}
+
+	if b.includePhase("plugin") && len(vendoredCheckouts) > 0 {
+		vendoredEnvironment, err := hooks("environment", false, false, vendoredCheckouts)
+		if err != nil {
+			return nil, err
+		}
+		add("environment (vendored plugins)", vendoredEnvironment)
+	}
+
+	if b.includePhase("command") {
+		preCommand, err := hooks("pre-command", true, true, allCheckouts)
+		if err != nil {
+			return nil, err
+		}
+		add("pre-command", preCommand)
+
+		// There can only be one command hook, in order of plugin, local and global
+		command, err := hooks("command", false, false, allCheckouts)
+		if err != nil {
+			return nil, err
+		}
+		for _, scope := range []struct{ global, local bool }{{false, true}, {true, false}} {
+			if len(command) == 0 {
+				if command, err = hooks("command", scope.global, scope.local, nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(command) > 0 {
+			command[0].Detail += " (overrides the default command)"
+		} else if strings.TrimSpace(b.Command) != "" {
+			command = []planEntry{{Source: "default", Detail: strings.Replace(strings.TrimSpace(b.Command), "\n", "\\n", -1)}}
+		} else {
+			command = []planEntry{{Source: "default", Detail: "fails, no command has been provided"}}
+		}
+		add("command", command)
+
+		postCommand, err := hooks("post-command", true, true, allCheckouts)
+		if err != nil {
+			return nil, err
+		}
+		add("post-command", postCommand)
+
+		if b.AutomaticArtifactUploadPaths != "" {
+			preArtifact, err := hooks("pre-artifact", true, true, allCheckouts)
+			if err != nil {
+				return nil, err
+			}
+			add("pre-artifact", preArtifact)
+
+			add("artifacts", []planEntry{{Source: "default", Detail: "upload " + b.AutomaticArtifactUploadPaths}})
+
+			postArtifact, err := hooks("post-artifact", true, true, allCheckouts)
+			if err != nil {
+				return nil, err
+			}
+			add("post-artifact", postArtifact)
+		}
+	}
+
+	preExit, err := hooks("pre-exit", true, true, allCheckouts)
+	if err != nil {
+		return nil, err
+	}
+	add("pre-exit", preExit)
+
+	return steps, nil
+}
+
+// planHooks returns the global, local and plugin hooks for a lifecycle point,
+// in the order they'd be run
+func (b *Bootstrap) planHooks(name string, global bool, local bool, checkouts []*pluginCheckout) ([]planEntry, error) {
+	var entries []planEntry
+
+	addPaths := func(source string, paths []string, note string) {
+		for _, path := range paths {
+			detail := path + b.planHookSettings(name)
+			if note != "" {
+				detail += " " + note
+			}
+			entries = append(entries, planEntry{Source: source, Detail: detail})
+		}
+	}
+
+	if global {
+		paths, err := b.globalHookPaths(name)
+		if err != nil {
+			return nil, err
+		}
+		addPaths("global", paths, "")
+	}
+
+	if local {
+		paths, err := b.localHookPaths(name)
+		if err != nil {
+			return nil, err
+		}
+
+		note := ""
+		if !b.LocalHooksEnabled {
+			note = "(refused, local hooks are disabled)"
+		}
+		addPaths("local", paths, note)
+	}
+
+	for _, checkout := range checkouts {
+		paths, err := b.findHookFiles(checkout.HooksDir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		source := "plugin " + checkout.Plugin.Name()
+		if checkout.Plugin.Vendored {
+			source = "vendored plugin " + checkout.Plugin.Name()
+		}
+		addPaths(source, paths, "")
+	}
+
+	return entries, nil
+}
+
+// planHookSettings describes the timeout and failure policy of a hook
+func (b *Bootstrap) planHookSettings(name string) string {
+	var settings []string
+
+	if timeout, ok := b.hookTimeouts[name]; ok {
+		settings = append(settings, "timeout "+timeout.String())
+	}
+
+	if policy, ok := b.hookFailurePolicies[name]; ok {
+		if policy.Policy == HookFailurePolicySoftFail {
+			settings = append(settings, fmt.Sprintf("%s:%d", policy.Policy, policy.ExitStatus))
+		} else {
+			settings = append(settings, policy.Policy)
+		}
+	}
+
+	if len(settings) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(settings, ", ") + "]"
+}
@@ -0,0 +1,61 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/pkg/errors"
+)
+
+// The file in a downloaded plugin that records the digest it was verified with
+const pluginDigestFile = ".buildkite-plugin-digest"
+
+// downloadPlugin downloads an archive or OCI plugin into its checkout
+// directory, unless it's already been downloaded
+func (b *Bootstrap) downloadPlugin(checkout *pluginCheckout) error {
+	p := checkout.Plugin
+	digestFile := filepath.Join(checkout.CheckoutDir, pluginDigestFile)
+
+	if digest, err := ioutil.ReadFile(digestFile); err == nil {
+		b.shell.Commentf("Plugin %q already downloaded (%s)", p.Label(), strings.TrimSpace(string(digest)))
+		return nil
+	}
+
+	if b.PluginsOffline {
+		return fmt.Errorf("Plugin %q hasn't been downloaded and plugins are offline", p.Label())
+	}
+
+	b.shell.Commentf("Downloading plugin %q", p.Label())
+
+	// Unpack into a temporary directory first, so that a failed download
+	// never leaves a partial plugin behind
+	tmp, err := ioutil.TempDir(b.PluginsPath, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	digest, err := plugin.Fetch(p, tmp)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to download plugin %q", p.Label())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, pluginDigestFile), []byte(digest+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(checkout.CheckoutDir); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, checkout.CheckoutDir); err != nil {
+		return err
+	}
+
+	b.shell.Commentf("Plugin %q resolved to %s", p.Label(), digest)
+	return nil
+}
@@ -0,0 +1,89 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+var fullCommitRegexp = regexp.MustCompile(`\A[0-9a-f]{40}\z`)
+
+// UpdatePluginCache makes sure a shared cache directory has a mirror of the
+// plugin's repository that contains the plugin's version, and returns the path
+// to the mirror. Unless the version is a full commit SHA that's already in the
+// mirror, the mirror is updated, as branches and tags can move. The mirror is
+// locked while it's updated, so the cache can be shared between agents. In
+// offline mode nothing is fetched, and an error is returned if the plugin or
+// its version isn't already in the cache.
+func UpdatePluginCache(sh *shell.Shell, cachePath string, p *plugin.Plugin, offline bool) (string, error) {
+	repo, err := p.Repository()
+	if err != nil {
+		return "", err
+	}
+
+	// Ensure the cache directory exists, otherwise we can't create the lock
+	if err := os.MkdirAll(cachePath, 0777); err != nil {
+		return "", err
+	}
+
+	mirrorDir := filepath.Join(cachePath, dirForRepository(repo))
+
+	// Lock the mirror while we clone or update it, as other agents might be
+	// doing the same thing
+	lock, err := sh.LockFile(mirrorDir+".lock", time.Minute*5)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	version := p.Version
+	if version == "" {
+		version = "HEAD"
+	}
+
+	if !fileExists(mirrorDir) {
+		if offline {
+			return "", fmt.Errorf("Plugin %q isn't in the plugin cache %q and plugins are offline. "+
+				"Use `buildkite-agent plugin fetch` to add it to the cache", p.Label(), cachePath)
+		}
+
+		sh.Commentf("Adding plugin %q to the plugin cache", p.Label())
+
+		if err := sh.Run("git", "clone", "--mirror", "-v", "--", repo, mirrorDir); err != nil {
+			return "", err
+		}
+	} else if !offline {
+		if fullCommitRegexp.MatchString(version) && hasGitCommit(sh, mirrorDir, version) {
+			sh.Commentf("Plugin %q is already in the plugin cache at commit %s", p.Label(), version)
+			return mirrorDir, nil
+		}
+
+		sh.Commentf("Updating plugin %q in the plugin cache", p.Label())
+
+		// Make sure the mirror points at the plugin's repository
+		if err := sh.Run("git", "--git-dir", mirrorDir, "remote", "set-url", "origin", repo); err != nil {
+			return "", err
+		}
+
+		if err := sh.Run("git", "--git-dir", mirrorDir, "remote", "update", "--prune"); err != nil {
+			return "", err
+		}
+	}
+
+	// Make sure the version is actually in the mirror, so that offline
+	// checkouts fail here with a clear error rather than half way through
+	if _, err := sh.RunAndCapture("git", "--git-dir", mirrorDir, "rev-parse", "--verify", "--quiet", version+"^{commit}"); err != nil {
+		if offline {
+			return "", fmt.Errorf("Version %q of plugin %q isn't in the plugin cache %q and plugins are offline. "+
+				"Use `buildkite-agent plugin fetch` to update the cache", version, p.Label(), cachePath)
+		}
+		return "", fmt.Errorf("Version %q of plugin %q doesn't exist in %s", version, p.Label(), repo)
+	}
+
+	return mirrorDir, nil
+}
@@ -0,0 +1,59 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// The environment variable that plugin hooks can read their configuration
+// from as json, after defaults from the plugin's schema have been applied
+const pluginConfigurationFileEnv = "BUILDKITE_PLUGIN_CONFIGURATION_FILE"
+
+// writePluginConfigurationFile writes a plugin's configuration to a json file
+// that's removed when the bootstrap finishes, returning its path
+func (b *Bootstrap) writePluginConfigurationFile(checkout *pluginCheckout) (string, error) {
+	if checkout.ConfigurationFile != "" {
+		return checkout.ConfigurationFile, nil
+	}
+
+	if b.pluginConfigurationDir == "" {
+		dir, err := ioutil.TempDir("", "buildkite-plugin-configuration")
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to create a directory for plugin configuration")
+		}
+		b.pluginConfigurationDir = dir
+		b.cleanupDirs = append(b.cleanupDirs, dir)
+	}
+
+	id, err := checkout.Identifier()
+	if err != nil {
+		return "", err
+	}
+
+	configuration := checkout.Plugin.Configuration
+	if configuration == nil {
+		configuration = map[string]interface{}{}
+	}
+
+	data, err := json.Marshal(configuration)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to encode the configuration of plugin %s", checkout.Plugin.Name())
+	}
+
+	// The same plugin can be used more than once with different
+	// configuration, so each checkout gets its own file
+	f, err := ioutil.TempFile(b.pluginConfigurationDir, id+"-*.json")
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create a file for the configuration of plugin %s", checkout.Plugin.Name())
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return "", errors.Wrapf(err, "Failed to write the configuration of plugin %s", checkout.Plugin.Name())
+	}
+
+	checkout.ConfigurationFile = f.Name()
+	return f.Name(), nil
+}
@@ -52,8 +52,8 @@ type Shell struct {
 	// The context for the shell
 	ctx context.Context
 
-	// Currently running command
-	cmd     *command
+	// Currently running commands
+	cmds    map[*command]struct{}
 	cmdLock sync.Mutex
 }
 
@@ -128,23 +128,27 @@ func (s *Shell) AbsolutePath(executable string) (string, error) {
 	return filepath.Abs(absolutePath)
 }
 
-// Interrupt running command
+// Interrupt running commands
 func (s *Shell) Interrupt() {
 	s.cmdLock.Lock()
 	defer s.cmdLock.Unlock()
 
-	if s.cmd != nil && s.cmd.proc != nil {
-		s.cmd.proc.Interrupt()
+	for cmd := range s.cmds {
+		if cmd.proc != nil {
+			cmd.proc.Interrupt()
+		}
 	}
 }
 
-// Terminate running command
+// Terminate running commands
 func (s *Shell) Terminate() {
 	s.cmdLock.Lock()
 	defer s.cmdLock.Unlock()
 
-	if s.cmd != nil && s.cmd.proc != nil {
-		s.cmd.proc.Terminate()
+	for cmd := range s.cmds {
+		if cmd.proc != nil {
+			cmd.proc.Terminate()
+		}
 	}
 }
 
@@ -213,6 +217,22 @@ func (s *Shell) RunWithoutPrompt(command string, arg ...string) error {
 	})
 }
 
+// RunWithOutput runs a command like RunWithoutPrompt, but writes stdout and
+// stderr to w rather than the shell's writer, and never uses a PTY. Commands
+// run this way can be run concurrently.
+func (s *Shell) RunWithOutput(w io.Writer, command string, arg ...string) error {
+	cmd, err := s.buildCommand(command, arg...)
+	if err != nil {
+		return err
+	}
+
+	return s.executeCommand(cmd, w, executeFlags{
+		Stdout: true,
+		Stderr: true,
+		PTY:    false,
+	})
+}
+
 // RunAndCapture runs a command and captures the output for processing. Stdout is captured, but
 // stderr isn't. If the shell is in debug mode then the command will be eched and both stderr
 // and stdout will be written to the logger. A PTY is never used for RunAndCapture.
@@ -351,9 +371,18 @@ type executeFlags struct {
 
 func (s *Shell) executeCommand(cmd *command, w io.Writer, flags executeFlags) error {
 	s.cmdLock.Lock()
-	s.cmd = cmd
+	if s.cmds == nil {
+		s.cmds = map[*command]struct{}{}
+	}
+	s.cmds[cmd] = struct{}{}
 	s.cmdLock.Unlock()
 
+	defer func() {
+		s.cmdLock.Lock()
+		delete(s.cmds, cmd)
+		s.cmdLock.Unlock()
+	}()
+
 	cmdStr := process.FormatCommand(cmd.Path, cmd.Args)
 
 	if s.Debug {
@@ -397,7 +426,7 @@ func (s *Shell) executeCommand(cmd *command, w io.Writer, flags executeFlags) er
 	p := process.New(logger.Discard, cfg)
 
 	s.cmdLock.Lock()
-	s.cmd.proc = p
+	cmd.proc = p
 	s.cmdLock.Unlock()
 
 	if err := p.Run(); err != nil {
@@ -178,6 +178,37 @@ func TestInterrupt(t *testing.T) {
 	}
 }
 
+func TestInterruptConcurrentCommands(t *testing.T) {
+	if runtime.GOOS == `windows` {
+		t.Skip("Not supported in windows")
+	}
+
+	sh := newShellForTest(t)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var out bytes.Buffer
+			errs <- sh.RunWithOutput(&out, "sleep", "10")
+		}()
+	}
+
+	// interrupt both processes after they've started
+	<-time.After(time.Millisecond * 200)
+	sh.Interrupt()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("Expected an error")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for commands to be interrupted")
+		}
+	}
+}
+
 func TestDefaultWorkingDirFromSystem(t *testing.T) {
 	sh, err := shell.New()
 	if err != nil {
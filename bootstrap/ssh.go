@@ -86,3 +86,15 @@ func findPathToSSHTools(sh *shell.Shell) (string, error) {
 
 	return "", fmt.Errorf("Unable to find ssh-keyscan: %v", err)
 }
+
+// strictGitSSHCommand returns a GIT_SSH_COMMAND that makes ssh refuse hosts
+// that aren't in known_hosts, rather than adding them
+func strictGitSSHCommand(command string) string {
+	if command == "" {
+		command = "ssh"
+	}
+	if strings.Contains(command, "StrictHostKeyChecking=yes") {
+		return command
+	}
+	return command + " -o StrictHostKeyChecking=yes"
+}
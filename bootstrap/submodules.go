@@ -0,0 +1,350 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/agent/v3/process"
+)
+
+// gitSubmoduleSelector selects submodules by path, with an optional clone depth
+type gitSubmoduleSelector struct {
+	Pattern string
+	Depth   int
+}
+
+// parseGitSubmoduleSelectors parses a comma separated list of submodule paths,
+// each of which can be a glob and can have a clone depth, e.g "vendor/*:1,docs"
+func parseGitSubmoduleSelectors(value string, defaultDepth int) ([]gitSubmoduleSelector, error) {
+	selectors := []gitSubmoduleSelector{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		selector := gitSubmoduleSelector{Pattern: item, Depth: defaultDepth}
+
+		if idx := strings.LastIndex(item, ":"); idx != -1 {
+			depth, err := strconv.Atoi(item[idx+1:])
+			if err != nil || depth < 0 {
+				return nil, fmt.Errorf("Invalid depth for submodule %q, expected a positive number", item[:idx])
+			}
+			selector.Pattern = item[:idx]
+			selector.Depth = depth
+		}
+
+		if _, err := path.Match(selector.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid submodule path pattern %q: %v", selector.Pattern, err)
+		}
+
+		selectors = append(selectors, selector)
+	}
+
+	return selectors, nil
+}
+
+// parseGitSubmoduleNumber parses an optional numeric submodule setting
+func parseGitSubmoduleNumber(name string, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s %q, expected a positive number", name, value)
+	}
+
+	return n, nil
+}
+
+// selectedGitSubmodule is a submodule that will be checked out
+type selectedGitSubmodule struct {
+	gitSubmodule
+	Depth int
+}
+
+// selectGitSubmodules filters submodules by the selectors, returning them all
+// if there are no selectors. The first selector that matches wins
+func selectGitSubmodules(submodules []gitSubmodule, selectors []gitSubmoduleSelector, defaultDepth int) []selectedGitSubmodule {
+	selected := []selectedGitSubmodule{}
+
+	for _, submodule := range submodules {
+		if len(selectors) == 0 {
+			selected = append(selected, selectedGitSubmodule{submodule, defaultDepth})
+			continue
+		}
+
+		for _, selector := range selectors {
+			if matched, _ := path.Match(selector.Pattern, submodule.Path); matched {
+				selected = append(selected, selectedGitSubmodule{submodule, selector.Depth})
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// updateGitSubmodules initializes and updates the submodules selected by
+// BUILDKITE_GIT_SUBMODULE_PATHS (or all of them), using mirrors for each
+// submodule repository when the git-mirrors experiment is enabled
+func (b *Bootstrap) updateGitSubmodules() error {
+	defaultDepth, err := parseGitSubmoduleNumber("BUILDKITE_GIT_SUBMODULE_DEPTH", b.GitSubmoduleDepth)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := parseGitSubmoduleNumber("BUILDKITE_GIT_SUBMODULE_JOBS", b.GitSubmoduleJobs)
+	if err != nil {
+		return err
+	}
+
+	selectors, err := parseGitSubmoduleSelectors(b.GitSubmodulePaths, defaultDepth)
+	if err != nil {
+		return err
+	}
+
+	// Checking for submodule repositories
+	submodules, err := gitEnumerateSubmodules(b.shell)
+	if err != nil {
+		b.shell.Warningf("Failed to enumerate git submodules: %v", err)
+
+		// Without a list of submodules we can't select any of them
+		if len(selectors) > 0 {
+			return err
+		}
+	}
+
+	selected := selectGitSubmodules(submodules, selectors, defaultDepth)
+
+	if len(selectors) > 0 {
+		for _, submodule := range submodules {
+			if !isSelectedGitSubmodule(selected, submodule) {
+				b.shell.Commentf("Skipping submodule %q, it isn't in BUILDKITE_GIT_SUBMODULE_PATHS", submodule.Path)
+			}
+		}
+
+		if len(selected) == 0 {
+			b.shell.Warningf("No submodules matched BUILDKITE_GIT_SUBMODULE_PATHS %q", b.GitSubmodulePaths)
+			return nil
+		}
+	}
+
+	// submodules might need their fingerprints verified too
+	for _, submodule := range selected {
+		if err := b.addRepositoryHostToSSHKnownHosts(submodule.URL); err != nil {
+			return err
+		}
+	}
+
+	baseArgs := []string{"submodule", "update", "--init", "--recursive", "--force"}
+	if jobs > 0 {
+		baseArgs = append(baseArgs, "--jobs", strconv.Itoa(jobs))
+	}
+
+	// Mirrors are per repository, so submodules are updated in groups that
+	// share a mirror to reference
+	if experiments.IsEnabled(`git-mirrors`) && b.Config.GitMirrorsPath != "" && len(selected) > 0 {
+		return b.updateGitSubmodulesWithMirrors(baseArgs, selected, jobs)
+	}
+
+	// Without a selection, a single update covers every submodule
+	if len(selectors) == 0 {
+		args := baseArgs
+		if defaultDepth > 0 {
+			args = append(args, "--depth", strconv.Itoa(defaultDepth))
+		}
+		return b.shell.Run("git", args...)
+	}
+
+	// Otherwise update the submodules in groups of the same depth, in the
+	// order that the depth first appears
+	depths := []int{}
+	paths := map[int][]string{}
+	for _, submodule := range selected {
+		if _, ok := paths[submodule.Depth]; !ok {
+			depths = append(depths, submodule.Depth)
+		}
+		paths[submodule.Depth] = append(paths[submodule.Depth], submodule.Path)
+	}
+
+	for _, depth := range depths {
+		args := append([]string{}, baseArgs...)
+		if depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(depth))
+		}
+		args = append(args, "--")
+		args = append(args, paths[depth]...)
+
+		if err := b.shell.Run("git", args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gitSubmoduleGroup is a set of submodules that can be updated with a single
+// git submodule update, because they share a mirror and a depth
+type gitSubmoduleGroup struct {
+	Mirror string
+	Depth  int
+	Paths  []string
+}
+
+// groupGitSubmodules groups submodules by mirror and depth, in the order that
+// each group first appears. Submodules without a mirror have an empty Mirror
+func groupGitSubmodules(selected []selectedGitSubmodule, mirrors map[string]string) []*gitSubmoduleGroup {
+	groups := []*gitSubmoduleGroup{}
+	byKey := map[string]*gitSubmoduleGroup{}
+
+	for _, submodule := range selected {
+		mirror := mirrors[submodule.Path]
+		key := fmt.Sprintf("%s:%d", mirror, submodule.Depth)
+
+		group, ok := byKey[key]
+		if !ok {
+			group = &gitSubmoduleGroup{Mirror: mirror, Depth: submodule.Depth}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.Paths = append(group.Paths, submodule.Path)
+	}
+
+	return groups
+}
+
+func (b *Bootstrap) updateGitSubmodulesWithMirrors(baseArgs []string, selected []selectedGitSubmodule, jobs int) error {
+	checkoutDir := b.shell.Getwd()
+
+	// Mirrors are updated one at a time first, as updating a mirror
+	// changes directory
+	mirrors := map[string]string{}
+	for _, submodule := range selected {
+		// Relative submodule urls are resolved against the superproject's
+		// remote, so they don't have a stable mirror of their own
+		if submodule.URL == "" || strings.HasPrefix(submodule.URL, "./") || strings.HasPrefix(submodule.URL, "../") {
+			continue
+		}
+
+		commit, err := gitSubmoduleCommit(b.shell, submodule.Path)
+		if err != nil {
+			b.shell.Warningf("%v", err)
+		}
+
+		mirrorDir, err := b.updateGitMirror(submodule.URL, commit)
+
+		// Updating the mirror changes directory, so head back to the checkout
+		if chdirErr := b.shell.Chdir(checkoutDir); chdirErr != nil {
+			return chdirErr
+		}
+
+		if err != nil {
+			return err
+		}
+
+		mirrors[submodule.Path] = mirrorDir
+	}
+
+	groups := groupGitSubmodules(selected, mirrors)
+	concurrent := jobs > 1 && len(groups) > 1
+
+	// Concurrent updates would each write to .git/config to initialize
+	// their submodules and fight over its lock, so the submodules are all
+	// initialized first. Each group then updates one submodule at a time,
+	// so that there are at most as many clones as jobs.
+	if concurrent {
+		baseArgs = withoutGitSubmoduleInitAndJobs(baseArgs)
+
+		args := []string{"submodule", "init", "--"}
+		for _, group := range groups {
+			args = append(args, group.Paths...)
+		}
+		if err := b.shell.Run("git", args...); err != nil {
+			return err
+		}
+	}
+
+	commands := [][]string{}
+	for _, group := range groups {
+		args := append([]string{}, baseArgs...)
+		if group.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(group.Depth))
+		}
+		if group.Mirror != "" {
+			args = append(args, "--reference", group.Mirror)
+		}
+		args = append(args, "--")
+		args = append(args, group.Paths...)
+		commands = append(commands, args)
+	}
+
+	if !concurrent {
+		for _, args := range commands {
+			if err := b.shell.Run("git", args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Each group has a different mirror to reference, so the groups are
+	// updated concurrently, up to the number of jobs at a time. Output is
+	// buffered so that each update's output is shown together.
+	var mu sync.Mutex
+	var firstErr error
+
+	p := pool.New(jobs)
+	for _, args := range commands {
+		args := args
+		p.Spawn(func() {
+			var out bytes.Buffer
+			err := b.shell.RunWithOutput(&out, "git", args...)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			b.shell.Promptf("%s", process.FormatCommand("git", args))
+			_, _ = b.shell.Writer.Write(out.Bytes())
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		})
+	}
+	p.Wait()
+
+	return firstErr
+}
+
+// withoutGitSubmoduleInitAndJobs removes --init and --jobs from the arguments
+// of a git submodule update
+func withoutGitSubmoduleInitAndJobs(args []string) []string {
+	result := []string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--init":
+		case "--jobs":
+			i++
+		default:
+			result = append(result, args[i])
+		}
+	}
+	return result
+}
+
+func isSelectedGitSubmodule(selected []selectedGitSubmodule, submodule gitSubmodule) bool {
+	for _, s := range selected {
+		if s.Name == submodule.Name {
+			return true
+		}
+	}
+	return false
+}
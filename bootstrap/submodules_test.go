@@ -0,0 +1,95 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingGitSubmoduleSelectors(t *testing.T) {
+	t.Parallel()
+
+	selectors, err := parseGitSubmoduleSelectors("vendor/*:1, docs,,tools/llamas:0", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []gitSubmoduleSelector{
+		{Pattern: "vendor/*", Depth: 1},
+		{Pattern: "docs", Depth: 5},
+		{Pattern: "tools/llamas", Depth: 0},
+	}, selectors)
+
+	selectors, err = parseGitSubmoduleSelectors("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, selectors)
+
+	for _, invalid := range []string{"docs:deep", "docs:-1", "vendor/[:1"} {
+		if _, err := parseGitSubmoduleSelectors(invalid, 0); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSelectingGitSubmodules(t *testing.T) {
+	t.Parallel()
+
+	submodules := []gitSubmodule{
+		{Name: "docs", Path: "docs", URL: "git@github.com:buildkite/docs.git"},
+		{Name: "llamas", Path: "vendor/llamas", URL: "git@github.com:buildkite/llamas.git"},
+		{Name: "alpacas", Path: "vendor/alpacas", URL: "git@github.com:buildkite/alpacas.git"},
+	}
+
+	// Everything is selected without selectors
+	selected := selectGitSubmodules(submodules, nil, 3)
+	assert.Len(t, selected, 3)
+	for _, s := range selected {
+		assert.Equal(t, 3, s.Depth)
+	}
+
+	// The first matching selector wins
+	selected = selectGitSubmodules(submodules, []gitSubmoduleSelector{
+		{Pattern: "vendor/llamas", Depth: 0},
+		{Pattern: "vendor/*", Depth: 1},
+	}, 3)
+
+	assert.Equal(t, []selectedGitSubmodule{
+		{submodules[1], 0},
+		{submodules[2], 1},
+	}, selected)
+	assert.False(t, isSelectedGitSubmodule(selected, submodules[0]))
+}
+
+func TestGroupingGitSubmodulesByMirror(t *testing.T) {
+	t.Parallel()
+
+	selected := []selectedGitSubmodule{
+		{gitSubmodule{Name: "docs", Path: "docs", URL: "../docs.git"}, 1},
+		{gitSubmodule{Name: "llamas", Path: "vendor/llamas", URL: "git@github.com:buildkite/llamas.git"}, 1},
+		{gitSubmodule{Name: "tools", Path: "tools", URL: "../tools.git"}, 1},
+		{gitSubmodule{Name: "llamas-v2", Path: "vendor/llamas-v2", URL: "git@github.com:buildkite/llamas.git"}, 1},
+		{gitSubmodule{Name: "alpacas", Path: "vendor/alpacas", URL: "git@github.com:buildkite/alpacas.git"}, 0},
+	}
+
+	mirrors := map[string]string{
+		"vendor/llamas":    "/mirrors/llamas",
+		"vendor/llamas-v2": "/mirrors/llamas",
+		"vendor/alpacas":   "/mirrors/alpacas",
+	}
+
+	assert.Equal(t, []*gitSubmoduleGroup{
+		{Mirror: "", Depth: 1, Paths: []string{"docs", "tools"}},
+		{Mirror: "/mirrors/llamas", Depth: 1, Paths: []string{"vendor/llamas", "vendor/llamas-v2"}},
+		{Mirror: "/mirrors/alpacas", Depth: 0, Paths: []string{"vendor/alpacas"}},
+	}, groupGitSubmodules(selected, mirrors))
+}
+
+func TestRemovingGitSubmoduleInitAndJobs(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t,
+		[]string{"submodule", "update", "--recursive", "--force", "--depth", "1"},
+		withoutGitSubmoduleInitAndJobs([]string{"submodule", "update", "--init", "--recursive", "--force", "--jobs", "4", "--depth", "1"}))
+}
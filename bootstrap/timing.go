@@ -0,0 +1,96 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	timingKindPhase    = "phase"
+	timingKindHook     = "hook"
+	timingKindPlugin   = "plugin"
+	timingKindCommand  = "command"
+	timingKindArtifact = "artifacts"
+)
+
+// timing is how long a phase, hook or step of the job took
+type timing struct {
+	Kind     string        `json:"kind"`
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"seconds"`
+}
+
+// timingReport is the timings of a job in the order they finished
+type timingReport []timing
+
+// recordTiming records how long something took since start
+func (b *Bootstrap) recordTiming(kind string, name string, start time.Time) {
+	d := time.Since(start)
+	b.timings = append(b.timings, timing{
+		Kind:     kind,
+		Name:     name,
+		Duration: d,
+		Seconds:  d.Seconds(),
+	})
+}
+
+// timePhase runs a phase of the bootstrap and records how long it took
+func (b *Bootstrap) timePhase(name string, f func() error) error {
+	defer b.recordTiming(timingKindPhase, name, time.Now())
+	return f()
+}
+
+// Markdown renders the report as a table for an annotation
+func (r timingReport) Markdown(title string) string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "**%s**\n\n", title)
+	fmt.Fprintf(&buf, "| Kind | Name | Duration |\n")
+	fmt.Fprintf(&buf, "| --- | --- | ---: |\n")
+
+	for _, t := range r {
+		fmt.Fprintf(&buf, "| %s | %s | %s |\n", t.Kind, t.Name, t.Duration.Round(10*time.Millisecond))
+	}
+
+	return buf.String()
+}
+
+// publishTimingReport uploads the timings of the job as an annotation and as
+// job meta-data. Failures are only warnings, as the report is informational
+func (b *Bootstrap) publishTimingReport() {
+	if !b.TimingReport || len(b.timings) == 0 {
+		return
+	}
+
+	b.shell.Headerf("Publishing timing report")
+
+	title := "Timing for job " + b.JobID
+	if label, _ := b.shell.Env.Get("BUILDKITE_LABEL"); label != "" {
+		title = "Timing for " + label
+	}
+
+	report := timingReport(b.timings)
+
+	err := b.shell.RunWithoutPrompt("buildkite-agent", "annotate",
+		"--context", "timing-report-"+b.JobID,
+		"--style", "info",
+		report.Markdown(title))
+	if err != nil {
+		b.shell.Warningf("Failed to annotate the build with the timing report: %v", err)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		b.shell.Warningf("Failed to encode the timing report: %v", err)
+		return
+	}
+
+	err = b.shell.RunWithoutPrompt("buildkite-agent", "meta-data", "set",
+		"timing-report:"+b.JobID, string(data))
+	if err != nil {
+		b.shell.Warningf("Failed to set the timing report meta-data: %v", err)
+	}
+}
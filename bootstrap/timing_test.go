@@ -0,0 +1,23 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimingReportMarkdown(t *testing.T) {
+	t.Parallel()
+
+	report := timingReport{
+		{Kind: timingKindPlugin, Name: "docker-compose#v3.0.0", Duration: 1234 * time.Millisecond},
+		{Kind: timingKindHook, Name: "global pre-command", Duration: 51 * time.Millisecond},
+	}
+
+	assert.Equal(t, "**Timing for :llama:**\n\n"+
+		"| Kind | Name | Duration |\n"+
+		"| --- | --- | ---: |\n"+
+		"| plugin | docker-compose#v3.0.0 | 1.23s |\n"+
+		"| hook | global pre-command | 50ms |\n", report.Markdown("Timing for :llama:"))
+}
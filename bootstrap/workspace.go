@@ -0,0 +1,238 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/nightlyone/lockfile"
+)
+
+const (
+	// Each agent reuses a checkout directory per pipeline (the default)
+	WorkspacePolicyReuse = "reuse"
+
+	// Each job gets a fresh checkout directory that is removed afterwards. The
+	// directory is created with ioutil.TempDir, overlay filesystems aren't
+	// set up by the agent.
+	WorkspacePolicyEphemeral = "ephemeral"
+
+	// Jobs share a fixed pool of checkout directories per pipeline
+	WorkspacePolicyPool = "pool"
+)
+
+// The directory in the build path that pooled workspaces live in. Agent names
+// never map to a directory starting with an underscore, so it can't collide.
+const workspacePoolDir = "_pool"
+
+// How long to wait between attempts to acquire a pooled workspace
+var workspacePoolRetryDuration = time.Second
+
+// ValidateWorkspacePolicy returns an error if the policy isn't one we know about
+func ValidateWorkspacePolicy(policy string) error {
+	switch policy {
+	case "", WorkspacePolicyReuse, WorkspacePolicyEphemeral, WorkspacePolicyPool:
+		return nil
+	}
+	return fmt.Errorf("Unknown workspace policy %q, expected %q, %q or %q",
+		policy, WorkspacePolicyReuse, WorkspacePolicyEphemeral, WorkspacePolicyPool)
+}
+
+// setUpWorkspace decides where the job will be checked out based on the
+// workspace policy, and returns the directory to use
+func (b *Bootstrap) setUpWorkspace() (string, error) {
+	if b.BuildPath == "" {
+		return "", fmt.Errorf("Must set either a BUILDKITE_BUILD_PATH or a BUILDKITE_BUILD_CHECKOUT_PATH")
+	}
+
+	dir, err := b.allocateWorkspace()
+	if err != nil {
+		return "", err
+	}
+
+	// Mark the workspace as used before looking for stale ones
+	touchWorkspace(b.shell, dir)
+
+	if b.WorkspaceMaxAgeDays > 0 {
+		removeStaleWorkspaces(b.shell, b.BuildPath, dir, time.Duration(b.WorkspaceMaxAgeDays)*24*time.Hour)
+	}
+
+	return dir, nil
+}
+
+func (b *Bootstrap) allocateWorkspace() (string, error) {
+	switch b.WorkspacePolicy {
+	case "", WorkspacePolicyReuse:
+		dir := filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug)
+		if err := b.lockReusedWorkspace(dir); err != nil {
+			return "", err
+		}
+		return dir, nil
+
+	case WorkspacePolicyEphemeral:
+		tmpPath := b.WorkspaceTmpPath
+		if tmpPath == "" {
+			tmpPath = os.TempDir()
+		}
+
+		if err := os.MkdirAll(tmpPath, 0777); err != nil {
+			return "", err
+		}
+
+		dir, err := ioutil.TempDir(tmpPath, "buildkite-job-"+b.JobID)
+		if err != nil {
+			return "", err
+		}
+
+		b.shell.Commentf("Using ephemeral workspace %s", dir)
+
+		// Track the directory so we can remove it at the end of the bootstrap
+		b.cleanupDirs = append(b.cleanupDirs, dir)
+		return dir, nil
+
+	case WorkspacePolicyPool:
+		return b.acquirePooledWorkspace()
+	}
+
+	return "", ValidateWorkspacePolicy(b.WorkspacePolicy)
+}
+
+// acquirePooledWorkspace locks the first free checkout directory in the
+// pipeline's pool, waiting for one to be released if they are all in use
+func (b *Bootstrap) acquirePooledWorkspace() (string, error) {
+	size := b.WorkspacePoolSize
+	if size < 1 {
+		size = 1
+	}
+
+	poolDir := filepath.Join(b.BuildPath, workspacePoolDir, b.OrganizationSlug)
+	if err := os.MkdirAll(poolDir, 0777); err != nil {
+		return "", err
+	}
+
+	for attempt := 0; ; attempt++ {
+		for i := 0; i < size; i++ {
+			dir := filepath.Join(poolDir, fmt.Sprintf("%s-%d", b.PipelineSlug, i))
+
+			lock, err := tryLockWorkspace(dir)
+			if err != nil {
+				continue
+			}
+
+			b.shell.Commentf("Acquired pooled workspace %s", dir)
+			b.workspaceLock = lock
+			return dir, nil
+		}
+
+		if attempt == 0 {
+			b.shell.Commentf("All %d pooled workspaces are in use, waiting for one to become free", size)
+		}
+
+		select {
+		case <-b.cancelCh:
+			return "", fmt.Errorf("Cancelled while waiting for a pooled workspace")
+		case <-time.After(workspacePoolRetryDuration):
+		}
+	}
+}
+
+// lockReusedWorkspace locks a reused checkout directory for the length of the
+// job, so that it isn't removed as stale by another agent while it's in use
+func (b *Bootstrap) lockReusedWorkspace(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		lock, err := tryLockWorkspace(dir)
+		if err == nil {
+			b.workspaceLock = lock
+			return nil
+		}
+
+		if attempt == 0 {
+			b.shell.Commentf("Workspace %s is locked, waiting for it to become free", dir)
+		}
+
+		select {
+		case <-b.cancelCh:
+			return fmt.Errorf("Cancelled while waiting for workspace %s", dir)
+		case <-time.After(workspacePoolRetryDuration):
+		}
+	}
+}
+
+// tryLockWorkspace attempts to lock a workspace directory without blocking
+func tryLockWorkspace(dir string) (*lockfile.Lockfile, error) {
+	path, err := filepath.Abs(dir + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockfile.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lock.TryLock(); err != nil {
+		return nil, err
+	}
+
+	return &lock, nil
+}
+
+// touchWorkspace updates the modification time of an existing workspace so
+// that it isn't considered stale
+func touchWorkspace(sh *shell.Shell, dir string) {
+	if !fileExists(dir) {
+		return
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		sh.Warningf("Failed to update modification time of %s: %v", dir, err)
+	}
+}
+
+// removeStaleWorkspaces removes checkout directories in the build path that
+// haven't been used for longer than maxAge, other than the current one.
+// Checkouts are always three levels deep, either agent/org/pipeline or
+// _pool/org/pipeline-n
+func removeStaleWorkspaces(sh *shell.Shell, buildPath string, current string, maxAge time.Duration) {
+	dirs, err := filepath.Glob(filepath.Join(buildPath, "*", "*", "*"))
+	if err != nil {
+		sh.Warningf("Failed to find stale workspaces: %v", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if dir == current {
+			continue
+		}
+		removeStaleWorkspace(sh, dir, maxAge)
+	}
+}
+
+func removeStaleWorkspace(sh *shell.Shell, dir string, maxAge time.Duration) {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+		return
+	}
+
+	// Workspaces are locked by the jobs using them, so skip any that are
+	// in use by another agent
+	lock, err := tryLockWorkspace(dir)
+	if err != nil {
+		sh.Commentf("Skipping stale workspace %s, it's in use", dir)
+		return
+	}
+	defer lock.Unlock()
+
+	sh.Commentf("Removing workspace %s, it hasn't been used since %s", dir, info.ModTime().Format(time.RFC3339))
+	if err := os.RemoveAll(dir); err != nil {
+		sh.Warningf("Failed to remove stale workspace %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,187 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newWorkspaceTestBootstrap(t *testing.T, conf Config) (*Bootstrap, func()) {
+	buildPath, err := ioutil.TempDir("", "workspace-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.BuildPath = buildPath
+	conf.AgentName = "My Agent"
+	conf.OrganizationSlug = "my-org"
+	conf.PipelineSlug = "my-pipeline"
+	conf.JobID = "1111"
+
+	b := New(conf)
+	b.shell = newTestShell(t)
+
+	return b, func() { os.RemoveAll(buildPath) }
+}
+
+func TestWorkspaceReusePolicy(t *testing.T) {
+	t.Parallel()
+
+	b, cleanup := newWorkspaceTestBootstrap(t, Config{})
+	defer cleanup()
+
+	dir, err := b.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(b.BuildPath, "My-Agent", "my-org", "my-pipeline"), dir)
+	assert.NotNil(t, b.workspaceLock)
+	assert.NoError(t, b.workspaceLock.Unlock())
+}
+
+func TestWorkspaceEphemeralPolicy(t *testing.T) {
+	t.Parallel()
+
+	b, cleanup := newWorkspaceTestBootstrap(t, Config{WorkspacePolicy: WorkspacePolicyEphemeral})
+	defer cleanup()
+
+	b.WorkspaceTmpPath = filepath.Join(b.BuildPath, "tmp")
+
+	dir, err := b.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, b.WorkspaceTmpPath, filepath.Dir(dir))
+	assert.True(t, fileExists(dir))
+	assert.Equal(t, []string{dir}, b.cleanupDirs)
+}
+
+func TestTearDownCleansUpWorkspaceWhenPreExitHookFails(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The pre-exit hook is a shell script")
+	}
+
+	b, cleanup := newWorkspaceTestBootstrap(t, Config{WorkspacePolicy: WorkspacePolicyEphemeral})
+	defer cleanup()
+
+	b.WorkspaceTmpPath = filepath.Join(b.BuildPath, "tmp")
+	b.HooksPath = filepath.Join(b.BuildPath, "hooks")
+
+	if err := os.MkdirAll(b.HooksPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(b.HooksPath, "pre-exit"), []byte("#!/bin/sh\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := b.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock is also held, like with the reuse and pool policies
+	lock, err := tryLockWorkspace(filepath.Join(b.BuildPath, "locked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.workspaceLock = lock
+
+	assert.Error(t, b.tearDown())
+	assert.False(t, fileExists(dir))
+	assert.False(t, fileExists(filepath.Join(b.BuildPath, "locked.lock")))
+}
+
+func TestWorkspacePoolPolicyAllocatesFreeSlots(t *testing.T) {
+	t.Parallel()
+
+	b1, cleanup := newWorkspaceTestBootstrap(t, Config{WorkspacePolicy: WorkspacePolicyPool, WorkspacePoolSize: 2})
+	defer cleanup()
+
+	dir1, err := b1.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(b1.BuildPath, "_pool", "my-org", "my-pipeline-0"), dir1)
+
+	// Pretend another running process holds the first slot
+	if err := b1.workspaceLock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir1+".lock", []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b2 := New(b1.Config)
+	b2.shell = newTestShell(t)
+
+	dir2, err := b2.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.workspaceLock.Unlock()
+
+	assert.Equal(t, filepath.Join(b1.BuildPath, "_pool", "my-org", "my-pipeline-1"), dir2)
+}
+
+func TestRemovingStaleWorkspaces(t *testing.T) {
+	t.Parallel()
+
+	b, cleanup := newWorkspaceTestBootstrap(t, Config{WorkspaceMaxAgeDays: 7})
+	defer cleanup()
+
+	current := filepath.Join(b.BuildPath, "My-Agent", "my-org", "my-pipeline")
+	stale := filepath.Join(b.BuildPath, "Other-Agent", "my-org", "old-pipeline")
+	locked := filepath.Join(b.BuildPath, "Other-Agent", "my-org", "busy-pipeline")
+	fresh := filepath.Join(b.BuildPath, "Other-Agent", "my-org", "new-pipeline")
+
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	for _, dir := range []string{current, stale, locked, fresh} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{current, stale, locked} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pretend another running process is using a workspace that hasn't
+	// changed in a while
+	if err := ioutil.WriteFile(locked+".lock", []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := b.setUpWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.workspaceLock.Unlock()
+
+	assert.Equal(t, current, dir)
+	assert.True(t, fileExists(current))
+	assert.True(t, fileExists(fresh))
+	assert.True(t, fileExists(locked))
+	assert.False(t, fileExists(stale))
+	assert.False(t, fileExists(stale+".lock"))
+}
+
+func TestValidateWorkspacePolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []string{"", "reuse", "ephemeral", "pool"} {
+		assert.NoError(t, ValidateWorkspacePolicy(policy))
+	}
+	assert.Error(t, ValidateWorkspacePolicy("overlay"))
+}
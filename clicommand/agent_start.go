@@ -11,7 +11,9 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
@@ -54,8 +56,18 @@ type AgentStartConfig struct {
 	BootstrapScript            string   `cli:"bootstrap-script" normalize:"commandpath"`
 	CancelGracePeriod          int      `cli:"cancel-grace-period"`
 	BuildPath                  string   `cli:"build-path" normalize:"filepath" validate:"required"`
+	WorkspacePolicy            string   `cli:"workspace-policy"`
+	WorkspaceTmpPath           string   `cli:"workspace-tmp-path" normalize:"filepath"`
+	WorkspacePoolSize          int      `cli:"workspace-pool-size"`
+	WorkspaceMaxAgeDays        int      `cli:"workspace-max-age-days"`
 	HooksPath                  string   `cli:"hooks-path" normalize:"filepath"`
+	HookTimeouts               []string `cli:"hook-timeouts" normalize:"list"`
+	HookFailurePolicies        []string `cli:"hook-failure-policies" normalize:"list"`
 	PluginsPath                string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsLockfile            string   `cli:"plugins-lockfile" normalize:"filepath"`
+	PluginsPolicy              string   `cli:"plugins-policy" normalize:"filepath"`
+	PluginsCachePath           string   `cli:"plugins-cache-path" normalize:"filepath"`
+	PluginsOffline             bool     `cli:"plugins-offline"`
 	Shell                      string   `cli:"shell"`
 	Tags                       []string `cli:"tags" normalize:"list"`
 	TagsFromEC2MetaData        bool     `cli:"tags-from-ec2-meta-data"`
@@ -73,14 +85,19 @@ type AgentStartConfig struct {
 	GitFetchFlags              string   `cli:"git-fetch-flags"`
 	GitMirrorsPath             string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout      int      `cli:"git-mirrors-lock-timeout"`
+	GitPullRequestMerge        string   `cli:"git-pull-request-merge"`
+	GitCredentialsPath         string   `cli:"git-credentials-path" normalize:"filepath"`
 	NoGitSubmodules            bool     `cli:"no-git-submodules"`
 	NoSSHKeyscan               bool     `cli:"no-ssh-keyscan"`
+	SSHKnownHostsPath          string   `cli:"ssh-known-hosts-path" normalize:"filepath"`
+	SSHStrictHostKeyChecking   bool     `cli:"ssh-strict-host-key-checking"`
 	NoCommandEval              bool     `cli:"no-command-eval"`
 	NoLocalHooks               bool     `cli:"no-local-hooks"`
 	NoPlugins                  bool     `cli:"no-plugins"`
 	NoPluginValidation         bool     `cli:"no-plugin-validation"`
 	NoPTY                      bool     `cli:"no-pty"`
 	TimestampLines             bool     `cli:"timestamp-lines"`
+	TimingReport               bool     `cli:"timing-report"`
 	HealthCheckAddr            string   `cli:"health-check-addr"`
 	MetricsDatadog             bool     `cli:"metrics-datadog"`
 	MetricsDatadogHost         string   `cli:"metrics-datadog-host"`
@@ -296,6 +313,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Seconds to lock a git mirror during clone, should exceed your longest checkout",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
 		},
+		cli.StringFlag{
+			Name:   "git-pull-request-merge",
+			Value:  "",
+			Usage:  "Build pull requests merged with their base branch, either \"local\" to merge in the checkout or \"ref\" to use the provider's merge ref",
+			EnvVar: "BUILDKITE_GIT_PULL_REQUEST_MERGE",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "",
@@ -308,23 +331,85 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Path to where the builds will run from",
 			EnvVar: "BUILDKITE_BUILD_PATH",
 		},
+		cli.StringFlag{
+			Name:   "workspace-policy",
+			Value:  "reuse",
+			Usage:  "How checkout directories are allocated, either \"reuse\" (one per agent and pipeline), \"ephemeral\" (a new one per job) or \"pool\" (shared between agents with locking)",
+			EnvVar: "BUILDKITE_WORKSPACE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "workspace-tmp-path",
+			Value:  "",
+			Usage:  "Path to create ephemeral workspaces in, e.g. a tmpfs mount. They are plain directories, the agent doesn't set up overlay filesystems. Defaults to the system temp dir",
+			EnvVar: "BUILDKITE_WORKSPACE_TMP_PATH",
+		},
+		cli.IntFlag{
+			Name:   "workspace-pool-size",
+			Value:  1,
+			Usage:  "The number of pooled checkout directories per pipeline when using the \"pool\" workspace policy",
+			EnvVar: "BUILDKITE_WORKSPACE_POOL_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "workspace-max-age-days",
+			Value:  0,
+			Usage:  "Remove checkout directories in the build path that haven't been used for this many days, 0 to keep them forever",
+			EnvVar: "BUILDKITE_WORKSPACE_MAX_AGE_DAYS",
+		},
 		cli.StringFlag{
 			Name:   "hooks-path",
 			Value:  "",
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.StringSliceFlag{
+			Name:   "hook-timeouts",
+			Usage:  "Timeouts for hooks, e.g. pre-exit=30s,environment=2m",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-failure-policies",
+			Usage:  "What happens when hooks fail, either fail, warn or soft-fail:<exit status>, e.g. pre-exit=warn",
+			EnvVar: "BUILDKITE_HOOK_FAILURE_POLICIES",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
 			Usage:  "Directory where the plugins are saved to",
 			EnvVar: "BUILDKITE_PLUGINS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "plugins-lockfile",
+			Value:  "",
+			Usage:  "Path to a file pinning plugins to the full commit SHAs they must resolve to, plugins that aren't listed are refused",
+			EnvVar: "BUILDKITE_PLUGINS_LOCKFILE",
+		},
+		cli.StringFlag{
+			Name:   "plugins-policy",
+			Value:  "",
+			Usage:  "Path to a file listing the plugin locations and versions that are allowed, other plugins are refused",
+			EnvVar: "BUILDKITE_PLUGINS_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "plugins-cache-path",
+			Value:  "",
+			Usage:  "Path to a plugin cache that can be shared between agents, plugins are cloned from mirrors in the cache",
+			EnvVar: "BUILDKITE_PLUGINS_CACHE_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "plugins-offline",
+			Usage:  "Only checkout plugins from the plugin cache, without fetching them from their repositories",
+			EnvVar: "BUILDKITE_PLUGINS_OFFLINE",
+		},
 		cli.BoolFlag{
 			Name:   "timestamp-lines",
 			Usage:  "Prepend timestamps on each line of output.",
 			EnvVar: "BUILDKITE_TIMESTAMP_LINES",
 		},
+		cli.BoolFlag{
+			Name:   "timing-report",
+			Usage:  "Publish how long each phase, hook and plugin took as an annotation and job meta-data",
+			EnvVar: "BUILDKITE_TIMING_REPORT",
+		},
 		cli.StringFlag{
 			Name:   "health-check-addr",
 			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, disabled by default",
@@ -335,11 +420,28 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Do not run jobs within a pseudo terminal",
 			EnvVar: "BUILDKITE_NO_PTY",
 		},
+		cli.StringFlag{
+			Name:   "git-credentials-path",
+			Value:  "",
+			Usage:  "Path to a file mapping repository urls to HTTPS tokens, supplied to git with the git-credential helper",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PATH",
+		},
 		cli.BoolFlag{
 			Name:   "no-ssh-keyscan",
 			Usage:  "Don't automatically run ssh-keyscan before checkout",
 			EnvVar: "BUILDKITE_NO_SSH_KEYSCAN",
 		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-path",
+			Value:  "",
+			Usage:  "Path to a known_hosts file of pinned host keys and @cert-authority entries, which replace any other keys for their hosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-strict-host-key-checking",
+			Usage:  "Fail checkouts and plugins from ssh hosts without pinned or already known host keys, rather than running ssh-keyscan",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING",
+		},
 		cli.BoolFlag{
 			Name:   "no-command-eval",
 			Usage:  "Don't allow this agent to run arbitrary console commands, including plugins",
@@ -497,6 +599,35 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		if err := bootstrap.ValidateWorkspacePolicy(cfg.WorkspacePolicy); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := bootstrap.ParseHookTimeouts(cfg.HookTimeouts); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := bootstrap.ParseHookFailurePolicies(cfg.HookFailurePolicies); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if cfg.PluginsPolicy != "" {
+			if _, err := plugin.LoadPolicy(cfg.PluginsPolicy); err != nil {
+				l.Fatal("Failed to load the plugin policy %s: %v", cfg.PluginsPolicy, err)
+			}
+		}
+
+		if cfg.PluginsOffline && cfg.PluginsCachePath == "" {
+			l.Fatal("Plugins can only be offline when a `--plugins-cache-path` is set")
+		}
+
+		switch cfg.GitPullRequestMerge {
+		case "", "local", "ref":
+			// Valid mode
+		default:
+			l.Fatal("Invalid git-pull-request-merge %q, expected \"local\" or \"ref\"", cfg.GitPullRequestMerge)
+		}
+
 		// Force some settings if on Windows (these aren't supported yet)
 		if runtime.GOOS == "windows" {
 			cfg.NoPTY = true
@@ -565,22 +696,37 @@ var AgentStartCommand = cli.Command{
 		agentConf := agent.AgentConfiguration{
 			BootstrapScript:            cfg.BootstrapScript,
 			BuildPath:                  cfg.BuildPath,
+			WorkspacePolicy:            cfg.WorkspacePolicy,
+			WorkspaceTmpPath:           cfg.WorkspaceTmpPath,
+			WorkspacePoolSize:          cfg.WorkspacePoolSize,
+			WorkspaceMaxAgeDays:        cfg.WorkspaceMaxAgeDays,
 			GitMirrorsPath:             cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
 			HooksPath:                  cfg.HooksPath,
+			HookTimeouts:               cfg.HookTimeouts,
+			HookFailurePolicies:        cfg.HookFailurePolicies,
 			PluginsPath:                cfg.PluginsPath,
+			PluginsLockfile:            cfg.PluginsLockfile,
+			PluginsPolicy:              cfg.PluginsPolicy,
+			PluginsCachePath:           cfg.PluginsCachePath,
+			PluginsOffline:             cfg.PluginsOffline,
 			GitCloneFlags:              cfg.GitCloneFlags,
 			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
 			GitCleanFlags:              cfg.GitCleanFlags,
 			GitFetchFlags:              cfg.GitFetchFlags,
+			GitPullRequestMerge:        cfg.GitPullRequestMerge,
+			GitCredentialsPath:         cfg.GitCredentialsPath,
 			GitSubmodules:              !cfg.NoGitSubmodules,
 			SSHKeyscan:                 !cfg.NoSSHKeyscan,
+			SSHKnownHostsPath:          cfg.SSHKnownHostsPath,
+			SSHStrictHostKeyChecking:   cfg.SSHStrictHostKeyChecking,
 			CommandEval:                !cfg.NoCommandEval,
 			PluginsEnabled:             !cfg.NoPlugins,
 			PluginValidation:           !cfg.NoPluginValidation,
 			LocalHooksEnabled:          !cfg.NoLocalHooks,
 			RunInPty:                   !cfg.NoPTY,
 			TimestampLines:             cfg.TimestampLines,
+			TimingReport:               cfg.TimingReport,
 			DisconnectAfterJob:         cfg.DisconnectAfterJob,
 			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
 			CancelGracePeriod:          cfg.CancelGracePeriod,
@@ -629,6 +775,10 @@ var AgentStartCommand = cli.Command{
 			l.Info("Automatic ssh-keyscan has been disabled")
 		}
 
+		if agentConf.SSHStrictHostKeyChecking {
+			l.Info("Strict ssh host key checking has been enabled")
+		}
+
 		if !agentConf.CommandEval {
 			l.Info("Evaluating console commands has been disabled")
 		}
@@ -1,14 +1,18 @@
 package clicommand
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/buildkite/agent/v3/stdin"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
@@ -16,6 +20,7 @@ import (
 var AnnotateHelpDescription = `Usage:
 
    buildkite-agent annotate [<body>] [arguments...]
+   buildkite-agent annotate remove [arguments...]
 
 Description:
 
@@ -30,8 +35,16 @@ Description:
    Annotations are written in CommonMark-compliant Markdown, with "GitHub
    Flavored Markdown" extensions.
 
-   The annotation body can be supplied as a command line argument, or by piping
-   content into the command.
+   The annotation body can be supplied as a command line argument, read from a
+   file with --file, or by piping content into the command.
+
+   Annotation bodies can be at most 1MiB. Larger bodies are truncated, and the
+   full body is uploaded as an artifact and linked to from the end of the
+   annotation. A warning is shown if the body has Markdown that won't render
+   as expected, such as a code block that's never closed.
+
+   Annotations are shown in order of --priority, from 10 down to 1, and then
+   by when they were created. Annotations have a priority of 3 by default.
 
    You can update an existing annotation's body by running the annotate command
    again and provide the same context as the one you want to update. Or if you
@@ -40,19 +53,29 @@ Description:
    You can also update just the style of an existing annotation by omitting the
    body entirely and providing a new style value.
 
+   To remove an annotation, run "buildkite-agent annotate remove" (or
+   "buildkite-agent annotation remove") with the context of the annotation.
+   As "remove" on its own is taken to mean this, an annotation with just
+   "remove" as its body has to be given with --file or on STDIN.
+
 Example:
 
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
+   $ buildkite-agent annotate --file report.md --context "report" --priority 8
+   $ buildkite-agent annotate remove --context "report"
    $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
 
 type AnnotateConfig struct {
-	Body    string `cli:"arg:0" label:"annotation body"`
-	Style   string `cli:"style"`
-	Context string `cli:"context"`
-	Append  bool   `cli:"append"`
-	Job     string `cli:"job" validate:"required"`
+	Body                string `cli:"arg:0" label:"annotation body"`
+	File                string `cli:"file"`
+	Style               string `cli:"style"`
+	Context             string `cli:"context"`
+	Append              bool   `cli:"append"`
+	Priority            int    `cli:"priority"`
+	ArtifactDestination string `cli:"artifact-destination"`
+	Job                 string `cli:"job" validate:"required"`
 
 	// Global flags
 	Debug   bool   `cli:"debug"`
@@ -86,6 +109,21 @@ var AnnotateCommand = cli.Command{
 			Usage:  "Append to the body of an existing annotation",
 			EnvVar: "BUILDKITE_ANNOTATION_APPEND",
 		},
+		cli.StringFlag{
+			Name:   "file",
+			Usage:  "Read the body of the annotation from a file",
+			EnvVar: "BUILDKITE_ANNOTATION_FILE",
+		},
+		cli.IntFlag{
+			Name:   "priority",
+			Usage:  "The priority of the annotation, from 1 to 10, with higher priority annotations shown first (default 3)",
+			EnvVar: "BUILDKITE_ANNOTATION_PRIORITY",
+		},
+		cli.StringFlag{
+			Name:   "artifact-destination",
+			Usage:  "Where to upload the full body of an annotation that's too large, as with artifact upload",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -105,6 +143,14 @@ var AnnotateCommand = cli.Command{
 		ProfileFlag,
 	},
 	Action: func(c *cli.Context) {
+		// "annotate remove" removes an annotation, rather than creating one
+		// with "remove" as its body. It's handled here rather than as a
+		// subcommand so flags can still be given after the body
+		if c.NArg() == 1 && c.Args().First() == "remove" {
+			removeAnnotation(c)
+			return
+		}
+
 		// The configuration will be loaded into this struct
 		cfg := AnnotateConfig{}
 
@@ -119,11 +165,28 @@ var AnnotateCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		if cfg.Priority != 0 && (cfg.Priority < 1 || cfg.Priority > 10) {
+			l.Fatal("The annotation priority must be between 1 and 10, not %d", cfg.Priority)
+		}
+
 		var body string
 		var err error
 
+		if cfg.Body != "" && cfg.File != "" {
+			l.Fatal("An annotation body can't be given along with --file")
+		}
+
 		if cfg.Body != "" {
 			body = cfg.Body
+		} else if cfg.File != "" {
+			l.Info("Reading annotation body from \"%s\"", cfg.File)
+
+			contents, err := ioutil.ReadFile(cfg.File)
+			if err != nil {
+				l.Fatal("Failed to read file: %s", err)
+			}
+
+			body = string(contents)
 		} else if stdin.IsReadable() {
 			l.Info("Reading annotation body from STDIN")
 
@@ -136,15 +199,30 @@ var AnnotateCommand = cli.Command{
 			body = string(stdin[:])
 		}
 
+		for _, problem := range agent.CheckAnnotationMarkdown(body) {
+			l.Warn("The annotation may not render as expected: %s", problem)
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		// Bodies that are too large for the API are truncated, with the full
+		// body uploaded as an artifact so it can be linked to
+		if len(body) > agent.AnnotationBodyLimit {
+			l.Warn("The annotation body is %d bytes, which is larger than the limit of %d bytes, so it will be truncated",
+				len(body), agent.AnnotationBodyLimit)
+
+			artifactPath := uploadAnnotationArtifact(l, client, cfg, body)
+			body = agent.TruncateAnnotation(body, agent.AnnotationBodyLimit, artifactPath)
+		}
+
 		// Create the annotation we'll send to the Buildkite API
 		annotation := &api.Annotation{
-			Body:    body,
-			Style:   cfg.Style,
-			Context: cfg.Context,
-			Append:  cfg.Append,
+			Body:     body,
+			Style:    cfg.Style,
+			Context:  cfg.Context,
+			Append:   cfg.Append,
+			Priority: cfg.Priority,
 		}
 
 		// Retry the annotation a few times before giving up
@@ -174,3 +252,47 @@ var AnnotateCommand = cli.Command{
 		l.Debug("Successfully annotated build")
 	},
 }
+
+// uploadAnnotationArtifact uploads the full body of an annotation as an
+// artifact, returning the path it was uploaded to. The file given with --file
+// is uploaded if there was one, otherwise the body is written to a temporary
+// file first.
+func uploadAnnotationArtifact(l logger.Logger, client *api.Client, cfg AnnotateConfig, body string) string {
+	path := cfg.File
+	if path == "" {
+		dir, err := ioutil.TempDir("", "buildkite-annotation")
+		if err != nil {
+			l.Fatal("Failed to create a temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		context := cfg.Context
+		if context == "" {
+			context = "default"
+		}
+
+		path = filepath.Join(dir, fmt.Sprintf("annotation-%s.md", filepath.Base(context)))
+		if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+			l.Fatal("Failed to write the annotation body: %s", err)
+		}
+	}
+
+	uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
+		JobID:       cfg.Job,
+		Paths:       path,
+		Destination: cfg.ArtifactDestination,
+		ContentType: "text/markdown",
+		DebugHTTP:   cfg.DebugHTTP,
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil || len(artifacts) != 1 {
+		l.Fatal("Failed to find the annotation body to upload: %v", err)
+	}
+
+	if err := uploader.Upload(); err != nil {
+		l.Fatal("Failed to upload the full annotation body: %s", err)
+	}
+
+	return artifacts[0].Path
+}
@@ -0,0 +1,83 @@
+package clicommand
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+// parseAnnotateArgs runs the annotate command's flag parsing against args,
+// returning the configuration it would have run with
+func parseAnnotateArgs(t *testing.T, args ...string) AnnotateConfig {
+	t.Helper()
+
+	cfg := AnnotateConfig{}
+
+	command := AnnotateCommand
+	command.Action = func(c *cli.Context) {
+		l, _ := newTestLogger()
+		require.NoError(t, cliconfig.Load(c, l, &cfg))
+	}
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{command}
+
+	require.NoError(t, app.Run(append([]string{"buildkite-agent", "annotate"}, args...)))
+
+	return cfg
+}
+
+func TestAnnotateParsesFlagsAfterTheBody(t *testing.T) {
+	cfg := parseAnnotateArgs(t,
+		"All tests passed! :rocket:",
+		"--context", "junit",
+		"--style", "success",
+		"--priority", "8",
+		"--job", "llamas",
+		"--agent-access-token", "alpacas",
+	)
+
+	assert.Equal(t, "All tests passed! :rocket:", cfg.Body)
+	assert.Equal(t, "junit", cfg.Context)
+	assert.Equal(t, "success", cfg.Style)
+	assert.Equal(t, 8, cfg.Priority)
+	assert.Equal(t, "llamas", cfg.Job)
+}
+
+func TestAnnotateTreatsCommandNamesAsTheBody(t *testing.T) {
+	cfg := parseAnnotateArgs(t, "help", "--context", "junit", "--job", "llamas", "--agent-access-token", "alpacas")
+
+	assert.Equal(t, "help", cfg.Body)
+	assert.Equal(t, "junit", cfg.Context)
+}
+
+func TestAnnotateRemoveRemovesTheAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		path string
+	}{
+		{[]string{"remove", "--context", "junit"}, "/jobs/llamas/annotations/junit"},
+		{[]string{"--context", "junit", "remove"}, "/jobs/llamas/annotations/junit"},
+		{[]string{"remove"}, "/jobs/llamas/annotations/default"},
+	} {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req.Method+" "+req.URL.Path)
+		}))
+
+		app := cli.NewApp()
+		app.Commands = []cli.Command{AnnotateCommand}
+
+		args := append([]string{"buildkite-agent", "annotate"}, tc.args...)
+		args = append(args, "--job", "llamas", "--agent-access-token", "alpacas", "--endpoint", server.URL)
+		require.NoError(t, app.Run(args))
+		server.Close()
+
+		assert.Equal(t, []string{"DELETE " + tc.path}, requests, "%v", tc.args)
+	}
+}
@@ -0,0 +1,123 @@
+package clicommand
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/urfave/cli"
+)
+
+var AnnotationRemoveHelpDescription = `Usage:
+
+   buildkite-agent annotation remove [arguments...]
+
+Description:
+
+   Remove an annotation from a build, using the context it was created with.
+   If no context is given, the annotation with the default context is removed.
+
+   This is the same as "buildkite-agent annotate remove".
+
+Example:
+
+   $ buildkite-agent annotation remove --context "junit"`
+
+type AnnotationRemoveConfig struct {
+	Context string `cli:"context"`
+	Job     string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+}
+
+var AnnotationRemoveCommand = cli.Command{
+	Name:        "remove",
+	Usage:       "Remove an annotation from a build",
+	Description: AnnotationRemoveHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "default",
+			Usage:  "The context of the annotation to remove",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build the annotation should be removed from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: removeAnnotation,
+}
+
+// removeAnnotation removes an annotation, for both "annotation remove" and
+// "annotate remove"
+func removeAnnotation(c *cli.Context) {
+	// The configuration will be loaded into this struct
+	cfg := AnnotationRemoveConfig{}
+
+	l := CreateLogger(&cfg)
+
+	// Load the configuration
+	if err := cliconfig.Load(c, l, &cfg); err != nil {
+		l.Fatal("%s", err)
+	}
+
+	// Setup any global configuration options
+	done := HandleGlobalFlags(l, cfg)
+	defer done()
+
+	if cfg.Context == "" {
+		cfg.Context = "default"
+	}
+
+	// Create the API client
+	client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+	// Retry the removal a few times before giving up
+	err := retry.Do(func(s *retry.Stats) error {
+		resp, err := client.AnnotationRemove(cfg.Job, cfg.Context)
+
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+
+		// Show the unexpected error
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+
+	// Show a fatal error if we gave up trying to remove the annotation
+	if err != nil {
+		l.Fatal("Failed to remove annotation: %s", err)
+	}
+
+	l.Debug("Successfully removed annotation")
+}
@@ -32,6 +32,12 @@ Description:
 
    You can run only specific phases with the --phases flag.
 
+   To see which global, local and plugin hooks would run for each phase and in what
+   order, use the --dry-run flag. No hooks or commands are run, and the repository
+   isn't checked out, but plugins are still cloned into the plugins path so their
+   hooks can be found. It can only be set with the flag, not from the job's
+   environment.
+
    The bootstrap is also responsible for executing hooks around the phases.
    See https://buildkite.com/docs/agent/v3/hooks for more details.
 
@@ -51,8 +57,15 @@ type BootstrapConfig struct {
 	RefSpec                      string   `cli:"refspec"`
 	Plugins                      string   `cli:"plugins"`
 	PullRequest                  string   `cli:"pullrequest"`
+	PullRequestBaseBranch        string   `cli:"pullrequest-base-branch"`
+	GitPullRequestMerge          string   `cli:"git-pull-request-merge"`
 	GitSubmodules                bool     `cli:"git-submodules"`
+	GitSubmodulePaths            string   `cli:"git-submodule-paths"`
+	GitSubmoduleDepth            string   `cli:"git-submodule-depth"`
+	GitSubmoduleJobs             string   `cli:"git-submodule-jobs"`
 	SSHKeyscan                   bool     `cli:"ssh-keyscan"`
+	SSHKnownHostsPath            string   `cli:"ssh-known-hosts-path" normalize:"filepath"`
+	SSHStrictHostKeyChecking     bool     `cli:"ssh-strict-host-key-checking"`
 	AgentName                    string   `cli:"agent" validate:"required"`
 	OrganizationSlug             string   `cli:"organization" validate:"required"`
 	PipelineSlug                 string   `cli:"pipeline" validate:"required"`
@@ -66,11 +79,23 @@ type BootstrapConfig struct {
 	GitCleanFlags                string   `cli:"git-clean-flags"`
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
+	GitCredentialsPath           string   `cli:"git-credentials-path" normalize:"filepath"`
 	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
+	WorkspacePolicy              string   `cli:"workspace-policy"`
+	WorkspaceTmpPath             string   `cli:"workspace-tmp-path" normalize:"filepath"`
+	WorkspacePoolSize            int      `cli:"workspace-pool-size"`
+	WorkspaceMaxAgeDays          int      `cli:"workspace-max-age-days"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
+	HookTimeouts                 []string `cli:"hook-timeouts" normalize:"list"`
+	HookFailurePolicies          []string `cli:"hook-failure-policies" normalize:"list"`
 	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsLockfile              string   `cli:"plugins-lockfile" normalize:"filepath"`
+	PluginsPolicy                string   `cli:"plugins-policy" normalize:"filepath"`
+	PluginsCachePath             string   `cli:"plugins-cache-path" normalize:"filepath"`
+	PluginsOffline               bool     `cli:"plugins-offline"`
 	CommandEval                  bool     `cli:"command-eval"`
+	TimingReport                 bool     `cli:"timing-report"`
 	PluginsEnabled               bool     `cli:"plugins-enabled"`
 	PluginValidation             bool     `cli:"plugin-validation"`
 	LocalHooksEnabled            bool     `cli:"local-hooks-enabled"`
@@ -79,6 +104,7 @@ type BootstrapConfig struct {
 	Shell                        string   `cli:"shell"`
 	Experiments                  []string `cli:"experiment" normalize:"list"`
 	Phases                       []string `cli:"phases" normalize:"list"`
+	DryRun                       bool     `cli:"dry-run"`
 	Profile                      string   `cli:"profile"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
 }
@@ -142,6 +168,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "The number/id of the pull request this commit belonged to",
 			EnvVar: "BUILDKITE_PULL_REQUEST",
 		},
+		cli.StringFlag{
+			Name:   "pullrequest-base-branch",
+			Value:  "",
+			Usage:  "The base branch that the pull request targets",
+			EnvVar: "BUILDKITE_PULL_REQUEST_BASE_BRANCH",
+		},
 		cli.StringFlag{
 			Name:   "agent",
 			Value:  "",
@@ -207,6 +239,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "git-pull-request-merge",
+			Value:  "",
+			Usage:  "Build pull requests merged with their base branch, either \"local\" to merge in the checkout or \"ref\" to use the provider's merge ref",
+			EnvVar: "BUILDKITE_GIT_PULL_REQUEST_MERGE",
+		},
 		cli.StringFlag{
 			Name:   "git-mirrors-path",
 			Value:  "",
@@ -219,6 +257,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Seconds to lock a git mirror during clone, should exceed your longest checkout",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
 		},
+		cli.StringFlag{
+			Name:   "git-credentials-path",
+			Value:  "",
+			Usage:  "Path to a file mapping repository urls to HTTPS tokens, supplied to git with the git-credential helper",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PATH",
+		},
 		cli.StringFlag{
 			Name:   "bin-path",
 			Value:  "",
@@ -231,23 +275,85 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Directory where builds will be created",
 			EnvVar: "BUILDKITE_BUILD_PATH",
 		},
+		cli.StringFlag{
+			Name:   "workspace-policy",
+			Value:  "reuse",
+			Usage:  "How checkout directories are allocated, either \"reuse\" (one per agent and pipeline), \"ephemeral\" (a new one per job) or \"pool\" (shared between agents with locking)",
+			EnvVar: "BUILDKITE_WORKSPACE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "workspace-tmp-path",
+			Value:  "",
+			Usage:  "Path to create ephemeral workspaces in, e.g. a tmpfs mount. They are plain directories, the agent doesn't set up overlay filesystems. Defaults to the system temp dir",
+			EnvVar: "BUILDKITE_WORKSPACE_TMP_PATH",
+		},
+		cli.IntFlag{
+			Name:   "workspace-pool-size",
+			Value:  1,
+			Usage:  "The number of pooled checkout directories per pipeline when using the \"pool\" workspace policy",
+			EnvVar: "BUILDKITE_WORKSPACE_POOL_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "workspace-max-age-days",
+			Value:  0,
+			Usage:  "Remove checkout directories in the build path that haven't been used for this many days, 0 to keep them forever",
+			EnvVar: "BUILDKITE_WORKSPACE_MAX_AGE_DAYS",
+		},
 		cli.StringFlag{
 			Name:   "hooks-path",
 			Value:  "",
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.StringSliceFlag{
+			Name:   "hook-timeouts",
+			Usage:  "Timeouts for hooks, e.g. pre-exit=30s,environment=2m",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "hook-failure-policies",
+			Usage:  "What happens when hooks fail, either fail, warn or soft-fail:<exit status>, e.g. pre-exit=warn",
+			EnvVar: "BUILDKITE_HOOK_FAILURE_POLICIES",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
 			Usage:  "Directory where the plugins are saved to",
 			EnvVar: "BUILDKITE_PLUGINS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "plugins-lockfile",
+			Value:  "",
+			Usage:  "Path to a file pinning plugins to the full commit SHAs they must resolve to, plugins that aren't listed are refused",
+			EnvVar: "BUILDKITE_PLUGINS_LOCKFILE",
+		},
+		cli.StringFlag{
+			Name:   "plugins-policy",
+			Value:  "",
+			Usage:  "Path to a file listing the plugin locations and versions that are allowed, other plugins are refused",
+			EnvVar: "BUILDKITE_PLUGINS_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "plugins-cache-path",
+			Value:  "",
+			Usage:  "Path to a plugin cache that can be shared between agents, plugins are cloned from mirrors in the cache",
+			EnvVar: "BUILDKITE_PLUGINS_CACHE_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "plugins-offline",
+			Usage:  "Only checkout plugins from the plugin cache, without fetching them from their repositories",
+			EnvVar: "BUILDKITE_PLUGINS_OFFLINE",
+		},
 		cli.BoolTFlag{
 			Name:   "command-eval",
 			Usage:  "Allow running of arbitary commands",
 			EnvVar: "BUILDKITE_COMMAND_EVAL",
 		},
+		cli.BoolFlag{
+			Name:   "timing-report",
+			Usage:  "Publish how long each phase, hook and plugin took as an annotation and job meta-data",
+			EnvVar: "BUILDKITE_TIMING_REPORT",
+		},
 		cli.BoolTFlag{
 			Name:   "plugins-enabled",
 			Usage:  "Allow plugins to be run",
@@ -268,11 +374,40 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Automatically run ssh-keyscan before checkout",
 			EnvVar: "BUILDKITE_SSH_KEYSCAN",
 		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-path",
+			Value:  "",
+			Usage:  "Path to a known_hosts file of pinned host keys and @cert-authority entries, which replace any other keys for their hosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-strict-host-key-checking",
+			Usage:  "Fail checkouts and plugins from ssh hosts without pinned or already known host keys, rather than running ssh-keyscan",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING",
+		},
 		cli.BoolTFlag{
 			Name:   "git-submodules",
 			Usage:  "Enable git submodules",
 			EnvVar: "BUILDKITE_GIT_SUBMODULES",
 		},
+		cli.StringFlag{
+			Name:   "git-submodule-paths",
+			Value:  "",
+			Usage:  "Comma separated submodule paths to check out, which can be globs and can include a clone depth (e.g \"vendor/*:1,docs\"). Defaults to all submodules",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "git-submodule-depth",
+			Value:  "",
+			Usage:  "The clone depth to use for submodules, defaults to the full history",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-submodule-jobs",
+			Value:  "",
+			Usage:  "The number of submodules to fetch in parallel",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_JOBS",
+		},
 		cli.BoolTFlag{
 			Name:   "pty",
 			Usage:  "Run jobs within a pseudo terminal",
@@ -289,6 +424,10 @@ var BootstrapCommand = cli.Command{
 			Usage:  "The specific phases to execute. The order they're defined is is irrelevant.",
 			EnvVar: "BUILDKITE_BOOTSTRAP_PHASES",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the hooks that would run for each phase, in order, without running any hooks or commands. Plugins are still cloned so their hooks can be found",
+		},
 		cli.StringSliceFlag{
 			Name:   "redacted-vars",
 			Usage:  "Pattern of environment variable names containing sensitive values",
@@ -329,6 +468,19 @@ var BootstrapCommand = cli.Command{
 			runInPty = false
 		}
 
+		// Validate the workspace policy
+		if err := bootstrap.ValidateWorkspacePolicy(cfg.WorkspacePolicy); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		// Validate the pull request merge mode
+		switch cfg.GitPullRequestMerge {
+		case "", "local", "ref":
+			// Valid mode
+		default:
+			l.Fatal("Invalid git-pull-request-merge %q, expected \"local\" or \"ref\"", cfg.GitPullRequestMerge)
+		}
+
 		// Validate phases
 		for _, phase := range cfg.Phases {
 			switch phase {
@@ -350,7 +502,12 @@ var BootstrapCommand = cli.Command{
 			RefSpec:                      cfg.RefSpec,
 			Plugins:                      cfg.Plugins,
 			GitSubmodules:                cfg.GitSubmodules,
+			GitSubmodulePaths:            cfg.GitSubmodulePaths,
+			GitSubmoduleDepth:            cfg.GitSubmoduleDepth,
+			GitSubmoduleJobs:             cfg.GitSubmoduleJobs,
 			PullRequest:                  cfg.PullRequest,
+			PullRequestBaseBranch:        cfg.PullRequestBaseBranch,
+			GitPullRequestMerge:          cfg.GitPullRequestMerge,
 			GitCloneFlags:                cfg.GitCloneFlags,
 			GitFetchFlags:                cfg.GitFetchFlags,
 			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
@@ -363,20 +520,35 @@ var BootstrapCommand = cli.Command{
 			ArtifactUploadDestination:    cfg.ArtifactUploadDestination,
 			CleanCheckout:                cfg.CleanCheckout,
 			BuildPath:                    cfg.BuildPath,
+			WorkspacePolicy:              cfg.WorkspacePolicy,
+			WorkspaceTmpPath:             cfg.WorkspaceTmpPath,
+			WorkspacePoolSize:            cfg.WorkspacePoolSize,
+			WorkspaceMaxAgeDays:          cfg.WorkspaceMaxAgeDays,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
+			GitCredentialsPath:           cfg.GitCredentialsPath,
 			BinPath:                      cfg.BinPath,
 			HooksPath:                    cfg.HooksPath,
+			HookTimeouts:                 cfg.HookTimeouts,
+			HookFailurePolicies:          cfg.HookFailurePolicies,
 			PluginsPath:                  cfg.PluginsPath,
+			PluginsLockfile:              cfg.PluginsLockfile,
+			PluginsPolicy:                cfg.PluginsPolicy,
+			PluginsCachePath:             cfg.PluginsCachePath,
+			PluginsOffline:               cfg.PluginsOffline,
 			PluginValidation:             cfg.PluginValidation,
 			Debug:                        cfg.Debug,
 			RunInPty:                     runInPty,
 			CommandEval:                  cfg.CommandEval,
+			TimingReport:                 cfg.TimingReport,
 			PluginsEnabled:               cfg.PluginsEnabled,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			SSHKeyscan:                   cfg.SSHKeyscan,
+			SSHKnownHostsPath:            cfg.SSHKnownHostsPath,
+			SSHStrictHostKeyChecking:     cfg.SSHStrictHostKeyChecking,
 			Shell:                        cfg.Shell,
 			Phases:                       cfg.Phases,
+			DryRun:                       cfg.DryRun,
 			RedactedVars:                 cfg.RedactedVars,
 		})
 
@@ -0,0 +1,114 @@
+package clicommand
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/gitcredential"
+	"github.com/urfave/cli"
+)
+
+var GitCredentialHelpDescription = `Usage:
+
+   buildkite-agent git-credential <operation> [arguments...]
+
+Description:
+
+   A git credential helper that supplies HTTPS tokens from the agent's
+   git-credentials-path configuration, so they never end up in remote urls or
+   .git/config. The bootstrap configures git to use it for checkouts,
+   submodules, mirrors and plugins when git-credentials-path is set.
+
+   Only the "get" operation returns credentials, "store" and "erase" are
+   ignored as tokens are looked up each time they are needed.
+
+   The configuration file looks like:
+
+     credentials:
+       - match: https://github.com/my-org/*
+         token-command: /usr/local/bin/github-app-token my-org
+       - match: https://gitlab.example.com/*
+         username: oauth2
+         token-env: GITLAB_TOKEN
+
+   The first credential that matches the repository url is used. Each needs
+   exactly one of token-command, token-env or token-file.
+
+   The scheme, host and path of a match pattern are matched separately. In the
+   host * matches within a single label, so https://*.example.com matches
+   https://git.example.com but not https://git.evil.com/.example.com. In the
+   path * matches within a single segment, except a trailing /* which matches
+   the rest of the path.
+
+   The bootstrap configures git with GIT_CONFIG_COUNT, which needs git 2.31 or
+   later.
+
+Example:
+
+   $ printf "protocol=https\nhost=github.com\npath=my-org/repo.git\n" | \
+       buildkite-agent git-credential get`
+
+type GitCredentialConfig struct {
+	Operation       string `cli:"arg:0" label:"operation" validate:"required"`
+	CredentialsPath string `cli:"credentials-path" normalize:"filepath" validate:"required"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+}
+
+var GitCredentialCommand = cli.Command{
+	Name:        "git-credential",
+	Usage:       "A git credential helper for HTTPS checkouts",
+	Description: GitCredentialHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "credentials-path",
+			Value:  "",
+			Usage:  "Path to a file mapping repository urls to credentials",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PATH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := GitCredentialConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Git expects helpers to silently ignore operations they don't support
+		if cfg.Operation != "get" {
+			return
+		}
+
+		config, err := gitcredential.LoadConfig(cfg.CredentialsPath)
+		if err != nil {
+			l.Fatal("Failed to load git credentials from %s: %v", cfg.CredentialsPath, err)
+		}
+
+		req, err := gitcredential.ReadRequest(os.Stdin)
+		if err != nil {
+			l.Fatal("Failed to read credential request: %v", err)
+		}
+
+		l.Debug("Looking up git credentials for %s", req.URL())
+
+		if err := config.Get(req, os.Stdout); err != nil {
+			l.Fatal("Failed to get git credentials for %s: %v", req.URL(), err)
+		}
+	},
+}
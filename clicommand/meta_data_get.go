@@ -1,11 +1,14 @@
 package clicommand
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
@@ -18,13 +21,19 @@ Description:
 
    Get data from a builds key/value store.
 
+   Use --all to get every key and value, as a JSON object with --format json.
+   With --format json, a single key is also output as a JSON object.
+
 Example:
 
-   $ buildkite-agent meta-data get "foo"`
+   $ buildkite-agent meta-data get "foo"
+   $ buildkite-agent meta-data get --all --format json`
 
 type MetaDataGetConfig struct {
-	Key     string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Key     string `cli:"arg:0" label:"meta-data key"`
 	Default string `cli:"default"`
+	All     bool   `cli:"all"`
+	Format  string `cli:"format"`
 	Job     string `cli:"job" validate:"required"`
 
 	// Global flags
@@ -49,6 +58,15 @@ var MetaDataGetCommand = cli.Command{
 			Value: "",
 			Usage: "If the meta-data value doesn't exist return this instead",
 		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "Get all of the build's meta-data, which requires --format json",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "The format to output values in, either text or json",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -82,9 +100,34 @@ var MetaDataGetCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		if cfg.Format != "text" && cfg.Format != "json" {
+			l.Fatal("Unknown format %q, expected either text or json", cfg.Format)
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		if cfg.All {
+			if cfg.Key != "" {
+				l.Fatal("A key can't be given with --all")
+			}
+			if cfg.Format != "json" {
+				l.Fatal("All meta-data can only be output with --format json")
+			}
+
+			values, err := getAllMetaData(l, client, cfg.Job)
+			if err != nil {
+				l.Fatal("Failed to get meta-data: %s", err)
+			}
+
+			printMetaDataJSON(l, values)
+			return
+		}
+
+		if cfg.Key == "" {
+			l.Fatal("Missing meta-data key")
+		}
+
 		// Find the meta data value
 		var metaData *api.MetaData
 		var err error
@@ -114,7 +157,11 @@ var MetaDataGetCommand = cli.Command{
 			if resp.StatusCode == 404 && c.IsSet("default") {
 				l.Warn("No meta-data value exists with key `%s`, returning the supplied default \"%s\"", cfg.Key, cfg.Default)
 
-				fmt.Print(cfg.Default)
+				if cfg.Format == "json" {
+					printMetaDataJSON(l, map[string]string{cfg.Key: cfg.Default})
+				} else {
+					fmt.Print(cfg.Default)
+				}
 				return
 			} else {
 				l.Fatal("Failed to get meta-data: %s", err)
@@ -122,6 +169,111 @@ var MetaDataGetCommand = cli.Command{
 		}
 
 		// Output the value to STDOUT
-		fmt.Print(metaData.Value)
+		if cfg.Format == "json" {
+			printMetaDataJSON(l, map[string]string{cfg.Key: metaData.Value})
+		} else {
+			fmt.Print(metaData.Value)
+		}
 	},
 }
+
+// getAllMetaData gets the keys of a build's meta-data, and then all of their
+// values in a single batch
+func getAllMetaData(l logger.Logger, client *api.Client, job string) (map[string]string, error) {
+	var keys []string
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+		keys, resp, err = client.MetaDataKeys(job)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	return getMetaDataValues(l, client, job, keys)
+}
+
+// getMetaDataValues gets the values of many meta-data keys at once, leaving
+// out keys that haven't been set. Agent APIs that don't have the batch
+// endpoint return a 404, in which case each value is got on its own instead
+func getMetaDataValues(l logger.Logger, client *api.Client, job string, keys []string) (map[string]string, error) {
+	var batch *api.MetaDataBatch
+	var notFound bool
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+		batch, resp, err = client.GetMetaDataBatch(job, keys)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			notFound = resp.StatusCode == 404
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+	values := map[string]string{}
+
+	if err != nil {
+		if !notFound {
+			return nil, err
+		}
+
+		l.Debug("Meta-data can't be got in a batch, getting each value separately")
+
+		for _, key := range keys {
+			var metaData *api.MetaData
+			var missing bool
+			err := retry.Do(func(s *retry.Stats) error {
+				var resp *api.Response
+				var err error
+				metaData, resp, err = client.GetMetaData(job, key)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+					missing = resp.StatusCode == 404
+					s.Break()
+				}
+				if err != nil && !missing {
+					l.Warn("%s (%s)", err, s)
+				}
+				return err
+			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+			// Keys that haven't been set are left out, like with a batch
+			if missing {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[key] = metaData.Value
+		}
+
+		return values, nil
+	}
+
+	for _, item := range batch.Items {
+		values[item.Key] = item.Value
+	}
+	return values, nil
+}
+
+func printMetaDataJSON(l logger.Logger, values map[string]string) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(values); err != nil {
+		l.Fatal("%s", err)
+	}
+}
@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGettingMetaDataValuesFallsBackToSingleKeys(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/job-1/data/get":
+			var m api.MetaData
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				t.Error(err)
+			}
+			if m.Key != "llamas" {
+				http.Error(rw, "Not found", http.StatusNotFound)
+				return
+			}
+			rw.Write([]byte(`{"key":"llamas","value":"1"}`))
+
+		default:
+			// Agent APIs without batches don't have batch_get
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	// Keys that haven't been set are left out, like with a batch
+	values, err := getMetaDataValues(logger.Discard, client, "job-1", []string{"llamas", "alpacas"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"llamas": "1"}, values)
+}
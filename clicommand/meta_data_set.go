@@ -1,12 +1,17 @@
 package clicommand
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
@@ -22,16 +27,22 @@ Description:
    You can supply the value as an argument to the command, or pipe in a file or
    script output.
 
+   Many values can be set at once with --from-json, from a file (or - for
+   STDIN) with a JSON object of keys and values. Values that aren't strings
+   are set as JSON.
+
 Example:
 
    $ buildkite-agent meta-data set "foo" "bar"
    $ buildkite-agent meta-data set "foo" < ./tmp/meta-data-value
-   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"`
+   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"
+   $ buildkite-agent meta-data set --from-json ./tmp/meta-data.json`
 
 type MetaDataSetConfig struct {
-	Key   string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Value string `cli:"arg:1" label:"meta-data value"`
-	Job   string `cli:"job" validate:"required"`
+	Key      string `cli:"arg:0" label:"meta-data key"`
+	Value    string `cli:"arg:1" label:"meta-data value"`
+	FromJSON string `cli:"from-json"`
+	Job      string `cli:"job" validate:"required"`
 
 	// Global flags
 	Debug   bool   `cli:"debug"`
@@ -50,6 +61,11 @@ var MetaDataSetCommand = cli.Command{
 	Usage:       "Set data on a build",
 	Description: MetaDataSetHelpDescription,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from-json",
+			Value: "",
+			Usage: "Set the keys and values of a JSON object in a file, or - to read it from STDIN",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -83,6 +99,32 @@ var MetaDataSetCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		if cfg.FromJSON != "" {
+			if cfg.Key != "" {
+				l.Fatal("Keys can't be given with --from-json, they're read from the JSON")
+			}
+
+			batch, err := readMetaDataJSON(cfg.FromJSON)
+			if err != nil {
+				l.Fatal("Failed to read meta-data from %q: %s", cfg.FromJSON, err)
+			}
+
+			l.Info("Setting %d meta-data values", len(batch.Items))
+
+			if err := setMetaDataBatch(l, client, cfg.Job, batch); err != nil {
+				l.Fatal("Failed to set meta-data: %s", err)
+			}
+
+			return
+		}
+
+		if cfg.Key == "" {
+			l.Fatal("Missing meta-data key")
+		}
+
 		// Read the value from STDIN if argument omitted entirely
 		if len(c.Args()) < 2 {
 			l.Info("Reading meta-data value from STDIN")
@@ -94,9 +136,6 @@ var MetaDataSetCommand = cli.Command{
 			cfg.Value = string(input)
 		}
 
-		// Create the API client
-		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
-
 		// Create the meta data to set
 		metaData := &api.MetaData{
 			Key:   cfg.Key,
@@ -104,19 +143,104 @@ var MetaDataSetCommand = cli.Command{
 		}
 
 		// Set the meta data
-		err := retry.Do(func(s *retry.Stats) error {
-			resp, err := client.SetMetaData(cfg.Job, metaData)
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
-				s.Break()
-			}
-			if err != nil {
-				l.Warn("%s (%s)", err, s)
-			}
-
-			return err
-		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
-		if err != nil {
+		if err := setMetaData(l, client, cfg.Job, metaData); err != nil {
 			l.Fatal("Failed to set meta-data: %s", err)
 		}
 	},
 }
+
+func setMetaData(l logger.Logger, client *api.Client, job string, metaData *api.MetaData) error {
+	return retry.Do(func(s *retry.Stats) error {
+		resp, err := client.SetMetaData(job, metaData)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+}
+
+// setMetaDataBatch sets many meta-data values at once. Agent APIs that don't
+// have the batch endpoint return a 404, in which case each value is set on
+// its own instead
+func setMetaDataBatch(l logger.Logger, client *api.Client, job string, batch *api.MetaDataBatch) error {
+	var notFound bool
+	err := retry.Do(func(s *retry.Stats) error {
+		resp, err := client.SetMetaDataBatch(job, batch)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			notFound = resp.StatusCode == 404
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err == nil || !notFound {
+		return err
+	}
+
+	l.Info("Meta-data can't be set in a batch, setting each value separately")
+
+	for _, metaData := range batch.Items {
+		if err := setMetaData(l, client, job, metaData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMetaDataJSON reads a JSON object of meta-data keys and values from a
+// file, or STDIN if the path is -
+func readMetaDataJSON(path string) (*api.MetaDataBatch, error) {
+	var input []byte
+	var err error
+	if path == "-" {
+		input, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		input, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(input, &values); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of keys and values: %v", err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	batch := &api.MetaDataBatch{}
+	for _, key := range keys {
+		// Strings are set as they are, and anything else as its JSON
+		var value string
+		if err := json.Unmarshal(values[key], &value); err != nil {
+			value = string(values[key])
+		}
+
+		if strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("meta-data keys can't be blank")
+		}
+		if value == "" {
+			return nil, fmt.Errorf("the value of %q is empty", key)
+		}
+
+		batch.Items = append(batch.Items, &api.MetaData{Key: key, Value: value})
+	}
+
+	if len(batch.Items) == 0 {
+		return nil, fmt.Errorf("there aren't any keys in the JSON object")
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,48 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingMetaDataBatchFallsBackToSingleKeys(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	set := map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/job-1/data/set":
+			var m api.MetaData
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			set[m.Key] = m.Value
+			mu.Unlock()
+			rw.Write([]byte(`{}`))
+
+		default:
+			// Agent APIs without batches don't have batch_set
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	err := setMetaDataBatch(logger.Discard, client, "job-1", &api.MetaDataBatch{Items: []*api.MetaData{
+		{Key: "llamas", Value: "1"},
+		{Key: "alpacas", Value: "2"},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"llamas": "1", "alpacas": "2"}, set)
+}
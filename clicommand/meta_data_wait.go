@@ -0,0 +1,143 @@
+package clicommand
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+var MetaDataWaitHelpDescription = `Usage:
+
+   buildkite-agent meta-data wait <key> [arguments...]
+
+Description:
+
+   Waits for a meta-data key to be set on a build, checking every --interval
+   until it exists. Exits with an error if it isn't set within --timeout.
+
+   This can be used to coordinate steps, where one step waits for another to
+   set meta-data before continuing.
+
+Example:
+
+   $ buildkite-agent meta-data wait "release-version" --timeout 10m
+   $ buildkite-agent meta-data get "release-version"`
+
+type MetaDataWaitConfig struct {
+	Key      string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Timeout  string `cli:"timeout"`
+	Interval string `cli:"interval"`
+	Job      string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+}
+
+var MetaDataWaitCommand = cli.Command{
+	Name:        "wait",
+	Usage:       "Wait for a meta-data key to be set on a build",
+	Description: MetaDataWaitHelpDescription,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: time.Minute * 10,
+			Usage: "The amount of time to wait for the key to be set",
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Value: time.Second * 5,
+			Usage: "The amount of time between checks for the key",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the meta-data be checked for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := MetaDataWaitConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			l.Fatal("Failed to parse timeout: %v", err)
+		}
+
+		interval, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			l.Fatal("Failed to parse interval: %v", err)
+		}
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		l.Info("Waiting up to %s for meta-data %q to be set", timeout, cfg.Key)
+
+		if err := waitForMetaData(l, client, cfg.Job, cfg.Key, timeout, interval); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		l.Info("Meta-data %q has been set", cfg.Key)
+	},
+}
+
+// waitForMetaData checks whether a meta-data key exists every interval, until
+// it does or the timeout is reached
+func waitForMetaData(l logger.Logger, client *api.Client, job, key string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		exists, resp, err := client.ExistsMetaData(job, key)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			return fmt.Errorf("Failed to see if meta-data exists: %s", err)
+		}
+
+		// Other errors might be temporary, so keep checking
+		if err != nil {
+			l.Warn("Failed to see if meta-data exists: %s", err)
+		} else if exists.Exists {
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("Meta-data %q wasn't set within %s", key, timeout)
+		}
+
+		l.Debug("Meta-data %q isn't set yet, checking again in %s", key, interval)
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,69 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMetaDataExistsServer returns a server where the "llamas" key exists once
+// it has been checked for setAfter times
+func newMetaDataExistsServer(t *testing.T, setAfter int32, checks *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jobs/job-1/data/exists" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+
+		var m api.MetaData
+		if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+			t.Error(err)
+		}
+
+		count := atomic.AddInt32(checks, 1)
+		fmt.Fprintf(rw, `{"exists":%t}`, m.Key == "llamas" && count >= setAfter)
+	}))
+}
+
+func TestWaitingForMetaData(t *testing.T) {
+	t.Parallel()
+
+	var checks int32
+	server := newMetaDataExistsServer(t, 3, &checks)
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	err := waitForMetaData(logger.Discard, client, "job-1", "llamas", time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&checks))
+}
+
+func TestWaitingForMetaDataTimesOut(t *testing.T) {
+	t.Parallel()
+
+	var checks int32
+	server := newMetaDataExistsServer(t, 1, &checks)
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	err := waitForMetaData(logger.Discard, client, "job-1", "alpacas", 100*time.Millisecond, 10*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), `"alpacas" wasn't set within 100ms`), err.Error())
+	}
+	assert.True(t, atomic.LoadInt32(&checks) > 1, "expected more than one check")
+
+	// Jobs that don't exist fail straight away
+	err = waitForMetaData(logger.Discard, client, "job-2", "llamas", time.Second, 10*time.Millisecond)
+	assert.Error(t, err)
+}
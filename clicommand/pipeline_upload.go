@@ -1,7 +1,9 @@
 package clicommand
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -14,8 +16,11 @@ import (
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/stdin"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/urfave/cli"
 )
 
@@ -40,20 +45,82 @@ Description:
    - buildkite/pipeline.json
 
    You can also pipe build pipelines to the command allowing you to create
-   scripts that generate dynamic pipelines.
+   scripts that generate dynamic pipelines, or run the script with --exec.
+   Its stderr is shown in the job's log, and the pipeline it prints to stdout
+   is only uploaded if it succeeds within --exec-timeout.
+
+   Pipelines can be split across files with include steps, and share steps
+   with template steps, which use templates with params either defined under
+   templates in the pipeline or in their own files:
+
+     steps:
+       - include: .buildkite/pipelines/web.yml
+       - template: .buildkite/templates/test.yml
+         params:
+           package: agent
+
+   Included files and templates are relative to the root of the checkout, which
+   is BUILDKITE_BUILD_CHECKOUT_PATH in a job, or the top level of the git
+   repository, wherever the upload is run from.
+
+   Steps can be kept only when files they watch have changed, using if_changed
+   with paths or globs (those starting with ! are excluded):
+
+     steps:
+       - command: make web
+         if_changed:
+           - web/**
+           - "!web/**/*.md"
+
+   The changed files are found by comparing the build's commit with the
+   --diff-base ref, a ref from --diff-base-from-meta-data, or the pull
+   request's base branch. If there's no base, every step is kept. Steps that
+   depended on a step that isn't kept depend on what it depended on instead.
+
+   With --interpolation-functions, values can also be interpolated from the
+   build's meta-data with ${meta-data:key}, from files in the repository with
+   ${file:path}, and transformed with lower, upper, trim and slug, e.g.
+   ${BUILDKITE_BRANCH|slug}.
+
+   Values of environment variables interpolated into the pipeline are visible
+   to anyone who can see the build, so the upload fails if a variable's name
+   matches --redacted-vars or its value looks like a token. Escape variables
+   with $$ (e.g. $$API_TOKEN) so they're interpolated when the job runs.
+
+   Before it's uploaded, the pipeline is checked against the schema of
+   pipeline steps, and any problems are reported with where they are in the
+   file. Attributes that aren't in the schema are only warnings, unless
+   --strict-validation is used. Use --no-validation to skip this check.
 
 Example:
 
    $ buildkite-agent pipeline upload
    $ buildkite-agent pipeline upload my-custom-pipeline.yml
-   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload
+   $ buildkite-agent pipeline upload --exec ./script/dynamic_step_generator -- --fast
+   $ buildkite-agent pipeline upload --dry-run --format summary
+   $ buildkite-agent pipeline upload --diff-against pipeline.golden.json`
 
 type PipelineUploadConfig struct {
 	FilePath        string `cli:"arg:0" label:"upload paths"`
+	Exec            string `cli:"exec"`
+	ExecTimeout     string `cli:"exec-timeout"`
 	Replace         bool   `cli:"replace"`
 	Job             string `cli:"job"`
 	DryRun          bool   `cli:"dry-run"`
+	Format          string `cli:"format"`
+	DiffAgainst     string `cli:"diff-against" normalize:"filepath"`
 	NoInterpolation bool   `cli:"no-interpolation"`
+	NoValidation    bool   `cli:"no-validation"`
+
+	StrictValidation       bool `cli:"strict-validation"`
+	InterpolationFunctions bool `cli:"interpolation-functions"`
+
+	DiffBase             string `cli:"diff-base"`
+	DiffBaseFromMetaData string `cli:"diff-base-from-meta-data"`
+
+	RejectSecrets bool     `cli:"reject-secrets"`
+	RedactedVars  []string `cli:"redacted-vars" normalize:"list"`
 
 	// Global flags
 	Debug   bool   `cli:"debug"`
@@ -83,16 +150,78 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "The job that is making the changes to its build",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:   "exec",
+			Value:  "",
+			Usage:  "Run a program that generates the pipeline, uploading what it prints to stdout if it succeeds. Arguments after -- are passed to it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_EXEC",
+		},
+		cli.DurationFlag{
+			Name:   "exec-timeout",
+			Value:  time.Minute * 5,
+			Usage:  "The amount of time the program from --exec can run for before it's stopped",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_EXEC_TIMEOUT",
+		},
 		cli.BoolFlag{
 			Name:   "dry-run",
 			Usage:  "Rather than uploading the pipeline, it will be echoed to stdout",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN",
 		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "json",
+			Usage:  "The format of the pipeline output with --dry-run or --diff-against, either json, yaml or summary",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "diff-against",
+			Value:  "",
+			Usage:  "Rather than uploading the pipeline, compare it in the --format given with a file, showing the differences and failing if there are any",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DIFF_AGAINST",
+		},
 		cli.BoolFlag{
 			Name:   "no-interpolation",
 			Usage:  "Skip variable interpolation the pipeline when uploaded",
 			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
 		},
+		cli.BoolFlag{
+			Name:   "interpolation-functions",
+			Usage:  "Allow interpolating meta-data with ${meta-data:key}, files with ${file:path} and transforms like ${VAR|lower|trim|slug}",
+			EnvVar: "BUILDKITE_PIPELINE_INTERPOLATION_FUNCTIONS",
+		},
+		cli.BoolFlag{
+			Name:   "no-validation",
+			Usage:  "Skip validating the pipeline against the pipeline schema before it's uploaded",
+			EnvVar: "BUILDKITE_PIPELINE_NO_VALIDATION",
+		},
+		cli.BoolFlag{
+			Name:   "strict-validation",
+			Usage:  "Fail validation for step attributes that aren't in the pipeline schema, rather than warning about them",
+			EnvVar: "BUILDKITE_PIPELINE_STRICT_VALIDATION",
+		},
+		cli.StringFlag{
+			Name:   "diff-base",
+			Value:  "",
+			Usage:  "The git ref to compare the build's commit with to find the changed files that steps with if_changed are kept for. Defaults to the pull request's base branch",
+			EnvVar: "BUILDKITE_PIPELINE_DIFF_BASE",
+		},
+		cli.StringFlag{
+			Name:   "diff-base-from-meta-data",
+			Value:  "",
+			Usage:  "A meta-data key with the git ref to compare the build's commit with, such as the last commit that passed",
+			EnvVar: "BUILDKITE_PIPELINE_DIFF_BASE_FROM_META_DATA",
+		},
+		cli.BoolTFlag{
+			Name:   "reject-secrets",
+			Usage:  "Fail the upload if the values of secret environment variables have been interpolated into the pipeline",
+			EnvVar: "BUILDKITE_PIPELINE_REJECT_SECRETS",
+		},
+		cli.StringSliceFlag{
+			Name:   "redacted-vars",
+			Usage:  "Pattern of environment variable names containing sensitive values",
+			EnvVar: "BUILDKITE_REDACTED_VARS",
+			Value:  &cli.StringSlice{"*_PASSWORD", "*_SECRET", "*_TOKEN"},
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -120,69 +249,20 @@ var PipelineUploadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
-		// Find the pipeline file either from STDIN or the first
-		// argument
+		// Find the pipeline file either from a generator, STDIN or the
+		// first argument
 		var input []byte
-		var err error
 		var filename string
 
-		if cfg.FilePath != "" {
-			l.Info("Reading pipeline config from \"%s\"", cfg.FilePath)
-
-			filename = filepath.Base(cfg.FilePath)
-			input, err = ioutil.ReadFile(cfg.FilePath)
+		if cfg.Exec != "" {
+			timeout, err := time.ParseDuration(cfg.ExecTimeout)
 			if err != nil {
-				l.Fatal("Failed to read file: %s", err)
+				l.Fatal("Failed to parse exec timeout: %v", err)
 			}
-		} else if stdin.IsReadable() {
-			l.Info("Reading pipeline config from STDIN")
 
-			// Actually read the file from STDIN
-			input, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				l.Fatal("Failed to read from STDIN: %s", err)
-			}
+			input, filename = runPipelineGenerator(l, cfg.Exec, c.Args(), timeout)
 		} else {
-			l.Info("Searching for pipeline config...")
-
-			paths := []string{
-				"buildkite.yml",
-				"buildkite.yaml",
-				"buildkite.json",
-				filepath.FromSlash(".buildkite/pipeline.yml"),
-				filepath.FromSlash(".buildkite/pipeline.yaml"),
-				filepath.FromSlash(".buildkite/pipeline.json"),
-				filepath.FromSlash("buildkite/pipeline.yml"),
-				filepath.FromSlash("buildkite/pipeline.yaml"),
-				filepath.FromSlash("buildkite/pipeline.json"),
-			}
-
-			// Collect all the files that exist
-			exists := []string{}
-			for _, path := range paths {
-				if _, err := os.Stat(path); err == nil {
-					exists = append(exists, path)
-				}
-			}
-
-			// If more than 1 of the config files exist, throw an
-			// error. There can only be one!!
-			if len(exists) > 1 {
-				l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
-			} else if len(exists) == 0 {
-				l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
-			}
-
-			found := exists[0]
-
-			l.Info("Found config file \"%s\"", found)
-
-			// Read the default file
-			filename = path.Base(found)
-			input, err = ioutil.ReadFile(found)
-			if err != nil {
-				l.Fatal("Failed to read file \"%s\" (%s)", found, err)
-			}
+			input, filename = readPipelineConfig(l, cfg.FilePath)
 		}
 
 		// Make sure the file actually has something in it
@@ -207,10 +287,14 @@ var PipelineUploadCommand = cli.Command{
 
 		// Parse the pipeline
 		result, err := agent.PipelineParser{
-			Env:             environ,
-			Filename:        filename,
-			Pipeline:        input,
-			NoInterpolation: cfg.NoInterpolation,
+			Env:                    environ,
+			Filename:               filename,
+			Pipeline:               input,
+			NoInterpolation:        cfg.NoInterpolation,
+			InterpolationFunctions: cfg.InterpolationFunctions,
+			MetaData: func(key string) (string, error) {
+				return readPipelineMetaData(l, cfg, key)
+			},
 		}.Parse()
 		if err != nil {
 			src := filename
@@ -220,20 +304,72 @@ var PipelineUploadCommand = cli.Command{
 			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", src, err)
 		}
 
+		// Check the pipeline against the schema, so mistakes are caught
+		// before the pipeline is uploaded
+		if !cfg.NoValidation {
+			validatePipeline(l, result, cfg.StrictValidation)
+		}
+
+		// Secrets that have been interpolated into the pipeline would be
+		// visible to anyone who can see the build
+		if cfg.RejectSecrets {
+			if err := result.CheckSecrets(cfg.RedactedVars); err != nil {
+				errs, ok := err.(agent.PipelineValidationErrors)
+				if !ok {
+					l.Fatal("%s", err)
+				}
+				for _, e := range errs {
+					l.Error("%s", e)
+				}
+				l.Fatal("The pipeline contains secrets from the environment, so it wasn't uploaded. " +
+					"Escape variables with $$ so they're interpolated when the job runs, or use --reject-secrets=false if they aren't secret")
+			}
+		}
+
+		// Steps with if_changed are only kept if the files they watch
+		// have changed since the diff base
+		if result.HasChangeConditions() {
+			changed := findChangedFiles(l, cfg, environ)
+
+			decisions, err := result.FilterUnchangedSteps(changed)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			for _, decision := range decisions {
+				l.Info("%s", decision)
+			}
+		}
+
 		// In dry-run mode we just output the generated pipeline to stdout
-		if cfg.DryRun {
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
+		if cfg.DryRun || cfg.DiffAgainst != "" {
+			output, err := result.Format(cfg.Format)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
 
-			// Dump json indented to stdout. All logging happens to stderr
+			// Compare the pipeline with a file, such as a golden file
+			// in the tests of a pipeline generator
+			if cfg.DiffAgainst != "" {
+				if !diffPipeline(l, output, cfg.DiffAgainst) {
+					os.Exit(1)
+				}
+				return
+			}
+
+			// Dump the pipeline to stdout. All logging happens to stderr
 			// this can be used with other tools to get interpolated json
-			if err := enc.Encode(result); err != nil {
+			if _, err := os.Stdout.Write(output); err != nil {
 				l.Fatal("%#v", err)
 			}
 
 			return
 		}
 
+		if cfg.Format != "json" {
+			l.Fatal("The --format option can only be used with --dry-run or --diff-against")
+		}
+
 		// Check we have a job id set if not in dry run
 		if cfg.Job == "" {
 			l.Fatal("Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
@@ -276,3 +412,264 @@ var PipelineUploadCommand = cli.Command{
 		l.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
+
+// readPipelineConfig reads a pipeline from a file, STDIN or the first of the
+// default pipeline files found, returning it and its filename
+func readPipelineConfig(l logger.Logger, filePath string) ([]byte, string) {
+	var input []byte
+	var err error
+	var filename string
+
+	if filePath != "" {
+		l.Info("Reading pipeline config from \"%s\"", filePath)
+
+		filename = filepath.Base(filePath)
+		input, err = ioutil.ReadFile(filePath)
+		if err != nil {
+			l.Fatal("Failed to read file: %s", err)
+		}
+	} else if stdin.IsReadable() {
+		l.Info("Reading pipeline config from STDIN")
+
+		// Actually read the file from STDIN
+		input, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			l.Fatal("Failed to read from STDIN: %s", err)
+		}
+	} else {
+		l.Info("Searching for pipeline config...")
+
+		paths := []string{
+			"buildkite.yml",
+			"buildkite.yaml",
+			"buildkite.json",
+			filepath.FromSlash(".buildkite/pipeline.yml"),
+			filepath.FromSlash(".buildkite/pipeline.yaml"),
+			filepath.FromSlash(".buildkite/pipeline.json"),
+			filepath.FromSlash("buildkite/pipeline.yml"),
+			filepath.FromSlash("buildkite/pipeline.yaml"),
+			filepath.FromSlash("buildkite/pipeline.json"),
+		}
+
+		// Collect all the files that exist
+		exists := []string{}
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				exists = append(exists, path)
+			}
+		}
+
+		// If more than 1 of the config files exist, throw an
+		// error. There can only be one!!
+		if len(exists) > 1 {
+			l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
+		} else if len(exists) == 0 {
+			l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
+		}
+
+		found := exists[0]
+
+		l.Info("Found config file \"%s\"", found)
+
+		// Read the default file
+		filename = path.Base(found)
+		input, err = ioutil.ReadFile(found)
+		if err != nil {
+			l.Fatal("Failed to read file \"%s\" (%s)", found, err)
+		}
+	}
+
+	return input, filename
+}
+
+// validatePipeline logs each problem found when validating a pipeline, and
+// exits if any of them are errors rather than warnings
+func validatePipeline(l logger.Logger, result *agent.PipelineParserResult, strict bool) {
+	warnings, err := result.Validate(strict)
+	for _, w := range warnings {
+		l.Warn("%s", w)
+	}
+	if err == nil {
+		return
+	}
+
+	errs, ok := err.(agent.PipelineValidationErrors)
+	if !ok {
+		l.Fatal("Pipeline validation failed (%s)", err)
+	}
+
+	for _, e := range errs {
+		l.Error("%s", e)
+	}
+
+	l.Fatal("Pipeline validation failed with %d error(s)", len(errs))
+}
+
+// findChangedFiles returns the files changed between the diff base and the
+// build's commit, or nil if they can't be found
+func findChangedFiles(l logger.Logger, cfg PipelineUploadConfig, environ *env.Environment) []string {
+	commit, ok := environ.Get("BUILDKITE_COMMIT")
+	if !ok || commit == "" || commit == "HEAD" {
+		commit = "HEAD"
+	}
+
+	base := cfg.DiffBase
+
+	if base == "" && cfg.DiffBaseFromMetaData != "" {
+		if cfg.AgentAccessToken == "" || cfg.Job == "" {
+			l.Warn("Can't read the diff base from meta-data without a job and agent access token")
+		} else {
+			client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+			metaData, resp, err := client.GetMetaData(cfg.Job, cfg.DiffBaseFromMetaData)
+			if err != nil {
+				if resp != nil && resp.StatusCode == 404 {
+					l.Warn("There's no meta-data for %q to use as the diff base", cfg.DiffBaseFromMetaData)
+				} else {
+					l.Warn("Failed to read the diff base from meta-data %q (%s)", cfg.DiffBaseFromMetaData, err)
+				}
+			} else {
+				base = metaData.Value
+			}
+		}
+	}
+
+	if branch, _ := environ.Get("BUILDKITE_PULL_REQUEST_BASE_BRANCH"); base == "" && branch != "" {
+		base = "origin/" + branch
+
+		// The base branch might not have been fetched with the build
+		if err := exec.Command("git", "rev-parse", "--verify", "--quiet", base).Run(); err != nil {
+			l.Info("Fetching the pull request's base branch %q", branch)
+			if out, err := exec.Command("git", "fetch", "origin", branch).CombinedOutput(); err != nil {
+				l.Warn("Failed to fetch %q (%s): %s", branch, err, strings.TrimSpace(string(out)))
+				return nil
+			}
+			base = "FETCH_HEAD"
+		}
+	}
+
+	if base == "" {
+		l.Warn("There's no diff base to find the changed files with, so all steps with if_changed are kept. Use --diff-base to set one")
+		return nil
+	}
+
+	out, err := exec.Command("git", "merge-base", base, commit).Output()
+	if err != nil {
+		l.Warn("Failed to find where %q and %q diverged (%s), so all steps with if_changed are kept", base, commit, err)
+		return nil
+	}
+	mergeBase := strings.TrimSpace(string(out))
+
+	out, err = exec.Command("git", "diff", "--name-only", "--no-renames", mergeBase, commit).Output()
+	if err != nil {
+		l.Warn("Failed to find the files changed since %q (%s), so all steps with if_changed are kept", base, err)
+		return nil
+	}
+
+	changed := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			changed = append(changed, line)
+		}
+	}
+
+	l.Info("Found %d files changed between %s and %s", len(changed), base, commit)
+	return changed
+}
+
+// diffPipeline compares a rendered pipeline with a file, printing a unified
+// diff of any differences to stdout. It returns whether they're the same
+func diffPipeline(l logger.Logger, output []byte, path string) bool {
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.Fatal("Failed to read %q to compare the pipeline with (%s)", path, err)
+	}
+
+	if bytes.Equal(expected, output) {
+		l.Info("The pipeline matches %q", path)
+		return true
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(expected)),
+		B:        difflib.SplitLines(string(output)),
+		FromFile: path,
+		ToFile:   "pipeline",
+		Context:  3,
+	})
+	if err != nil {
+		l.Fatal("Failed to compare the pipeline with %q (%s)", path, err)
+	}
+
+	fmt.Print(diff)
+	l.Error("The pipeline is different to %q", path)
+	return false
+}
+
+// readPipelineMetaData reads a meta-data value of the build for interpolation
+func readPipelineMetaData(l logger.Logger, cfg PipelineUploadConfig, key string) (string, error) {
+	if cfg.Job == "" || cfg.AgentAccessToken == "" {
+		return "", fmt.Errorf("meta-data can only be read with a job and an agent access token")
+	}
+
+	client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+	var metaData *api.MetaData
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+		metaData, resp, err = client.GetMetaData(cfg.Job, key)
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		return "", err
+	}
+
+	return metaData.Value, nil
+}
+
+// runPipelineGenerator runs a program that prints a pipeline to stdout,
+// with its stderr going to the job's log. The pipeline is returned with the
+// program's name as its filename, and only if the program succeeded
+func runPipelineGenerator(l logger.Logger, path string, args []string, timeout time.Duration) ([]byte, string) {
+	name := filepath.Base(path)
+
+	l.Info("Running %q to generate the pipeline", strings.Join(append([]string{path}, args...), " "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	p := process.New(logger.Discard, process.Config{
+		Path:    path,
+		Args:    args,
+		Env:     os.Environ(),
+		Stdout:  &stdout,
+		Stderr:  os.Stderr,
+		Context: ctx,
+	})
+
+	if err := p.Run(); err != nil {
+		l.Fatal("Failed to run %q (%s)", path, err)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		l.Fatal("%q didn't finish within %s, so its pipeline wasn't uploaded", name, timeout)
+	}
+
+	status := p.WaitStatus()
+	if status.Signaled() {
+		l.Fatal("%q was stopped by %s, so its pipeline wasn't uploaded", name, process.SignalString(status.Signal()))
+	}
+	if status.ExitStatus() != 0 {
+		l.Fatal("%q exited with status %d, so its pipeline wasn't uploaded", name, status.ExitStatus())
+	}
+
+	return stdout.Bytes(), name
+}
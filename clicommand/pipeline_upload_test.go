@@ -0,0 +1,134 @@
+package clicommand
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errFatal is panicked by the test logger's exit function, so that tests can
+// check what happens when a command calls l.Fatal
+type errFatal struct{}
+
+func newTestLogger() (logger.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+
+	printer := logger.NewTextPrinter(buf)
+	printer.Colors = false
+
+	return logger.NewConsoleLogger(printer, func(int) { panic(errFatal{}) }), buf
+}
+
+// runFatally calls fn, returning whether it called l.Fatal
+func runFatally(fn func()) (fatal bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(errFatal); !ok {
+				panic(r)
+			}
+			fatal = true
+		}
+	}()
+
+	fn()
+	return false
+}
+
+func writeTestPipelineGenerator(t *testing.T, script string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "pipeline-generator")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "generate-pipeline")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700))
+
+	return path
+}
+
+func TestRunPipelineGenerator(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Pipeline generators are shell scripts")
+	}
+
+	path := writeTestPipelineGenerator(t, `echo "generating" >&2; echo "steps:"; echo "  - command: $1"`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, _ := newTestLogger()
+
+	var output []byte
+	var name string
+	require.False(t, runFatally(func() {
+		output, name = runPipelineGenerator(l, path, []string{"make"}, time.Minute)
+	}))
+
+	assert.Equal(t, "steps:\n  - command: make\n", string(output))
+	assert.Equal(t, "generate-pipeline", name)
+}
+
+func TestRunPipelineGeneratorFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Pipeline generators are shell scripts")
+	}
+
+	for _, tc := range []struct {
+		Name    string
+		Script  string
+		Timeout time.Duration
+		Message string
+	}{
+		{"non-zero exit", "echo 'steps: []'; exit 3", time.Minute, `"generate-pipeline" exited with status 3, so its pipeline wasn't uploaded`},
+		{"signal", "echo 'steps: []'; kill -KILL $$", time.Minute, `"generate-pipeline" was stopped by SIGKILL, so its pipeline wasn't uploaded`},
+		{"timeout", "echo 'steps: []'; exec sleep 10", 100 * time.Millisecond, `"generate-pipeline" didn't finish within 100ms, so its pipeline wasn't uploaded`},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			path := writeTestPipelineGenerator(t, tc.Script)
+			defer os.RemoveAll(filepath.Dir(path))
+
+			l, buf := newTestLogger()
+
+			start := time.Now()
+			assert.True(t, runFatally(func() {
+				runPipelineGenerator(l, path, nil, tc.Timeout)
+			}), "expected the generator to fail")
+			assert.Contains(t, buf.String(), tc.Message)
+			assert.True(t, time.Since(start) < 5*time.Second, "expected the generator to be stopped")
+		})
+	}
+}
+
+func TestRunPipelineGeneratorNameIsInParseErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Pipeline generators are shell scripts")
+	}
+
+	path := writeTestPipelineGenerator(t, `echo "steps: ["`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	l, _ := newTestLogger()
+
+	var output []byte
+	var name string
+	require.False(t, runFatally(func() {
+		output, name = runPipelineGenerator(l, path, nil, time.Minute)
+	}))
+
+	_, err := agent.PipelineParser{
+		Filename:        name,
+		Pipeline:        output,
+		NoInterpolation: true,
+	}.Parse()
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Failed to parse generate-pipeline:"), err.Error())
+}
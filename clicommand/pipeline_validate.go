@@ -0,0 +1,110 @@
+package clicommand
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/urfave/cli"
+)
+
+var PipelineValidateHelpDescription = `Usage:
+
+   buildkite-agent pipeline validate <file> [arguments...]
+
+Description:
+
+   Checks a pipeline against the schema of pipeline steps without uploading
+   it, reporting every problem found with the file, line and column it's at.
+   The pipeline is found in the same way as with "pipeline upload", either from
+   the file given, STDIN or one of the default pipeline files.
+
+   Attributes that aren't in the schema are reported as warnings, as the
+   schema might not know about every attribute. Use --strict to treat them as
+   errors.
+
+   The command exits with a non-zero status if the pipeline isn't valid.
+
+Example:
+
+   $ buildkite-agent pipeline validate
+   $ buildkite-agent pipeline validate my-custom-pipeline.yml
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline validate`
+
+type PipelineValidateConfig struct {
+	FilePath               string `cli:"arg:0" label:"pipeline path"`
+	NoInterpolation        bool   `cli:"no-interpolation"`
+	InterpolationFunctions bool   `cli:"interpolation-functions"`
+	Strict                 bool   `cli:"strict"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+}
+
+var PipelineValidateCommand = cli.Command{
+	Name:        "validate",
+	Usage:       "Checks a pipeline for mistakes without uploading it",
+	Description: PipelineValidateHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "no-interpolation",
+			Usage:  "Skip variable interpolation of the pipeline before it's validated",
+			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
+		},
+		cli.BoolFlag{
+			Name:   "interpolation-functions",
+			Usage:  "Allow interpolating files with ${file:path} and transforms like ${VAR|lower|trim|slug}. Meta-data can't be read when validating",
+			EnvVar: "BUILDKITE_PIPELINE_INTERPOLATION_FUNCTIONS",
+		},
+		cli.BoolFlag{
+			Name:   "strict",
+			Usage:  "Fail for step attributes that aren't in the pipeline schema, rather than warning about them",
+			EnvVar: "BUILDKITE_PIPELINE_STRICT_VALIDATION",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PipelineValidateConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		input, filename := readPipelineConfig(l, cfg.FilePath)
+
+		// Make sure the file actually has something in it
+		if len(input) == 0 {
+			l.Fatal("Config file is empty")
+		}
+
+		result, err := agent.PipelineParser{
+			Env:                    env.FromSlice(os.Environ()),
+			Filename:               filename,
+			Pipeline:               input,
+			NoInterpolation:        cfg.NoInterpolation,
+			InterpolationFunctions: cfg.InterpolationFunctions,
+		}.Parse()
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		validatePipeline(l, result, cfg.Strict)
+
+		l.Info("Pipeline is valid")
+	},
+}
@@ -0,0 +1,98 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/bootstrap"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var PluginFetchHelpDescription = `Usage:
+
+   buildkite-agent plugin fetch [options...] <plugin>
+
+Description:
+
+   Adds a plugin to the plugin cache, or updates it if it's already there.
+   This can be used to pre-populate the plugin cache when building agent
+   images, so that jobs can checkout plugins with plugins-offline set.
+
+   The plugin is referenced the same way as in a pipeline, including the
+   version to fetch.
+
+Example:
+
+   $ buildkite-agent plugin fetch --plugins-cache-path /var/cache/buildkite/plugins \
+       docker-compose#v3.0.0`
+
+type PluginFetchConfig struct {
+	Plugin           string `cli:"arg:0" label:"plugin" validate:"required"`
+	PluginsCachePath string `cli:"plugins-cache-path" normalize:"filepath" validate:"required"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+}
+
+var PluginFetchCommand = cli.Command{
+	Name:        "fetch",
+	Usage:       "Adds a plugin to the shared plugin cache",
+	Description: PluginFetchHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "plugins-cache-path",
+			Value:  "",
+			Usage:  "Path to the plugin cache shared between agents",
+			EnvVar: "BUILDKITE_PLUGINS_CACHE_PATH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PluginFetchConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		p, err := plugin.CreatePlugin(cfg.Plugin, nil)
+		if err != nil {
+			l.Fatal("Failed to parse plugin %q: %v", cfg.Plugin, err)
+		}
+
+		if p.Vendored {
+			l.Fatal("Vendored plugins are part of the repository and can't be cached")
+		}
+
+		if p.IsArchive() || p.IsOCI() {
+			l.Fatal("Only plugins in git repositories can be added to the plugin cache")
+		}
+
+		sh, err := shell.New()
+		if err != nil {
+			l.Fatal("%v", err)
+		}
+		sh.Logger = shell.StderrLogger
+		sh.Debug = cfg.Debug
+
+		mirrorDir, err := bootstrap.UpdatePluginCache(sh, cfg.PluginsCachePath, p, false)
+		if err != nil {
+			l.Fatal("Failed to fetch plugin %q: %v", p.Label(), err)
+		}
+
+		l.Info("Plugin %q is cached in %s", p.Label(), mirrorDir)
+	},
+}
@@ -0,0 +1,342 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/buildkite/agent/v3/testreport"
+	zglob "github.com/mattn/go-zglob"
+	"github.com/urfave/cli"
+)
+
+var TestReportHelpDescription = `Usage:
+
+   buildkite-agent test-report <pattern> [arguments...]
+
+Description:
+
+   Summarises test results as an annotation on the build, with the number of
+   tests that passed, failed and were skipped, and the name and output of each
+   failing test.
+
+   Test results are read from the files that match the pattern, which can be
+   JUnit XML files or the output of "go test -json". You can use ; to give
+   more than one pattern, and ** to match files in sub-directories.
+
+   Each job's results are stored as build meta-data, and every job of a step
+   updates the same annotation with the results from all of the step's jobs
+   that have reported so far. This means parallel jobs of a step add up to a
+   single annotation. Use --context to combine results from different steps,
+   or to keep results from the same step apart.
+
+Example:
+
+   $ buildkite-agent test-report "junit/*.xml"
+   $ go test -json ./... > test-results.json; buildkite-agent test-report test-results.json
+   $ buildkite-agent test-report "tmp/rspec-*.xml" --title "RSpec" --context "rspec"`
+
+type TestReportConfig struct {
+	Paths   string `cli:"arg:0" label:"test report paths" validate:"required"`
+	Context string `cli:"context"`
+	Title   string `cli:"title"`
+	Step    string `cli:"step"`
+	Job     string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug   bool   `cli:"debug"`
+	NoColor bool   `cli:"no-color"`
+	Profile string `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool   `cli:"debug-http"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool   `cli:"no-http2"`
+}
+
+var TestReportCommand = cli.Command{
+	Name:        "test-report",
+	Usage:       "Summarise JUnit XML or Go test JSON results as an annotation on the build",
+	Description: TestReportHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "context",
+			Usage:  "The context of the annotation, which is shared by all jobs that report to it (default: \"test-report-\" and the step's ID)",
+			EnvVar: "BUILDKITE_TEST_REPORT_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "title",
+			Value:  "Test results",
+			Usage:  "The heading of the annotation",
+			EnvVar: "BUILDKITE_TEST_REPORT_TITLE",
+		},
+		cli.StringFlag{
+			Name:   "step",
+			Value:  "",
+			Usage:  "Which step the test results are from, used for the default context",
+			EnvVar: "BUILDKITE_STEP_ID",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job the test results are from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := TestReportConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		context := cfg.Context
+		if context == "" {
+			context = "test-report"
+			if cfg.Step != "" {
+				context += "-" + cfg.Step
+			}
+		}
+
+		summary := readTestReports(l, cfg.Paths)
+		l.Info("Found %d tests, %d failed, %d passed and %d skipped",
+			summary.Total(), summary.Failed, summary.Passed, summary.Skipped)
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		reportTestResults(l, client, cfg.Job, context, cfg.Title, summary)
+
+		l.Debug("Successfully annotated build with test results")
+	},
+}
+
+// The most times the annotation is updated because other jobs stored their
+// results while it was being written
+const maxTestReportAnnotations = 5
+
+// reportTestResults stores a job's results in meta-data, so that they can be
+// merged with the results of the other jobs that report to the same
+// annotation, and then annotates the build with all of the results so far.
+//
+// Jobs that finish at the same time can each write the annotation before
+// seeing each other's results, so the keys are checked again after
+// annotating, and the annotation is written again until they stop changing.
+// The last job to write the annotation will then have seen every result.
+func reportTestResults(l logger.Logger, client *api.Client, job, context, title string, summary *testreport.Summary) {
+	prefix := "test-report:" + context + ":"
+
+	value, err := json.Marshal(summary)
+	if err != nil {
+		l.Fatal("%s", err)
+	}
+
+	err = retry.Do(func(s *retry.Stats) error {
+		resp, err := client.SetMetaData(job, &api.MetaData{Key: prefix + job, Value: string(value)})
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		l.Fatal("Failed to store test results: %s", err)
+	}
+
+	keys, err := getTestReportKeys(l, client, job, prefix)
+	if err != nil {
+		l.Fatal("Failed to get test results from other jobs: %s", err)
+	}
+
+	for i := 1; ; i++ {
+		values, err := getMetaDataValues(l, client, job, keys)
+		if err != nil {
+			l.Fatal("Failed to get test results from other jobs: %s", err)
+		}
+
+		summaries := []*testreport.Summary{summary}
+		for _, key := range sortedKeys(values) {
+			if key == prefix+job {
+				continue
+			}
+
+			var other testreport.Summary
+			if err := json.Unmarshal([]byte(values[key]), &other); err != nil {
+				l.Warn("Ignoring test results in meta-data %q: %s", key, err)
+				continue
+			}
+			summaries = append(summaries, &other)
+		}
+
+		merged := testreport.Merge(summaries...)
+		if len(summaries) > 1 {
+			l.Info("Merged results from %d jobs, %d tests in total", merged.Reports, merged.Total())
+		}
+
+		annotation := &api.Annotation{
+			Body:    merged.Markdown(title),
+			Style:   merged.Style(),
+			Context: context,
+		}
+
+		err = retry.Do(func(s *retry.Stats) error {
+			resp, err := client.Annotate(job, annotation)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+		if err != nil {
+			l.Fatal("Failed to annotate build: %s", err)
+		}
+
+		latest, err := getTestReportKeys(l, client, job, prefix)
+		if err != nil {
+			l.Fatal("Failed to get test results from other jobs: %s", err)
+		}
+
+		if equalKeys(keys, latest) {
+			break
+		}
+
+		if i == maxTestReportAnnotations {
+			l.Warn("Results from other jobs are still being stored, so the annotation may not include them all")
+			break
+		}
+
+		l.Info("Results from other jobs were stored while annotating, so the annotation will be updated")
+		keys = latest
+	}
+}
+
+// getTestReportKeys gets the meta-data keys of the test results stored for an
+// annotation, in the order they're merged
+func getTestReportKeys(l logger.Logger, client *api.Client, job, prefix string) ([]string, error) {
+	var keys []string
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+		keys, resp, err = client.MetaDataKeys(job)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+
+	return matching, nil
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readTestReports parses every file that matches the ; separated patterns,
+// returning a summary of all of their results
+func readTestReports(l logger.Logger, paths string) *testreport.Summary {
+	report := &testreport.Report{}
+	found := 0
+
+	for _, pattern := range strings.Split(paths, agent.ArtifactPathDelimiter) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		files, err := zglob.Glob(pattern)
+		if err == os.ErrNotExist {
+			l.Info("File not found: %s", pattern)
+			continue
+		} else if err != nil {
+			l.Fatal("Failed to find test reports matching %s: %s", pattern, err)
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				l.Fatal("Failed to read test report: %s", err)
+			}
+
+			r, err := testreport.Parse(data)
+			if err != nil {
+				l.Fatal("Failed to read test report %s: %s", file, err)
+			}
+
+			l.Debug("Found %d tests in %s", len(r.Results), file)
+			report.Results = append(report.Results, r.Results...)
+			found++
+		}
+	}
+
+	if found == 0 {
+		l.Fatal("No test reports found matching: %s", paths)
+	}
+
+	return report.Summarise()
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/testreport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportTestResultsUpdatesAnnotationWithResultsStoredWhileAnnotating(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	metaData := map[string]string{}
+	var annotations []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch req.URL.Path {
+		case "/jobs/job-1/data/set":
+			var m api.MetaData
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				t.Error(err)
+			}
+			metaData[m.Key] = m.Value
+
+		case "/jobs/job-1/data/keys":
+			keys := []string{"unrelated"}
+			for key := range metaData {
+				keys = append(keys, key)
+			}
+			json.NewEncoder(rw).Encode(keys)
+
+		case "/jobs/job-1/data/batch_get":
+			var get api.MetaDataBatchGet
+			if err := json.NewDecoder(req.Body).Decode(&get); err != nil {
+				t.Error(err)
+			}
+			batch := api.MetaDataBatch{}
+			for _, key := range get.Keys {
+				if value, ok := metaData[key]; ok {
+					batch.Items = append(batch.Items, &api.MetaData{Key: key, Value: value})
+				}
+			}
+			json.NewEncoder(rw).Encode(batch)
+
+		case "/jobs/job-1/annotations":
+			var a api.Annotation
+			if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+				t.Error(err)
+			}
+			annotations = append(annotations, a.Body)
+
+			// Another job stores its results while the first annotation is
+			// being written, after this job has got the results so far
+			metaData["test-report:rspec:job-2"] = `{"passed":3}`
+
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	l, _ := newTestLogger()
+	require.False(t, runFatally(func() {
+		reportTestResults(l, client, "job-1", "rspec", "RSpec", &testreport.Summary{Passed: 2, Reports: 1})
+	}))
+
+	require.Len(t, annotations, 2)
+	assert.Equal(t, "#### RSpec\n\n2 passed of 2 tests\n", annotations[0])
+	assert.Equal(t, "#### RSpec\n\n5 passed of 5 tests, from 2 jobs\n", annotations[1])
+}
@@ -0,0 +1,93 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var envFileKeyRegex = regexp.MustCompile(`\A[a-zA-Z_][a-zA-Z0-9_]*\z`)
+
+// FromEnvFile parses environment variables written to a file by a hook. The
+// file can either be a JSON object of string values:
+//
+//	{"LLAMAS": "rock", "ALPACAS": "are ok"}
+//
+// Or in dotenv format, one variable per line, with blank lines and lines
+// starting with # ignored. Double quoted values support escapes like \n and
+// single quoted values are used as is:
+//
+//	# Comments are ignored
+//	LLAMAS=rock
+//	export ALPACAS="are\nok"
+//	CAMELS='are $okay'
+func FromEnvFile(body string) (*Environment, error) {
+	trimmed := strings.TrimSpace(body)
+
+	if strings.HasPrefix(trimmed, "{") {
+		return fromJSON(trimmed)
+	}
+
+	return fromDotenv(trimmed)
+}
+
+func fromJSON(body string) (*Environment, error) {
+	values := map[string]string{}
+	if err := json.Unmarshal([]byte(body), &values); err != nil {
+		return nil, fmt.Errorf("Expected a JSON object of strings: %v", err)
+	}
+
+	env := &Environment{env: make(map[string]string)}
+	for k, v := range values {
+		if !envFileKeyRegex.MatchString(k) {
+			return nil, fmt.Errorf("Invalid environment variable name %q", k)
+		}
+		env.Set(k, v)
+	}
+
+	return env, nil
+}
+
+func fromDotenv(body string) (*Environment, error) {
+	env := &Environment{env: make(map[string]string)}
+
+	// Normalize \r\n to just \n
+	body = strings.Replace(body, "\r\n", "\n", -1)
+
+	for idx, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("Line %d: expected KEY=value", idx+1)
+		}
+
+		key, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		if !envFileKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("Line %d: invalid environment variable name %q", idx+1, key)
+		}
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: invalid quoted value for %s", idx+1, key)
+			}
+			value = unquoted
+
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+
+		env.Set(key, value)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,68 @@
+package env
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromEnvFileParsesDotenv(t *testing.T) {
+	var lines = []string{
+		`# A comment`,
+		``,
+		`LLAMAS=rock`,
+		`export ALPACAS="are\nok"`,
+		`CAMELS='are $okay'`,
+		`EMPTY=`,
+		`EQUALS=a=b`,
+	}
+
+	env, err := FromEnvFile(strings.Join(lines, "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"LLAMAS":  "rock",
+		"ALPACAS": "are\nok",
+		"CAMELS":  "are $okay",
+		"EMPTY":   "",
+		"EQUALS":  "a=b",
+	}, env.ToMap())
+}
+
+func TestFromEnvFileParsesJSON(t *testing.T) {
+	env, err := FromEnvFile(`{"LLAMAS": "rock", "ALPACAS": "are\nok"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"LLAMAS":  "rock",
+		"ALPACAS": "are\nok",
+	}, env.ToMap())
+}
+
+func TestFromEnvFileReturnsErrors(t *testing.T) {
+	for _, body := range []string{
+		`LLAMAS`,
+		`1LLAMAS=rock`,
+		`LLAMAS="rock\q"`,
+		`{"LLAMAS": 1}`,
+		`{"BAD KEY": "value"}`,
+	} {
+		if _, err := FromEnvFile(body); err == nil {
+			t.Errorf("Expected an error for %q", body)
+		}
+	}
+}
+
+func TestFromEnvFileWithEmptyFile(t *testing.T) {
+	env, err := FromEnvFile("\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, env.Length())
+}
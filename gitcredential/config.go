@@ -0,0 +1,241 @@
+// Package gitcredential maps git remote urls to credentials and implements the
+// git credential helper protocol, so that short-lived HTTPS tokens can be given
+// to git without writing them into remote urls or .git/config
+package gitcredential
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/buildkite/shellwords"
+	"github.com/buildkite/yaml"
+)
+
+// How long a token-command can run for before it's killed
+var TokenCommandTimeout = time.Minute
+
+// Config is a set of credentials, the first one that matches a url is used
+type Config struct {
+	Credentials []Credential `yaml:"credentials"`
+}
+
+// Credential supplies a username and token for urls that match a pattern
+type Credential struct {
+	// A url pattern like https://github.com/my-org/*. The scheme, host and
+	// path are matched separately. In the host * matches part of a single
+	// label, like https://*.example.com. In the path * matches part of a
+	// single segment, except a trailing /* which matches the rest of the path
+	Match string `yaml:"match"`
+
+	// The username to authenticate with, defaults to "x-access-token"
+	Username string `yaml:"username"`
+
+	// A command that prints a token to stdout
+	TokenCommand string `yaml:"token-command"`
+
+	// An environment variable containing the token
+	TokenEnv string `yaml:"token-env"`
+
+	// A file containing the token
+	TokenFile string `yaml:"token-file"`
+}
+
+// LoadConfig reads a credential config file
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(b)
+}
+
+// ParseConfig parses and validates a yaml (or json) credential config
+func ParseConfig(b []byte) (*Config, error) {
+	var config Config
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+
+	for idx, c := range config.Credentials {
+		if c.Match == "" {
+			return nil, fmt.Errorf("Credential %d is missing a match pattern", idx)
+		}
+
+		if u, err := url.Parse(c.Match); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("Credential match pattern %q isn't a url with a scheme and host", c.Match)
+		}
+
+		sources := 0
+		for _, source := range []string{c.TokenCommand, c.TokenEnv, c.TokenFile} {
+			if source != "" {
+				sources++
+			}
+		}
+
+		if sources != 1 {
+			return nil, fmt.Errorf("Credential for %q needs exactly one of token-command, token-env or token-file", c.Match)
+		}
+	}
+
+	return &config, nil
+}
+
+// Find returns the first credential matching the url, or nil if none do
+func (c *Config) Find(url string) *Credential {
+	for idx := range c.Credentials {
+		if matchPattern(c.Credentials[idx].Match, url) {
+			return &c.Credentials[idx]
+		}
+	}
+	return nil
+}
+
+// Token returns the token for the credential
+func (c *Credential) Token() (string, error) {
+	var token string
+
+	switch {
+	case c.TokenEnv != "":
+		var ok bool
+		if token, ok = os.LookupEnv(c.TokenEnv); !ok {
+			return "", fmt.Errorf("Environment variable %s isn't set", c.TokenEnv)
+		}
+
+	case c.TokenFile != "":
+		b, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		token = string(b)
+
+	case c.TokenCommand != "":
+		args, err := shellwords.Split(c.TokenCommand)
+		if err != nil {
+			return "", err
+		}
+		if len(args) == 0 {
+			return "", errors.New("Empty token-command")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), TokenCommandTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("Token command %q failed: %v", c.TokenCommand, err)
+		}
+		token = string(out)
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("Empty token for %q", c.Match)
+	}
+
+	// A newline would let the token inject other attributes into git's input
+	if strings.ContainsAny(token, "\n\x00") {
+		return "", fmt.Errorf("Token for %q contains invalid characters", c.Match)
+	}
+
+	return token, nil
+}
+
+// UsernameOrDefault returns the configured username, or the one that most
+// token based HTTPS git hosts accept
+func (c *Credential) UsernameOrDefault() string {
+	if c.Username != "" {
+		return c.Username
+	}
+	return "x-access-token"
+}
+
+// matchPattern matches a url against a pattern. The scheme and port must be
+// the same, and the host and path must match, where * can't match across the
+// dots in the host or the slashes in the path. A trailing /* in the pattern
+// matches the rest of the path. Trailing slashes and .git suffixes are ignored
+func matchPattern(pattern string, rawurl string) bool {
+	p, err := url.Parse(pattern)
+	if err != nil {
+		return false
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+
+	if !strings.EqualFold(p.Scheme, u.Scheme) || p.Port() != u.Port() {
+		return false
+	}
+
+	if !matchSegments(strings.Split(strings.ToLower(p.Hostname()), "."),
+		strings.Split(strings.ToLower(u.Hostname()), "."), false) {
+		return false
+	}
+
+	return matchSegments(splitPath(p.Path), splitPath(u.Path), true)
+}
+
+// splitPath splits a url path into its segments, ignoring leading and
+// trailing slashes and a .git suffix
+func splitPath(path string) []string {
+	path = strings.Trim(strings.TrimSuffix(strings.Trim(path, "/"), ".git"), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// matchSegments matches each segment against the pattern's segment in the same
+// position. If rest is true, a final * segment matches one or more segments
+func matchSegments(patterns []string, segments []string, rest bool) bool {
+	if rest && len(patterns) > 0 && patterns[len(patterns)-1] == "*" {
+		if len(segments) < len(patterns) {
+			return false
+		}
+		patterns = patterns[:len(patterns)-1]
+		segments = segments[:len(patterns)]
+	}
+
+	if len(patterns) != len(segments) {
+		return false
+	}
+
+	for idx := range patterns {
+		if !matchWildcard(patterns[idx], segments[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchWildcard matches a string against a pattern where * matches any number
+// of characters
+func matchWildcard(pattern string, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+
+	if pattern[0] == '*' {
+		for i := 0; i <= len(s); i++ {
+			if matchWildcard(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return s != "" && pattern[0] == s[0] && matchWildcard(pattern[1:], s[1:])
+}
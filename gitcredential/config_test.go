@@ -0,0 +1,161 @@
+package gitcredential
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = []byte(`
+credentials:
+  - match: https://github.com/buildkite/*
+    token-env: GITCREDENTIAL_TEST_TOKEN
+  - match: https://gitlab.example.com/*
+    username: oauth2
+    token-command: echo "  llamas  "
+  - match: https://*.git.example.com/team-*/repo
+    token-file: /tmp/token
+`)
+
+func TestParsingConfig(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []Credential{
+		{Match: "https://github.com/buildkite/*", TokenEnv: "GITCREDENTIAL_TEST_TOKEN"},
+		{Match: "https://gitlab.example.com/*", Username: "oauth2", TokenCommand: `echo "  llamas  "`},
+		{Match: "https://*.git.example.com/team-*/repo", TokenFile: "/tmp/token"},
+	}, config.Credentials)
+
+	for _, invalid := range []string{
+		"credentials:\n  - token-env: FOO\n",
+		"credentials:\n  - match: https://github.com/*\n",
+		"credentials:\n  - match: https://github.com/*\n    token-env: FOO\n    token-file: /tmp/foo\n",
+		"credentials:\n  - match: github.com/*\n    token-env: FOO\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestFindingCredentials(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for url, match := range map[string]string{
+		"https://github.com/buildkite/agent.git":   "https://github.com/buildkite/*",
+		"https://github.com/buildkite/agent":       "https://github.com/buildkite/*",
+		"https://gitlab.example.com/group/repo":    "https://gitlab.example.com/*",
+		"https://github.com/other-org/agent.git":   "",
+		"https://github.com/buildkite":             "",
+		"http://github.com/buildkite/agent.git":    "",
+		"https://github.com.evil.com/buildkite/x":  "",
+		"https://GitHub.com/buildkite/agent":       "https://github.com/buildkite/*",
+		"https://github.com:8443/buildkite/agent":  "",
+		"https://gitlab.example.com/a/b/c.git":     "https://gitlab.example.com/*",
+		"https://gitlab.example.com":               "",
+		"https://eu.git.example.com/team-a/repo":   "https://*.git.example.com/team-*/repo",
+		"https://git.example.com/team-a/repo":      "",
+		"https://a.b.git.example.com/team-a/repo":  "",
+		"https://eu.git.example.com/team-a/b/repo": "",
+		"https://eu.git.example.com/team-a/repo2":  "",
+	} {
+		cred := config.Find(url)
+		if match == "" {
+			assert.Nil(t, cred, url)
+		} else if assert.NotNil(t, cred, url) {
+			assert.Equal(t, match, cred.Match, url)
+		}
+	}
+}
+
+func TestCredentialTokens(t *testing.T) {
+	os.Setenv("GITCREDENTIAL_TEST_TOKEN", "alpacas\n")
+	defer os.Unsetenv("GITCREDENTIAL_TEST_TOKEN")
+
+	os.Setenv("GITCREDENTIAL_TEST_INJECTION", "llamas\nhost=evil.com")
+	defer os.Unsetenv("GITCREDENTIAL_TEST_INJECTION")
+
+	f, err := ioutil.TempFile("", "gitcredential-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("camels\n")
+	f.Close()
+
+	for _, tc := range []struct {
+		Credential Credential
+		Token      string
+	}{
+		{Credential{TokenEnv: "GITCREDENTIAL_TEST_TOKEN"}, "alpacas"},
+		{Credential{TokenFile: f.Name()}, "camels"},
+		{Credential{TokenCommand: `echo "  llamas  "`}, "llamas"},
+	} {
+		token, err := tc.Credential.Token()
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.Token, token)
+		}
+	}
+
+	for _, cred := range []Credential{
+		{TokenEnv: "GITCREDENTIAL_TEST_MISSING"},
+		{TokenCommand: "false"},
+		{TokenEnv: "GITCREDENTIAL_TEST_INJECTION"},
+	} {
+		_, err := cred.Token()
+		assert.Error(t, err)
+	}
+}
+
+func TestGettingCredentials(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := ReadRequest(strings.NewReader("protocol=https\nhost=gitlab.example.com\npath=group/repo.git\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "https://gitlab.example.com/group/repo.git", req.URL())
+
+	var out bytes.Buffer
+	if err := config.Get(req, &out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "username=oauth2\npassword=llamas\n", out.String())
+
+	// Nothing is returned for unmatched urls or plain http
+	for _, input := range []string{
+		"protocol=https\nhost=bitbucket.org\npath=team/repo.git\n",
+		"protocol=http\nhost=gitlab.example.com\npath=group/repo.git\n",
+	} {
+		req, err := ReadRequest(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out.Reset()
+		if err := config.Get(req, &out); err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, out.String())
+	}
+}
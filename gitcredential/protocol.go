@@ -0,0 +1,81 @@
+package gitcredential
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Request is the set of attributes git sends to a credential helper, see
+// https://git-scm.com/docs/git-credential#IOFMT
+type Request struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+}
+
+// ReadRequest reads key=value attributes until a blank line or EOF
+func ReadRequest(r io.Reader) (*Request, error) {
+	req := &Request{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("Invalid credential attribute %q", line)
+		}
+
+		switch key, value := line[:idx], line[idx+1:]; key {
+		case "protocol":
+			req.Protocol = value
+		case "host":
+			req.Host = value
+		case "path":
+			req.Path = value
+		case "username":
+			req.Username = value
+		}
+	}
+
+	return req, scanner.Err()
+}
+
+// URL returns the url that the request is for. Git only sends the path when
+// credential.useHttpPath is set, otherwise the url is for the whole host
+func (r *Request) URL() string {
+	url := r.Protocol + "://" + r.Host
+	if r.Path != "" {
+		url += "/" + strings.TrimPrefix(r.Path, "/")
+	}
+	return url
+}
+
+// Get finds a credential for the request and writes it to w in the format
+// that git expects. Nothing is written if no credential matches, so git moves
+// on to the next helper
+func (c *Config) Get(req *Request, w io.Writer) error {
+	// Tokens are only ever sent over https
+	if req.Protocol != "https" {
+		return nil
+	}
+
+	cred := c.Find(req.URL())
+	if cred == nil {
+		return nil
+	}
+
+	token, err := cred.Token()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "username=%s\npassword=%s\n", cred.UsernameOrDefault(), token)
+	return err
+}
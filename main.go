@@ -63,6 +63,13 @@ func main() {
 	app.Commands = []cli.Command{
 		clicommand.AgentStartCommand,
 		clicommand.AnnotateCommand,
+		{
+			Name:  "annotation",
+			Usage: "Make changes to the annotations on the currently running build",
+			Subcommands: []cli.Command{
+				clicommand.AnnotationRemoveCommand,
+			},
+		},
 		{
 			Name:  "artifact",
 			Usage: "Upload/download artifacts from Buildkite jobs",
@@ -80,6 +87,7 @@ func main() {
 				clicommand.MetaDataGetCommand,
 				clicommand.MetaDataExistsCommand,
 				clicommand.MetaDataKeysCommand,
+				clicommand.MetaDataWaitCommand,
 			},
 		},
 		{
@@ -87,6 +95,14 @@ func main() {
 			Usage: "Make changes to the pipeline of the currently running build",
 			Subcommands: []cli.Command{
 				clicommand.PipelineUploadCommand,
+				clicommand.PipelineValidateCommand,
+			},
+		},
+		{
+			Name:  "plugin",
+			Usage: "Manage the plugins available to agents",
+			Subcommands: []cli.Command{
+				clicommand.PluginFetchCommand,
 			},
 		},
 		{
@@ -97,7 +113,9 @@ func main() {
 				clicommand.StepUpdateCommand,
 			},
 		},
+		clicommand.TestReportCommand,
 		clicommand.BootstrapCommand,
+		clicommand.GitCredentialCommand,
 	}
 
 	// When no sub command is used
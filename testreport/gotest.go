@@ -0,0 +1,132 @@
+package testreport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// goTestEvent is a line of the output of "go test -json"
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// ParseGoTest reads the results from the output of "go test -json". Lines that
+// aren't JSON, such as build errors written to stderr, are ignored.
+func ParseGoTest(data []byte) (*Report, error) {
+	var order []string
+	results := map[string]*Result{}
+	packageOutput := map[string]*strings.Builder{}
+	packageFailures := map[string]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] != '{' {
+			continue
+		}
+
+		var event goTestEvent
+		if err := json.Unmarshal(text, &event); err != nil {
+			return nil, fmt.Errorf("Failed to parse Go test JSON on line %d: %v", line, err)
+		}
+
+		// Events without a test are about the package as a whole
+		if event.Test == "" {
+			switch event.Action {
+			case "output":
+				if packageOutput[event.Package] == nil {
+					packageOutput[event.Package] = &strings.Builder{}
+				}
+				packageOutput[event.Package].WriteString(event.Output)
+			case "fail":
+				// A package that fails without any failing tests
+				// most likely didn't build, or panicked
+				if !packageFailures[event.Package] {
+					name := event.Package
+					order = append(order, name)
+					results[name] = &Result{Name: name, Status: Failed}
+					if output := packageOutput[event.Package]; output != nil {
+						results[name].Output = output.String()
+					}
+				}
+			}
+			continue
+		}
+
+		name := event.Package + "." + event.Test
+		result, ok := results[name]
+		if !ok {
+			order = append(order, name)
+			result = &Result{Name: name}
+			results[name] = result
+		}
+
+		switch event.Action {
+		case "output":
+			if !isGoTestProgress(event.Output) {
+				result.Output += event.Output
+			}
+		case "pass":
+			result.Status = Passed
+		case "skip":
+			result.Status = Skipped
+		case "fail":
+			result.Status = Failed
+			packageFailures[event.Package] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tests that never finished, which happens when the test binary is
+	// killed, are counted as failures
+	for _, result := range results {
+		if result.Status == "" {
+			result.Status = Failed
+		}
+	}
+
+	report := &Report{}
+	for _, name := range order {
+		result := results[name]
+
+		// A test fails when any of its subtests fail, so to save
+		// repeating them only the subtests are kept
+		if result.Status == Failed && hasFailedSubtest(results, name) {
+			continue
+		}
+
+		report.Results = append(report.Results, *result)
+	}
+
+	return report, nil
+}
+
+// isGoTestProgress returns whether a line of output is one of the lines go
+// test prints as tests are started, paused and continued
+func isGoTestProgress(output string) bool {
+	for _, prefix := range []string{"=== RUN", "=== PAUSE", "=== CONT"} {
+		if strings.HasPrefix(output, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFailedSubtest(results map[string]*Result, name string) bool {
+	for other, result := range results {
+		if result.Status == Failed && strings.HasPrefix(other, name+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package testreport
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// junitSuite is either a <testsuites> or a <testsuite> element, which can be
+// nested inside each other
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string         `xml:"name,attr"`
+	Classname string         `xml:"classname,attr"`
+	Failures  []junitFailure `xml:"failure"`
+	Errors    []junitFailure `xml:"error"`
+	Skipped   *junitFailure  `xml:"skipped"`
+	SystemErr string         `xml:"system-err"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// ParseJUnit reads the results from a JUnit XML file
+func ParseJUnit(data []byte) (*Report, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("Failed to parse JUnit XML: %v", err)
+	}
+
+	report := &Report{}
+	addJUnitSuite(report, root)
+
+	return report, nil
+}
+
+func addJUnitSuite(report *Report, suite junitSuite) {
+	for _, c := range suite.Cases {
+		result := Result{Name: c.Name, Status: Passed}
+		if c.Classname != "" && c.Classname != c.Name {
+			result.Name = c.Classname + "." + c.Name
+		}
+
+		if failures := append(c.Failures, c.Errors...); len(failures) > 0 {
+			result.Status = Failed
+
+			var output []string
+			for _, f := range failures {
+				output = append(output, f.output())
+			}
+			if c.SystemErr != "" {
+				output = append(output, strings.TrimSpace(c.SystemErr))
+			}
+			result.Output = strings.Join(output, "\n\n")
+		} else if c.Skipped != nil {
+			result.Status = Skipped
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	for _, s := range suite.Suites {
+		addJUnitSuite(report, s)
+	}
+}
+
+// output is the message of a failure followed by its body, which is usually
+// a stack trace, leaving out the message if the body already includes it
+func (f junitFailure) output() string {
+	message := strings.TrimSpace(f.Message)
+	body := strings.TrimSpace(f.Body)
+
+	switch {
+	case message == "" && body == "":
+		return f.Type
+	case message == "" || strings.Contains(body, message):
+		return body
+	case body == "":
+		return message
+	default:
+		return message + "\n" + body
+	}
+}
@@ -0,0 +1,87 @@
+package testreport
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Markdown renders the summary as the body of a build annotation, with the
+// output of each failure in a collapsed section
+func (s *Summary) Markdown(title string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "#### %s\n\n", title)
+
+	var counts []string
+	if s.Failed > 0 {
+		counts = append(counts, fmt.Sprintf("%d failed", s.Failed))
+	}
+	counts = append(counts, fmt.Sprintf("%d passed", s.Passed))
+	if s.Skipped > 0 {
+		counts = append(counts, fmt.Sprintf("%d skipped", s.Skipped))
+	}
+	fmt.Fprintf(&b, "%s of %s", joinCounts(counts), pluralise(s.Total(), "test"))
+	if s.Reports > 1 {
+		fmt.Fprintf(&b, ", from %d jobs", s.Reports)
+	}
+	b.WriteString("\n")
+
+	for _, f := range s.Failures {
+		fmt.Fprintf(&b, "\n<details>\n<summary><code>%s</code></summary>\n\n", html.EscapeString(f.Name))
+		if f.Output != "" {
+			fence := codeFence(f.Output)
+			fmt.Fprintf(&b, "%s\n%s\n%s\n\n", fence, f.Output, fence)
+		}
+		b.WriteString("</details>\n")
+	}
+
+	if hidden := s.Failed - len(s.Failures); hidden > 0 {
+		fmt.Fprintf(&b, "\n_and %s not shown_\n", pluralise(hidden, "more failure"))
+	}
+
+	return b.String()
+}
+
+// Style is the annotation style for the summary
+func (s *Summary) Style() string {
+	if s.Failed > 0 {
+		return "error"
+	}
+	return "success"
+}
+
+// codeFence returns a fence of backticks longer than any run of backticks in
+// output, so that the output can't close the code block early
+func codeFence(output string) string {
+	longest, run := 0, 0
+	for _, r := range output {
+		if r == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+func joinCounts(counts []string) string {
+	if len(counts) == 1 {
+		return counts[0]
+	}
+	return strings.Join(counts[:len(counts)-1], ", ") + " and " + counts[len(counts)-1]
+}
+
+func pluralise(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
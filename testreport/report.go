@@ -0,0 +1,159 @@
+// Package testreport parses test results from JUnit XML and Go test JSON
+// files, and summarises them as Markdown for build annotations
+package testreport
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The most failures kept in a summary, and the most lines and bytes of output
+// kept for each failure. These keep summaries small enough to be stored as
+// build meta-data.
+var (
+	MaxFailures    = 20
+	MaxOutputLines = 30
+	MaxOutputBytes = 4096
+)
+
+// Status is the outcome of a single test
+type Status string
+
+const (
+	Passed  Status = "passed"
+	Failed  Status = "failed"
+	Skipped Status = "skipped"
+)
+
+// Result is the outcome of a single test case
+type Result struct {
+	Name   string
+	Status Status
+	Output string
+}
+
+// Report is the results from one or more test report files
+type Report struct {
+	Results []Result
+}
+
+// Parse reads the results from a JUnit XML or Go test JSON file, working out
+// which from the contents of the file
+func Parse(data []byte) (*Report, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return &Report{}, nil
+	}
+
+	switch trimmed[0] {
+	case '<':
+		return ParseJUnit(data)
+	case '{':
+		return ParseGoTest(data)
+	default:
+		return nil, fmt.Errorf("Unknown test report format, expected JUnit XML or Go test JSON")
+	}
+}
+
+// Summary counts the results in a report, keeping the names and output of
+// failed tests
+type Summary struct {
+	Passed   int       `json:"passed"`
+	Failed   int       `json:"failed"`
+	Skipped  int       `json:"skipped"`
+	Failures []Failure `json:"failures,omitempty"`
+
+	// The number of reports that have been merged into this one
+	Reports int `json:"-"`
+}
+
+// Failure is the name and truncated output of a failed test
+type Failure struct {
+	Name   string `json:"name"`
+	Output string `json:"output,omitempty"`
+}
+
+// Summarise counts the results in the report, keeping up to MaxFailures
+// failures with their output truncated
+func (r *Report) Summarise() *Summary {
+	s := &Summary{Reports: 1}
+
+	for _, result := range r.Results {
+		switch result.Status {
+		case Passed:
+			s.Passed++
+		case Skipped:
+			s.Skipped++
+		case Failed:
+			s.Failed++
+			if len(s.Failures) < MaxFailures {
+				s.Failures = append(s.Failures, Failure{
+					Name:   result.Name,
+					Output: truncateOutput(result.Output),
+				})
+			}
+		}
+	}
+
+	return s
+}
+
+// Total is the number of tests in the summary
+func (s *Summary) Total() int {
+	return s.Passed + s.Failed + s.Skipped
+}
+
+// Merge combines summaries, such as those from parallel jobs of the same step,
+// keeping up to MaxFailures failures sorted by name
+func Merge(summaries ...*Summary) *Summary {
+	merged := &Summary{}
+
+	for _, s := range summaries {
+		merged.Passed += s.Passed
+		merged.Failed += s.Failed
+		merged.Skipped += s.Skipped
+		merged.Failures = append(merged.Failures, s.Failures...)
+		if s.Reports == 0 {
+			merged.Reports++
+		} else {
+			merged.Reports += s.Reports
+		}
+	}
+
+	sort.SliceStable(merged.Failures, func(i, j int) bool {
+		return merged.Failures[i].Name < merged.Failures[j].Name
+	})
+	if len(merged.Failures) > MaxFailures {
+		merged.Failures = merged.Failures[:MaxFailures]
+	}
+
+	return merged
+}
+
+// truncateOutput keeps the end of a test's output, which is usually where the
+// reason it failed is
+func truncateOutput(output string) string {
+	output = strings.TrimRight(output, "\n")
+
+	lines := strings.Split(output, "\n")
+	if len(lines) > MaxOutputLines {
+		lines = lines[len(lines)-MaxOutputLines:]
+		output = "...\n" + strings.Join(lines, "\n")
+	}
+
+	if len(output) > MaxOutputBytes {
+		output = output[len(output)-MaxOutputBytes:]
+		if i := strings.Index(output, "\n"); i >= 0 {
+			output = output[i+1:]
+		}
+		for len(output) > 0 && !utf8.RuneStart(output[0]) {
+			output = output[1:]
+		}
+		output = "...\n" + output
+	}
+
+	return output
+}
@@ -0,0 +1,138 @@
+package testreport
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testJUnit = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="models">
+    <testcase classname="User" name="validates email" time="0.01"/>
+    <testcase classname="User" name="saves" time="0.02">
+      <failure message="expected true, got false" type="AssertionError">expected true, got false
+  at user_spec.rb:12</failure>
+    </testcase>
+    <testsuite name="nested">
+      <testcase classname="Llama" name="spits">
+        <skipped message="not today"/>
+      </testcase>
+      <testcase classname="Llama" name="eats">
+        <error message="undefined method 'hay'"/>
+        <system-err>stack level too deep</system-err>
+      </testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>
+`)
+
+var testGoTest = []byte(`{"Action":"run","Package":"example.com/llamas","Test":"TestSpit"}
+{"Action":"output","Package":"example.com/llamas","Test":"TestSpit","Output":"=== RUN   TestSpit\n"}
+{"Action":"output","Package":"example.com/llamas","Test":"TestSpit","Output":"--- PASS: TestSpit (0.00s)\n"}
+{"Action":"pass","Package":"example.com/llamas","Test":"TestSpit","Elapsed":0}
+{"Action":"run","Package":"example.com/llamas","Test":"TestEat"}
+{"Action":"run","Package":"example.com/llamas","Test":"TestEat/hay"}
+{"Action":"output","Package":"example.com/llamas","Test":"TestEat/hay","Output":"    llamas_test.go:10: not hungry\n"}
+{"Action":"fail","Package":"example.com/llamas","Test":"TestEat/hay","Elapsed":0}
+{"Action":"fail","Package":"example.com/llamas","Test":"TestEat","Elapsed":0}
+{"Action":"run","Package":"example.com/llamas","Test":"TestSleep"}
+{"Action":"skip","Package":"example.com/llamas","Test":"TestSleep","Elapsed":0}
+{"Action":"fail","Package":"example.com/llamas","Elapsed":0.1}
+# example.com/alpacas
+alpacas.go:3:1: syntax error
+{"Action":"output","Package":"example.com/alpacas","Output":"FAIL\texample.com/alpacas [build failed]\n"}
+{"Action":"fail","Package":"example.com/alpacas","Elapsed":0}
+`)
+
+func TestParseJUnit(t *testing.T) {
+	report, err := Parse(testJUnit)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Result{
+		{Name: "User.validates email", Status: Passed},
+		{Name: "User.saves", Status: Failed, Output: "expected true, got false\n  at user_spec.rb:12"},
+		{Name: "Llama.spits", Status: Skipped},
+		{Name: "Llama.eats", Status: Failed, Output: "undefined method 'hay'\n\nstack level too deep"},
+	}, report.Results)
+}
+
+func TestParseGoTest(t *testing.T) {
+	report, err := Parse(testGoTest)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Result{
+		{Name: "example.com/llamas.TestSpit", Status: Passed, Output: "--- PASS: TestSpit (0.00s)\n"},
+		{Name: "example.com/llamas.TestEat/hay", Status: Failed, Output: "    llamas_test.go:10: not hungry\n"},
+		{Name: "example.com/llamas.TestSleep", Status: Skipped},
+		{Name: "example.com/alpacas", Status: Failed, Output: "FAIL\texample.com/alpacas [build failed]\n"},
+	}, report.Results)
+}
+
+func TestParseRejectsUnknownFormats(t *testing.T) {
+	_, err := Parse([]byte("ok  \texample.com/llamas\t0.1s\n"))
+	assert.EqualError(t, err, "Unknown test report format, expected JUnit XML or Go test JSON")
+}
+
+func TestSummariseTruncatesOutput(t *testing.T) {
+	output := strings.Repeat("a line of output\n", MaxOutputLines+10)
+
+	summary := (&Report{Results: []Result{
+		{Name: "TestLlamas", Status: Failed, Output: output},
+		{Name: "TestAlpacas", Status: Passed},
+	}}).Summarise()
+
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 1, summary.Passed)
+	require.Len(t, summary.Failures, 1)
+
+	lines := strings.Split(summary.Failures[0].Output, "\n")
+	assert.Len(t, lines, MaxOutputLines+1)
+	assert.Equal(t, "...", lines[0])
+	assert.Equal(t, "a line of output", lines[1])
+}
+
+func TestMergeAndMarkdown(t *testing.T) {
+	merged := Merge(
+		&Summary{Passed: 10, Failed: 1, Failures: []Failure{{Name: "TestLlamas", Output: "```go\nspat\n```"}}},
+		&Summary{Passed: 5, Skipped: 2, Failed: 1, Failures: []Failure{{Name: "TestAlpacas<1>"}}},
+	)
+
+	assert.Equal(t, 2, merged.Reports)
+	assert.Equal(t, 19, merged.Total())
+	assert.Equal(t, "error", merged.Style())
+	assert.Equal(t, "#### Tests\n"+
+		"\n"+
+		"2 failed, 15 passed and 2 skipped of 19 tests, from 2 jobs\n"+
+		"\n"+
+		"<details>\n"+
+		"<summary><code>TestAlpacas&lt;1&gt;</code></summary>\n"+
+		"\n"+
+		"</details>\n"+
+		"\n"+
+		"<details>\n"+
+		"<summary><code>TestLlamas</code></summary>\n"+
+		"\n"+
+		"````\n```go\nspat\n```\n````\n"+
+		"\n"+
+		"</details>\n", merged.Markdown("Tests"))
+}
+
+func TestMarkdownMentionsFailuresThatArentShown(t *testing.T) {
+	summary := &Summary{Passed: 1, Failed: 3, Reports: 1, Failures: []Failure{{Name: "TestLlamas"}}}
+
+	assert.Equal(t, "#### Tests\n"+
+		"\n"+
+		"3 failed and 1 passed of 4 tests\n"+
+		"\n"+
+		"<details>\n"+
+		"<summary><code>TestLlamas</code></summary>\n"+
+		"\n"+
+		"</details>\n"+
+		"\n"+
+		"_and 2 more failures not shown_\n", summary.Markdown("Tests"))
+
+	assert.Equal(t, "success", (&Summary{Passed: 1}).Style())
+}